@@ -0,0 +1,378 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+
+	C "github.com/pmkol/mosdns-x/constant"
+	"github.com/pmkol/mosdns-x/mlog"
+)
+
+const redacted = "REDACTED"
+
+// secretKeys are substrings of config keys whose values are redacted.
+var secretKeys = []string{"password", "passwd", "secret", "token", "salt", "username", "auth", "api_key"}
+
+// secretPaths are the full paths of secret config keys that are too
+// generic for secretKeys, e.g. "key" is also a path of certificate keys.
+var secretPaths = []string{"cluster.key"}
+
+func init() {
+	var (
+		cfgFile string
+		dir     string
+		out     string
+		api     string
+	)
+	c := &cobra.Command{
+		Use:   "bugreport [-c config_file] [-d working_dir] [-o output]",
+		Short: "Collect config, runtime state and profiles into an archive for debugging.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(dir) > 0 {
+				if err := os.Chdir(dir); err != nil {
+					return fmt.Errorf("failed to change the current working directory, %w", err)
+				}
+			}
+			if len(out) == 0 {
+				out = fmt.Sprintf("mosdns-bugreport-%s.tar.gz", time.Now().Format("20060102-150405"))
+			}
+			if err := writeBugReport(cfgFile, api, out); err != nil {
+				return err
+			}
+			mlog.L().Info("bug report saved", zap.String("file", out))
+			return nil
+		},
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+	}
+	fs := c.Flags()
+	fs.StringVarP(&cfgFile, "config", "c", "", "config file")
+	fs.StringVarP(&dir, "dir", "d", "", "working dir")
+	fs.StringVarP(&out, "out", "o", "", "output file")
+	fs.StringVar(&api, "api", "", "api address of the running mosdns, default is the api.http in the config")
+	rootCmd.AddCommand(c)
+}
+
+type bugReport struct {
+	tw     *tar.Writer
+	now    time.Time
+	errLog bytes.Buffer // errors that occurred while collecting
+}
+
+func (b *bugReport) add(name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: b.now,
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(data)
+	return err
+}
+
+func (b *bugReport) logErr(what string, err error) {
+	fmt.Fprintf(&b.errLog, "%s: %v\n", what, err)
+}
+
+func writeBugReport(cfgFile, api, out string) error {
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create output file, %w", err)
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	b := &bugReport{tw: tar.NewWriter(gw), now: time.Now()}
+
+	info := fmt.Sprintf("version: v%s\nbuild time: %s\ngo: %s\nos/arch: %s/%s\ncpu: %d\ntime: %s\n",
+		C.Version, C.BuildTime, runtime.Version(), runtime.GOOS, runtime.GOARCH, runtime.NumCPU(), b.now.Format(time.RFC3339))
+	if err := b.add("info.txt", []byte(info)); err != nil {
+		return err
+	}
+
+	cfg, fileUsed, err := loadConfig(cfgFile)
+	if err != nil {
+		b.logErr("load config", err)
+	} else {
+		if err := mergeInclude(cfg, 0, []string{fileUsed}); err != nil {
+			b.logErr("load sub config", err)
+		}
+		if err := b.addConfigs(append([]string{fileUsed}, cfg.Include...)); err != nil {
+			return err
+		}
+		if err := b.addPluginsAndProviders(cfg); err != nil {
+			return err
+		}
+		if len(api) == 0 {
+			api = cfg.API.HTTP
+		}
+	}
+
+	if len(api) > 0 {
+		if err := b.addRuntimeState(api); err != nil {
+			return err
+		}
+	} else {
+		b.logErr("runtime state", fmt.Errorf("api address is not configured"))
+	}
+
+	if b.errLog.Len() > 0 {
+		if err := b.add("errors.txt", b.errLog.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// addConfigs adds the config files with secrets redacted.
+func (b *bugReport) addConfigs(files []string) error {
+	for i, file := range files {
+		v := viper.New()
+		v.SetConfigFile(file)
+		if err := v.ReadInConfig(); err != nil {
+			b.logErr("read config "+file, err)
+			continue
+		}
+		data, err := yaml.Marshal(redactConfig("", v.AllSettings()))
+		if err != nil {
+			b.logErr("marshal config "+file, err)
+			continue
+		}
+		name := fmt.Sprintf("config/%d_%s.yaml", i, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)))
+		if err := b.add(name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bugReport) addPluginsAndProviders(cfg *Config) error {
+	var plugins bytes.Buffer
+	for _, pc := range cfg.Plugins {
+		fmt.Fprintf(&plugins, "%s\t%s\n", pc.Tag, pc.Type)
+	}
+	if err := b.add("plugins.txt", plugins.Bytes()); err != nil {
+		return err
+	}
+
+	var providers bytes.Buffer
+	for _, dpc := range cfg.DataProviders {
+		fi, err := os.Stat(dpc.File)
+		if err != nil {
+			fmt.Fprintf(&providers, "%s\t%s\terror: %v\n", dpc.Tag, dpc.File, err)
+			continue
+		}
+		fmt.Fprintf(&providers, "%s\t%s\tsize: %d\tmodified: %s\tauto_reload: %t\tlazy: %t\n",
+			dpc.Tag, dpc.File, fi.Size(), fi.ModTime().Format(time.RFC3339), dpc.AutoReload, dpc.Lazy)
+	}
+	return b.add("providers.txt", providers.Bytes())
+}
+
+// addRuntimeState fetches the runtime state from the api of the
+// running mosdns.
+func (b *bugReport) addRuntimeState(api string) error {
+	base := api
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	if strings.HasPrefix(base, "http://:") { // listening on all addresses.
+		base = "http://127.0.0.1:" + strings.TrimPrefix(base, "http://:")
+	}
+
+	files := []struct{ name, path string }{
+		{"metrics.txt", "/metrics"},
+		{"recent_errors.log", "/debug/recent_errors"},
+		{"goroutine.txt", "/debug/pprof/goroutine?debug=2"},
+		{"heap.pprof", "/debug/pprof/heap"},
+	}
+	c := &http.Client{Timeout: time.Second * 10}
+	for _, file := range files {
+		data, err := httpGet(c, base+file.path)
+		if err != nil {
+			b.logErr("fetch "+file.path, err)
+			continue
+		}
+		if err := b.add("runtime/"+file.name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func httpGet(c *http.Client, url string) ([]byte, error) {
+	res, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status %s", res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// redactConfig returns a copy of v with secrets removed. Values of
+// secret keys are replaced, and so are the user info of urls. path is
+// the dot separated path of v.
+func redactConfig(path string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			p := k
+			if len(path) > 0 {
+				p = path + "." + k
+			}
+			m[k] = redactConfig(p, e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			s = append(s, redactConfig(path, e))
+		}
+		return s
+	case string:
+		if isSecret(path) && len(v) > 0 {
+			return redacted
+		}
+		return redactURL(v)
+	default:
+		return v
+	}
+}
+
+func isSecret(path string) bool {
+	path = strings.ToLower(path)
+	for _, p := range secretPaths {
+		if path == p {
+			return true
+		}
+	}
+	key := path[strings.LastIndexByte(path, '.')+1:]
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL replaces the user info of url s. It does not parse s because
+// some urls have multiple hosts, e.g. "redis-cluster://:pass@h1,h2".
+func redactURL(s string) string {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return s
+	}
+	rest := s[i+3:]
+	if end := strings.IndexAny(rest, "/?#"); end >= 0 {
+		rest = rest[:end]
+	}
+	at := strings.LastIndexByte(rest, '@')
+	if at < 0 {
+		return s
+	}
+	return s[:i+3] + redacted + s[i+3+at:]
+}
+
+// recentLogSize is the number of warning and error logs that are kept
+// in memory for the bug report.
+const recentLogSize = 256
+
+// logRing keeps the last written lines. Each Write is a line.
+type logRing struct {
+	mu    sync.Mutex
+	lines [][]byte
+	next  int
+	full  bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([][]byte, size)}
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	copy(b, p)
+	r.mu.Lock()
+	r.lines[r.next] = b
+	r.next++
+	if r.next == len(r.lines) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+	return len(p), nil
+}
+
+func (r *logRing) Sync() error {
+	return nil
+}
+
+// snapshot returns the lines, oldest first.
+func (r *logRing) snapshot() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([][]byte(nil), r.lines[:r.next]...)
+	}
+	s := make([][]byte, 0, len(r.lines))
+	s = append(s, r.lines[r.next:]...)
+	return append(s, r.lines[:r.next]...)
+}
+
+// tee returns a zap.Option that also writes the warning and error logs
+// of a logger to r in json.
+func (r *logRing) tee() zap.Option {
+	ec := zap.NewProductionEncoderConfig()
+	ec.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(ec), r, zapcore.WarnLevel)
+	return zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(c, core)
+	})
+}
@@ -13,6 +13,15 @@ type Config struct {
 	Plugins       []PluginConfig                     `yaml:"plugins"`
 	Servers       []ServerConfig                     `yaml:"servers"`
 	API           APIConfig                          `yaml:"api"`
+	Random        RandomConfig                       `yaml:"random"`
+	Debug         DebugConfig                        `yaml:"debug"`
+	Cluster       ClusterConfig                      `yaml:"cluster"`
+
+	Upgrade UpgradeConfig `yaml:"upgrade"`
+
+	// KeyDir is the directory of the persistent stateless reset key and
+	// session ticket key. See server.SetKeyDir.
+	KeyDir string `yaml:"key_dir"`
 
 	// Experimental
 	Security SecurityConfig `yaml:"security"`
@@ -33,9 +42,28 @@ type PluginConfig struct {
 }
 
 type ServerConfig struct {
-	Exec      string                  `yaml:"exec"`
-	Timeout   uint                    `yaml:"timeout"` // (sec) query timeout.
-	Listeners []*ServerListenerConfig `yaml:"listeners"`
+	EntryConfig `yaml:",inline"`
+	Listeners   []*ServerListenerConfig `yaml:"listeners"`
+
+	// DDR answers the svcb queries of "_dns.resolver.arpa." with the dot,
+	// doh, doq and doh3 listeners of the server (rfc 9462).
+	DDR DDRConfig `yaml:"ddr"`
+}
+
+type DDRConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Target is the name of the resolver, its certificates must be valid
+	// for it. Default is the first dns name of the first certificate of
+	// the listeners.
+	Target string `yaml:"target"`
+}
+
+// EntryConfig configures the entry executable of servers and how queries
+// are handled before they are passed to it.
+type EntryConfig struct {
+	Exec    string `yaml:"exec"`
+	Timeout uint   `yaml:"timeout"` // (sec) query timeout.
 
 	// Early blocking options
 	BlockAAAA  bool `yaml:"block_aaaa"`
@@ -43,6 +71,33 @@ type ServerConfig struct {
 	BlockHTTPS bool `yaml:"block_https"`
 	BlockNoDot bool `yaml:"block_no_dot"`
 	StripEDNS0 bool `yaml:"strip_edns0"`
+
+	// Policies of queries that do not have exactly one question.
+	// ZeroQuestion: "refuse" (default), "formerr".
+	// MultiQuestion: "refuse" (default), "formerr", "first".
+	ZeroQuestion  string `yaml:"zero_question"`
+	MultiQuestion string `yaml:"multi_question"`
+
+	// MaxClientConcurrent is the max number of in-flight queries of a client
+	// address. Default is 0, no limit.
+	// ClientOverflow is the policy of queries beyond it: "refuse" (default)
+	// or "drop".
+	MaxClientConcurrent int    `yaml:"max_client_concurrent"`
+	ClientOverflow      string `yaml:"client_overflow"`
+
+	// Answers of TXT CH queries of "version.bind." and "hostname.bind.".
+	// Empty values mean such queries are refused.
+	ChaosVersion  string `yaml:"chaos_version"`
+	ChaosHostname string `yaml:"chaos_hostname"`
+
+	// AllowedClients are CIDRs or IPs of the clients that can send queries.
+	// Empty means all clients. The client address of doh, http listeners
+	// is from the forwarding headers of trusted proxies, see
+	// ServerListenerConfig.TrustedProxies.
+	// ClientDenied is the policy of queries from other clients: "refuse"
+	// (default) or "drop".
+	AllowedClients []string `yaml:"allowed_clients"`
+	ClientDenied   string   `yaml:"client_denied"`
 }
 
 type ServerListenerConfig struct {
@@ -52,7 +107,8 @@ type ServerListenerConfig struct {
 	// "dot", "tls" -> dns over tls
 	// "doh", "https" -> dns over https (rfc 8844)
 	// "http" -> dns over https (rfc 8844) but without tls
-	// "doq", "quic" -> dns over quic (rfc 9250)
+	// "h2c" -> same as "http", but also accepts cleartext http/2
+	// "doq", "quic" -> dns over quic (rfc 9250), also accepts draft alpn "doq-i11" and "doq-i02"
 	// "doh3", "h3" -> dns over http3 (rfc 9114 && rfc 8844)
 	Protocol string `yaml:"protocol"`
 
@@ -74,14 +130,209 @@ type ServerListenerConfig struct {
 	GetUserIPFromHeader string `yaml:"get_user_ip_from_header"` // used by doh, http, except "True-Client-IP" "X-Real-IP" "X-Forwarded-For".
 	ProxyProtocol       bool   `yaml:"proxy_protocol"`           // accepting the PROXYProtocol
 
+	// TrustedProxies are CIDRs or IPs of the proxies in front of the
+	// listener. Only they can send PROXY protocol headers (proxy_protocol)
+	// and forwarding headers (X-Forwarded-For etc. and
+	// get_user_ip_from_header), which give the real client address. Other
+	// peers are the clients themselves. Empty means all peers are trusted.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
 	IdleTimeout uint `yaml:"idle_timeout"` // (sec) used by tcp, dot, doh as connection idle timeout.
 	AllowedSNI  string `yaml:"allowed_sni"` // 只允许指定的SNI访问
+
+	// Used by udp. MaxConcurrentQueries limits the number of queries that are
+	// handled concurrently. Zero means no limit. OverflowPolicy specifies
+	// how to handle the queries that exceed the limit, can be
+	// "drop" (default) or "servfail".
+	MaxConcurrentQueries int    `yaml:"max_concurrent_queries"`
+	OverflowPolicy       string `yaml:"overflow_policy"`
+
+	// Used by doh, doh3, http, h2c. MaxConcurrentRequests limits the number
+	// of requests that are handled concurrently. Zero means no limit.
+	// HTTPOverflowPolicy specifies how to handle the requests that exceed
+	// the limit, can be "503" (default), "429" or "queue". Queued requests
+	// wait for at most QueueTimeout (sec, default 1) and then get 503.
+	MaxConcurrentRequests int    `yaml:"max_concurrent_requests"`
+	HTTPOverflowPolicy    string `yaml:"http_overflow_policy"`
+	QueueTimeout          uint   `yaml:"queue_timeout"`
+
+	// Compression is the compression policy of responses, can be
+	// "always" (default) or "auto". "auto" only compresses responses that
+	// would not fit in the transport otherwise.
+	Compression string `yaml:"compression"`
+
+	// Certs are additional certificates, used by dot, doh, doq. The
+	// certificate is selected by the server name of the client hello.
+	// cert and key are used if no certificate matches, or the first
+	// of certs if cert and key are not configured.
+	Certs []CertConfig `yaml:"certs"`
+
+	// cert can also be a pkcs#12 bundle (.p12 or .pfx), then key is not
+	// required. The password of the bundle or of an encrypted key is read
+	// from KeyPasswordFile, or from the env KeyPasswordEnv.
+	KeyPasswordFile string `yaml:"key_password_file"`
+	KeyPasswordEnv  string `yaml:"key_password_env"`
+
+	// ClientCA enables tls client certificate authentication, used by dot,
+	// doh, doq. Client certificates are verified against the CA file.
+	// If RequireClientCert is true, clients without a valid certificate
+	// are rejected.
+	ClientCA          string `yaml:"client_ca"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+
+	// TLS parameters, used by dot, doh, doq. Empty values mean defaults.
+	// Versions are like "1.2", "1.3". Cipher suites are names like
+	// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". Curves can be "X25519",
+	// "P256", "P384", "P521" and "X25519MLKEM768". doq and doh3 always use
+	// tls 1.3 and only curves are applied.
+	TLSMinVersion   string   `yaml:"tls_min_version"`
+	TLSMaxVersion   string   `yaml:"tls_max_version"`
+	TLSCipherSuites []string `yaml:"tls_cipher_suites"`
+	TLSCurves       []string `yaml:"tls_curves"`
+
+	// SessionTicketKeyRotation (sec) rotates the tls session ticket key,
+	// used by dot, doh, doq. The previous key is still accepted until the
+	// next rotation. Zero disables the rotation.
+	SessionTicketKeyRotation uint `yaml:"session_ticket_key_rotation"`
+
+	// UDPReadBuffer and UDPWriteBuffer are the SO_RCVBUF and SO_SNDBUF
+	// sizes in bytes, used by udp, doq, doh3. Default is 64KiB and the
+	// system default. Note that quic-go raises the buffers of doq and doh3
+	// to at least 7MiB if the system limits allow.
+	UDPReadBuffer  int `yaml:"udp_read_buffer"`
+	UDPWriteBuffer int `yaml:"udp_write_buffer"`
+
+	// QUIC transport parameters, used by doq, doh3.
+	QUIC QUICConfig `yaml:"quic"`
+
+	// Timeouts of tcp, dot and doh. The idle timeout of doq and doh3
+	// is quic.max_idle_timeout.
+	Timeouts TimeoutConfig `yaml:"timeouts"`
+
+	// DNS cookies (rfc 7873), used by udp.
+	Cookie CookieConfig `yaml:"cookie"`
+
+	// HealthQuery makes the health path of doh, http listeners send a
+	// query through the entry, see HealthQueryConfig.
+	HealthQuery HealthQueryConfig `yaml:"health_query"`
+
+	// Entry optionally gives the listener its own entry and entry options
+	// instead of the ones of the server. Options are not inherited from the
+	// server, except that an empty exec defaults to the exec of the server.
+	Entry *EntryConfig `yaml:"entry"`
+
+	// Routes are additional url paths of doh, http listeners, each with its
+	// own entry. The entry options of a route are not inherited either,
+	// except that an empty exec defaults to the exec of the listener.
+	Routes []RouteConfig `yaml:"routes"`
+}
+
+type RouteConfig struct {
+	Path        string `yaml:"path"`
+	EntryConfig `yaml:",inline"`
+}
+
+// QUICConfig is a copy of server.QUICOpts. Zero values mean defaults.
+type QUICConfig struct {
+	InitialStreamReceiveWindow     uint64 `yaml:"initial_stream_receive_window"`
+	MaxStreamReceiveWindow         uint64 `yaml:"max_stream_receive_window"`
+	InitialConnectionReceiveWindow uint64 `yaml:"initial_connection_receive_window"`
+	MaxConnectionReceiveWindow     uint64 `yaml:"max_connection_receive_window"`
+	MaxIncomingStreams             int64  `yaml:"max_incoming_streams"`
+	MaxIdleTimeout                 uint   `yaml:"max_idle_timeout"` // (sec) default is idle_timeout
+	RequireAddressValidation       bool   `yaml:"require_address_validation"`
+
+	// DisableGSO disables the generic segmentation offload of QUIC
+	// sockets. quic-go only has a process wide switch, so it is applied
+	// at startup to all QUIC sockets, including the ones of upstreams, if
+	// any listener sets it. Changes take effect after a restart.
+	DisableGSO bool `yaml:"disable_gso"`
+}
+
+// TimeoutConfig is the timeouts of a listener. All values are in
+// milliseconds. Zero values mean defaults.
+type TimeoutConfig struct {
+	ReadHeader uint `yaml:"read_header"` // default 3000, used by doh, http, h2c.
+	Read       uint `yaml:"read"`        // default 10000, used by doh, http, h2c.
+	Write      uint `yaml:"write"`       // default no timeout, used by tcp, dot, doh, http, h2c.
+	FirstRead  uint `yaml:"first_read"`  // default 500, used by tcp, dot.
+}
+
+// HealthQueryConfig is the query of the health path. The health path
+// fails if the query fails, times out or is not answered with NOERROR
+// or NXDOMAIN. It is disabled if Name is empty.
+type HealthQueryConfig struct {
+	Name    string `yaml:"name"`
+	Type    string `yaml:"type"`    // default "A"
+	Timeout uint   `yaml:"timeout"` // (ms) default 2000
+}
+
+type CookieConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Secret is the hex encoded 16 bytes secret of server cookies.
+	// Servers behind the same anycast address should share it. Empty
+	// means a random secret.
+	Secret string `yaml:"secret"`
+
+	// Require makes the server only answer queries with a valid server
+	// cookie. Queries without a cookie are answered with TC.
+	Require bool `yaml:"require"`
+}
+
+type CertConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+
+	// See ServerListenerConfig.KeyPasswordFile and KeyPasswordEnv.
+	KeyPasswordFile string `yaml:"key_password_file"`
+	KeyPasswordEnv  string `yaml:"key_password_env"`
 }
 
 type APIConfig struct {
 	HTTP string `yaml:"http"`
 }
 
+type RandomConfig struct {
+	// Seed makes the random source deterministic, e.g. for reproducible
+	// integration tests. Zero (default) means a non-deterministic source.
+	Seed uint64 `yaml:"seed"`
+}
+
+type DebugConfig struct {
+	// AllocAudit exports approximate heap allocations of hot paths
+	// (handler, cache lookup, upstream exchange) as metrics. It has
+	// a small cost and is meant for staging.
+	AllocAudit bool `yaml:"alloc_audit"`
+}
+
+// UpgradeConfig configures the graceful upgrade. On SIGUSR2, mosdns starts
+// a new process with the same arguments, which inherits the listeners.
+// Once the new process is ready, the old one stops accepting connections
+// and exits after DrainTimeout. Existing doq and doh3 connections are not
+// handed over: the old process closes them when the new one is ready, and
+// the new one only reads the doq and doh3 sockets after that, clients have
+// to reconnect. Not supported on windows.
+type UpgradeConfig struct {
+	DrainTimeout uint `yaml:"drain_timeout"` // (sec) Default is 10.
+}
+
+// ClusterConfig configures the cluster mode, in which instances share
+// dynamic state of plugins via redis pub/sub. See package cluster.
+type ClusterConfig struct {
+	// Redis is the url of the redis server. The cluster mode is disabled
+	// if it is empty.
+	Redis string `yaml:"redis"`
+
+	// Key is the shared key that signs the messages between instances,
+	// so instances that can reach the redis server but don't know the key
+	// cannot change the state of others. It is required.
+	Key string `yaml:"key"`
+
+	Channel string `yaml:"channel"` // default is "mosdns_cluster"
+	NodeID  string `yaml:"node_id"` // default is random
+}
+
 type SecurityConfig struct {
 	BadIPObserver BadIPObserverConfig `yaml:"bad_ip_observer"`
 }
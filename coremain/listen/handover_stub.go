@@ -0,0 +1,37 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+package listen
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+func Inherited(_, _ string) bool {
+	return false
+}
+
+func Listen(ctx context.Context, lc net.ListenConfig, network, addr string) (net.Listener, error) {
+	return lc.Listen(ctx, network, addr)
+}
+
+func ListenPacket(ctx context.Context, lc net.ListenConfig, network, addr string) (net.PacketConn, error) {
+	return lc.ListenPacket(ctx, network, addr)
+}
+
+func ListenExclusivePacket(ctx context.Context, lc net.ListenConfig, network, addr string) (net.PacketConn, error) {
+	return lc.ListenPacket(ctx, network, addr)
+}
+
+func NotifyUpgrade(_ chan<- os.Signal) {}
+
+func NotifyReady() {}
+
+func Upgrade(_ time.Duration) error {
+	return errors.New("upgrade is not supported on this platform")
+}
+
+func CloseListeners() {}
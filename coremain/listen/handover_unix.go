@@ -0,0 +1,392 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package listen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Environment variables that pass the listeners and the pipes to the new
+// process. The listener files start from fd 3, in the order of the keys,
+// and are followed by the write end of the ready pipe and the read end of
+// the takeover pipe.
+const (
+	envInheritedListeners = "MOSDNS_INHERITED_LISTENERS"
+	envReadyFD            = "MOSDNS_READY_FD"
+	envTakeoverFD         = "MOSDNS_TAKEOVER_FD"
+)
+
+var handover struct {
+	sync.Mutex
+	wd           string                // working dir when the process started
+	inherited    map[string][]*os.File // listeners inherited from the old process, by key
+	readyFile    *os.File              // nil if the process was not started by Upgrade
+	takeoverFile *os.File              // write end of the takeover pipe of the new process
+	listeners    []listener            // listeners of this process
+}
+
+// takeover is closed once the old process stopped reading the exclusive
+// packet connections, or at start if the process was not started by Upgrade.
+var takeover = make(chan struct{})
+
+type listener struct {
+	key       string
+	c         io.Closer // net.Listener or net.PacketConn
+	exclusive bool      // see ListenExclusivePacket
+}
+
+func init() {
+	handover.wd, _ = os.Getwd()
+	if s, ok := os.LookupEnv(envInheritedListeners); ok {
+		os.Unsetenv(envInheritedListeners)
+		handover.inherited = make(map[string][]*os.File)
+		if len(s) > 0 {
+			for i, key := range strings.Split(s, ",") {
+				handover.inherited[key] = append(handover.inherited[key], os.NewFile(uintptr(3+i), key))
+			}
+		}
+	}
+	if s, ok := os.LookupEnv(envReadyFD); ok {
+		os.Unsetenv(envReadyFD)
+		if fd, err := strconv.Atoi(s); err == nil {
+			handover.readyFile = os.NewFile(uintptr(fd), "ready")
+		}
+	}
+	var takeoverFile *os.File
+	if s, ok := os.LookupEnv(envTakeoverFD); ok {
+		os.Unsetenv(envTakeoverFD)
+		if fd, err := strconv.Atoi(s); err == nil {
+			takeoverFile = os.NewFile(uintptr(fd), "takeover")
+		}
+	}
+	if takeoverFile != nil {
+		go waitTakeover(takeoverFile, takeover)
+	} else {
+		close(takeover)
+	}
+}
+
+// waitTakeover closes c once the old process writes to or closes the
+// other end of f, which it also does if it exits.
+func waitTakeover(f *os.File, c chan struct{}) {
+	f.Read(make([]byte, 1))
+	f.Close()
+	close(c)
+}
+
+func listenerKey(network, addr string) string {
+	return network + " " + addr
+}
+
+// Inherited reports whether the listener of network and addr is inherited
+// from the old process and not taken yet.
+func Inherited(network, addr string) bool {
+	handover.Lock()
+	defer handover.Unlock()
+	return len(handover.inherited[listenerKey(network, addr)]) > 0
+}
+
+func takeInherited(key string) *os.File {
+	handover.Lock()
+	defer handover.Unlock()
+	files := handover.inherited[key]
+	if len(files) == 0 {
+		return nil
+	}
+	handover.inherited[key] = files[1:]
+	return files[0]
+}
+
+func addListener(key string, c io.Closer, exclusive bool) {
+	handover.Lock()
+	defer handover.Unlock()
+	handover.listeners = append(handover.listeners, listener{key: key, c: c, exclusive: exclusive})
+}
+
+// Listen is like lc.Listen but uses the inherited listener if there is one.
+// The listener can be handed over by Upgrade.
+func Listen(ctx context.Context, lc net.ListenConfig, network, addr string) (net.Listener, error) {
+	key := listenerKey(network, addr)
+	var l net.Listener
+	var err error
+	if f := takeInherited(key); f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+	} else {
+		l, err = lc.Listen(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	addListener(key, l, false)
+	return l, nil
+}
+
+// ListenPacket is like lc.ListenPacket but uses the inherited connection if
+// there is one. The connection can be handed over by Upgrade.
+func ListenPacket(ctx context.Context, lc net.ListenConfig, network, addr string) (net.PacketConn, error) {
+	return listenPacket(ctx, lc, network, addr, false)
+}
+
+// ListenExclusivePacket is like ListenPacket, but the connection is not
+// read by the old and the new process at the same time, for connection
+// oriented protocols like QUIC whose packets must go to the process that
+// owns the connection. The old process closes it once the new process is
+// ready, and the new process does not read it until then.
+func ListenExclusivePacket(ctx context.Context, lc net.ListenConfig, network, addr string) (net.PacketConn, error) {
+	c, err := listenPacket(ctx, lc, network, addr, true)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-takeover:
+		return c, nil
+	default:
+		return newGatedPacketConn(c), nil
+	}
+}
+
+func listenPacket(ctx context.Context, lc net.ListenConfig, network, addr string, exclusive bool) (net.PacketConn, error) {
+	key := listenerKey(network, addr)
+	var c net.PacketConn
+	var err error
+	if f := takeInherited(key); f != nil {
+		c, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		c, err = lc.ListenPacket(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	addListener(key, c, exclusive)
+	return c, nil
+}
+
+// NotifyUpgrade relays SIGUSR2, the upgrade signal, to c.
+func NotifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// NotifyReady closes the inherited listeners that are not used and tells
+// the old process that this process is ready, if it was started by Upgrade.
+func NotifyReady() {
+	handover.Lock()
+	defer handover.Unlock()
+	for _, files := range handover.inherited {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	handover.inherited = nil
+	if f := handover.readyFile; f != nil {
+		f.Write([]byte{1})
+		f.Close()
+		handover.readyFile = nil
+	}
+}
+
+// Upgrade starts a new process with the same arguments, which inherits
+// the listeners of this process. It returns nil once the new process is
+// ready, or an error if it exits or is not ready in timeout, in which case
+// it is killed.
+func Upgrade(timeout time.Duration) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	handover.Lock()
+	keys := make([]string, 0, len(handover.listeners))
+	files := make([]*os.File, 0, len(handover.listeners)+1)
+	for _, l := range handover.listeners {
+		fc, ok := l.c.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := fc.File()
+		if err != nil {
+			handover.Unlock()
+			closeFiles(files)
+			return fmt.Errorf("failed to get the file of listener %s, %w", l.key, err)
+		}
+		keys = append(keys, l.key)
+		files = append(files, f)
+	}
+	handover.Unlock()
+	defer closeFiles(files)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tr, tw, err := os.Pipe()
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Dir = handover.wd
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w, tr)
+	cmd.Env = append(os.Environ(),
+		envInheritedListeners+"="+strings.Join(keys, ","),
+		envReadyFD+"="+strconv.Itoa(3+len(files)),
+		envTakeoverFD+"="+strconv.Itoa(4+len(files)),
+	)
+	err = cmd.Start()
+	w.Close()
+	tr.Close()
+	if err != nil {
+		tw.Close()
+		return err
+	}
+
+	r.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		tw.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, io.EOF) {
+			return errors.New("new process exited before it was ready")
+		}
+		return fmt.Errorf("new process is not ready, %w", err)
+	}
+	handover.Lock()
+	handover.takeoverFile = tw
+	handover.Unlock()
+	return cmd.Process.Release()
+}
+
+// CloseListeners closes the stream listeners and the exclusive packet
+// connections, so new connections go to the new process only, and then
+// lets the new process read the exclusive packet connections. Other packet
+// connections are not closed, the queries that are already in them are
+// still served.
+func CloseListeners() {
+	handover.Lock()
+	defer handover.Unlock()
+	for _, l := range handover.listeners {
+		switch c := l.c.(type) {
+		case *net.UnixListener:
+			// The socket file is used by the new process.
+			c.SetUnlinkOnClose(false)
+			c.Close()
+		case net.Listener:
+			c.Close()
+		default:
+			if l.exclusive {
+				c.Close()
+			}
+		}
+	}
+	if f := handover.takeoverFile; f != nil {
+		f.Close()
+		handover.takeoverFile = nil
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// gate blocks the reads of a connection until takeover.
+type gate struct {
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newGate() *gate {
+	return &gate{closed: make(chan struct{})}
+}
+
+func (g *gate) wait() error {
+	select {
+	case <-takeover:
+		return nil
+	case <-g.closed:
+		return net.ErrClosed
+	}
+}
+
+func (g *gate) close() {
+	g.closeOnce.Do(func() { close(g.closed) })
+}
+
+// gatedPacketConn is a net.PacketConn whose reads wait for takeover.
+type gatedPacketConn struct {
+	net.PacketConn
+	g *gate
+}
+
+// gatedUDPConn is a gated *net.UDPConn. It keeps the methods of
+// *net.UDPConn, so quic-go can still use its optimizations on it.
+type gatedUDPConn struct {
+	*net.UDPConn
+	g     *gate
+	batch *ipv4.PacketConn
+}
+
+func newGatedPacketConn(c net.PacketConn) net.PacketConn {
+	if uc, ok := c.(*net.UDPConn); ok {
+		return &gatedUDPConn{UDPConn: uc, g: newGate(), batch: ipv4.NewPacketConn(uc)}
+	}
+	return &gatedPacketConn{PacketConn: c, g: newGate()}
+}
+
+func (c *gatedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if err := c.g.wait(); err != nil {
+		return 0, nil, err
+	}
+	return c.PacketConn.ReadFrom(b)
+}
+
+func (c *gatedPacketConn) Close() error {
+	c.g.close()
+	return c.PacketConn.Close()
+}
+
+func (c *gatedUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if err := c.g.wait(); err != nil {
+		return 0, nil, err
+	}
+	return c.UDPConn.ReadFrom(b)
+}
+
+func (c *gatedUDPConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	if err := c.g.wait(); err != nil {
+		return 0, 0, 0, nil, err
+	}
+	return c.UDPConn.ReadMsgUDP(b, oob)
+}
+
+// ReadBatch is used by quic-go instead of ReadMsgUDP if it is available.
+func (c *gatedUDPConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	if err := c.g.wait(); err != nil {
+		return 0, err
+	}
+	return c.batch.ReadBatch(ms, flags)
+}
+
+func (c *gatedUDPConn) Close() error {
+	c.g.close()
+	return c.UDPConn.Close()
+}
@@ -0,0 +1,168 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package listen
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// resetHandover makes the process look like it was started by Upgrade
+// until the write end of the returned pipe is closed.
+func resetHandover(t *testing.T) *os.File {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := takeover
+	takeover = make(chan struct{})
+	go waitTakeover(r, takeover)
+	t.Cleanup(func() {
+		w.Close()
+		takeover = prev
+		handover.Lock()
+		for _, l := range handover.listeners {
+			l.c.Close()
+		}
+		handover.listeners = nil
+		handover.inherited = nil
+		handover.takeoverFile = nil
+		handover.Unlock()
+	})
+	return w
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func Test_ListenExclusivePacket_handover(t *testing.T) {
+	ctx := context.Background()
+	old, err := ListenExclusivePacket(ctx, net.ListenConfig{}, "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := old.(*net.UDPConn); !ok {
+		t.Fatalf("conn of a process not started by Upgrade is gated: %T", old)
+	}
+	addr := old.LocalAddr().String()
+
+	// Hand the socket over as Upgrade does, within this process.
+	w := resetHandover(t)
+	handover.listeners = []listener{{key: listenerKey("udp", addr), c: old, exclusive: true}}
+	f, err := old.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handover.inherited = map[string][]*os.File{listenerKey("udp", addr): {f}}
+	handover.takeoverFile = w
+
+	c, err := ListenExclusivePacket(ctx, net.ListenConfig{}, "udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(*gatedUDPConn); !ok {
+		t.Fatalf("inherited conn is not gated: %T", c)
+	}
+	defer c.Close()
+	readC := make(chan readResult, 1)
+	go func() {
+		n, _, err := c.ReadFrom(make([]byte, 64))
+		readC <- readResult{n: n, err: err}
+	}()
+
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Before the takeover, the old process reads everything.
+	if _, err := client.Write([]byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	old.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := old.ReadFrom(make([]byte, 64)); err != nil || n != 3 {
+		t.Fatalf("old conn read: n = %d, err = %v", n, err)
+	}
+	select {
+	case r := <-readC:
+		t.Fatalf("new conn read before the takeover: %+v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Only the old conn is a listener of the old process.
+	handover.listeners = handover.listeners[:1]
+	CloseListeners()
+	if _, _, err := old.ReadFrom(make([]byte, 64)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("old conn is not closed, read err = %v", err)
+	}
+	if _, err := client.Write([]byte("new!")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-readC:
+		if r.err != nil || r.n != 4 {
+			t.Fatalf("new conn read: %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("new conn did not read after the takeover")
+	}
+}
+
+func Test_gatedPacketConn_close(t *testing.T) {
+	resetHandover(t)
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newGatedPacketConn(uc).(*gatedUDPConn)
+
+	errC := make(chan error, 2)
+	go func() {
+		_, _, err := c.ReadFrom(make([]byte, 64))
+		errC <- err
+	}()
+	go func() {
+		_, err := c.ReadBatch(make([]ipv4.Message, 1), 0)
+		errC <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errC:
+			if !errors.Is(err, net.ErrClosed) {
+				t.Fatalf("want net.ErrClosed, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("blocked read is not unblocked by Close")
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package listen
+
+// SocketOpts are the options of listening sockets.
+type SocketOpts struct {
+	// ReadBuffer and WriteBuffer are the sizes of SO_RCVBUF and SO_SNDBUF
+	// in bytes. They are capped by the system limits, e.g. net.core.rmem_max
+	// and net.core.wmem_max on linux. Zero ReadBuffer means 64KiB, and zero
+	// WriteBuffer means the system default.
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+func (o SocketOpts) readBuffer() int {
+	if o.ReadBuffer > 0 {
+		return o.ReadBuffer
+	}
+	return 64 * 1024
+}
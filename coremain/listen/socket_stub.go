@@ -6,6 +6,6 @@ import (
 	"net"
 )
 
-func CreateListenConfig(_ bool) net.ListenConfig {
+func CreateListenConfig(_ bool, _ SocketOpts) net.ListenConfig {
 	return net.ListenConfig{}
 }
@@ -9,7 +9,7 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func CreateListenConfig(uds bool) net.ListenConfig {
+func CreateListenConfig(uds bool, opts SocketOpts) net.ListenConfig {
 	return net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
 			if uds {
@@ -25,7 +25,11 @@ func CreateListenConfig(uds bool) net.ListenConfig {
 				if e != nil {
 					return
 				}
-				e = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, 64*1024)
+				e = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, opts.readBuffer())
+				if e != nil || opts.WriteBuffer <= 0 {
+					return
+				}
+				e = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, opts.WriteBuffer)
 			})
 			if err != nil {
 				return err
@@ -7,7 +7,7 @@ import (
 	"syscall"
 )
 
-func CreateListenConfig(uds bool) net.ListenConfig {
+func CreateListenConfig(uds bool, opts SocketOpts) net.ListenConfig {
 	return net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
 			if uds {
@@ -19,7 +19,11 @@ func CreateListenConfig(uds bool) net.ListenConfig {
 				if e != nil {
 					return
 				}
-				e = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 64*1024)
+				e = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, opts.readBuffer())
+				if e != nil || opts.WriteBuffer <= 0 {
+					return
+				}
+				e = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, opts.WriteBuffer)
 			})
 			if err != nil {
 				return err
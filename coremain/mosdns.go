@@ -1,22 +1,42 @@
 package coremain
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/coremain/listen"
 	"github.com/pmkol/mosdns-x/mlog"
+	"github.com/pmkol/mosdns-x/pkg/allocaudit"
+	"github.com/pmkol/mosdns-x/pkg/cluster"
 	"github.com/pmkol/mosdns-x/pkg/data_provider"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/safe_close"
+	"github.com/pmkol/mosdns-x/pkg/server"
+	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
+	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
+const (
+	defaultDrainTimeout = time.Second * 10
+	upgradeReadyTimeout = time.Second * 30
+)
+
+// Mosdns holds the data providers and plugins of a config. A new Mosdns
+// is created on every reload. See process.
 type Mosdns struct {
 	logger *zap.Logger
 
@@ -26,37 +46,286 @@ type Mosdns struct {
 	// Plugins
 	execs    map[string]executable_seq.Executable
 	matchers map[string]executable_seq.Matcher
+	plugins  []Plugin
 
-	httpAPIMux    *http.ServeMux
-	httpAPIServer *http.Server
+	httpAPIMux *http.ServeMux // handlers of plugins
 
-	metricsReg *prometheus.Registry
+	cluster *cluster.Cluster // nil if the cluster mode is disabled
+
+	metricsReg *prometheus.Registry // metrics of plugins
+
+	sc *safe_close.SafeClose
+}
+
+// process runs the listeners and the api server, which stay open across
+// reloads, and passes queries to the entry handlers of the current Mosdns.
+type process struct {
+	logger *zap.Logger
+
+	// loadConfig loads the config on reload. Nil if reload is not supported.
+	loadConfig func() (*Config, error)
+
+	reloadMu sync.Mutex
+	servers  []ServerConfig // servers of the current config
+	current  atomic.Pointer[Mosdns]
+	handlers map[string]*D.SwappableHandler // entry handlers of listeners, by handlerKey
+
+	apiMux *http.ServeMux
+
+	metricsReg            *prometheus.Registry
+	abnormalQuestionTotal *prometheus.CounterVec
+	udpOverflowTotal      *prometheus.CounterVec
+	httpOverflowTotal     *prometheus.CounterVec
+	clientOverflowTotal   prometheus.Counter
+	clientDeniedTotal     prometheus.Counter
+	activeConns           *prometheus.GaugeVec
+	activeStreams         *prometheus.GaugeVec
+
+	// upgraded is set once a new process took over the listeners.
+	upgraded atomic.Bool
 
 	sc *safe_close.SafeClose
 }
 
 func RunMosdns(cfg *Config) error {
+	return runMosdns(cfg, nil)
+}
+
+// newProcess creates a process with its metrics registered.
+func newProcess(lg *zap.Logger, loadConfig func() (*Config, error)) *process {
+	p := &process{
+		logger:     lg,
+		loadConfig: loadConfig,
+		apiMux:     http.NewServeMux(),
+		metricsReg: newMetricsReg(),
+		sc:         safe_close.NewSafeClose(),
+		abnormalQuestionTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "abnormal_question_query_total",
+			Help: "The total number of queries that do not have exactly one question",
+		}, []string{"kind"}),
+		udpOverflowTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "udp_overflow_query_total",
+			Help: "The total number of udp queries that exceed the max concurrent queries of the listener",
+		}, []string{"listener"}),
+		httpOverflowTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_overflow_request_total",
+			Help: "The total number of http requests that are rejected because of the max concurrent requests of the listener",
+		}, []string{"listener"}),
+		clientOverflowTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "client_overflow_query_total",
+			Help: "The total number of queries that exceed the max concurrent queries of the client",
+		}),
+		clientDeniedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "client_denied_query_total",
+			Help: "The total number of queries from clients that are not allowed",
+		}),
+		activeConns: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "active_connections",
+			Help: "The number of open connections of tcp, dot, doh, doh3 and doq listeners",
+		}, []string{"protocol", "listener"}),
+		activeStreams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "active_streams",
+			Help: "The number of doq streams and http requests that are in progress",
+		}, []string{"protocol", "listener"}),
+	}
+	reg := prometheus.WrapRegistererWithPrefix("mosdns_", p.metricsReg)
+	reg.MustRegister(p.abnormalQuestionTotal, p.udpOverflowTotal, p.httpOverflowTotal, p.clientOverflowTotal, p.clientDeniedTotal, p.activeConns, p.activeStreams)
+	return p
+}
+
+func runMosdns(cfg *Config, loadConfig func() (*Config, error)) error {
 	lg, err := mlog.NewLogger(&cfg.Log)
 	if err != nil {
 		return fmt.Errorf("failed to init logger: %w", err)
 	}
+	// The warnings and errors of the process are kept for the bug report.
+	recentLogs := newLogRing(recentLogSize)
+	lg = lg.WithOptions(recentLogs.tee())
+	if err := mlog.SetPrivacy(&cfg.Log.Privacy); err != nil {
+		return fmt.Errorf("failed to init log privacy: %w", err)
+	}
+	utils.SetRandSeed(cfg.Random.Seed)
+	server.SetKeyDir(cfg.KeyDir)
+	if quicGSODisabled(cfg.Servers) {
+		server.DisableQUICGSO()
+	}
+
+	p := newProcess(lg, loadConfig)
+	reg := prometheus.WrapRegistererWithPrefix("mosdns_", p.metricsReg)
+	if cfg.Debug.AllocAudit {
+		if err := allocaudit.Enable(reg); err != nil {
+			return fmt.Errorf("failed to enable alloc audit, %w", err)
+		}
+		lg.Warn("alloc audit is enabled, this has a small performance cost")
+	}
+
+	p.apiMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		g := prometheus.Gatherers{p.metricsReg, p.current.Load().metricsReg}
+		promhttp.HandlerFor(g, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+	p.apiMux.HandleFunc("/debug/pprof/", pprof.Index)
+	p.apiMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	p.apiMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	p.apiMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	p.apiMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	p.apiMux.HandleFunc("/debug/recent_errors", func(w http.ResponseWriter, _ *http.Request) {
+		for _, line := range recentLogs.snapshot() {
+			_, _ = w.Write(line)
+		}
+	})
+	p.apiMux.HandleFunc("/reload", p.handleReloadRequest)
+	p.apiMux.HandleFunc("/certs/reload", p.handleCertsReloadRequest)
+	p.apiMux.HandleFunc("/plugins/", func(w http.ResponseWriter, r *http.Request) {
+		p.current.Load().httpAPIMux.ServeHTTP(w, r)
+	})
+
+	if err := p.load(cfg); err != nil {
+		return err
+	}
+	m := p.current.Load()
+	for i := range cfg.Servers {
+		if err := p.startServers(i, &cfg.Servers[i]); err != nil {
+			return fmt.Errorf("failed to start server #%d, %w", i, err)
+		}
+	}
 
+	// Load lazy data providers after servers are started.
+	m.dataManager.StartLazyLoad()
+
+	// Start http api server
+	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
+		httpServer := &http.Server{
+			Addr:    httpAddr,
+			Handler: p.apiMux,
+		}
+		lg.Info("starting api http server", zap.String("addr", httpAddr))
+		l, err := listen.Listen(context.Background(), net.ListenConfig{}, "tcp", httpAddr)
+		if err != nil {
+			return fmt.Errorf("failed to start api http server, %w", err)
+		}
+		p.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+			defer done()
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- httpServer.Serve(l)
+			}()
+			select {
+			case err := <-errChan:
+				if p.upgraded.Load() {
+					<-closeSignal
+					return
+				}
+				p.sc.SendCloseSignal(err)
+			case <-closeSignal:
+				httpServer.Close()
+			}
+		})
+	}
+
+	p.handleUpgrade(&cfg.Upgrade)
+	p.handleReloadSignal()
+	listen.NotifyReady()
+
+	<-p.sc.ReceiveCloseSignal()
+	p.sc.Done()
+	p.sc.CloseWait()
+	return p.sc.Err()
+}
+
+// load loads the plugins and the entry handlers of cfg as the current ones.
+func (p *process) load(cfg *Config) error {
+	if len(cfg.Servers) == 0 {
+		return errors.New("no server is configured")
+	}
+	m, err := newMosdns(p.logger, cfg)
+	if err != nil {
+		return err
+	}
+	handlers, err := p.newEntryHandlers(m, cfg.Servers)
+	if err != nil {
+		m.close()
+		return err
+	}
+	p.current.Store(m)
+	p.servers = cfg.Servers
+	p.handlers = make(map[string]*D.SwappableHandler, len(handlers))
+	for k, h := range handlers {
+		p.handlers[k] = D.NewSwappableHandler(h)
+	}
+	return nil
+}
+
+// handleUpgrade starts a new process on the upgrade signal and exits
+// after the new process is ready. See UpgradeConfig.
+func (p *process) handleUpgrade(cfg *UpgradeConfig) {
+	drainTimeout := defaultDrainTimeout
+	if cfg.DrainTimeout > 0 {
+		drainTimeout = time.Duration(cfg.DrainTimeout) * time.Second
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	listen.NotifyUpgrade(sigChan)
+	p.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		for {
+			select {
+			case <-sigChan:
+				p.logger.Info("upgrading, starting new process")
+				if err := listen.Upgrade(upgradeReadyTimeout); err != nil {
+					p.logger.Error("failed to upgrade", zap.Error(err))
+					continue
+				}
+				p.upgraded.Store(true)
+				listen.CloseListeners()
+				p.logger.Info("new process is ready, draining", zap.Duration("timeout", drainTimeout))
+				select {
+				case <-time.After(drainTimeout):
+					p.sc.SendCloseSignal(nil)
+				case <-closeSignal:
+				}
+				return
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+}
+
+// ready reports whether the data providers of the current Mosdns are loaded.
+func (p *process) ready() bool {
+	return p.current.Load().dataManager.Ready()
+}
+
+// newMosdns loads the data providers and plugins of cfg.
+func newMosdns(lg *zap.Logger, cfg *Config) (_ *Mosdns, err error) {
 	m := &Mosdns{
 		logger:      lg,
 		dataManager: data_provider.NewDataManager(),
 		execs:       make(map[string]executable_seq.Executable),
 		matchers:    make(map[string]executable_seq.Matcher),
 		httpAPIMux:  http.NewServeMux(),
-		metricsReg:  newMetricsReg(),
+		metricsReg:  prometheus.NewRegistry(),
 		sc:          safe_close.NewSafeClose(),
 	}
+	defer func() {
+		if err != nil {
+			m.close()
+		}
+	}()
 
-	m.httpAPIMux.Handle("/metrics", promhttp.HandlerFor(m.metricsReg, promhttp.HandlerOpts{}))
-	m.httpAPIMux.HandleFunc("/debug/pprof/", pprof.Index)
-	m.httpAPIMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	m.httpAPIMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	m.httpAPIMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	m.httpAPIMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if len(cfg.Cluster.Redis) > 0 {
+		c, err := newCluster(&cfg.Cluster, lg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init cluster, %w", err)
+		}
+		m.cluster = c
+		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+			defer done()
+			<-closeSignal
+			_ = c.Close()
+		})
+		lg.Info("cluster mode enabled", zap.String("node_id", c.NodeID()))
+	}
 
 	// Init data manager
 	dupTag := make(map[string]struct{})
@@ -65,13 +334,20 @@ func RunMosdns(cfg *Config) error {
 			continue
 		}
 		if _, ok := dupTag[dpc.Tag]; ok {
-			return fmt.Errorf("duplicated provider tag %s", dpc.Tag)
+			return nil, fmt.Errorf("duplicated provider tag %s", dpc.Tag)
 		}
 		dupTag[dpc.Tag] = struct{}{}
 
 		dp, err := data_provider.NewDataProvider(lg, dpc)
 		if err != nil {
-			return fmt.Errorf("failed to init data provider %s, %w", dpc.Tag, err)
+			return nil, fmt.Errorf("failed to init data provider %s, %w", dpc.Tag, err)
+		}
+		if dpc.Cluster {
+			if m.cluster == nil {
+				lg.Warn("cluster mode is disabled, data is not shared", zap.String("provider", dpc.Tag))
+			} else {
+				dp.ShareWith(m.cluster, "data_provider/"+dpc.Tag)
+			}
 		}
 		m.dataManager.AddDataProvider(dpc.Tag, dp)
 	}
@@ -80,7 +356,7 @@ func RunMosdns(cfg *Config) error {
 	for tag, f := range LoadNewPersetPluginFuncs() {
 		p, err := f(NewBP(tag, "preset", m.logger, m))
 		if err != nil {
-			return fmt.Errorf("failed to init preset plugin %s, %w", tag, err)
+			return nil, fmt.Errorf("failed to init preset plugin %s, %w", tag, err)
 		}
 		m.addPlugin(p)
 	}
@@ -92,14 +368,14 @@ func RunMosdns(cfg *Config) error {
 			continue
 		}
 		if _, dup := dupTag[pc.Tag]; dup {
-			return fmt.Errorf("duplicated plugin tag %s", pc.Tag)
+			return nil, fmt.Errorf("duplicated plugin tag %s", pc.Tag)
 		}
 		dupTag[pc.Tag] = struct{}{}
 
 		m.logger.Info("loading plugin", zap.String("tag", pc.Tag), zap.String("type", pc.Type))
 		p, err := NewPlugin(&pc, m.logger, m)
 		if err != nil {
-			return fmt.Errorf("failed to init plugin #%d, %w", i, err)
+			return nil, fmt.Errorf("failed to init plugin #%d, %w", i, err)
 		}
 
 		m.addPlugin(p)
@@ -107,45 +383,43 @@ func RunMosdns(cfg *Config) error {
 			m.httpAPIMux.Handle(fmt.Sprintf("/plugins/%s/", p.Tag()), h)
 		}
 	}
+	return m, nil
+}
 
-	if len(cfg.Servers) == 0 {
-		return errors.New("no server is configured")
+// NewTestMosdns returns a Mosdns for the tests of plugins. execs and
+// matchers can be nil.
+func NewTestMosdns(execs map[string]executable_seq.Executable, matchers map[string]executable_seq.Matcher) *Mosdns {
+	if execs == nil {
+		execs = make(map[string]executable_seq.Executable)
 	}
-	for i, sc := range cfg.Servers {
-		if err := m.startServers(&sc); err != nil {
-			return fmt.Errorf("failed to start server #%d, %w", i, err)
-		}
+	if matchers == nil {
+		matchers = make(map[string]executable_seq.Matcher)
 	}
+	return &Mosdns{
+		logger:      zap.NewNop(),
+		dataManager: data_provider.NewDataManager(),
+		execs:       execs,
+		matchers:    matchers,
+		httpAPIMux:  http.NewServeMux(),
+		metricsReg:  prometheus.NewRegistry(),
+		sc:          safe_close.NewSafeClose(),
+	}
+}
 
-	// Start http api server
-	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
-		httpServer := &http.Server{
-			Addr:    httpAddr,
-			Handler: m.httpAPIMux,
+// close closes the plugins and data providers of m.
+func (m *Mosdns) close() {
+	for _, p := range m.plugins {
+		if err := p.Close(); err != nil {
+			m.logger.Warn("failed to close plugin", zap.String("tag", p.Tag()), zap.Error(err))
 		}
-		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
-			defer done()
-			errChan := make(chan error, 1)
-			go func() {
-				m.logger.Info("starting api http server", zap.String("addr", httpAddr))
-				errChan <- httpServer.ListenAndServe()
-			}()
-			select {
-			case err := <-errChan:
-				m.sc.SendCloseSignal(err)
-			case <-closeSignal:
-				httpServer.Close()
-			}
-		})
 	}
-
-	<-m.sc.ReceiveCloseSignal()
+	m.dataManager.Close()
 	m.sc.Done()
 	m.sc.CloseWait()
-	return m.sc.Err()
 }
 
 func (m *Mosdns) addPlugin(p Plugin) {
+	m.plugins = append(m.plugins, p)
 	t := p.Tag()
 	if p, ok := p.(ExecutablePlugin); ok {
 		m.execs[t] = p
@@ -171,6 +445,12 @@ func (m *Mosdns) GetMatchers() map[string]executable_seq.Matcher {
 	return m.matchers
 }
 
+// GetCluster returns the cluster of this instance. It is nil if the
+// cluster mode is disabled, which is still valid to use.
+func (m *Mosdns) GetCluster() *cluster.Cluster {
+	return m.cluster
+}
+
 func (m *Mosdns) GetMetricsReg() prometheus.Registerer {
 	return prometheus.WrapRegistererWithPrefix("mosdns_", m.metricsReg)
 }
@@ -179,6 +459,26 @@ func (m *Mosdns) GetHTTPAPIMux() *http.ServeMux {
 	return m.httpAPIMux
 }
 
+func newCluster(cfg *ClusterConfig, lg *zap.Logger) (*cluster.Cluster, error) {
+	opt, err := redis.ParseURL(cfg.Redis)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url, %w", err)
+	}
+	client := redis.NewClient(opt)
+	c, err := cluster.New(cluster.Opts{
+		Client:  client,
+		Key:     []byte(cfg.Key),
+		Channel: cfg.Channel,
+		NodeID:  cfg.NodeID,
+		Logger:  lg.Named("cluster"),
+	})
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
 func newMetricsReg() *prometheus.Registry {
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
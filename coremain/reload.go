@@ -0,0 +1,210 @@
+package coremain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/server"
+)
+
+// handleReloadSignal reloads the config on SIGHUP.
+func (p *process) handleReloadSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	p.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		for {
+			select {
+			case <-sigChan:
+				if err := p.reload(); err != nil {
+					p.logger.Error("failed to reload config", zap.Error(err))
+				}
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+}
+
+// handleReloadRequest reloads the config on a POST request.
+func (p *process) handleReloadRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := p.reload(); err != nil {
+		p.logger.Error("failed to reload config", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// handleCertsReloadRequest reloads the certificates of listeners on a POST
+// request.
+func (p *process) handleCertsReloadRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := server.ReloadCerts()
+	if err != nil {
+		p.logger.Error("failed to reload certificates", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.logger.Info("certificates reloaded", zap.Int("num", n))
+	_, _ = fmt.Fprintf(w, "ok, %d certificates reloaded\n", n)
+}
+
+// reloadReadyTimeout is the max time to wait for the lazy data providers
+// of the new config.
+var reloadReadyTimeout = time.Minute
+
+// reload loads the config again and replaces the data providers, the
+// plugins and the entry handlers of listeners. If anything fails, the
+// current ones are kept. The new ones serve queries once their lazy data
+// providers are loaded. Listeners are kept open, so their protocols,
+// addresses and routes cannot be changed by a reload, and their other
+// options, e.g. certificates and timeouts, are not applied. Neither are
+// the log, api and upgrade options. These require a restart or an upgrade.
+func (p *process) reload() error {
+	if p.loadConfig == nil {
+		return errors.New("reload is not supported")
+	}
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	p.logger.Info("reloading config")
+	cfg, err := p.loadConfig()
+	if err != nil {
+		return err
+	}
+	if err := sameListeners(p.servers, cfg.Servers); err != nil {
+		return fmt.Errorf("listeners are changed, %w", err)
+	}
+	m, err := newMosdns(p.logger, cfg)
+	if err != nil {
+		return err
+	}
+	handlers, err := p.newEntryHandlers(m, cfg.Servers)
+	if err != nil {
+		m.close()
+		return err
+	}
+	m.dataManager.StartLazyLoad()
+	ctx, cancel := context.WithTimeout(context.Background(), reloadReadyTimeout)
+	defer cancel()
+	if err := m.dataManager.WaitReady(ctx); err != nil {
+		m.close()
+		return fmt.Errorf("failed to load lazy data providers, %w", err)
+	}
+	p.warnListenerChanges(cfg.Servers)
+
+	old := p.current.Swap(m)
+	for k, h := range handlers {
+		p.handlers[k].Swap(h)
+	}
+
+	// Close the old one once the queries that it is serving are done.
+	time.AfterFunc(maxQueryTimeout(p.servers), old.close)
+	p.servers = cfg.Servers
+	p.logger.Info("config reloaded")
+	return nil
+}
+
+// sameListeners returns an error if the listeners of a and b have
+// different protocols, addresses or routes.
+func sameListeners(a, b []ServerConfig) error {
+	if len(a) != len(b) {
+		return fmt.Errorf("server number %d -> %d", len(a), len(b))
+	}
+	for i := range a {
+		la, lb := a[i].Listeners, b[i].Listeners
+		if len(la) != len(lb) {
+			return fmt.Errorf("server #%d, listener number %d -> %d", i, len(la), len(lb))
+		}
+		for j := range la {
+			if la[j].Protocol != lb[j].Protocol || la[j].Addr != lb[j].Addr || la[j].UnixDomainSocket != lb[j].UnixDomainSocket {
+				return fmt.Errorf("server #%d, listener %s %s -> %s %s", i, la[j].Protocol, la[j].Addr, lb[j].Protocol, lb[j].Addr)
+			}
+			if len(la[j].Routes) != len(lb[j].Routes) {
+				return fmt.Errorf("listener %s, route number %d -> %d", la[j].Addr, len(la[j].Routes), len(lb[j].Routes))
+			}
+			for k := range la[j].Routes {
+				if pa, pb := la[j].Routes[k].Path, lb[j].Routes[k].Path; pa != pb {
+					return fmt.Errorf("listener %s, route %s -> %s", la[j].Addr, pa, pb)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// warnListenerChanges logs the options of listeners that are changed by
+// servers but cannot be applied by a reload.
+func (p *process) warnListenerChanges(servers []ServerConfig) {
+	for i := range servers {
+		for j, lc := range servers[i].Listeners {
+			if opts := changedListenerOptions(p.servers[i].Listeners[j], lc); len(opts) > 0 {
+				p.logger.Warn(
+					"listener options are changed, they require a restart or an upgrade",
+					zap.String("listener", lc.Addr),
+					zap.Strings("options", opts),
+				)
+			}
+		}
+	}
+}
+
+// changedListenerOptions returns the yaml names of the options that are
+// different between a and b, except the entries, which are reloaded.
+func changedListenerOptions(a, b *ServerListenerConfig) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	var opts []string
+	for i := 0; i < va.NumField(); i++ {
+		f := va.Type().Field(i)
+		switch f.Name {
+		case "Entry":
+			continue
+		case "Routes":
+			// Paths are checked by sameListeners.
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			opts = append(opts, name)
+		}
+	}
+	return opts
+}
+
+// maxQueryTimeout returns the max query timeout of the entries of servers.
+func maxQueryTimeout(servers []ServerConfig) time.Duration {
+	d := defaultQueryTimeout
+	update := func(ec *EntryConfig) {
+		d = max(d, queryTimeout(ec))
+	}
+	for i := range servers {
+		update(&servers[i].EntryConfig)
+		for _, lc := range servers[i].Listeners {
+			if lc.Entry != nil {
+				update(lc.Entry)
+			}
+			for k := range lc.Routes {
+				update(&lc.Routes[k].EntryConfig)
+			}
+		}
+	}
+	return d
+}
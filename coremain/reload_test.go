@@ -0,0 +1,177 @@
+package coremain
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/data_provider"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const testAnswerType = "test_answer"
+
+// testAnswerArgs answers A queries with Addr.
+type testAnswerArgs struct {
+	Addr string `yaml:"addr"`
+}
+
+type testAnswer struct {
+	*BP
+	addr netip.Addr
+}
+
+func (t *testAnswer) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: qCtx.Q().Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   t.addr.AsSlice(),
+	})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func init() {
+	RegNewPluginFunc(testAnswerType, func(bp *BP, args interface{}) (Plugin, error) {
+		addr, err := netip.ParseAddr(args.(*testAnswerArgs).Addr)
+		if err != nil {
+			return nil, err
+		}
+		return &testAnswer{BP: bp, addr: addr}, nil
+	}, func() interface{} { return new(testAnswerArgs) })
+}
+
+func testReloadConfig(addr string) *Config {
+	return &Config{
+		Plugins: []PluginConfig{{Tag: "answer", Type: testAnswerType, Args: &testAnswerArgs{Addr: addr}}},
+		Servers: []ServerConfig{{
+			EntryConfig: EntryConfig{Exec: "answer"},
+			Listeners:   []*ServerListenerConfig{{Protocol: "udp", Addr: "127.0.0.1:5353"}},
+		}},
+	}
+}
+
+// queryProcess returns the answer of p to an A query.
+func queryProcess(t *testing.T, p *process) string {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r, err := p.handlers[handlerKey(0, 0, "")].ServeDNS(context.Background(), q, query_context.NewRequestMeta(netip.MustParseAddr("127.0.0.1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+	return r.Answer[0].(*dns.A).A.String()
+}
+
+func Test_process_reload(t *testing.T) {
+	defer func(d time.Duration) { reloadReadyTimeout = d }(reloadReadyTimeout)
+	reloadReadyTimeout = 100 * time.Millisecond
+
+	// A lazy provider that never loads, its file is a directory.
+	badLazyFile := filepath.Join(t.TempDir(), "dir")
+	if err := os.Mkdir(badLazyFile, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	goodLazyFile := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(goodLazyFile, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var next *Config
+	var loadErr error
+	p := newProcess(zap.NewNop(), func() (*Config, error) { return next, loadErr })
+	if err := p.load(testReloadConfig("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     func() *Config
+		loadErr error
+		wantErr bool
+		want    string
+	}{
+		{"reloaded", func() *Config { return testReloadConfig("192.0.2.2") }, nil, false, "192.0.2.2"},
+		{"config error", func() *Config { return nil }, errors.New("bad config"), true, "192.0.2.2"},
+		{"plugin error", func() *Config { return testReloadConfig("invalid") }, nil, true, "192.0.2.2"},
+		{"listener changed", func() *Config {
+			c := testReloadConfig("192.0.2.3")
+			c.Servers[0].Listeners[0].Addr = "127.0.0.1:5354"
+			return c
+		}, nil, true, "192.0.2.2"},
+		{"lazy provider not loaded", func() *Config {
+			c := testReloadConfig("192.0.2.3")
+			c.DataProviders = []data_provider.DataProviderConfig{{Tag: "lazy", File: badLazyFile, Lazy: true}}
+			return c
+		}, nil, true, "192.0.2.2"},
+		{"lazy provider loaded", func() *Config {
+			c := testReloadConfig("192.0.2.4")
+			c.DataProviders = []data_provider.DataProviderConfig{{Tag: "lazy", File: goodLazyFile, Lazy: true}}
+			return c
+		}, nil, false, "192.0.2.4"},
+		{"listener option changed", func() *Config {
+			c := testReloadConfig("192.0.2.5")
+			c.Servers[0].Listeners[0].IdleTimeout = 30
+			return c
+		}, nil, false, "192.0.2.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, loadErr = tt.cfg(), tt.loadErr
+			err := p.reload()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reload() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := queryProcess(t, p); got != tt.want {
+				t.Fatalf("want answer %s, got %s", tt.want, got)
+			}
+			if !p.current.Load().dataManager.Ready() {
+				t.Fatal("current data providers are not ready")
+			}
+		})
+	}
+}
+
+func Test_changedListenerOptions(t *testing.T) {
+	a := &ServerListenerConfig{Protocol: "dot", Addr: ":853", Cert: "a.pem", Entry: &EntryConfig{Exec: "a"}}
+	b := &ServerListenerConfig{Protocol: "dot", Addr: ":853", Cert: "b.pem", TLSCurves: []string{"X25519"}, Entry: &EntryConfig{Exec: "b"}}
+	got := changedListenerOptions(a, b)
+	if len(got) != 2 || got[0] != "cert" || got[1] != "tls_curves" {
+		t.Fatalf("want [cert tls_curves], got %v", got)
+	}
+	if got := changedListenerOptions(a, a); len(got) != 0 {
+		t.Fatalf("want no change, got %v", got)
+	}
+}
+
+func Test_process_handleCertsReloadRequest(t *testing.T) {
+	p := newProcess(zap.NewNop(), nil)
+	tests := []struct {
+		method     string
+		wantStatus int
+	}{
+		{http.MethodGet, http.StatusMethodNotAllowed},
+		{http.MethodPost, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p.handleCertsReloadRequest(w, httptest.NewRequest(tt.method, "/certs/reload", nil))
+		if w.Code != tt.wantStatus {
+			t.Fatalf("%s, want status %d, got %d", tt.method, tt.wantStatus, w.Code)
+		}
+	}
+}
@@ -2,17 +2,23 @@ package coremain
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/pires/go-proxyproto"
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/coremain/listen"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/real_ip"
 	"github.com/pmkol/mosdns-x/pkg/server"
 	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
 	H "github.com/pmkol/mosdns-x/pkg/server/http_handler"
@@ -20,29 +26,137 @@ import (
 
 const defaultQueryTimeout = time.Second * 10
 
-func (m *Mosdns) startServers(cfg *ServerConfig) error {
-	if len(cfg.Listeners) == 0 {
-		return errors.New("no server listener is configured")
+// handlerKey is the key of the entry handler of listener l of server s.
+// path is the url path of a route, or empty for the listener itself.
+func handlerKey(s, l int, path string) string {
+	return fmt.Sprintf("%d/%d/%s", s, l, path)
+}
+
+// newEntryHandlers creates the entry handlers of the listeners of servers
+// with the executables of m, by handlerKey.
+func (p *process) newEntryHandlers(m *Mosdns, servers []ServerConfig) (map[string]D.Handler, error) {
+	handlers := make(map[string]D.Handler)
+	for i := range servers {
+		cfg := &servers[i]
+		if len(cfg.Listeners) == 0 {
+			return nil, fmt.Errorf("server #%d, no server listener is configured", i)
+		}
+		// DDR is answered by the entry handlers, after their client ACLs.
+		var ddr *D.DDR
+		if cfg.DDR.Enabled {
+			ddrTarget, ddrEndpoints, err := ddrFromListeners(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("server #%d, failed to init ddr, %w", i, err)
+			}
+			ddr = D.NewDDR(ddrTarget, ddrEndpoints)
+		}
+		dnsHandler, err := p.newEntryHandler(m, &cfg.EntryConfig, ddr)
+		if err != nil {
+			return nil, fmt.Errorf("server #%d, %w", i, err)
+		}
+
+		for j, lc := range cfg.Listeners {
+			h := dnsHandler
+			exec := cfg.Exec
+			if lc.Entry != nil {
+				ec := *lc.Entry
+				if len(ec.Exec) == 0 {
+					ec.Exec = cfg.Exec
+				}
+				exec = ec.Exec
+				if h, err = p.newEntryHandler(m, &ec, ddr); err != nil {
+					return nil, fmt.Errorf("listener %s, %w", lc.Addr, err)
+				}
+			}
+			handlers[handlerKey(i, j, "")] = h
+
+			for _, rc := range lc.Routes {
+				if len(rc.Path) == 0 {
+					return nil, fmt.Errorf("listener %s, empty route path", lc.Addr)
+				}
+				k := handlerKey(i, j, rc.Path)
+				if _, dup := handlers[k]; dup {
+					return nil, fmt.Errorf("listener %s, duplicated route path %s", lc.Addr, rc.Path)
+				}
+				ec := rc.EntryConfig
+				if len(ec.Exec) == 0 {
+					ec.Exec = exec
+				}
+				rh, err := p.newEntryHandler(m, &ec, ddr)
+				if err != nil {
+					return nil, fmt.Errorf("listener %s, route %s, %w", lc.Addr, rc.Path, err)
+				}
+				handlers[k] = rh
+			}
+		}
 	}
+	return handlers, nil
+}
+
+// startServers starts the listeners of server i with the handlers in
+// p.handlers.
+func (p *process) startServers(i int, cfg *ServerConfig) error {
+	for j, lc := range cfg.Listeners {
+		var routes map[string]D.Handler
+		for _, rc := range lc.Routes {
+			if routes == nil {
+				routes = make(map[string]D.Handler)
+			}
+			routes[rc.Path] = p.handlers[handlerKey(i, j, rc.Path)]
+		}
+		if err := p.startServerListener(lc, p.handlers[handlerKey(i, j, "")], routes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quicGSODisabled reports whether any listener of servers disables GSO.
+func quicGSODisabled(servers []ServerConfig) bool {
+	for _, sc := range servers {
+		for _, lc := range sc.Listeners {
+			if lc.QUIC.DisableGSO {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// queryTimeout returns the query timeout of cfg.
+func queryTimeout(cfg *EntryConfig) time.Duration {
+	if cfg.Timeout > 0 {
+		return time.Duration(cfg.Timeout) * time.Second
+	}
+	return defaultQueryTimeout
+}
+
+func (p *process) newEntryHandler(m *Mosdns, cfg *EntryConfig, ddr *D.DDR) (D.Handler, error) {
 	if len(cfg.Exec) == 0 {
-		return errors.New("empty entry")
+		return nil, errors.New("empty entry")
 	}
 
 	entry := m.execs[cfg.Exec]
 	if entry == nil {
-		return fmt.Errorf("cannot find entry %s", cfg.Exec)
+		return nil, fmt.Errorf("cannot find entry %s", cfg.Exec)
 	}
 
-	queryTimeout := defaultQueryTimeout
-	if cfg.Timeout > 0 {
-		queryTimeout = time.Duration(cfg.Timeout) * time.Second
+	var allowedClients *netlist.List
+	if len(cfg.AllowedClients) > 0 {
+		allowedClients = netlist.NewList()
+		for _, s := range cfg.AllowedClients {
+			if err := netlist.LoadFromText(allowedClients, s); err != nil {
+				return nil, fmt.Errorf("invalid allowed client %s, %w", s, err)
+			}
+		}
+		allowedClients.Sort()
 	}
 
-	// Link blocking options from ServerConfig to EntryHandlerOpts
+	// Link blocking options from EntryConfig to EntryHandlerOpts
 	dnsHandler, err := D.NewEntryHandler(D.EntryHandlerOpts{
 		Logger:             m.logger,
 		Entry:              entry,
-		QueryTimeout:       queryTimeout,
+		QueryTimeout:       queryTimeout(cfg),
 		RecursionAvailable: true,
 
 		// New early blocking options mapped from config
@@ -51,81 +165,229 @@ func (m *Mosdns) startServers(cfg *ServerConfig) error {
 		BlockHTTPS: cfg.BlockHTTPS,
 		BlockNoDot: cfg.BlockNoDot,
 		StripEDNS0: cfg.StripEDNS0,
+
+		ZeroQuestion:         cfg.ZeroQuestion,
+		MultiQuestion:        cfg.MultiQuestion,
+		ZeroQuestionCounter:  p.abnormalQuestionTotal.WithLabelValues("zero"),
+		MultiQuestionCounter: p.abnormalQuestionTotal.WithLabelValues("multi"),
+
+		MaxClientConcurrent:   cfg.MaxClientConcurrent,
+		ClientOverflow:        cfg.ClientOverflow,
+		ClientOverflowCounter: p.clientOverflowTotal,
+
+		ChaosVersion:  cfg.ChaosVersion,
+		ChaosHostname: cfg.ChaosHostname,
+
+		AllowedClients:      allowedClients,
+		ClientDenied:        cfg.ClientDenied,
+		ClientDeniedCounter: p.clientDeniedTotal,
+
+		DDR: ddr,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to init entry handler, %w", err)
+		return nil, fmt.Errorf("failed to init entry handler, %w", err)
 	}
-
-	for _, lc := range cfg.Listeners {
-		if err := m.startServerListener(lc, dnsHandler); err != nil {
-			return err
-		}
-	}
-	return nil
+	return dnsHandler, nil
 }
 
-func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Handler) error {
+func (p *process) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Handler, routes map[string]D.Handler) error {
 	if len(cfg.Addr) == 0 {
 		return errors.New("no address to bind")
 	}
 
-	m.logger.Info("starting server", zap.String("proto", cfg.Protocol), zap.String("addr", cfg.Addr))
+	p.logger.Info("starting server", zap.String("proto", cfg.Protocol), zap.String("addr", cfg.Addr))
 
 	idleTimeout := time.Duration(0)
 	if cfg.IdleTimeout > 0 {
 		idleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
 	}
 
+	switch cfg.OverflowPolicy {
+	case "", server.OverflowDrop, server.OverflowServfail:
+	default:
+		return fmt.Errorf("invalid overflow policy %s", cfg.OverflowPolicy)
+	}
+
+	switch cfg.HTTPOverflowPolicy {
+	case "", server.HTTPOverflowUnavailable, server.HTTPOverflowTooManyRequests, server.HTTPOverflowQueue:
+	default:
+		return fmt.Errorf("invalid http overflow policy %s", cfg.HTTPOverflowPolicy)
+	}
+
+	switch cfg.Compression {
+	case "", dnsutils.CompressAlways, dnsutils.CompressAuto:
+	default:
+		return fmt.Errorf("invalid compression policy %s", cfg.Compression)
+	}
+
+	trustedProxies, err := real_ip.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	var healthQuery *dns.Question
+	if hq := cfg.HealthQuery; len(hq.Name) > 0 {
+		qtype := dns.TypeA
+		if len(hq.Type) > 0 {
+			t, ok := dns.StringToType[strings.ToUpper(hq.Type)]
+			if !ok {
+				return fmt.Errorf("invalid health query type %s", hq.Type)
+			}
+			qtype = t
+		}
+		healthQuery = &dns.Question{Name: dns.Fqdn(hq.Name), Qtype: qtype, Qclass: dns.ClassINET}
+	}
+
 	httpHandler, err := H.NewHandler(H.HandlerOpts{
 		DNSHandler:  dnsHandler,
 		Path:        cfg.URLPath,
 		HealthPath:  cfg.HealthPath,
 		RedirectURL: cfg.RedirectURL,
 		SrcIPHeader: cfg.GetUserIPFromHeader,
-		Logger:      m.logger,
+		Logger:      p.logger,
+		Ready:       p.ready,
+		Compression: cfg.Compression,
+		Routes:      routes,
+
+		TrustedProxies: trustedProxies,
+
+		HealthQuery:   healthQuery,
+		HealthTimeout: time.Duration(cfg.HealthQuery.Timeout) * time.Millisecond,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to init http handler, %w", err)
 	}
 
+	tlsMinVersion, err := server.ParseTLSVersion(cfg.TLSMinVersion)
+	if err != nil {
+		return err
+	}
+	tlsMaxVersion, err := server.ParseTLSVersion(cfg.TLSMaxVersion)
+	if err != nil {
+		return err
+	}
+	cipherSuites, err := server.ParseCipherSuites(cfg.TLSCipherSuites)
+	if err != nil {
+		return err
+	}
+	curves, err := server.ParseCurves(cfg.TLSCurves)
+	if err != nil {
+		return err
+	}
+
+	var cookieSecret []byte
+	if len(cfg.Cookie.Secret) > 0 {
+		cookieSecret, err = hex.DecodeString(cfg.Cookie.Secret)
+		if err != nil || len(cookieSecret) != dnsutils.CookieSecretLen {
+			return fmt.Errorf("invalid cookie secret, it must be %d bytes in hex", dnsutils.CookieSecretLen)
+		}
+	}
+
+	keyPw, err := keyPassword(cfg.KeyPasswordFile, cfg.KeyPasswordEnv)
+	if err != nil {
+		return err
+	}
+	var certs []server.CertPair
+	for _, cc := range cfg.Certs {
+		pw, err := keyPassword(cc.KeyPasswordFile, cc.KeyPasswordEnv)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, server.CertPair{Cert: cc.Cert, Key: cc.Key, Password: pw})
+	}
+
 	opts := server.ServerOpts{
 		DNSHandler:  dnsHandler,
 		HttpHandler: httpHandler,
 		Cert:        cfg.Cert,
 		Key:         cfg.Key,
+		KeyPassword: keyPw,
+		Certs:       certs,
 		KernelTX:    cfg.KernelTX,
 		KernelRX:    cfg.KernelRX,
 		IdleTimeout: idleTimeout,
-		Logger:      m.logger,
+		Logger:      p.logger,
+
+		ReadHeaderTimeout: time.Duration(cfg.Timeouts.ReadHeader) * time.Millisecond,
+		ReadTimeout:       time.Duration(cfg.Timeouts.Read) * time.Millisecond,
+		WriteTimeout:      time.Duration(cfg.Timeouts.Write) * time.Millisecond,
+		FirstReadTimeout:  time.Duration(cfg.Timeouts.FirstRead) * time.Millisecond,
+
+		ClientCA:          cfg.ClientCA,
+		RequireClientCert: cfg.RequireClientCert,
+
+		TLSMinVersion:   tlsMinVersion,
+		TLSMaxVersion:   tlsMaxVersion,
+		TLSCipherSuites: cipherSuites,
+		TLSCurves:       curves,
+
+		SessionTicketKeyRotation: time.Duration(cfg.SessionTicketKeyRotation) * time.Second,
+
+		QUIC: server.QUICOpts{
+			InitialStreamReceiveWindow:     cfg.QUIC.InitialStreamReceiveWindow,
+			MaxStreamReceiveWindow:         cfg.QUIC.MaxStreamReceiveWindow,
+			InitialConnectionReceiveWindow: cfg.QUIC.InitialConnectionReceiveWindow,
+			MaxConnectionReceiveWindow:     cfg.QUIC.MaxConnectionReceiveWindow,
+			MaxIncomingStreams:             cfg.QUIC.MaxIncomingStreams,
+			MaxIdleTimeout:                 time.Duration(cfg.QUIC.MaxIdleTimeout) * time.Second,
+			RequireAddressValidation:       cfg.QUIC.RequireAddressValidation,
+		},
+
+		UDPMaxConcurrent:   cfg.MaxConcurrentQueries,
+		UDPOverflowPolicy:  cfg.OverflowPolicy,
+		UDPOverflowCounter: p.udpOverflowTotal.WithLabelValues(cfg.Addr),
+
+		HTTPMaxConcurrent:   cfg.MaxConcurrentRequests,
+		HTTPOverflowPolicy:  cfg.HTTPOverflowPolicy,
+		HTTPQueueTimeout:    time.Duration(cfg.QueueTimeout) * time.Second,
+		HTTPOverflowCounter: p.httpOverflowTotal.WithLabelValues(cfg.Addr),
+
+		Compression: cfg.Compression,
+
+		Cookies:       cfg.Cookie.Enabled,
+		CookieSecret:  cookieSecret,
+		RequireCookie: cfg.Cookie.Require,
+	}
+	if protocol := protocolName(cfg.Protocol); protocol != "udp" {
+		opts.ConnGauge = p.activeConns.WithLabelValues(protocol, cfg.Addr)
+		if protocol != "tcp" && protocol != "dot" {
+			opts.StreamGauge = p.activeStreams.WithLabelValues(protocol, cfg.Addr)
+		}
 	}
 	s := server.NewServer(opts)
 
-	// helper func for proxy protocol listener
-	requirePP := func(_ net.Addr) (proxyproto.Policy, error) {
-		return proxyproto.REQUIRE, nil
+	var socketOpts listen.SocketOpts
+	switch cfg.Protocol {
+	case "", "udp", "quic", "doq", "h3", "doh3":
+		socketOpts.ReadBuffer = cfg.UDPReadBuffer
+		socketOpts.WriteBuffer = cfg.UDPWriteBuffer
 	}
-
-	config := listen.CreateListenConfig(cfg.UnixDomainSocket)
+	config := listen.CreateListenConfig(cfg.UnixDomainSocket, socketOpts)
 	abstract := strings.HasPrefix(cfg.Addr, "@")
 	ctx := context.Background()
 
 	var run func() error
 	switch cfg.Protocol {
 	case "", "udp", "quic", "doq", "h3", "doh3":
+		// QUIC packets must go to the process that owns the connection.
+		listenPacket := listen.ListenExclusivePacket
+		if protocolName(cfg.Protocol) == "udp" {
+			listenPacket = listen.ListenPacket
+		}
 		var conn net.PacketConn
 		var err error
 		if cfg.UnixDomainSocket {
-			if !abstract {
+			if !abstract && !listen.Inherited("unixgram", cfg.Addr) {
 				os.Remove(cfg.Addr)
 			}
-			conn, err = config.ListenPacket(ctx, "unixgram", cfg.Addr)
+			conn, err = listenPacket(ctx, config, "unixgram", cfg.Addr)
 			if !abstract {
 				if err := os.Chmod(cfg.Addr, 0777); err != nil {
-					m.logger.Warn("failed to chmod unix socket", zap.String("addr", cfg.Addr), zap.Error(err))
+					p.logger.Warn("failed to chmod unix socket", zap.String("addr", cfg.Addr), zap.Error(err))
 				}
 			}
 		} else {
-			conn, err = config.ListenPacket(ctx, "udp", cfg.Addr)
+			conn, err = listenPacket(ctx, config, "udp", cfg.Addr)
 		}
 		if err != nil {
 			return err
@@ -134,7 +396,7 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Han
 		case "", "udp":
 			run = func() error { return s.ServeUDP(conn) }
 		case "quic", "doq":
-			l, err := s.CreateQUICListner(conn, []string{"doq"}, cfg.AllowedSNI)
+			l, err := s.CreateQUICListner(conn, server.DoQNextProtos, cfg.AllowedSNI)
 			if err != nil {
 				return err
 			}
@@ -146,27 +408,27 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Han
 			}
 			run = func() error { return s.ServeH3(l) }
 		}
-	case "tcp", "http", "tls", "dot", "https", "doh":
+	case "tcp", "http", "h2c", "tls", "dot", "https", "doh":
 		var l net.Listener
 		var err error
 		if cfg.UnixDomainSocket {
-			if !abstract {
+			if !abstract && !listen.Inherited("unix", cfg.Addr) {
 				os.Remove(cfg.Addr)
 			}
-			l, err = config.Listen(ctx, "unix", cfg.Addr)
+			l, err = listen.Listen(ctx, config, "unix", cfg.Addr)
 			if !abstract {
 				if err := os.Chmod(cfg.Addr, 0777); err != nil {
-					m.logger.Warn("failed to chmod unix socket", zap.String("addr", cfg.Addr), zap.Error(err))
+					p.logger.Warn("failed to chmod unix socket", zap.String("addr", cfg.Addr), zap.Error(err))
 				}
 			}
 		} else {
-			l, err = config.Listen(ctx, "tcp", cfg.Addr)
+			l, err = listen.Listen(ctx, config, "tcp", cfg.Addr)
 		}
 		if err != nil {
 			return err
 		}
 		if cfg.ProxyProtocol {
-			l = &proxyproto.Listener{Listener: l, Policy: requirePP}
+			l = &proxyproto.Listener{Listener: l, ConnPolicy: trustedProxies.ProxyProtocolPolicy()}
 		}
 		switch cfg.Protocol {
 		case "tcp":
@@ -179,6 +441,8 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Han
 			run = func() error { return s.ServeTCP(l) }
 		case "http":
 			run = func() error { return s.ServeHTTP(l) }
+		case "h2c":
+			run = func() error { return s.ServeH2C(l) }
 		case "https", "doh":
 			l, err = s.CreateETLSListner(l, []string{"h2"}, cfg.AllowedSNI)
 			if err != nil {
@@ -194,18 +458,141 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Han
 		return fmt.Errorf("failed to init runner for protocol %s", cfg.Protocol)
 	}
 
-	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+	p.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 		defer done()
+		defer s.Close()
 		errChan := make(chan error, 1)
 		go func() {
 			errChan <- run()
 		}()
 		select {
 		case err := <-errChan:
-			m.sc.SendCloseSignal(fmt.Errorf("server exited, %w", err))
+			if p.upgraded.Load() {
+				// The listener was closed after the upgrade.
+				<-closeSignal
+				return
+			}
+			p.sc.SendCloseSignal(fmt.Errorf("server exited, %w", err))
 		case <-closeSignal:
 		}
 	})
 
 	return nil
 }
+
+// ddrFromListeners returns the target and the endpoints of the designated
+// resolver from the encrypted listeners of cfg.
+func ddrFromListeners(cfg *ServerConfig) (string, []D.DDREndpoint, error) {
+	target := cfg.DDR.Target
+	var endpoints []D.DDREndpoint
+	for _, lc := range cfg.Listeners {
+		var e D.DDREndpoint
+		switch lc.Protocol {
+		case "tls", "dot":
+			e.ALPN = []string{"dot"}
+		case "https", "doh":
+			e.ALPN = []string{"h2"}
+		case "quic", "doq":
+			e.ALPN = []string{"doq"}
+		case "h3", "doh3":
+			e.ALPN = []string{"h3"}
+		default:
+			continue
+		}
+		if lc.UnixDomainSocket {
+			continue
+		}
+		_, portStr, err := net.SplitHostPort(lc.Addr)
+		if err != nil {
+			return "", nil, fmt.Errorf("listener %s, %w", lc.Addr, err)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return "", nil, fmt.Errorf("listener %s, invalid port, %w", lc.Addr, err)
+		}
+		e.Port = uint16(port)
+		if e.ALPN[0] == "h2" || e.ALPN[0] == "h3" {
+			path := lc.URLPath
+			if len(path) == 0 {
+				path = "/dns-query"
+			}
+			e.DoHPath = path + "{?dns}"
+		}
+		endpoints = append(endpoints, e)
+
+		if len(target) == 0 {
+			certFile, pwFile, pwEnv := lc.Cert, lc.KeyPasswordFile, lc.KeyPasswordEnv
+			if len(certFile) == 0 && len(lc.Certs) > 0 {
+				cc := lc.Certs[0]
+				certFile, pwFile, pwEnv = cc.Cert, cc.KeyPasswordFile, cc.KeyPasswordEnv
+			}
+			if len(certFile) > 0 {
+				password, err := keyPassword(pwFile, pwEnv)
+				if err != nil {
+					return "", nil, fmt.Errorf("listener %s, %w", lc.Addr, err)
+				}
+				if target, err = certDNSName(certFile, password); err != nil {
+					return "", nil, fmt.Errorf("listener %s, %w", lc.Addr, err)
+				}
+			}
+		}
+	}
+	if len(endpoints) == 0 {
+		return "", nil, errors.New("no dot, doh, doq or doh3 listener")
+	}
+	if len(target) == 0 {
+		return "", nil, errors.New("no target, and listener certificates have no dns name")
+	}
+	return target, endpoints, nil
+}
+
+// certDNSName returns the first dns name of the certificate in file.
+func certDNSName(file, password string) (string, error) {
+	cert, err := server.LoadLeaf(file, password)
+	if err != nil {
+		return "", err
+	}
+	if len(cert.DNSNames) == 0 {
+		return "", nil
+	}
+	return cert.DNSNames[0], nil
+}
+
+// keyPassword returns the password of a certificate key from file, or
+// from the environment variable env if file is empty. Trailing line
+// breaks of the file are trimmed.
+func keyPassword(file, env string) (string, error) {
+	if len(file) > 0 {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read key password file, %w", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if len(env) > 0 {
+		pw, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("key password env %s is not set", env)
+		}
+		return pw, nil
+	}
+	return "", nil
+}
+
+// protocolName returns the canonical name of a listener protocol.
+func protocolName(protocol string) string {
+	switch protocol {
+	case "", "udp":
+		return "udp"
+	case "tls", "dot":
+		return "dot"
+	case "https", "doh":
+		return "doh"
+	case "quic", "doq":
+		return "doq"
+	case "h3", "doh3":
+		return "doh3"
+	default:
+		return protocol
+	}
+}
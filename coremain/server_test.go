@@ -0,0 +1,121 @@
+package coremain
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_process_listenerEntry(t *testing.T) {
+	cfg := &Config{
+		Plugins: []PluginConfig{
+			{Tag: "answer", Type: testAnswerType, Args: &testAnswerArgs{Addr: "192.0.2.1"}},
+			{Tag: "other", Type: testAnswerType, Args: &testAnswerArgs{Addr: "192.0.2.2"}},
+		},
+		Servers: []ServerConfig{{
+			EntryConfig: EntryConfig{Exec: "answer"},
+			Listeners: []*ServerListenerConfig{
+				{Protocol: "udp", Addr: "127.0.0.1:5353"},
+				{Protocol: "udp", Addr: "127.0.0.1:5354", Entry: &EntryConfig{Exec: "other"}},
+				{Protocol: "udp", Addr: "127.0.0.1:5355", Entry: &EntryConfig{Timeout: 1}}, // inherits the exec
+			},
+		}},
+	}
+	p := newProcess(zap.NewNop(), nil)
+	if err := p.load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for l, want := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		r, err := p.handlers[handlerKey(0, l, "")].ServeDNS(context.Background(), q, query_context.NewRequestMeta(netip.MustParseAddr("127.0.0.1")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != want {
+			t.Fatalf("listener #%d, want answer %s, got %v", l, want, r.Answer)
+		}
+	}
+
+	cfg.Servers[0].Listeners[1].Entry.Exec = "missing"
+	err := newProcess(zap.NewNop(), nil).load(cfg)
+	if err == nil || !strings.Contains(err.Error(), "127.0.0.1:5354") {
+		t.Fatalf("want an error of the listener, got %v", err)
+	}
+}
+
+func Test_process_ddrAllowedClients(t *testing.T) {
+	cfg := &Config{
+		Plugins: []PluginConfig{
+			{Tag: "answer", Type: testAnswerType, Args: &testAnswerArgs{Addr: "192.0.2.1"}},
+		},
+		Servers: []ServerConfig{{
+			EntryConfig: EntryConfig{Exec: "answer", AllowedClients: []string{"192.168.0.0/16"}, ClientDenied: "drop"},
+			Listeners: []*ServerListenerConfig{
+				{Protocol: "tls", Addr: "127.0.0.1:853"},
+				{Protocol: "tcp", Addr: "127.0.0.1:53", Entry: &EntryConfig{Exec: "answer", AllowedClients: []string{"10.0.0.0/8"}}},
+			},
+			DDR: DDRConfig{Enabled: true, Target: "dns.example"},
+		}},
+	}
+	p := newProcess(zap.NewNop(), nil)
+	if err := p.load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(l int, client string) (*dns.Msg, error) {
+		q := new(dns.Msg)
+		q.SetQuestion("_dns.resolver.arpa.", dns.TypeSVCB)
+		return p.handlers[handlerKey(0, l, "")].ServeDNS(context.Background(), q, query_context.NewRequestMeta(netip.MustParseAddr(client)))
+	}
+
+	if r, err := serve(0, "192.168.1.1"); err != nil || len(r.Answer) != 1 {
+		t.Fatalf("want a ddr answer, got %v, %v", r, err)
+	}
+	if r, err := serve(0, "10.0.0.1"); err == nil {
+		t.Fatalf("denied client got a response, %v", r)
+	}
+	// The listener entry has its own acl.
+	if r, err := serve(1, "10.0.0.1"); err != nil || len(r.Answer) != 1 {
+		t.Fatalf("want a ddr answer, got %v, %v", r, err)
+	}
+	if r, err := serve(1, "192.168.1.1"); err != nil || r.Rcode != dns.RcodeRefused || len(r.Answer) != 0 {
+		t.Fatalf("want refused, got %v, %v", r, err)
+	}
+}
+
+func Test_loadConfig_inlineEntry(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := `
+servers:
+  - exec: main
+    timeout: 5
+    listeners:
+      - protocol: udp
+        addr: 127.0.0.1:53
+        entry:
+          exec: other
+          block_aaaa: true
+`
+	if err := os.WriteFile(f, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := loadConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cfg.Servers[0]
+	if s.Exec != "main" || s.Timeout != 5 {
+		t.Fatalf("inline entry options are not loaded, got %+v", s.EntryConfig)
+	}
+	if e := s.Listeners[0].Entry; e == nil || e.Exec != "other" || !e.BlockAAAA || e.Timeout != 0 {
+		t.Fatalf("unexpected listener entry %+v", e)
+	}
+}
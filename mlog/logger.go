@@ -41,6 +41,9 @@ type LogConfig struct {
 	// OmitTime omits the time in log.
 	OmitTime bool `yaml:"omit_time"`
 
+	// Privacy controls the redaction of client addresses and query names.
+	Privacy PrivacyConfig `yaml:"privacy"`
+
 	// parsed level
 	lvl zapcore.Level
 }
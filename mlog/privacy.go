@@ -0,0 +1,223 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+const (
+	PrivacyPlain    = "plain"
+	PrivacyHash     = "hash"
+	PrivacyTruncate = "truncate"
+)
+
+// PrivacyConfig controls how client addresses and query names are
+// written into logs.
+type PrivacyConfig struct {
+	// Salt is the key of the hash policy. Hashed values are stable as long
+	// as the salt is unchanged.
+	Salt string `yaml:"salt"`
+
+	// ClientIP is the policy for client addresses.
+	// "" or "plain": no redaction.
+	// "hash": replaced by a salted hash.
+	// "truncate": masked by IPv4Mask or IPv6Mask.
+	ClientIP string `yaml:"client_ip"`
+	IPv4Mask int    `yaml:"ipv4_mask"` // Default is 24.
+	IPv6Mask int    `yaml:"ipv6_mask"` // Default is 48.
+
+	// QName is the policy for query names.
+	// "" or "plain": no redaction.
+	// "hash": replaced by a salted hash.
+	// "truncate": only the last QNameLabels labels are kept.
+	QName       string `yaml:"qname"`
+	QNameLabels int    `yaml:"qname_labels"` // Default is 2.
+}
+
+type privacyPolicy struct {
+	salt        []byte
+	clientIP    string
+	ipv4Mask    int
+	ipv6Mask    int
+	qname       string
+	qnameLabels int
+}
+
+var privacy atomic.Pointer[privacyPolicy]
+
+// SetPrivacy sets the global log privacy policy.
+func SetPrivacy(c *PrivacyConfig) error {
+	p := &privacyPolicy{
+		salt:        []byte(c.Salt),
+		clientIP:    c.ClientIP,
+		ipv4Mask:    c.IPv4Mask,
+		ipv6Mask:    c.IPv6Mask,
+		qname:       c.QName,
+		qnameLabels: c.QNameLabels,
+	}
+	if p.ipv4Mask == 0 {
+		p.ipv4Mask = 24
+	}
+	if p.ipv6Mask == 0 {
+		p.ipv6Mask = 48
+	}
+	if p.qnameLabels == 0 {
+		p.qnameLabels = 2
+	}
+
+	for _, policy := range [...]*string{&p.clientIP, &p.qname} {
+		switch *policy {
+		case "", PrivacyPlain:
+			*policy = ""
+		case PrivacyHash, PrivacyTruncate:
+		default:
+			return fmt.Errorf("invalid privacy policy %s", *policy)
+		}
+	}
+	if p.ipv4Mask < 0 || p.ipv4Mask > 32 {
+		return fmt.Errorf("invalid ipv4 mask %d", p.ipv4Mask)
+	}
+	if p.ipv6Mask < 0 || p.ipv6Mask > 128 {
+		return fmt.Errorf("invalid ipv6 mask %d", p.ipv6Mask)
+	}
+	if p.qnameLabels < 0 {
+		return fmt.Errorf("invalid qname labels %d", p.qnameLabels)
+	}
+
+	if p.clientIP == "" && p.qname == "" {
+		privacy.Store(nil)
+		return nil
+	}
+	privacy.Store(p)
+	return nil
+}
+
+func (p *privacyPolicy) hash(s string) string {
+	h := hmac.New(sha256.New, p.salt)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// QName returns name redacted by the global privacy policy.
+func QName(name string) string {
+	p := privacy.Load()
+	if p == nil {
+		return name
+	}
+	switch p.qname {
+	case PrivacyHash:
+		return p.hash(name)
+	case PrivacyTruncate:
+		labels := dnsLabels(name)
+		if len(labels) <= p.qnameLabels {
+			return name
+		}
+		return "*." + strings.Join(labels[len(labels)-p.qnameLabels:], ".") + "."
+	default:
+		return name
+	}
+}
+
+func dnsLabels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// IP returns the string form of addr redacted by the global privacy policy.
+func IP(addr netip.Addr) string {
+	p := privacy.Load()
+	if p == nil {
+		return addr.String()
+	}
+	switch p.clientIP {
+	case PrivacyHash:
+		return p.hash(addr.String())
+	case PrivacyTruncate:
+		bits := p.ipv6Mask
+		if addr.Is4() || addr.Is4In6() {
+			addr = addr.Unmap()
+			bits = p.ipv4Mask
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return addr.String()
+		}
+		return prefix.String()
+	default:
+		return addr.String()
+	}
+}
+
+// Addr returns the string form of a client address s, which can be an
+// "ip:port" or an "ip", redacted by the global privacy policy.
+// The port is dropped if the address is redacted.
+func Addr(s string) string {
+	p := privacy.Load()
+	if p == nil || p.clientIP == "" {
+		return s
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return IP(ap.Addr())
+	}
+	if a, err := netip.ParseAddr(s); err == nil {
+		return IP(a)
+	}
+	return p.hash(s)
+}
+
+type redactedAddr struct {
+	addr net.Addr
+}
+
+func (r redactedAddr) String() string {
+	if r.addr == nil {
+		return "<nil>"
+	}
+	return Addr(r.addr.String())
+}
+
+// ClientAddr returns a zap.Field of the client address addr.
+// The address is redacted lazily, only if the entry is written.
+func ClientAddr(key string, addr net.Addr) zap.Field {
+	return zap.Stringer(key, redactedAddr{addr: addr})
+}
+
+// RawMsg returns a zap.Field of the wire message b. Because the raw
+// message contains the query name, it is skipped if query names
+// are redacted.
+func RawMsg(key string, b []byte) zap.Field {
+	if p := privacy.Load(); p != nil && p.qname != "" {
+		return zap.Skip()
+	}
+	return zap.Binary(key, b)
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPrivacy(t *testing.T) {
+	defer SetPrivacy(&PrivacyConfig{})
+
+	if err := SetPrivacy(&PrivacyConfig{ClientIP: "invalid"}); err == nil {
+		t.Fatal("invalid policy should return an err")
+	}
+
+	if err := SetPrivacy(&PrivacyConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := QName("www.example.com."); got != "www.example.com." {
+		t.Fatalf("plain qname: got %s", got)
+	}
+	if got := Addr("1.2.3.4:53"); got != "1.2.3.4:53" {
+		t.Fatalf("plain addr: got %s", got)
+	}
+
+	if err := SetPrivacy(&PrivacyConfig{ClientIP: PrivacyTruncate, QName: PrivacyTruncate}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in, want string
+		f        func(string) string
+	}{
+		{"www.example.com.", "*.example.com.", QName},
+		{"example.com.", "example.com.", QName},
+		{".", ".", QName},
+		{"1.2.3.4:53", "1.2.3.0/24", Addr},
+		{"[2001:db8:1:2::1]:53", "2001:db8:1::/48", Addr},
+		{"::ffff:1.2.3.4", "1.2.3.0/24", Addr},
+	}
+	for _, tt := range tests {
+		if got := tt.f(tt.in); got != tt.want {
+			t.Errorf("truncate %s: want %s, got %s", tt.in, tt.want, got)
+		}
+	}
+
+	if err := SetPrivacy(&PrivacyConfig{ClientIP: PrivacyHash, QName: PrivacyHash, Salt: "salt"}); err != nil {
+		t.Fatal(err)
+	}
+	h1 := IP(netip.MustParseAddr("1.2.3.4"))
+	if h1 == "1.2.3.4" || len(h1) != 16 {
+		t.Fatalf("hashed ip: got %s", h1)
+	}
+	if h2 := Addr("1.2.3.4:5353"); h2 != h1 {
+		t.Fatalf("hash should not depend on the port, %s != %s", h1, h2)
+	}
+	if QName("example.com.") == "example.com." {
+		t.Fatal("qname was not hashed")
+	}
+
+	if err := SetPrivacy(&PrivacyConfig{ClientIP: PrivacyHash, Salt: "another salt"}); err != nil {
+		t.Fatal(err)
+	}
+	if IP(netip.MustParseAddr("1.2.3.4")) == h1 {
+		t.Fatal("hash should depend on the salt")
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package allocaudit measures heap allocations of hot paths and exports
+// them as metrics. It is disabled by default and is meant to catch
+// allocation regressions in staging.
+//
+// The measurement is the delta of the process-wide allocation counters
+// before and after a path, so it also includes the allocations of other
+// goroutines and the counters are updated in batches. Single samples are
+// approximate, but the average over many queries is meaningful when the
+// concurrency is low.
+package allocaudit
+
+import (
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Path is an audited hot path.
+type Path int
+
+const (
+	Handler          Path = iota // the entry handler, including the whole entry chain
+	CacheLookup                  // the lookup of the cache plugin
+	UpstreamExchange             // a single upstream exchange
+	numPaths
+)
+
+var pathNames = [numPaths]string{"handler", "cache_lookup", "upstream_exchange"}
+
+func (p Path) String() string {
+	return pathNames[p]
+}
+
+var (
+	enabled atomic.Bool
+
+	bytesHist = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "alloc_audit_bytes",
+		Help:    "The approximate heap bytes allocated by a hot path",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 10),
+	}, []string{"path"})
+	objectsHist = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "alloc_audit_objects",
+		Help:    "The approximate heap objects allocated by a hot path",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"path"})
+
+	// observers of each path, initialized by Enable.
+	bytesObservers   [numPaths]prometheus.Observer
+	objectsObservers [numPaths]prometheus.Observer
+	enableOnce       sync.Once
+)
+
+// Enable registers the metrics to reg and enables the audit.
+// Only the first call takes effect.
+func Enable(reg prometheus.Registerer) error {
+	var err error
+	enableOnce.Do(func() {
+		if err = reg.Register(bytesHist); err != nil {
+			return
+		}
+		if err = reg.Register(objectsHist); err != nil {
+			return
+		}
+		for p := Path(0); p < numPaths; p++ {
+			bytesObservers[p] = bytesHist.WithLabelValues(p.String())
+			objectsObservers[p] = objectsHist.WithLabelValues(p.String())
+		}
+		enabled.Store(true)
+	})
+	return err
+}
+
+// Enabled reports whether the audit is enabled.
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Sample is a snapshot of the allocation counters.
+type Sample struct {
+	bytes, objects uint64
+	ok             bool
+}
+
+// Begin takes a snapshot of the allocation counters. It is cheap and
+// returns an empty Sample if the audit is disabled.
+func Begin() Sample {
+	if !enabled.Load() {
+		return Sample{}
+	}
+	b, o := read()
+	return Sample{bytes: b, objects: o, ok: true}
+}
+
+// End observes the allocations of path p since s was taken.
+func (s Sample) End(p Path) {
+	if !s.ok {
+		return
+	}
+	b, o := read()
+	bytesObservers[p].Observe(float64(b - s.bytes))
+	objectsObservers[p].Observe(float64(o - s.objects))
+}
+
+var samplesPool = sync.Pool{New: func() any {
+	s := make([]metrics.Sample, 2)
+	s[0].Name = "/gc/heap/allocs:bytes"
+	s[1].Name = "/gc/heap/allocs:objects"
+	return &s
+}}
+
+func read() (bytes, objects uint64) {
+	s := samplesPool.Get().(*[]metrics.Sample)
+	metrics.Read(*s)
+	bytes, objects = (*s)[0].Value.Uint64(), (*s)[1].Value.Uint64()
+	samplesPool.Put(s)
+	return bytes, objects
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package allocaudit
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var sink []byte
+
+func TestAudit(t *testing.T) {
+	Begin().End(Handler) // no-op before Enable
+
+	reg := prometheus.NewRegistry()
+	if err := Enable(reg); err != nil {
+		t.Fatal(err)
+	}
+	if !Enabled() {
+		t.Fatal("audit is not enabled")
+	}
+	s := Begin()
+	for i := 0; i < 100; i++ {
+		sink = make([]byte, 1<<16)
+	}
+	s.End(CacheLookup)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "alloc_audit_bytes" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() != CacheLookup.String() {
+				continue
+			}
+			h := m.GetHistogram()
+			if h.GetSampleCount() != 1 || h.GetSampleSum() < 100<<16 {
+				t.Fatalf("unexpected histogram %v", h)
+			}
+			return
+		}
+	}
+	t.Fatal("metric not found")
+}
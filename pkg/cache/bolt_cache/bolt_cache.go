@@ -0,0 +1,678 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bolt_cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/cache"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const (
+	defaultMaxSize       = 64 << 20 // 64 MiB
+	defaultFlushInterval = time.Second
+	defaultGCInterval    = time.Minute
+
+	// maxPending is the max number of buffered stores. Stores are dropped
+	// if the db cannot keep up.
+	maxPending = 16384
+
+	// compactTxMaxSize is the max size of a transaction during compaction.
+	compactTxMaxSize = 4 << 20
+
+	openTimeout      = time.Second
+	retryOpenTimeout = time.Millisecond * 100
+)
+
+var (
+	// entryBucket maps key to storedTime | expirationTime | v.
+	entryBucket = []byte("entry")
+	// expireBucket maps expirationTime | key to nil. It is ordered by
+	// expirationTime, so the gc can find expired entries quickly.
+	expireBucket = []byte("expire")
+)
+
+var nopLogger = zap.NewNop()
+
+var errDBNotOpen = errors.New("cache db is not open")
+
+type BoltCacheOpts struct {
+	// Path is the path of the db file. It is created if it does not exist,
+	// and recreated if it is invalid.
+	Path string
+
+	// MaxSize is the max total bytes of the cached values. If it is exceeded,
+	// the gc evicts the entries that expire soonest. The db file is compacted
+	// when it becomes two times larger than MaxSize or than itself after the
+	// last compaction. Default is 64 MiB.
+	MaxSize int64
+
+	// FlushInterval specifies how often the buffered stores are written
+	// to the db in one transaction. Buffering stores reduces the writes
+	// to the flash storage. Default is 1s.
+	FlushInterval time.Duration
+
+	// GCInterval specifies how often the expired entries are deleted.
+	// Default is 1 min.
+	GCInterval time.Duration
+
+	// Logger is the *zap.Logger for this BoltCache.
+	// A nil Logger will disable logging.
+	Logger *zap.Logger
+}
+
+func (opts *BoltCacheOpts) Init() error {
+	if len(opts.Path) == 0 {
+		return errors.New("empty path")
+	}
+	utils.SetDefaultNum(&opts.MaxSize, defaultMaxSize)
+	utils.SetDefaultNum(&opts.FlushInterval, defaultFlushInterval)
+	utils.SetDefaultNum(&opts.GCInterval, defaultGCInterval)
+	if opts.Logger == nil {
+		opts.Logger = nopLogger
+	}
+	return nil
+}
+
+// BoltCache is a cache.Backend that stores entries in a bolt db file, for
+// devices that have little memory but some flash storage. Entries survive
+// restarts.
+// If the db file is locked by another process, e.g. the old one during an
+// upgrade, or it cannot be reopened after compaction, BoltCache misses
+// until the db file can be opened.
+type BoltCache struct {
+	opts   BoltCacheOpts
+	closed uint32
+	closeC chan struct{}
+	doneC  chan struct{}
+
+	db *sharedDB
+
+	// flushMu serializes flushes, so Flush won't miss the entries that
+	// are being written.
+	flushMu   sync.Mutex
+	pendingMu sync.Mutex
+	pending   map[uint64]*elem // stores to be written
+	flushing  map[uint64]*elem // stores being written
+
+	evictions   uint64 // atomic
+	storeErrors uint64 // atomic
+}
+
+// sharedDB is an opened db file. bolt locks the db file, so the BoltCaches
+// of the same file in a process, e.g. the old and the new one during a
+// reload, share it.
+type sharedDB struct {
+	path string
+	refs int // guarded by sharedDBsMu
+
+	// mu is locked while the db is being opened or compacted, during
+	// which Get misses rather than waits.
+	mu sync.RWMutex
+	db *bbolt.DB // nil if the db is not open
+
+	n    int64 // number of entries in the db, atomic
+	size int64 // total bytes of values in the db, atomic
+
+	compactMu           sync.Mutex
+	sizeAfterCompaction int64 // db file size, guarded by compactMu
+}
+
+var (
+	sharedDBsMu sync.Mutex
+	sharedDBs   = make(map[string]*sharedDB)
+)
+
+type elem struct {
+	v  []byte
+	st int64
+	ex int64
+}
+
+var (
+	_ cache.Flusher       = (*BoltCache)(nil)
+	_ cache.StatsReporter = (*BoltCache)(nil)
+)
+
+func NewBoltCache(opts BoltCacheOpts) (*BoltCache, error) {
+	if err := opts.Init(); err != nil {
+		return nil, err
+	}
+	db, err := acquireDB(opts.Path, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+	c := &BoltCache{
+		opts:    opts,
+		closeC:  make(chan struct{}),
+		doneC:   make(chan struct{}),
+		db:      db,
+		pending: make(map[uint64]*elem),
+	}
+	go c.run()
+	return c, nil
+}
+
+// acquireDB returns the sharedDB of path, and opens it if it is not open
+// in this process. If it is locked by another process, it is returned
+// unopened.
+func acquireDB(path string, logger *zap.Logger) (*sharedDB, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	sharedDBsMu.Lock()
+	defer sharedDBsMu.Unlock()
+	if s := sharedDBs[path]; s != nil {
+		s.refs++
+		return s, nil
+	}
+
+	s := &sharedDB{path: path, refs: 1}
+	if err := s.open(openTimeout, logger); err != nil {
+		if !errors.Is(err, berrors.ErrTimeout) {
+			return nil, err
+		}
+		logger.Warn("cache db is locked by another process, it will be opened once released", zap.String("path", path))
+	}
+	sharedDBs[path] = s
+	return s, nil
+}
+
+// release closes s if it is not used by other BoltCaches.
+func (s *sharedDB) release() error {
+	sharedDBsMu.Lock()
+	defer sharedDBsMu.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(sharedDBs, s.path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+// open opens the db file and counts its entries. It is a noop if the db
+// is already open.
+func (s *sharedDB) open(timeout time.Duration, logger *zap.Logger) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		return nil
+	}
+	db, err := openDB(s.path, timeout, logger)
+	if err != nil {
+		return err
+	}
+	var n, size int64
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(expireBucket); err != nil {
+			return err
+		}
+		entries, err := tx.CreateBucketIfNotExists(entryBucket)
+		if err != nil {
+			return err
+		}
+		return entries.ForEach(func(_, v []byte) error {
+			n++
+			size += int64(len(v) - 16)
+			return nil
+		})
+	}); err != nil {
+		_ = db.Close()
+		return fmt.Errorf("failed to init db, %w", err)
+	}
+	s.db = db
+	atomic.StoreInt64(&s.n, n)
+	atomic.StoreInt64(&s.size, size)
+	s.compactMu.Lock()
+	if fi, err := os.Stat(s.path); err == nil {
+		s.sizeAfterCompaction = fi.Size()
+	}
+	s.compactMu.Unlock()
+	return nil
+}
+
+// isOpen reports whether the db is open. It is racy, and only used to
+// skip retries.
+func (s *sharedDB) isOpen() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db != nil
+}
+
+// openDB opens the db file at path. An invalid db file is recreated,
+// since it is just a cache.
+func openDB(path string, timeout time.Duration, logger *zap.Logger) (*bbolt.DB, error) {
+	opts := &bbolt.Options{
+		Timeout:        timeout,
+		NoFreelistSync: true,
+		FreelistType:   bbolt.FreelistMapType,
+	}
+	db, err := bbolt.Open(path, 0o644, opts)
+	if err == nil || errors.Is(err, berrors.ErrTimeout) || errors.Is(err, os.ErrPermission) {
+		return db, err
+	}
+	logger.Warn("invalid cache db file, recreating it", zap.String("path", path), zap.Error(err))
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	return bbolt.Open(path, 0o644, opts)
+}
+
+func (c *BoltCache) isClosed() bool {
+	return atomic.LoadUint32(&c.closed) != 0
+}
+
+// Close writes the buffered stores and closes the db.
+func (c *BoltCache) Close() error {
+	if !atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		return nil
+	}
+	close(c.closeC)
+	<-c.doneC
+	return c.db.release()
+}
+
+func (c *BoltCache) Get(key uint64) (v []byte, storedTime, expirationTime int64) {
+	if c.isClosed() {
+		return nil, 0, 0
+	}
+
+	c.pendingMu.Lock()
+	e, ok := c.pending[key]
+	if !ok {
+		e, ok = c.flushing[key]
+	}
+	c.pendingMu.Unlock()
+	if ok {
+		return e.v, e.st, e.ex
+	}
+
+	if !c.db.mu.TryRLock() {
+		return nil, 0, 0
+	}
+	defer c.db.mu.RUnlock()
+	if c.db.db == nil {
+		return nil, 0, 0
+	}
+	err := c.db.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(entryBucket).Get(keyBytes(key))
+		if len(b) < 16 {
+			return nil
+		}
+		storedTime = int64(binary.BigEndian.Uint64(b))
+		expirationTime = int64(binary.BigEndian.Uint64(b[8:]))
+		v = bytes.Clone(b[16:])
+		return nil
+	})
+	if err != nil {
+		c.opts.Logger.Warn("failed to read cache db", zap.Error(err))
+		return nil, 0, 0
+	}
+	return v, storedTime, expirationTime
+}
+
+// Store buffers the entry. It is written to the db by the next flush.
+func (c *BoltCache) Store(key uint64, v []byte, storedTime, expirationTime int64) {
+	if c.isClosed() || time.Now().Unix() >= expirationTime {
+		return
+	}
+
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if _, ok := c.pending[key]; !ok && len(c.pending) >= maxPending {
+		atomic.AddUint64(&c.storeErrors, 1)
+		return
+	}
+	c.pending[key] = &elem{v: bytes.Clone(v), st: storedTime, ex: expirationTime}
+}
+
+// Len returns the number of entries in the db.
+func (c *BoltCache) Len() int {
+	return int(atomic.LoadInt64(&c.db.n))
+}
+
+// Stats implements cache.StatsReporter.
+func (c *BoltCache) Stats() cache.Stats {
+	return cache.Stats{
+		Evictions:   atomic.LoadUint64(&c.evictions),
+		StoreErrors: atomic.LoadUint64(&c.storeErrors),
+	}
+}
+
+// Flush implements cache.Flusher.
+func (c *BoltCache) Flush(ctx context.Context, match func(key uint64, v []byte) bool) (int, error) {
+	if c.isClosed() {
+		return 0, errors.New("cache is closed")
+	}
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	if err := c.flushLocked(); err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	err := c.update(func(tx *bbolt.Tx, d *delta) error {
+		var keys []uint64
+		err := tx.Bucket(entryBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			key := binary.BigEndian.Uint64(k)
+			if match == nil || match(key, v[16:]) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := deleteEntry(tx, d, key); err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (c *BoltCache) run() {
+	defer close(c.doneC)
+	flushTicker := time.NewTicker(c.opts.FlushInterval)
+	defer flushTicker.Stop()
+	gcTicker := time.NewTicker(c.opts.GCInterval)
+	defer gcTicker.Stop()
+	for {
+		select {
+		case <-c.closeC:
+			c.flush()
+			return
+		case <-flushTicker.C:
+			c.retryOpen()
+			c.flush()
+		case <-gcTicker.C:
+			c.gc(time.Now().Unix())
+			c.compactIfNeeded()
+		}
+	}
+}
+
+// retryOpen opens the db if it is not open.
+func (c *BoltCache) retryOpen() {
+	if c.db.isOpen() {
+		return
+	}
+	if err := c.db.open(retryOpenTimeout, c.opts.Logger); err != nil {
+		if !errors.Is(err, berrors.ErrTimeout) {
+			c.opts.Logger.Debug("failed to open cache db", zap.Error(err))
+		}
+		return
+	}
+	c.opts.Logger.Info("cache db opened", zap.String("path", c.db.path), zap.Int("entries", c.Len()))
+}
+
+func (c *BoltCache) flush() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	if err := c.flushLocked(); err != nil && !errors.Is(err, errDBNotOpen) {
+		c.opts.Logger.Warn("failed to write cache db", zap.Error(err))
+	}
+}
+
+// flushLocked writes the buffered stores in one transaction.
+// flushMu must be held.
+func (c *BoltCache) flushLocked() error {
+	c.pendingMu.Lock()
+	batch := c.pending
+	c.pending = make(map[uint64]*elem)
+	c.flushing = batch
+	c.pendingMu.Unlock()
+	defer func() {
+		c.pendingMu.Lock()
+		c.flushing = nil
+		c.pendingMu.Unlock()
+	}()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	err := c.update(func(tx *bbolt.Tx, d *delta) error {
+		for key, e := range batch {
+			if err := putEntry(tx, d, key, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		atomic.AddUint64(&c.storeErrors, uint64(len(batch)))
+	}
+	return err
+}
+
+// gc deletes the expired entries, and evicts the entries that expire
+// soonest while the total size of values exceeds MaxSize.
+func (c *BoltCache) gc(nowUnix int64) {
+	var evicted int
+	err := c.update(func(tx *bbolt.Tx, d *delta) error {
+		evicted = 0
+		expires := tx.Bucket(expireBucket)
+		for {
+			// Cursors may be invalidated by deletions, so use a new one.
+			k, _ := expires.Cursor().First()
+			if k == nil {
+				return nil
+			}
+			expired := int64(binary.BigEndian.Uint64(k)) <= nowUnix
+			if !expired {
+				if atomic.LoadInt64(&c.db.size)+d.size <= c.opts.MaxSize {
+					return nil
+				}
+				evicted++
+			}
+			key := binary.BigEndian.Uint64(k[8:])
+			if err := expires.Delete(bytes.Clone(k)); err != nil {
+				return err
+			}
+			if err := deleteEntry(tx, d, key); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		if !errors.Is(err, errDBNotOpen) {
+			c.opts.Logger.Warn("cache db gc failed", zap.Error(err))
+		}
+		return
+	}
+	if evicted > 0 {
+		atomic.AddUint64(&c.evictions, uint64(evicted))
+		c.opts.Logger.Debug("cache db is full, entries evicted", zap.Int("evicted", evicted))
+	}
+}
+
+// compactIfNeeded compacts the db file if it is two times larger than
+// MaxSize and than itself after the last compaction, because bolt reuses
+// freed pages but never shrinks its file.
+func (c *BoltCache) compactIfNeeded() {
+	s := c.db
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	fi, err := os.Stat(s.path)
+	if err != nil || !s.isOpen() {
+		return
+	}
+	if fi.Size() <= 2*max(c.opts.MaxSize, s.sizeAfterCompaction) {
+		return
+	}
+	if err := c.compact(); err != nil {
+		c.opts.Logger.Warn("failed to compact cache db", zap.Error(err))
+		return
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		c.opts.Logger.Info("cache db compacted", zap.Int64("size", fi.Size()))
+		s.sizeAfterCompaction = fi.Size()
+	}
+}
+
+func (c *BoltCache) compact() error {
+	s := c.db
+	tmp := s.path + ".compact"
+	_ = os.Remove(tmp)
+	dst, err := openDB(tmp, openTimeout, c.opts.Logger)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		_ = dst.Close()
+		_ = os.Remove(tmp)
+		return errDBNotOpen
+	}
+	err = bbolt.Compact(dst, s.db, compactTxMaxSize)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.db.Close()
+		s.db = nil
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	renameErr := os.Rename(tmp, s.path)
+	if renameErr != nil {
+		_ = os.Remove(tmp)
+	}
+
+	// Reopen the db, compacted or not. If it cannot be reopened, the db
+	// stays closed and the cache misses, until retryOpen opens it.
+	db, err := openDB(s.path, openTimeout, c.opts.Logger)
+	if err != nil {
+		c.opts.Logger.Error("failed to reopen cache db after compaction, the cache is disabled until it is reopened", zap.Error(err))
+		return errors.Join(renameErr, err)
+	}
+	s.db = db
+	return renameErr
+}
+
+// delta is the change of the entry count and the value size made by
+// a transaction.
+type delta struct {
+	n    int64
+	size int64
+}
+
+// update runs f in a write transaction and applies its delta once the
+// transaction is committed.
+func (c *BoltCache) update(f func(tx *bbolt.Tx, d *delta) error) error {
+	c.db.mu.RLock()
+	defer c.db.mu.RUnlock()
+	if c.db.db == nil {
+		return errDBNotOpen
+	}
+	var d delta
+	err := c.db.db.Update(func(tx *bbolt.Tx) error {
+		d = delta{}
+		return f(tx, &d)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.db.n, d.n)
+	atomic.AddInt64(&c.db.size, d.size)
+	return nil
+}
+
+func putEntry(tx *bbolt.Tx, d *delta, key uint64, e *elem) error {
+	if err := deleteEntry(tx, d, key); err != nil {
+		return err
+	}
+	b := make([]byte, 16+len(e.v))
+	binary.BigEndian.PutUint64(b, uint64(e.st))
+	binary.BigEndian.PutUint64(b[8:], uint64(e.ex))
+	copy(b[16:], e.v)
+	if err := tx.Bucket(entryBucket).Put(keyBytes(key), b); err != nil {
+		return err
+	}
+	if err := tx.Bucket(expireBucket).Put(expireKey(e.ex, key), nil); err != nil {
+		return err
+	}
+	d.n++
+	d.size += int64(len(e.v))
+	return nil
+}
+
+// deleteEntry deletes the entry of key and its expireBucket key, if any.
+func deleteEntry(tx *bbolt.Tx, d *delta, key uint64) error {
+	entries := tx.Bucket(entryBucket)
+	k := keyBytes(key)
+	old := entries.Get(k)
+	if old == nil {
+		return nil
+	}
+	ex := int64(binary.BigEndian.Uint64(old[8:]))
+	d.n--
+	d.size -= int64(len(old) - 16)
+	if err := tx.Bucket(expireBucket).Delete(expireKey(ex, key)); err != nil {
+		return err
+	}
+	return entries.Delete(k)
+}
+
+func keyBytes(key uint64) []byte {
+	return binary.BigEndian.AppendUint64(make([]byte, 0, 8), key)
+}
+
+func expireKey(ex int64, key uint64) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(ex))
+	binary.BigEndian.PutUint64(b[8:], key)
+	return b
+}
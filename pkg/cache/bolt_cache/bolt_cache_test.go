@@ -0,0 +1,187 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bolt_cache
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+func newTestCache(t *testing.T, path string, maxSize int64) *BoltCache {
+	t.Helper()
+	c, err := NewBoltCache(BoltCacheOpts{
+		Path:          path,
+		MaxSize:       maxSize,
+		FlushInterval: time.Hour,
+		GCInterval:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func Test_BoltCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c := newTestCache(t, path, 0)
+	now := time.Now().Unix()
+	v := []byte("test")
+
+	c.Store(1, v, now, now+60)
+	if got, st, ex := c.Get(1); !bytes.Equal(got, v) || st != now || ex != now+60 {
+		t.Fatalf("pending entry, got %v %d %d", got, st, ex)
+	}
+	c.flush()
+	if got, _, _ := c.Get(1); !bytes.Equal(got, v) {
+		t.Fatalf("flushed entry, want %v, got %v", v, got)
+	}
+	if c.Len() != 1 {
+		t.Fatalf("want len 1, got %d", c.Len())
+	}
+
+	// Entries survive restarts. Pending entries are written on close.
+	c.Store(2, v, now, now+60)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c = newTestCache(t, path, 0)
+	defer c.Close()
+	for _, key := range []uint64{1, 2} {
+		if got, _, _ := c.Get(key); !bytes.Equal(got, v) {
+			t.Fatalf("reopened entry %d, want %v, got %v", key, v, got)
+		}
+	}
+	if c.Len() != 2 {
+		t.Fatalf("want len 2, got %d", c.Len())
+	}
+
+	n, err := c.Flush(context.Background(), func(key uint64, _ []byte) bool { return key == 1 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || c.Len() != 1 {
+		t.Fatalf("want 1 flushed and len 1, got %d flushed and len %d", n, c.Len())
+	}
+	if got, _, _ := c.Get(1); got != nil {
+		t.Fatal("flushed entry is still cached")
+	}
+}
+
+func Test_BoltCache_gc(t *testing.T) {
+	c := newTestCache(t, filepath.Join(t.TempDir(), "cache.db"), 9)
+	defer c.Close()
+	now := time.Now().Unix()
+	v := []byte("12345")
+
+	c.Store(1, v, now, now+10)
+	c.Store(2, v, now, now+20)
+	c.Store(3, v, now, now+30)
+	c.flush()
+	if c.Len() != 3 || c.db.size != 15 {
+		t.Fatalf("want len 3 and size 15, got %d %d", c.Len(), c.db.size)
+	}
+
+	// Entry 1 expires, then entry 2 is evicted to fit the max size.
+	c.gc(now + 10)
+	if c.Len() != 1 || c.db.size != 5 {
+		t.Fatalf("want len 1 and size 5, got %d %d", c.Len(), c.db.size)
+	}
+	if got, _, _ := c.Get(3); got == nil {
+		t.Fatal("entry 3 should not be evicted")
+	}
+
+	c.gc(now + 30)
+	if c.Len() != 0 || c.db.size != 0 {
+		t.Fatalf("want empty cache, got len %d size %d", c.Len(), c.db.size)
+	}
+}
+
+func Test_BoltCache_reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	old := newTestCache(t, path, 0)
+	now := time.Now().Unix()
+	v := []byte("test")
+	old.Store(1, v, now, now+60)
+	old.flush()
+
+	// The new cache of a reload opens the same file while the old one is
+	// still serving.
+	c := newTestCache(t, path, 0)
+	defer c.Close()
+	if got, _, _ := c.Get(1); !bytes.Equal(got, v) {
+		t.Fatalf("want %v, got %v", v, got)
+	}
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Store(2, v, now, now+60)
+	c.flush()
+	if got, _, _ := c.Get(2); !bytes.Equal(got, v) || c.Len() != 2 {
+		t.Fatalf("db is not usable after the old cache is closed, got %v, len %d", got, c.Len())
+	}
+}
+
+func Test_BoltCache_locked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	// Another process, e.g. the old one during an upgrade, holds the db.
+	other, err := bbolt.Open(path, 0o644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewBoltCache(BoltCacheOpts{
+		Path:          path,
+		FlushInterval: 10 * time.Millisecond,
+		GCInterval:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	now := time.Now().Unix()
+	v := []byte("test")
+	if got, _, _ := c.Get(1); got != nil {
+		t.Fatal("unexpected entry")
+	}
+	if _, err := c.Flush(context.Background(), nil); err == nil {
+		t.Fatal("want err when the db is not open")
+	}
+
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.db.isOpen() {
+		if time.Now().After(deadline) {
+			t.Fatal("db is not opened after it is released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Store(1, v, now, now+60)
+	c.flush()
+	if got, _, _ := c.Get(1); !bytes.Equal(got, v) {
+		t.Fatalf("want %v, got %v", v, got)
+	}
+}
@@ -20,7 +20,9 @@
 package cache
 
 import (
+	"context"
 	"io"
+	"time"
 )
 
 // Backend represents a cache backend.
@@ -43,3 +45,42 @@ type Backend interface {
 	// Closer closes the cache backend. Get and Store should become noop calls.
 	io.Closer
 }
+
+// Flusher is implemented by the Backend that can delete its entries.
+type Flusher interface {
+	// Flush deletes the entries that match returns true for, or all entries
+	// if match is nil. match must not modify v. Flush returns the number of
+	// deleted entries. Unlike other Backend methods, it may take a long time
+	// and returns an error if it fails.
+	Flush(ctx context.Context, match func(key uint64, v []byte) bool) (int, error)
+}
+
+// Stats is the statistics of a Backend.
+type Stats struct {
+	// Evictions is the number of entries that were evicted to make room
+	// for new entries.
+	Evictions uint64
+	// StoreErrors is the number of entries that failed to be stored,
+	// including the dropped ones.
+	StoreErrors uint64
+	// ShardLens is the number of entries of each shard. It is nil if the
+	// Backend is not sharded.
+	ShardLens []int
+	// ShardCap is the max number of entries of each shard. It is 0 if the
+	// Backend is not sharded or the number of entries is not limited.
+	ShardCap int
+
+	// CleanerRuns is the number of runs of the cleaner that deletes the
+	// expired entries periodically, and CleanerRemoved is the number of
+	// entries it deleted. CleanerDuration is the total time of the runs
+	// and CleanerLastDuration is the time of the last run.
+	CleanerRuns         uint64
+	CleanerRemoved      uint64
+	CleanerDuration     time.Duration
+	CleanerLastDuration time.Duration
+}
+
+// StatsReporter is implemented by the Backend that reports its Stats.
+type StatsReporter interface {
+	Stats() Stats
+}
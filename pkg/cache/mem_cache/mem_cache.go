@@ -1,10 +1,14 @@
 package mem_cache
 
 import (
+	"context"
+	"math"
 	"sync/atomic"
 	"time"
 
+	"github.com/pmkol/mosdns-x/pkg/cache"
 	"github.com/pmkol/mosdns-x/pkg/concurrent_lru"
+	"github.com/pmkol/mosdns-x/pkg/lru"
 )
 
 const (
@@ -18,17 +22,60 @@ type MemCache struct {
 	closed           uint32
 	closeCleanerChan chan struct{}
 	lru              *concurrent_lru.ShardedLRU[*elem]
+	shardCap         int    // 0 if the number of entries is not limited
+	evictions        uint64 // atomic
+
+	cleanerRuns         uint64 // atomic
+	cleanerRemoved      uint64 // atomic
+	cleanerDuration     int64  // atomic, ns
+	cleanerLastDuration int64  // atomic, ns
 }
 
 type elem struct {
 	v  []byte
 	st int64
 	ex int64
+
+	// deleted is set before the elem is cleaned, so it is not counted as
+	// an eviction. It is protected by the lock of its shard.
+	deleted bool
+}
+
+// MemCacheOpts configures a MemCache.
+type MemCacheOpts struct {
+	// Size is the max number of entries. If it is zero, the default is
+	// 2048, or no limit if MaxBytes is set.
+	Size int
+
+	// MaxBytes bounds the memory used by the entries, which is their values
+	// plus about 128 bytes each. The least recently used entries are evicted
+	// when it is exceeded. The budget is split across 128 shards, so a value
+	// larger than MaxBytes/128 is not cached. Zero means no limit.
+	MaxBytes int
+
+	// CleanerInterval specifies how often expired entries are deleted.
+	// Zero disables the cleaner.
+	CleanerInterval time.Duration
+
+	// Policy is the eviction policy. Default is lru.PolicyLRU.
+	Policy lru.Policy
 }
 
 func NewMemCache(size int, cleanerInterval time.Duration) *MemCache {
+	c, err := NewMemCacheWithOpts(MemCacheOpts{Size: size, CleanerInterval: cleanerInterval})
+	if err != nil {
+		panic(err) // LRU policy never fails
+	}
+	return c
+}
+
+func NewMemCacheWithOpts(opts MemCacheOpts) (*MemCache, error) {
+	size := opts.Size
 	if size <= 0 {
 		size = shardSize * 16
+		if opts.MaxBytes > 0 {
+			size = math.MaxInt
+		}
 	}
 
 	sizePerShard := size / shardSize
@@ -38,18 +85,37 @@ func NewMemCache(size int, cleanerInterval time.Duration) *MemCache {
 
 	c := &MemCache{
 		closeCleanerChan: make(chan struct{}),
-		lru: concurrent_lru.NewShardedLRU[*elem](
-			shardSize,
-			sizePerShard,
-			nil,
-		),
+	}
+	l, err := concurrent_lru.NewShardedCache[*elem](
+		opts.Policy,
+		shardSize,
+		sizePerShard,
+		c.onEvict,
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.lru = l
+	if size != math.MaxInt {
+		c.shardCap = sizePerShard
+	}
+	if opts.MaxBytes > 0 {
+		c.lru.SetMaxBytes(max(opts.MaxBytes/shardSize, 1), elemSize)
 	}
 
-	if cleanerInterval > 0 {
-		go c.startCleaner(cleanerInterval)
+	if opts.CleanerInterval > 0 {
+		go c.startCleaner(opts.CleanerInterval)
 	}
 
-	return c
+	return c, nil
+}
+
+// elemOverhead approximates the memory of an entry besides its value,
+// including the elem, the lru list node and the map entry.
+const elemOverhead = 128
+
+func elemSize(_ uint64, e *elem) int {
+	return len(e.v) + elemOverhead
 }
 
 func (c *MemCache) isClosed() bool {
@@ -93,6 +159,29 @@ func (c *MemCache) Store(
 	})
 }
 
+// Flush implements cache.Flusher.
+func (c *MemCache) Flush(_ context.Context, match func(key uint64, v []byte) bool) (int, error) {
+	return c.clean(func(key uint64, e *elem) bool {
+		return match == nil || match(key, e.v)
+	}), nil
+}
+
+func (c *MemCache) clean(f func(key uint64, e *elem) bool) int {
+	return c.lru.Clean(func(key uint64, e *elem) bool {
+		if f(key, e) {
+			e.deleted = true
+			return true
+		}
+		return false
+	})
+}
+
+func (c *MemCache) onEvict(_ uint64, e *elem) {
+	if !e.deleted {
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
 func (c *MemCache) startCleaner(interval time.Duration) {
 	if interval <= 0 {
 		interval = defaultCleanerInterval
@@ -107,11 +196,17 @@ func (c *MemCache) startCleaner(interval time.Duration) {
 			return
 
 		case <-ticker.C:
-			now := time.Now().Unix()
+			start := time.Now()
+			now := start.Unix()
 
-			c.lru.Clean(func(_ uint64, e *elem) bool {
+			removed := c.clean(func(_ uint64, e *elem) bool {
 				return e.ex <= now
 			})
+			elapsed := int64(time.Since(start))
+			atomic.AddUint64(&c.cleanerRuns, 1)
+			atomic.AddUint64(&c.cleanerRemoved, uint64(removed))
+			atomic.AddInt64(&c.cleanerDuration, elapsed)
+			atomic.StoreInt64(&c.cleanerLastDuration, elapsed)
 		}
 	}
 }
@@ -119,3 +214,23 @@ func (c *MemCache) startCleaner(interval time.Duration) {
 func (c *MemCache) Len() int {
 	return c.lru.Len()
 }
+
+// Bytes returns the memory used by the entries as measured for
+// MemCacheOpts.MaxBytes. It is 0 if MaxBytes is not set.
+func (c *MemCache) Bytes() int {
+	return c.lru.Bytes()
+}
+
+// Stats implements cache.StatsReporter.
+func (c *MemCache) Stats() cache.Stats {
+	return cache.Stats{
+		Evictions: atomic.LoadUint64(&c.evictions),
+		ShardLens: c.lru.ShardLens(),
+		ShardCap:  c.shardCap,
+
+		CleanerRuns:         atomic.LoadUint64(&c.cleanerRuns),
+		CleanerRemoved:      atomic.LoadUint64(&c.cleanerRemoved),
+		CleanerDuration:     time.Duration(atomic.LoadInt64(&c.cleanerDuration)),
+		CleanerLastDuration: time.Duration(atomic.LoadInt64(&c.cleanerLastDuration)),
+	}
+}
@@ -20,6 +20,7 @@
 package mem_cache
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -62,6 +63,92 @@ func Test_memCache_cleaner(t *testing.T) {
 	if c.Len() != 0 {
 		t.Fatal()
 	}
+	stats := c.Stats()
+	if stats.CleanerRuns == 0 || stats.CleanerRemoved != 64 {
+		t.Fatalf("want 64 entries removed by the cleaner, got %d in %d runs", stats.CleanerRemoved, stats.CleanerRuns)
+	}
+	if stats.CleanerDuration < stats.CleanerLastDuration {
+		t.Fatalf("total cleaner duration %s is less than the last one %s", stats.CleanerDuration, stats.CleanerLastDuration)
+	}
+}
+
+func Test_memCache_Flush(t *testing.T) {
+	c := NewMemCache(1024, 0)
+	defer c.Close()
+	now := time.Now().Unix()
+	for i := 0; i < 64; i++ {
+		c.Store(uint64(i), []byte{byte(i % 2)}, now, now+60)
+	}
+
+	n, err := c.Flush(context.Background(), func(_ uint64, v []byte) bool { return v[0] == 0 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 32 || c.Len() != 32 {
+		t.Fatalf("want 32 flushed and 32 left, got %d flushed and %d left", n, c.Len())
+	}
+	if v, _, _ := c.Get(1); v == nil {
+		t.Fatal("unmatched entry flushed")
+	}
+
+	if n, _ := c.Flush(context.Background(), nil); n != 32 || c.Len() != 0 {
+		t.Fatalf("want all 32 flushed, got %d flushed and %d left", n, c.Len())
+	}
+}
+
+func Test_memCache_MaxBytes(t *testing.T) {
+	const maxBytes = 1 << 20
+	c, err := NewMemCacheWithOpts(MemCacheOpts{MaxBytes: maxBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	now := time.Now().Unix()
+	for i := 0; i < 4096; i++ {
+		c.Store(uint64(i), make([]byte, 1024), now, now+60)
+	}
+	if c.Bytes() > maxBytes {
+		t.Fatalf("want at most %d bytes, got %d", maxBytes, c.Bytes())
+	}
+	if c.Len() == 0 || c.Bytes() != c.Len()*(1024+elemOverhead) {
+		t.Fatalf("len %d and bytes %d mismatched", c.Len(), c.Bytes())
+	}
+
+	// Larger than the budget of a shard.
+	c.Store(4096, make([]byte, maxBytes/shardSize), now, now+60)
+	if v, _, _ := c.Get(4096); v != nil {
+		t.Fatal("oversized entry is cached")
+	}
+}
+
+func Test_memCache_Stats(t *testing.T) {
+	c := NewMemCache(shardSize*16, 0)
+	defer c.Close()
+	now := time.Now().Unix()
+	for i := 0; i < shardSize*32; i++ {
+		c.Store(uint64(i), []byte{}, now, now+60)
+	}
+
+	stats := c.Stats()
+	if stats.Evictions != shardSize*16 {
+		t.Fatalf("want %d evictions, got %d", shardSize*16, stats.Evictions)
+	}
+	sum := 0
+	for _, l := range stats.ShardLens {
+		sum += l
+	}
+	if len(stats.ShardLens) != shardSize || sum != c.Len() {
+		t.Fatalf("%d shards with %d entries, want %d shards with %d entries", len(stats.ShardLens), sum, shardSize, c.Len())
+	}
+	if stats.ShardCap != 16 {
+		t.Fatalf("want shard cap 16, got %d", stats.ShardCap)
+	}
+
+	// Flushed entries are not evicted.
+	c.Flush(context.Background(), nil)
+	if got := c.Stats().Evictions; got != stats.Evictions {
+		t.Fatalf("flush changed evictions from %d to %d", stats.Evictions, got)
+	}
 }
 
 func Test_memCache_race(t *testing.T) {
@@ -25,13 +25,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/pkg/cache"
 	"github.com/pmkol/mosdns-x/pkg/pool"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
@@ -53,6 +55,28 @@ type RedisCacheOpts struct {
 	// Logger is the *zap.Logger for this RedisCache.
 	// A nil Logger will disable logging.
 	Logger *zap.Logger
+
+	// StartDisabled makes the RedisCache start with the client disabled,
+	// as if the server was unreachable. The client is enabled once the
+	// server responds to ping. So the startup won't be blocked or fail
+	// when the server is unavailable.
+	StartDisabled bool
+
+	// Fallback is an optional backend that is used while the client
+	// is disabled. It is closed when RedisCache.Close is called.
+	Fallback cache.Backend
+
+	// KeyPrefix is prepended to all keys, so multiple caches can share one
+	// redis db. Flush only deletes the keys with the prefix.
+	KeyPrefix string
+
+	// WriteBehindInterval enables write-behind. Stores are queued and sent
+	// to redis by BatchStore in batches of up to WriteBehindSize (default
+	// 256) or every WriteBehindInterval, so Store does not wait for redis.
+	// Stores are dropped if the queue is full. A stored value is not
+	// visible to Get until its batch is sent.
+	WriteBehindInterval time.Duration
+	WriteBehindSize     int
 }
 
 func (opts *RedisCacheOpts) Init() error {
@@ -69,15 +93,27 @@ func (opts *RedisCacheOpts) Init() error {
 type RedisCache struct {
 	opts           RedisCacheOpts
 	clientDisabled uint32
+	closed         uint32
+
+	writeBehind *writeBehind // nil if write-behind is disabled
+	storeErrors uint64       // atomic
 }
 
 func NewRedisCache(opts RedisCacheOpts) (*RedisCache, error) {
 	if err := opts.Init(); err != nil {
 		return nil, err
 	}
-	return &RedisCache{
+	r := &RedisCache{
 		opts: opts,
-	}, nil
+	}
+	if opts.StartDisabled {
+		r.disableClient()
+	}
+	if opts.WriteBehindInterval > 0 {
+		r.writeBehind = newWriteBehind(opts.WriteBehindInterval, opts.WriteBehindSize)
+		go r.writeBehind.run(r.BatchStore)
+	}
+	return r, nil
 }
 
 func (r *RedisCache) disabled() bool {
@@ -92,6 +128,9 @@ func (r *RedisCache) disableClient() {
 			backoff := time.Millisecond * 100
 			for {
 				time.Sleep(backoff)
+				if atomic.LoadUint32(&r.closed) != 0 {
+					return
+				}
 				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
 				err := r.opts.Client.Ping(ctx).Err()
 				cancel()
@@ -99,24 +138,32 @@ func (r *RedisCache) disableClient() {
 					if backoff >= maxBackoff {
 						backoff = maxBackoff
 					} else {
-						backoff += time.Duration(rand.Intn(1000))*time.Millisecond + time.Second
+						backoff += time.Duration(utils.RandIntN(1000))*time.Millisecond + time.Second
 					}
 					r.opts.Logger.Warn("redis ping failed", zap.Error(err), zap.Duration("next_ping", backoff))
 					continue
 				}
 				atomic.StoreUint32(&r.clientDisabled, 0)
+				r.opts.Logger.Info("redis enabled")
 				return
 			}
 		}()
 	}
 }
 
+func (r *RedisCache) strKey(key uint64) string {
+	return r.opts.KeyPrefix + fmt.Sprintf("%016x", key)
+}
+
 func (r *RedisCache) Get(key uint64) (v []byte, storedTime, expirationTime int64) {
 	if r.disabled() {
+		if fb := r.opts.Fallback; fb != nil {
+			return fb.Get(key)
+		}
 		return nil, 0, 0
 	}
 
-	strKey := fmt.Sprintf("%016x", key)
+	strKey := r.strKey(key)
 	ctx, cancel := context.WithTimeout(context.Background(), r.opts.ClientTimeout)
 	defer cancel()
 	b, err := r.opts.Client.Get(ctx, strKey).Bytes()
@@ -139,6 +186,9 @@ func (r *RedisCache) Get(key uint64) (v []byte, storedTime, expirationTime int64
 // Store stores kv into redis.
 func (r *RedisCache) Store(key uint64, v []byte, storedTime, expirationTime int64) {
 	if r.disabled() {
+		if fb := r.opts.Fallback; fb != nil {
+			fb.Store(key, v, storedTime, expirationTime)
+		}
 		return
 	}
 
@@ -148,12 +198,25 @@ func (r *RedisCache) Store(key uint64, v []byte, storedTime, expirationTime int6
 		return
 	}
 
-	strKey := fmt.Sprintf("%016x", key)
+	if r.writeBehind != nil {
+		if atomic.LoadUint32(&r.closed) != 0 {
+			return
+		}
+		kv := KV{Key: key, V: append([]byte(nil), v...), StoreTime: storedTime, ExpirationTime: expirationTime}
+		if !r.writeBehind.push(kv) {
+			atomic.AddUint64(&r.storeErrors, 1)
+			r.opts.Logger.Debug("redis write-behind queue is full, store dropped")
+		}
+		return
+	}
+
+	strKey := r.strKey(key)
 	data := packRedisData(time.Unix(storedTime, 0), time.Unix(expirationTime, 0), v)
 	defer data.Release()
 	ctx, cancel := context.WithTimeout(context.Background(), r.opts.ClientTimeout)
 	defer cancel()
 	if err := r.opts.Client.Set(ctx, strKey, data.Bytes(), time.Duration(ttl)*time.Second).Err(); err != nil {
+		atomic.AddUint64(&r.storeErrors, 1)
 		r.opts.Logger.Warn("redis set", zap.Error(err))
 		r.disableClient()
 	}
@@ -169,6 +232,11 @@ type KV struct {
 // BatchStore stores a batch of kv into redis via redis pipeline.
 func (r *RedisCache) BatchStore(b []KV) {
 	if r.disabled() {
+		if fb := r.opts.Fallback; fb != nil {
+			for _, kv := range b {
+				fb.Store(kv.Key, kv.V, kv.StoreTime, kv.ExpirationTime)
+			}
+		}
 		return
 	}
 
@@ -183,13 +251,14 @@ func (r *RedisCache) BatchStore(b []KV) {
 			continue
 		}
 
-		strKey := fmt.Sprintf("%016x", kv.Key)
+		strKey := r.strKey(kv.Key)
 		data := packRedisData(time.Unix(kv.StoreTime, 0), time.Unix(kv.ExpirationTime, 0), kv.V)
 		buffers = append(buffers, data)
 		pipeline.Set(ctx, strKey, data.Bytes(), time.Duration(ttl)*time.Second)
 	}
 
 	if _, err := pipeline.Exec(ctx); err != nil {
+		atomic.AddUint64(&r.storeErrors, uint64(len(buffers)))
 		r.opts.Logger.Warn("redis pipeline set", zap.Error(err))
 		r.disableClient()
 	}
@@ -198,23 +267,203 @@ func (r *RedisCache) BatchStore(b []KV) {
 	}
 }
 
-// Close closes the redis client.
+// flushScanCount is the COUNT of SCAN when flushing.
+const flushScanCount = 512
+
+// Flush implements cache.Flusher. It scans all keys of the db (of all
+// masters of a cluster) that look like cache keys, so it can be slow on
+// large dbs. The fallback backend is flushed too. If the client is
+// disabled, only the fallback is flushed and an error is returned.
+func (r *RedisCache) Flush(ctx context.Context, match func(key uint64, v []byte) bool) (int, error) {
+	var n int
+	if fb, ok := r.opts.Fallback.(cache.Flusher); ok {
+		fn, err := fb.Flush(ctx, match)
+		if err != nil {
+			return 0, err
+		}
+		n += fn
+	}
+	if r.disabled() {
+		return n, errors.New("redis is unavailable")
+	}
+
+	pattern := globEscaper.Replace(r.opts.KeyPrefix) + "????????????????"
+	var deleted atomic.Int64
+	err := r.forEachNode(ctx, func(ctx context.Context, node redis.Cmdable) error {
+		var cursor uint64
+		for {
+			keys, next, err := node.Scan(ctx, cursor, pattern, flushScanCount).Result()
+			if err != nil {
+				return fmt.Errorf("redis scan, %w", err)
+			}
+			// The pattern also matches other keys of 16 characters.
+			keys = cacheKeys(r.opts.KeyPrefix, keys)
+			if match != nil {
+				keys, err = matchKeys(ctx, node, r.opts.KeyPrefix, keys, match)
+				if err != nil {
+					return err
+				}
+			}
+			d, err := delKeys(ctx, node, keys)
+			deleted.Add(int64(d))
+			if err != nil {
+				return err
+			}
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	})
+	return n + int(deleted.Load()), err
+}
+
+// globEscaper escapes the special characters of redis glob patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// masterIterator is implemented by *redis.ClusterClient.
+type masterIterator interface {
+	ForEachMaster(ctx context.Context, fn func(ctx context.Context, client *redis.Client) error) error
+}
+
+// forEachNode calls fn with each master of a cluster client concurrently,
+// or with the client if it is not a cluster client.
+func (r *RedisCache) forEachNode(ctx context.Context, fn func(ctx context.Context, node redis.Cmdable) error) error {
+	if c, ok := r.opts.Client.(masterIterator); ok {
+		return c.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return fn(ctx, client)
+		})
+	}
+	return fn(ctx, r.opts.Client)
+}
+
+// cacheKeys returns the keys that are prefix followed by 16 lower case
+// hex digits, which is the format of strKey.
+func cacheKeys(prefix string, keys []string) []string {
+	filtered := keys[:0]
+	for _, key := range keys {
+		if isCacheKey(prefix, key) {
+			filtered = append(filtered, key)
+		}
+	}
+	return filtered
+}
+
+func isCacheKey(prefix, key string) bool {
+	s, ok := strings.CutPrefix(key, prefix)
+	if !ok || len(s) != 16 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// matchKeys returns the keys whose values match. Keys are read one by one
+// in a pipeline, because keys in different slots of a cluster cannot be
+// read by one MGET.
+func matchKeys(ctx context.Context, node redis.Cmdable, prefix string, keys []string, match func(key uint64, v []byte) bool) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	pipeline := node.Pipeline()
+	cmds := make([]*redis.StringCmd, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, pipeline.Get(ctx, key))
+	}
+	if _, err := pipeline.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis get, %w", err)
+	}
+	matched := keys[:0]
+	for i, cmd := range cmds {
+		b, err := cmd.Bytes()
+		if err != nil { // deleted or expired
+			continue
+		}
+		key, _ := strconv.ParseUint(strings.TrimPrefix(keys[i], prefix), 16, 64)
+		_, _, m, err := unpackRedisValue(b)
+		if err != nil {
+			continue
+		}
+		if match(key, m) {
+			matched = append(matched, keys[i])
+		}
+	}
+	return matched, nil
+}
+
+// delKeys deletes keys one by one in a pipeline, see matchKeys.
+func delKeys(ctx context.Context, node redis.Cmdable, keys []string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	pipeline := node.Pipeline()
+	cmds := make([]*redis.IntCmd, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, pipeline.Del(ctx, key))
+	}
+	_, err := pipeline.Exec(ctx)
+	var n int
+	for _, cmd := range cmds {
+		n += int(cmd.Val())
+	}
+	if err != nil {
+		return n, fmt.Errorf("redis del, %w", err)
+	}
+	return n, nil
+}
+
+// Close closes the redis client and the fallback backend. Queued stores
+// of write-behind are sent before the client is closed.
 func (r *RedisCache) Close() error {
+	if !atomic.CompareAndSwapUint32(&r.closed, 0, 1) {
+		return nil
+	}
+	if r.writeBehind != nil {
+		r.writeBehind.close()
+	}
+	if fb := r.opts.Fallback; fb != nil {
+		_ = fb.Close()
+	}
 	if f := r.opts.ClientCloser; f != nil {
 		return f.Close()
 	}
 	return nil
 }
 
+// Len returns the size of the redis db, or the sum of the dbs of all
+// masters of a cluster. If the client is disabled, it returns the size of
+// the fallback backend, or 0 if there is no fallback.
 func (r *RedisCache) Len() int {
+	if r.disabled() {
+		if fb := r.opts.Fallback; fb != nil {
+			return fb.Len()
+		}
+		return 0
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
 	defer cancel()
-	i, err := r.opts.Client.DBSize(ctx).Result()
+	var size atomic.Int64
+	err := r.forEachNode(ctx, func(ctx context.Context, node redis.Cmdable) error {
+		i, err := node.DBSize(ctx).Result()
+		size.Add(i)
+		return err
+	})
 	if err != nil {
 		r.opts.Logger.Error("dbsize", zap.Error(err))
 		return 0
 	}
-	return int(i)
+	return int(size.Load())
+}
+
+// Stats implements cache.StatsReporter. Redis evicts keys itself, so
+// Evictions is always 0.
+func (r *RedisCache) Stats() cache.Stats {
+	return cache.Stats{StoreErrors: atomic.LoadUint64(&r.storeErrors)}
 }
 
 // packRedisData packs storedTime, expirationTime and v into one byte slice.
@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package redis_cache
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// NewClient creates a redis client from rawURL. Besides the urls that
+// redis.ParseURL accepts, it accepts:
+//   - redis cluster urls, which have the scheme "redis-cluster" or
+//     "rediss-cluster" (tls) and comma separated seed addresses, e.g.
+//     "redis-cluster://:password@10.0.0.1:6379,10.0.0.2:6379". The cluster
+//     client follows MOVED and ASK redirections.
+//   - redis sentinel urls, which have the scheme "redis-sentinel" or
+//     "rediss-sentinel" (tls), comma separated sentinel addresses, the
+//     master name and an optional db in the path, e.g.
+//     "redis-sentinel://:password@10.0.0.1:26379,10.0.0.2:26379/mymaster/1".
+//     The password of sentinels can be set by the query parameters
+//     "sentinel_username" and "sentinel_password". The client follows the
+//     failovers of the master.
+//
+// maxRetries is the MaxRetries option of the client.
+func NewClient(rawURL string, maxRetries int) (redis.UniversalClient, error) {
+	scheme, rest, _ := strings.Cut(rawURL, "://")
+	switch scheme {
+	case "redis-cluster", "rediss-cluster":
+		u, err := parseMultiHostURL(rest, "6379")
+		if err != nil {
+			return nil, err
+		}
+		opts := &redis.ClusterOptions{
+			Addrs:      u.addrs,
+			Username:   u.username,
+			Password:   u.password,
+			MaxRetries: maxRetries,
+		}
+		if scheme == "rediss-cluster" {
+			opts.TLSConfig = u.tlsConfig()
+		}
+		return redis.NewClusterClient(opts), nil
+	case "redis-sentinel", "rediss-sentinel":
+		u, err := parseMultiHostURL(rest, "26379")
+		if err != nil {
+			return nil, err
+		}
+		masterName, dbStr, _ := strings.Cut(strings.TrimPrefix(u.path, "/"), "/")
+		if len(masterName) == 0 {
+			return nil, fmt.Errorf("no master name in redis sentinel url")
+		}
+		var db int
+		if len(dbStr) > 0 {
+			if db, err = strconv.Atoi(dbStr); err != nil {
+				return nil, fmt.Errorf("invalid db %s, %w", dbStr, err)
+			}
+		}
+		opts := &redis.FailoverOptions{
+			MasterName:       masterName,
+			SentinelAddrs:    u.addrs,
+			SentinelUsername: u.query.Get("sentinel_username"),
+			SentinelPassword: u.query.Get("sentinel_password"),
+			Username:         u.username,
+			Password:         u.password,
+			DB:               db,
+			MaxRetries:       maxRetries,
+		}
+		if scheme == "rediss-sentinel" {
+			opts.TLSConfig = u.tlsConfig()
+		}
+		return redis.NewFailoverClient(opts), nil
+	default:
+		opts, err := redis.ParseURL(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		opts.MaxRetries = maxRetries
+		return redis.NewClient(opts), nil
+	}
+}
+
+type multiHostURL struct {
+	username string
+	password string
+	addrs    []string
+	path     string
+	query    url.Values
+}
+
+// parseMultiHostURL parses the url after the scheme. It is not parsed by
+// url.Parse, which does not accept multiple hosts. Addresses without
+// a port get defaultPort.
+func parseMultiHostURL(rest, defaultPort string) (*multiHostURL, error) {
+	u := new(multiHostURL)
+	rest, rawQuery, _ := strings.Cut(rest, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query, %w", err)
+	}
+	u.query = query
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, u.path = rest[:i], rest[i:]
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		var userinfo string
+		userinfo, rest = rest[:i], rest[i+1:]
+		user, pass, _ := strings.Cut(userinfo, ":")
+		if u.username, err = url.PathUnescape(user); err != nil {
+			return nil, fmt.Errorf("invalid username, %w", err)
+		}
+		if u.password, err = url.PathUnescape(pass); err != nil {
+			return nil, fmt.Errorf("invalid password, %w", err)
+		}
+	}
+	for _, addr := range strings.Split(rest, ",") {
+		if len(addr) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+		}
+		u.addrs = append(u.addrs, addr)
+	}
+	if len(u.addrs) == 0 {
+		return nil, fmt.Errorf("no address in redis url")
+	}
+	return u, nil
+}
+
+func (u *multiHostURL) tlsConfig() *tls.Config {
+	host, _, _ := net.SplitHostPort(u.addrs[0])
+	return &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+}
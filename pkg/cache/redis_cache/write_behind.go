@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package redis_cache
+
+import (
+	"time"
+)
+
+const defaultWriteBehindSize = 256
+
+// writeBehind queues the stores of a RedisCache and stores them by
+// BatchStore in batches, so stores do not wait for redis.
+type writeBehind struct {
+	interval time.Duration
+	size     int
+	queue    chan KV
+	closeC   chan struct{}
+	doneC    chan struct{}
+}
+
+func newWriteBehind(interval time.Duration, size int) *writeBehind {
+	if size <= 0 {
+		size = defaultWriteBehindSize
+	}
+	return &writeBehind{
+		interval: interval,
+		size:     size,
+		queue:    make(chan KV, size*4),
+		closeC:   make(chan struct{}),
+		doneC:    make(chan struct{}),
+	}
+}
+
+// push queues kv. It returns false if the queue is full.
+func (w *writeBehind) push(kv KV) bool {
+	select {
+	case w.queue <- kv:
+		return true
+	default:
+		return false
+	}
+}
+
+// run stores the queued kvs by store until close is called. The remaining
+// kvs are stored before it returns.
+func (w *writeBehind) run(store func(b []KV)) {
+	defer close(w.doneC)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	batch := make([]KV, 0, w.size)
+	flush := func() {
+		if len(batch) > 0 {
+			store(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case kv := <-w.queue:
+			batch = append(batch, kv)
+			if len(batch) >= w.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-w.closeC:
+			for {
+				select {
+				case kv := <-w.queue:
+					batch = append(batch, kv)
+					if len(batch) >= w.size {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// close stops run and waits for the remaining kvs to be stored.
+func (w *writeBehind) close() {
+	close(w.closeC)
+	<-w.doneC
+}
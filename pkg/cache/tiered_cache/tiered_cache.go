@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tiered_cache
+
+import (
+	"context"
+	"errors"
+
+	"github.com/pmkol/mosdns-x/pkg/cache"
+)
+
+// TieredCache is a two-tier cache.Backend. Get looks up the front backend
+// first, then the back backend, and promotes the hits of the back to the
+// front. Store stores to both. Typically, the front is a small local
+// memory cache and the back is a shared redis cache, so hot entries do
+// not cost a round trip to redis.
+type TieredCache struct {
+	front cache.Backend
+	back  cache.Backend
+}
+
+var (
+	_ cache.Flusher       = (*TieredCache)(nil)
+	_ cache.StatsReporter = (*TieredCache)(nil)
+)
+
+func NewTieredCache(front, back cache.Backend) *TieredCache {
+	return &TieredCache{front: front, back: back}
+}
+
+func (c *TieredCache) Get(key uint64) (v []byte, storedTime, expirationTime int64) {
+	if v, st, ex := c.front.Get(key); v != nil {
+		return v, st, ex
+	}
+	v, storedTime, expirationTime = c.back.Get(key)
+	if v != nil {
+		c.front.Store(key, v, storedTime, expirationTime)
+	}
+	return v, storedTime, expirationTime
+}
+
+func (c *TieredCache) Store(key uint64, v []byte, storedTime, expirationTime int64) {
+	c.front.Store(key, v, storedTime, expirationTime)
+	c.back.Store(key, v, storedTime, expirationTime)
+}
+
+// Len returns the length of the back backend, which has all entries.
+func (c *TieredCache) Len() int {
+	return c.back.Len()
+}
+
+// Flush implements cache.Flusher. Both backends are flushed, and the
+// number of entries deleted from the back backend is returned, because
+// the front ones are copies of them.
+func (c *TieredCache) Flush(ctx context.Context, match func(key uint64, v []byte) bool) (int, error) {
+	var errs []error
+	if f, ok := c.front.(cache.Flusher); ok {
+		if _, err := f.Flush(ctx, match); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	var n int
+	if f, ok := c.back.(cache.Flusher); ok {
+		var err error
+		if n, err = f.Flush(ctx, match); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+// Stats implements cache.StatsReporter. It sums the Evictions and
+// StoreErrors of both backends. Others are the ones of the front backend.
+func (c *TieredCache) Stats() cache.Stats {
+	var stats cache.Stats
+	if r, ok := c.front.(cache.StatsReporter); ok {
+		stats = r.Stats()
+	}
+	if r, ok := c.back.(cache.StatsReporter); ok {
+		back := r.Stats()
+		stats.Evictions += back.Evictions
+		stats.StoreErrors += back.StoreErrors
+	}
+	return stats
+}
+
+// Close closes both backends.
+func (c *TieredCache) Close() error {
+	return errors.Join(c.front.Close(), c.back.Close())
+}
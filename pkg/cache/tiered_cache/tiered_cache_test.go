@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tiered_cache
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
+)
+
+func Test_TieredCache(t *testing.T) {
+	front := mem_cache.NewMemCache(16, 0)
+	back := mem_cache.NewMemCache(16, 0)
+	c := NewTieredCache(front, back)
+	defer c.Close()
+
+	now := time.Now().Unix()
+	v := []byte("test")
+	back.Store(1, v, now, now+60)
+	if got, _, _ := c.Get(1); !bytes.Equal(got, v) {
+		t.Fatalf("want %v from back, got %v", v, got)
+	}
+	if got, _, _ := front.Get(1); !bytes.Equal(got, v) {
+		t.Fatal("back hit is not promoted to front")
+	}
+
+	c.Store(2, v, now, now+60)
+	if got, _, _ := front.Get(2); got == nil {
+		t.Fatal("not stored to front")
+	}
+	if got, _, _ := back.Get(2); got == nil {
+		t.Fatal("not stored to back")
+	}
+
+	n, err := c.Flush(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || front.Len() != 0 || back.Len() != 0 {
+		t.Fatalf("want 2 flushed and empty tiers, got %d flushed, front %d, back %d", n, front.Len(), back.Len())
+	}
+}
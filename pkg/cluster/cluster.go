@@ -0,0 +1,260 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package cluster shares dynamic state between mosdns instances, e.g. an
+// anycast fleet, via redis pub/sub. Plugins publish messages to topics and
+// receive the messages that other instances published to the same topics.
+package cluster
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultChannel  = "mosdns_cluster"
+	publishQueueLen = 1024
+)
+
+var nopLogger = zap.NewNop()
+
+type Opts struct {
+	// Client cannot be nil. It is closed when Cluster.Close is called.
+	Client *redis.Client
+
+	// Key is the shared key of the cluster. Messages are signed with it
+	// and messages with an invalid signature are dropped. It cannot be
+	// empty.
+	Key []byte
+
+	// Channel is the redis pub/sub channel. Instances that share the
+	// same channel are in the same cluster. Default is "mosdns_cluster".
+	Channel string
+
+	// NodeID identifies this instance. Messages published by this instance
+	// are not delivered to itself. Default is a random id. It does not use
+	// the seeded random source so instances with the same seed get
+	// different ids.
+	NodeID string
+
+	// Logger is the *zap.Logger for this Cluster.
+	// A nil Logger will disable logging.
+	Logger *zap.Logger
+}
+
+func (opts *Opts) Init() error {
+	if opts.Client == nil {
+		return errors.New("nil client")
+	}
+	if len(opts.Key) == 0 {
+		return errors.New("empty key")
+	}
+	if len(opts.Channel) == 0 {
+		opts.Channel = defaultChannel
+	}
+	if len(opts.NodeID) == 0 {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		opts.NodeID = hex.EncodeToString(b)
+	}
+	if opts.Logger == nil {
+		opts.Logger = nopLogger
+	}
+	return nil
+}
+
+// Handler handles a message that another instance published.
+// It must not block.
+type Handler func(data []byte)
+
+type message struct {
+	Node  string `json:"node"`
+	Topic string `json:"topic"`
+	Data  []byte `json:"data"`
+	MAC   []byte `json:"mac"`
+}
+
+// sum returns the HMAC-SHA256 of m with key.
+func (m *message) sum(key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, b := range [][]byte{[]byte(m.Node), []byte(m.Topic), m.Data} {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(b)))
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// Cluster publishes and receives messages. A nil *Cluster is valid,
+// which publishes and receives nothing, so plugins don't need to check
+// whether the cluster mode is enabled.
+type Cluster struct {
+	opts Opts
+
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+
+	pubQueue     chan *message
+	dropped      atomic.Uint64
+	pubsub       *redis.PubSub
+	closeOnce    sync.Once
+	closeNotify  chan struct{}
+	loopsRunning sync.WaitGroup
+}
+
+// New creates a Cluster and subscribes to the channel.
+func New(opts Opts) (*Cluster, error) {
+	if err := opts.Init(); err != nil {
+		return nil, err
+	}
+	c := &Cluster{
+		opts:        opts,
+		handlers:    make(map[string][]Handler),
+		pubQueue:    make(chan *message, publishQueueLen),
+		pubsub:      opts.Client.Subscribe(context.Background(), opts.Channel),
+		closeNotify: make(chan struct{}),
+	}
+	c.loopsRunning.Add(2)
+	go c.publishLoop()
+	go c.receiveLoop()
+	return c, nil
+}
+
+// NodeID returns the id of this instance.
+func (c *Cluster) NodeID() string {
+	if c == nil {
+		return ""
+	}
+	return c.opts.NodeID
+}
+
+// Subscribe registers h to the topic.
+func (c *Cluster) Subscribe(topic string, h Handler) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.handlers[topic] = append(c.handlers[topic], h)
+	c.mu.Unlock()
+}
+
+// Publish sends data to the topic of other instances asynchronously.
+// It never blocks. Messages are dropped if the publish queue is full.
+func (c *Cluster) Publish(topic string, data []byte) {
+	if c == nil {
+		return
+	}
+	select {
+	case c.pubQueue <- &message{Node: c.opts.NodeID, Topic: topic, Data: data}:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of messages that were dropped because the
+// publish queue was full.
+func (c *Cluster) Dropped() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.dropped.Load()
+}
+
+func (c *Cluster) publishLoop() {
+	defer c.loopsRunning.Done()
+	for {
+		select {
+		case m := <-c.pubQueue:
+			m.MAC = m.sum(c.opts.Key)
+			b, err := json.Marshal(m)
+			if err != nil {
+				continue
+			}
+			if err := c.opts.Client.Publish(context.Background(), c.opts.Channel, b).Err(); err != nil {
+				c.opts.Logger.Warn("failed to publish cluster message", zap.String("topic", m.Topic), zap.Error(err))
+			}
+		case <-c.closeNotify:
+			return
+		}
+	}
+}
+
+func (c *Cluster) receiveLoop() {
+	defer c.loopsRunning.Done()
+	ch := c.pubsub.Channel()
+	for {
+		select {
+		case m, ok := <-ch:
+			if !ok {
+				return
+			}
+			c.handleMessage(m.Payload)
+		case <-c.closeNotify:
+			return
+		}
+	}
+}
+
+func (c *Cluster) handleMessage(payload string) {
+	m := new(message)
+	if err := json.Unmarshal([]byte(payload), m); err != nil {
+		c.opts.Logger.Warn("invalid cluster message", zap.Error(err))
+		return
+	}
+	if !hmac.Equal(m.MAC, m.sum(c.opts.Key)) {
+		c.opts.Logger.Warn("invalid cluster message signature", zap.String("node", m.Node), zap.String("topic", m.Topic))
+		return
+	}
+	if m.Node == c.opts.NodeID {
+		return
+	}
+	c.mu.RLock()
+	hs := c.handlers[m.Topic]
+	c.mu.RUnlock()
+	for _, h := range hs {
+		h(m.Data)
+	}
+}
+
+// Close stops the Cluster and closes the client.
+func (c *Cluster) Close() error {
+	if c == nil {
+		return nil
+	}
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closeNotify)
+		_ = c.pubsub.Close()
+		c.loopsRunning.Wait()
+		err = c.opts.Client.Close()
+	})
+	return err
+}
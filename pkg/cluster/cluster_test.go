@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cluster
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestNew_emptyKey(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	defer client.Close()
+	if _, err := New(Opts{Client: client}); err == nil {
+		t.Fatal("want an error for the empty key")
+	}
+}
+
+func TestCluster_handleMessage(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	c, err := New(Opts{Client: client, Key: []byte("key"), NodeID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var got []string
+	c.Subscribe("t1", func(data []byte) { got = append(got, string(data)) })
+
+	payload := func(key, node, topic, data string) string {
+		m := &message{Node: node, Topic: topic, Data: []byte(data)}
+		m.MAC = m.sum([]byte(key))
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	c.handleMessage(payload("key", "b", "t1", "1"))
+	c.handleMessage(payload("key", "a", "t1", "2"))            // from itself
+	c.handleMessage(payload("key", "b", "t2", "3"))            // not subscribed
+	c.handleMessage(payload("bad", "b", "t1", "4"))            // wrong key
+	c.handleMessage(`{"node":"b","topic":"t1","data":"NQ=="}`) // not signed
+	c.handleMessage("invalid")
+	if len(got) != 1 || got[0] != "1" {
+		t.Fatalf("unexpected messages %v", got)
+	}
+
+	// The signature covers the topic and the data.
+	tampered := &message{Node: "b", Topic: "t1", Data: []byte("6")}
+	tampered.MAC = tampered.sum([]byte("key"))
+	tampered.Data = []byte("7")
+	b, err := json.Marshal(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.handleMessage(string(b))
+	if len(got) != 1 {
+		t.Fatalf("unexpected messages %v", got)
+	}
+
+	var nilCluster *Cluster
+	nilCluster.Subscribe("t1", func([]byte) {})
+	nilCluster.Publish("t1", nil)
+	if err := nilCluster.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -146,6 +146,25 @@ func (l *HPClientLimiter) AcquireToken(addr netip.Addr) bool {
 	return res
 }
 
+// AddCount adds n used tokens to the counter of addr without checking the
+// limit, e.g. the tokens that addr used on other instances.
+func (l *HPClientLimiter) AddCount(addr netip.Addr, n int) {
+	addr = l.ApplyMask(addr).Addr()
+	now := time.Now()
+	f := func(key netAddrHash, v *counter, exist bool) (newV *counter, setV, deleteV bool) {
+		if !exist {
+			v = new(counter)
+		}
+		if v.startTime.Add(l.opts.Interval).Before(now) {
+			v.startTime = now
+			v.c = 0
+		}
+		v.c += n
+		return v, !exist, false
+	}
+	l.m.TestAndSet(netAddrHash(addr), f)
+}
+
 // ApplyMask masks the addr by the mask values in HPLimiterOpts.
 func (l *HPClientLimiter) ApplyMask(addr netip.Addr) netip.Prefix {
 	switch {
@@ -61,6 +61,24 @@ func Test_HPClientLimiter(t *testing.T) {
 	}
 }
 
+func Test_HPClientLimiter_AddCount(t *testing.T) {
+	limiter, err := NewHPClientLimiter(HPLimiterOpts{
+		Threshold: 8,
+		IPv4Mask:  24,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter.AddCount(netip.AddrFrom4([4]byte{1, 1, 1, 1}), 7)
+	if !limiter.AcquireToken(netip.AddrFrom4([4]byte{1, 1, 1, 2})) {
+		t.Fatal("token should be available")
+	}
+	if limiter.AcquireToken(netip.AddrFrom4([4]byte{1, 1, 1, 3})) {
+		t.Fatal("limit should be reached")
+	}
+}
+
 func Benchmark_HPClientLimiter_AcquireToken(b *testing.B) {
 	l, err := NewHPClientLimiter(HPLimiterOpts{
 		Threshold: 4,
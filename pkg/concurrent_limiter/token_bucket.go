@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package concurrent_limiter
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/concurrent_map"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+type TokenBucketLimiterOpts struct {
+	// QPS is the rate that tokens are refilled. Must be positive.
+	QPS float64
+	// Burst is the size of the bucket. Default is max(1, QPS).
+	Burst int
+
+	// IP masks to aggregate a IP range.
+	IPv4Mask int // Default is 24.
+	IPv6Mask int // Default is 56.
+
+	// Default is 10s. Negative value disables the cleaner.
+	CleanerInterval time.Duration
+}
+
+func (opts *TokenBucketLimiterOpts) Init() error {
+	if !(opts.QPS > 0) {
+		return fmt.Errorf("invalid qps %v, should be positive", opts.QPS)
+	}
+	if opts.Burst < 0 {
+		return fmt.Errorf("invalid burst %d", opts.Burst)
+	}
+	if opts.Burst == 0 {
+		opts.Burst = int(opts.QPS)
+		utils.SetDefaultNum(&opts.Burst, 1)
+	}
+	if m := opts.IPv4Mask; m < 0 || m > 32 {
+		return fmt.Errorf("invalid ipv4 mask %d, should be 0~32", m)
+	}
+	if m := opts.IPv6Mask; m < 0 || m > 128 {
+		return fmt.Errorf("invalid ipv6 mask %d, should be 0~128", m)
+	}
+	utils.SetDefaultNum(&opts.IPv4Mask, 24)
+	utils.SetDefaultNum(&opts.IPv6Mask, 56)
+	utils.SetDefaultNum(&opts.CleanerInterval, time.Second*10)
+	return nil
+}
+
+var _ ClientLimiter = (*TokenBucketLimiter)(nil)
+
+// TokenBucketLimiter is a ClientLimiter that has a token bucket for
+// each client subnet.
+type TokenBucketLimiter struct {
+	opts        TokenBucketLimiterOpts
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	m           *concurrent_map.Map[netAddrHash, *bucket]
+}
+
+type bucket struct {
+	tokens   float64
+	lastTime time.Time
+}
+
+func NewTokenBucketLimiter(opts TokenBucketLimiterOpts) (*TokenBucketLimiter, error) {
+	if err := opts.Init(); err != nil {
+		return nil, err
+	}
+	l := &TokenBucketLimiter{
+		opts:        opts,
+		closeNotify: make(chan struct{}),
+		m:           concurrent_map.NewMap[netAddrHash, *bucket](),
+	}
+	if opts.CleanerInterval > 0 {
+		go l.cleanerLoop()
+	}
+	return l, nil
+}
+
+func (l *TokenBucketLimiter) cleanerLoop() {
+	ticker := time.NewTicker(l.opts.CleanerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.GC(now)
+		case <-l.closeNotify:
+			return
+		}
+	}
+}
+
+func (l *TokenBucketLimiter) AcquireToken(addr netip.Addr) bool {
+	return l.acquireToken(addr, time.Now())
+}
+
+func (l *TokenBucketLimiter) acquireToken(addr netip.Addr, now time.Time) bool {
+	addr = l.ApplyMask(addr).Addr()
+	res := false
+	f := func(key netAddrHash, v *bucket, exist bool) (newV *bucket, setV, deleteV bool) {
+		if !exist {
+			v = &bucket{tokens: float64(l.opts.Burst), lastTime: now}
+		}
+		l.refill(v, now)
+		if v.tokens >= 1 {
+			v.tokens--
+			res = true
+		}
+		return v, !exist, false
+	}
+	l.m.TestAndSet(netAddrHash(addr), f)
+	return res
+}
+
+func (l *TokenBucketLimiter) refill(b *bucket, now time.Time) {
+	if d := now.Sub(b.lastTime); d > 0 {
+		b.tokens += d.Seconds() * l.opts.QPS
+		if burst := float64(l.opts.Burst); b.tokens > burst {
+			b.tokens = burst
+		}
+		b.lastTime = now
+	}
+}
+
+// ApplyMask masks the addr by the mask values in TokenBucketLimiterOpts.
+func (l *TokenBucketLimiter) ApplyMask(addr netip.Addr) netip.Prefix {
+	switch {
+	case addr.Is4():
+		return netip.PrefixFrom(addr, l.opts.IPv4Mask).Masked()
+	case addr.Is4In6():
+		return netip.PrefixFrom(netip.AddrFrom4(addr.As4()), l.opts.IPv4Mask).Masked()
+	case addr.Is6():
+		return netip.PrefixFrom(addr, l.opts.IPv6Mask).Masked()
+	}
+	return netip.Prefix{}
+}
+
+// GC removes full buckets, which are the same as new ones.
+func (l *TokenBucketLimiter) GC(now time.Time) {
+	f := func(key netAddrHash, v *bucket, ok bool) (newV *bucket, setV, deleteV bool) {
+		if !ok {
+			return nil, false, false
+		}
+		l.refill(v, now)
+		return nil, false, v.tokens >= float64(l.opts.Burst)
+	}
+	l.m.RangeDo(f)
+}
+
+// Close closes TokenBucketLimiter's cleaner (if it was started).
+// Close always returns a nil error.
+func (l *TokenBucketLimiter) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeNotify)
+	})
+	return nil
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package concurrent_limiter
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_TokenBucketLimiter(t *testing.T) {
+	limiter, err := NewTokenBucketLimiter(TokenBucketLimiterOpts{
+		QPS:             10,
+		Burst:           5,
+		CleanerInterval: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	a := netip.MustParseAddr("1.1.1.1")
+	for i := 1; i <= 8; i++ {
+		if ok := limiter.acquireToken(a, now); ok != (i <= 5) {
+			t.Fatalf("#%d: got %v", i, ok)
+		}
+	}
+
+	// Same /24.
+	if limiter.acquireToken(netip.MustParseAddr("1.1.1.2"), now) {
+		t.Fatal("bucket should be empty")
+	}
+	// Other subnets have their own buckets.
+	if !limiter.acquireToken(netip.MustParseAddr("2001:db8:0:ff::1"), now) {
+		t.Fatal("token should be available")
+	}
+	if limiter.m.Len() != 2 {
+		t.Fatal()
+	}
+
+	// 2 tokens are refilled after 200ms.
+	now = now.Add(time.Millisecond * 200)
+	for i := 1; i <= 3; i++ {
+		if ok := limiter.acquireToken(a, now); ok != (i <= 2) {
+			t.Fatalf("#%d after refill: got %v", i, ok)
+		}
+	}
+
+	limiter.GC(now.Add(time.Second)) // all buckets are full
+	if remain := limiter.m.Len(); remain != 0 {
+		t.Fatal("gc test failed")
+	}
+}
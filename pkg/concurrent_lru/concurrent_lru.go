@@ -15,6 +15,20 @@ func NewShardedLRU[V any](
 	shardNum, maxSizePerShard int,
 	onEvict func(key uint64, v V),
 ) *ShardedLRU[V] {
+	cl, err := NewShardedCache[V](lru.PolicyLRU, shardNum, maxSizePerShard, onEvict)
+	if err != nil {
+		panic(err)
+	}
+	return cl
+}
+
+// NewShardedCache is like NewShardedLRU, but its shards use the eviction
+// policy instead of LRU.
+func NewShardedCache[V any](
+	policy lru.Policy,
+	shardNum, maxSizePerShard int,
+	onEvict func(key uint64, v V),
+) (*ShardedLRU[V], error) {
 
 	if shardNum <= 0 || shardNum&(shardNum-1) != 0 {
 		panic("shardNum must be a power of 2 and > 0")
@@ -26,12 +40,24 @@ func NewShardedLRU[V any](
 	}
 
 	for i := range cl.l {
+		c, err := lru.NewCache[uint64, V](policy, maxSizePerShard, onEvict)
+		if err != nil {
+			return nil, err
+		}
 		cl.l[i] = &ConcurrentLRU[uint64, V]{
-			lru: lru.NewLRU[uint64, V](maxSizePerShard, onEvict),
+			lru: c,
 		}
 	}
 
-	return cl
+	return cl, nil
+}
+
+// SetMaxBytes calls LRU.SetMaxBytes of each shard. It must be called
+// before any entry is added.
+func (c *ShardedLRU[V]) SetMaxBytes(maxBytesPerShard int, sizeOf func(key uint64, v V) int) {
+	for _, shard := range c.l {
+		shard.SetMaxBytes(maxBytesPerShard, sizeOf)
+	}
 }
 
 func (c *ShardedLRU[V]) getShard(key uint64) *ConcurrentLRU[uint64, V] {
@@ -65,11 +91,28 @@ func (c *ShardedLRU[V]) Len() int {
 	return sum
 }
 
+// ShardLens returns the length of each shard.
+func (c *ShardedLRU[V]) ShardLens() []int {
+	lens := make([]int, len(c.l))
+	for i, shard := range c.l {
+		lens[i] = shard.Len()
+	}
+	return lens
+}
+
+func (c *ShardedLRU[V]) Bytes() int {
+	sum := 0
+	for _, shard := range c.l {
+		sum += shard.Bytes()
+	}
+	return sum
+}
+
 // -----------------------------
 
 type ConcurrentLRU[K comparable, V any] struct {
 	sync.Mutex
-	lru *lru.LRU[K, V]
+	lru lru.Cache[K, V]
 }
 
 func NewConcurrentLRU[K comparable, V any](
@@ -81,6 +124,12 @@ func NewConcurrentLRU[K comparable, V any](
 	}
 }
 
+func (c *ConcurrentLRU[K, V]) SetMaxBytes(maxBytes int, sizeOf func(key K, v V) int) {
+	c.Lock()
+	c.lru.SetMaxBytes(maxBytes, sizeOf)
+	c.Unlock()
+}
+
 func (c *ConcurrentLRU[K, V]) Add(key K, v V) {
 	c.Lock()
 	c.lru.Add(key, v)
@@ -113,3 +162,10 @@ func (c *ConcurrentLRU[K, V]) Len() int {
 	c.Unlock()
 	return n
 }
+
+func (c *ConcurrentLRU[K, V]) Bytes() int {
+	c.Lock()
+	n := c.lru.Bytes()
+	c.Unlock()
+	return n
+}
@@ -20,14 +20,17 @@
 package data_provider
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/pkg/cluster"
 	"github.com/pmkol/mosdns-x/pkg/safe_close"
 )
 
@@ -58,20 +61,105 @@ func (m *DataManager) GetDataProvider(name string) *DataProvider {
 	return m.ps[name]
 }
 
+// StartLazyLoad loads lazy providers in background.
+// It should be called after all listeners are added and servers are started.
+func (m *DataManager) StartLazyLoad() {
+	m.pm.RLock()
+	defer m.pm.RUnlock()
+	for _, p := range m.ps {
+		if p.lazy {
+			p.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+				defer done()
+				p.lazyLoad(closeSignal)
+			})
+		}
+	}
+}
+
+// WaitReady waits until all providers are loaded or ctx is done.
+func (m *DataManager) WaitReady(ctx context.Context) error {
+	m.pm.RLock()
+	ps := make([]*DataProvider, 0, len(m.ps))
+	for _, p := range m.ps {
+		ps = append(ps, p)
+	}
+	m.pm.RUnlock()
+	for _, p := range ps {
+		select {
+		case <-p.readyC:
+		case <-ctx.Done():
+			return fmt.Errorf("%s is not loaded, %w", p.file, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Close closes all providers.
+func (m *DataManager) Close() {
+	m.pm.RLock()
+	defer m.pm.RUnlock()
+	for _, p := range m.ps {
+		p.Close()
+	}
+}
+
+// Ready returns true if all providers are loaded.
+func (m *DataManager) Ready() bool {
+	m.pm.RLock()
+	defer m.pm.RUnlock()
+	for _, p := range m.ps {
+		if !p.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
 type DataProviderConfig struct {
 	Tag        string `yaml:"tag"`
 	File       string `yaml:"file"`
 	AutoReload bool   `yaml:"auto_reload"`
+
+	// Lazy makes the provider load its data in background after servers
+	// are started, so a large file won't block the startup.
+	Lazy bool `yaml:"lazy"`
+
+	// LazyMatch is the result of domain and ip matchers that use this
+	// provider before the lazy data is loaded. Default false means
+	// nothing is matched (fail open). Matchers that carry values
+	// (e.g. hosts, redirect) never match before the data is loaded.
+	LazyMatch bool `yaml:"lazy_match"`
+
+	// Cluster shares the reloaded data with other instances in the
+	// cluster, see coremain.ClusterConfig. The data received from other
+	// instances replaces the data in memory, but not the file.
+	Cluster bool `yaml:"cluster"`
 }
 
+// Failed lazy loads are retried after lazyLoadMinRetry, which doubles
+// until lazyLoadMaxRetry.
+var (
+	lazyLoadMinRetry = time.Second * 5
+	lazyLoadMaxRetry = time.Minute * 5
+)
+
 type DataProvider struct {
 	logger     *zap.Logger
 	file       string
 	autoReload bool
+	lazy       bool
+	lazyMatch  bool
+	ready      atomic.Bool   // set with lm held
+	readyC     chan struct{} // closed once ready
 
 	lm        sync.Mutex
 	listeners map[DataListener]struct{}
 
+	cluster      *cluster.Cluster // nil if sharing is disabled
+	clusterTopic string
+	received     atomic.Pointer[[]byte] // the latest data from the cluster
+	receivedC    chan struct{}
+
 	sc *safe_close.SafeClose
 }
 
@@ -80,6 +168,9 @@ func NewDataProvider(lg *zap.Logger, cfg DataProviderConfig) (*DataProvider, err
 	dp.logger = lg
 	dp.file = cfg.File
 	dp.autoReload = cfg.AutoReload
+	dp.lazy = cfg.Lazy
+	dp.lazyMatch = cfg.LazyMatch
+	dp.readyC = make(chan struct{})
 
 	dp.sc = safe_close.NewSafeClose()
 
@@ -90,9 +181,16 @@ func NewDataProvider(lg *zap.Logger, cfg DataProviderConfig) (*DataProvider, err
 }
 
 func (ds *DataProvider) init() error {
-	_, err := ds.loadFromDisk()
-	if err != nil {
-		return err
+	if ds.lazy {
+		if _, err := os.Stat(ds.file); err != nil {
+			return err
+		}
+	} else {
+		if _, err := ds.loadFromDisk(); err != nil {
+			return err
+		}
+		ds.ready.Store(true)
+		close(ds.readyC)
 	}
 
 	if ds.autoReload {
@@ -108,24 +206,75 @@ func (ds *DataProvider) Close() {
 	ds.sc.CloseWait()
 }
 
-// LoadAndAddListener loads the DataListener, returns any error that occurs, and
-// add this DataListener to this DataProvider.
-func (ds *DataProvider) LoadAndAddListener(l DataListener) error {
-	b, err := ds.GetData()
-	if err != nil {
-		return err
-	}
+// Lazy returns true if the provider is lazy.
+func (ds *DataProvider) Lazy() bool {
+	return ds.lazy
+}
 
-	if err := l.Update(b); err != nil {
-		return err
+// LazyMatch returns the configured result of matchers before the
+// lazy data is loaded.
+func (ds *DataProvider) LazyMatch() bool {
+	return ds.lazyMatch
+}
+
+// Ready returns true if the data was loaded.
+func (ds *DataProvider) Ready() bool {
+	return ds.ready.Load()
+}
+
+// lazyLoad loads the lazy data. If it fails, it is retried with a backoff
+// until closeSignal.
+func (ds *DataProvider) lazyLoad(closeSignal <-chan struct{}) {
+	retry := lazyLoadMinRetry
+	for {
+		start := time.Now()
+		b, err := ds.loadFromDisk()
+		if err == nil {
+			ds.lm.Lock()
+			ds.ready.Store(true)
+			close(ds.readyC)
+			ls := ds.listenersLocked()
+			ds.lm.Unlock()
+			ds.updateListeners(ls, b)
+			ds.logger.Info("lazy data loaded", zap.String("file", ds.file), zap.Duration("elapsed", time.Since(start)))
+			return
+		}
+		ds.logger.Error("failed to load lazy data", zap.String("file", ds.file), zap.Duration("retry_in", retry), zap.Error(err))
+		select {
+		case <-time.After(retry):
+			retry = min(retry*2, lazyLoadMaxRetry)
+		case <-closeSignal:
+			return
+		}
 	}
+}
 
+// LoadAndAddListener loads the DataListener, returns any error that occurs, and
+// add this DataListener to this DataProvider.
+// If the provider is lazy and is not ready, the DataListener will be
+// loaded later.
+func (ds *DataProvider) LoadAndAddListener(l DataListener) error {
+	// The listener is added and ready is checked with lm held, so it is
+	// either loaded here or by lazyLoad.
 	ds.lm.Lock()
 	if ds.listeners == nil {
 		ds.listeners = make(map[DataListener]struct{})
 	}
 	ds.listeners[l] = struct{}{}
+	ready := !ds.lazy || ds.ready.Load()
 	ds.lm.Unlock()
+	if !ready {
+		return nil
+	}
+
+	b, err := ds.GetData()
+	if err == nil {
+		err = l.Update(b)
+	}
+	if err != nil {
+		ds.DeleteListener(l)
+		return err
+	}
 	return nil
 }
 
@@ -135,19 +284,63 @@ func (ds *DataProvider) DeleteListener(l DataListener) {
 	delete(ds.listeners, l)
 }
 
+// GetData returns the latest data received from the cluster, or the data
+// of the file if there is none.
 func (ds *DataProvider) GetData() ([]byte, error) {
+	if b := ds.received.Load(); b != nil {
+		return *b, nil
+	}
 	return os.ReadFile(ds.file)
 }
 
+// receive stores the data from the cluster. It is pushed to the
+// listeners by the goroutine started by ShareWith.
+func (ds *DataProvider) receive(data []byte) {
+	ds.received.Store(&data)
+	select {
+	case ds.receivedC <- struct{}{}:
+	default:
+	}
+}
+
+// ShareWith shares the data of the provider with other instances in c via
+// topic. The data is published when the file is reloaded.
+func (ds *DataProvider) ShareWith(c *cluster.Cluster, topic string) {
+	ds.cluster = c
+	ds.clusterTopic = topic
+	ds.receivedC = make(chan struct{}, 1)
+	c.Subscribe(topic, ds.receive)
+	ds.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		for {
+			select {
+			case <-ds.receivedC:
+				ds.logger.Info("data received from the cluster", zap.String("file", ds.file))
+				ds.pushData(*ds.received.Load())
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+}
+
 // pushData notify the notifier and trigger all listeners.
 func (ds *DataProvider) pushData(newData []byte) {
 	ds.lm.Lock()
+	ls := ds.listenersLocked()
+	ds.lm.Unlock()
+	ds.updateListeners(ls, newData)
+}
+
+func (ds *DataProvider) listenersLocked() []DataListener {
 	ls := make([]DataListener, 0, len(ds.listeners))
 	for listener := range ds.listeners {
 		ls = append(ls, listener)
 	}
-	ds.lm.Unlock()
+	return ls
+}
 
+func (ds *DataProvider) updateListeners(ls []DataListener, newData []byte) {
 	for _, l := range ls {
 		if err := l.Update(newData); err != nil {
 			ds.logger.Error(
@@ -221,7 +414,9 @@ func (ds *DataProvider) startFsWatcher() error {
 								"file reloaded",
 								zap.String("file", ds.file),
 							)
+							ds.received.Store(nil)
 							ds.pushData(v)
+							ds.cluster.Publish(ds.clusterTopic, v)
 						}
 
 						delayReloadTimer = nil
@@ -0,0 +1,187 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/cluster"
+)
+
+type testListener struct {
+	updates atomic.Int32
+	data    atomic.Value
+}
+
+func (l *testListener) Update(b []byte) error {
+	l.data.Store(string(b))
+	l.updates.Add(1)
+	return nil
+}
+
+func newLazyProvider(t *testing.T, data string) (*DataManager, *DataProvider, string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewDataProvider(zap.NewNop(), DataProviderConfig{File: file, Lazy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewDataManager()
+	m.AddDataProvider("data", p)
+	t.Cleanup(m.Close)
+	return m, p, file
+}
+
+func waitReady(t *testing.T, p *DataProvider) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("provider is not ready")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDataProvider_lazyListeners(t *testing.T) {
+	// Listeners added before, during and after the lazy load are all
+	// loaded exactly once.
+	for i := 0; i < 50; i++ {
+		m, p, _ := newLazyProvider(t, "data")
+		var ls []*testListener
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		add := func() {
+			defer wg.Done()
+			l := new(testListener)
+			if err := p.LoadAndAddListener(l); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			ls = append(ls, l)
+			mu.Unlock()
+		}
+		wg.Add(1)
+		add()
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go add()
+		}
+		m.StartLazyLoad()
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go add()
+		}
+		wg.Wait()
+		waitReady(t, p)
+		wg.Add(1)
+		add()
+
+		for j, l := range ls {
+			if n := l.updates.Load(); n != 1 {
+				t.Fatalf("round %d, listener #%d, want 1 update, got %d", i, j, n)
+			}
+		}
+	}
+}
+
+func TestDataProvider_lazyRetry(t *testing.T) {
+	defer func(minRetry, maxRetry time.Duration) {
+		lazyLoadMinRetry, lazyLoadMaxRetry = minRetry, maxRetry
+	}(lazyLoadMinRetry, lazyLoadMaxRetry)
+	lazyLoadMinRetry, lazyLoadMaxRetry = 10*time.Millisecond, 20*time.Millisecond
+
+	m, p, file := newLazyProvider(t, "old")
+	l := new(testListener)
+	if err := p.LoadAndAddListener(l); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is gone when the lazy load starts, and comes back later.
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	m.StartLazyLoad()
+	time.Sleep(50 * time.Millisecond)
+	if p.Ready() {
+		t.Fatal("provider should not be ready")
+	}
+	if err := os.WriteFile(file, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitReady(t, p)
+	if got := l.data.Load(); got != "new" {
+		t.Fatalf("want data new, got %v", got)
+	}
+}
+
+func TestDataProvider_ShareWith(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(file, []byte("local"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewDataProvider(zap.NewNop(), DataProviderConfig{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	c, err := cluster.New(cluster.Opts{Client: client, Key: []byte("key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	p.ShareWith(c, "data_provider/data")
+
+	l := new(testListener)
+	if err := p.LoadAndAddListener(l); err != nil {
+		t.Fatal(err)
+	}
+	p.receive([]byte("shared"))
+	deadline := time.Now().Add(5 * time.Second)
+	for l.data.Load() != "shared" {
+		if time.Now().After(deadline) {
+			t.Fatalf("want data shared, got %v", l.data.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Listeners added later get the received data, not the file.
+	l2 := new(testListener)
+	if err := p.LoadAndAddListener(l2); err != nil {
+		t.Fatal(err)
+	}
+	if got := l2.data.Load(); got != "shared" {
+		t.Fatalf("want data shared, got %v", got)
+	}
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Compression policies of responses.
+const (
+	// CompressAlways compresses all responses. It is the default.
+	CompressAlways = "always"
+	// CompressAuto only compresses responses that do not fit in the
+	// transport without compression, which saves cpu time at the cost
+	// of bytes.
+	CompressAuto = "auto"
+)
+
+// SetCompress sets m.Compress according to the compression policy.
+// limit is the max msg size that the transport can send. An unknown
+// policy is treated as CompressAlways.
+func SetCompress(m *dns.Msg, policy string, limit int) {
+	if policy != CompressAuto {
+		m.Compress = true
+		return
+	}
+	m.Compress = false
+	m.Compress = m.Len() > limit
+}
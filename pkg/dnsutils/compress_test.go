@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSetCompress(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("a-long-name-that-compresses-well.example.com.", dns.TypeA)
+	for i := 0; i < 20; i++ {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IPv4(1, 1, 1, byte(i)),
+		})
+	}
+	uncompressed := m.Len()
+
+	SetCompress(m, CompressAlways, dns.MaxMsgSize)
+	if !m.Compress {
+		t.Fatal("always should compress")
+	}
+	SetCompress(m, CompressAuto, dns.MaxMsgSize)
+	if m.Compress {
+		t.Fatal("auto should not compress a small msg")
+	}
+	SetCompress(m, CompressAuto, uncompressed-1)
+	if !m.Compress {
+		t.Fatal("auto should compress a msg that exceeds the limit")
+	}
+}
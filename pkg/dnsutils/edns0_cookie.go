@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ClientCookieLen = 8
+
+	// ServerCookieLen is the length of the server cookies generated by
+	// NewServerCookie.
+	ServerCookieLen = 16
+
+	// CookieSecretLen is the length of the secret of server cookies.
+	CookieSecretLen = 16
+)
+
+// Lifetime of server cookies, in seconds. See RFC 9018 section 4.3.
+const (
+	serverCookieMaxAge    = 3600
+	serverCookieMaxFuture = 300
+)
+
+// GetMsgCookie returns the COOKIE option of m, or nil.
+func GetMsgCookie(m *dns.Msg) *dns.EDNS0_COOKIE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	c, _ := GetEDNS0Option(opt, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	return c
+}
+
+// ParseCookie splits the COOKIE option c into the client and the server
+// cookie. serverCookie is nil if c only has a client cookie.
+// ok is false if c is malformed, see RFC 7873 section 5.2.2.
+func ParseCookie(c *dns.EDNS0_COOKIE) (clientCookie, serverCookie []byte, ok bool) {
+	b, err := hex.DecodeString(c.Cookie)
+	if err != nil {
+		return nil, nil, false
+	}
+	switch {
+	case len(b) == ClientCookieLen:
+		return b, nil, true
+	case len(b) >= ClientCookieLen+8 && len(b) <= ClientCookieLen+32:
+		return b[:ClientCookieLen], b[ClientCookieLen:], true
+	default:
+		return nil, nil, false
+	}
+}
+
+// SetCookie sets the COOKIE option of m. m will be upgraded to an EDNS0
+// msg if it is not.
+func SetCookie(m *dns.Msg, clientCookie, serverCookie []byte) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = UpgradeEDNS0(m)
+	}
+	RemoveEDNS0Option(opt, dns.EDNS0COOKIE)
+	b := make([]byte, 0, len(clientCookie)+len(serverCookie))
+	b = append(append(b, clientCookie...), serverCookie...)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(b)})
+}
+
+// NewServerCookie returns an interoperable server cookie of RFC 9018
+// for the client cookie and ip at timestamp now, which is in seconds
+// since the unix epoch.
+func NewServerCookie(secret *[CookieSecretLen]byte, clientCookie []byte, clientIP netip.Addr, now uint32) []byte {
+	b := make([]byte, ServerCookieLen)
+	b[0] = 1 // version, followed by 3 reserved bytes.
+	binary.BigEndian.PutUint32(b[4:], now)
+	binary.LittleEndian.PutUint64(b[8:], serverCookieHash(secret, clientCookie, b[:8], clientIP))
+	return b
+}
+
+// ValidServerCookie reports whether serverCookie was generated by
+// NewServerCookie with the same secret, client cookie and ip and has
+// not expired at timestamp now.
+func ValidServerCookie(secret *[CookieSecretLen]byte, clientCookie, serverCookie []byte, clientIP netip.Addr, now uint32) bool {
+	if len(serverCookie) != ServerCookieLen || serverCookie[0] != 1 {
+		return false
+	}
+	// Serial number arithmetic, so it works after the year 2106.
+	age := int32(now - binary.BigEndian.Uint32(serverCookie[4:]))
+	if age > serverCookieMaxAge || age < -serverCookieMaxFuture {
+		return false
+	}
+	return binary.LittleEndian.Uint64(serverCookie[8:]) == serverCookieHash(secret, clientCookie, serverCookie[:8], clientIP)
+}
+
+// serverCookieHash returns SipHash-2-4(Client Cookie | Version | Reserved |
+// Timestamp | Client-IP, Server Secret).
+func serverCookieHash(secret *[CookieSecretLen]byte, clientCookie, header []byte, clientIP netip.Addr) uint64 {
+	b := make([]byte, 0, ClientCookieLen+8+16)
+	b = append(b, clientCookie...)
+	b = append(b, header...)
+	b = append(b, clientIP.Unmap().AsSlice()...)
+	return sipHash24(binary.LittleEndian.Uint64(secret[:8]), binary.LittleEndian.Uint64(secret[8:]), b)
+}
+
+func sipHash24(k0, k1 uint64, p []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	last := uint64(len(p)) << 56
+	for ; len(p) >= 8; p = p[8:] {
+		m := binary.LittleEndian.Uint64(p)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	for i := range p {
+		last |= uint64(p[i]) << (8 * i)
+	}
+	v3 ^= last
+	round()
+	round()
+	v0 ^= last
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
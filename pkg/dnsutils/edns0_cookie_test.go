@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_sipHash24(t *testing.T) {
+	// Test vector from the appendix of the SipHash paper.
+	p := make([]byte, 15)
+	for i := range p {
+		p[i] = byte(i)
+	}
+	if got := sipHash24(0x0706050403020100, 0x0f0e0d0c0b0a0908, p); got != 0xa129ca6149be45e5 {
+		t.Fatalf("sipHash24() = %x, want a129ca6149be45e5", got)
+	}
+}
+
+func TestNewServerCookie(t *testing.T) {
+	mustDecode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// Test vectors from RFC 9018 appendix A. Cookies without a want
+	// value are only validated.
+	tests := []struct {
+		name         string
+		secret       string
+		clientCookie string
+		clientIP     string
+		now          uint32
+		want         string
+	}{
+		{"ipv4", "e5e973e5a6b2a43f48e7dc849e37bfcf", "2464c4abcf10c957", "198.51.100.100", 1559731985, "010000005cf79f111f8130c3eee29480"},
+		{"ipv4 renewed", "e5e973e5a6b2a43f48e7dc849e37bfcf", "2464c4abcf10c957", "198.51.100.100", 1559734385, "010000005cf7a871d4a564a1442aca77"},
+		{"ipv6", "dd3bdf9344b678b185a6f5cb60fca715", "22681ab97d52c298", "2001:db8:220:1:59de:d0f4:8769:82b8", 1559741961, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := (*[CookieSecretLen]byte)(mustDecode(tt.secret))
+			clientCookie := mustDecode(tt.clientCookie)
+			clientIP := netip.MustParseAddr(tt.clientIP)
+			got := NewServerCookie(secret, clientCookie, clientIP, tt.now)
+			if len(tt.want) > 0 && !bytes.Equal(got, mustDecode(tt.want)) {
+				t.Fatalf("NewServerCookie() = %x, want %s", got, tt.want)
+			}
+
+			if !ValidServerCookie(secret, clientCookie, got, clientIP, tt.now+serverCookieMaxAge) {
+				t.Error("cookie should be valid")
+			}
+			if ValidServerCookie(secret, clientCookie, got, clientIP, tt.now+serverCookieMaxAge+1) {
+				t.Error("expired cookie should be invalid")
+			}
+			if ValidServerCookie(secret, clientCookie, got, clientIP, tt.now-serverCookieMaxFuture-1) {
+				t.Error("cookie from the future should be invalid")
+			}
+			if ValidServerCookie(secret, clientCookie, got, netip.MustParseAddr("192.0.2.1"), tt.now) {
+				t.Error("cookie of another client ip should be invalid")
+			}
+		})
+	}
+}
+
+func TestParseCookie(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	clientCookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	serverCookie := bytes.Repeat([]byte{9}, ServerCookieLen)
+	SetCookie(m, clientCookie, serverCookie)
+
+	SetCookie(m, clientCookie, serverCookie) // replaces the old one
+	if len(m.Extra) != 1 || len(m.IsEdns0().Option) != 1 {
+		t.Fatalf("want exactly one cookie option, got %v", m.Extra)
+	}
+
+	c := GetMsgCookie(m)
+	if c == nil {
+		t.Fatal("missing cookie")
+	}
+	gotClient, gotServer, ok := ParseCookie(c)
+	if !ok || !bytes.Equal(gotClient, clientCookie) || !bytes.Equal(gotServer, serverCookie) {
+		t.Fatalf("ParseCookie() = %x, %x, %v", gotClient, gotServer, ok)
+	}
+
+	for _, s := range []string{"01020304", "0102030405060708090a", "zz"} {
+		if _, _, ok := ParseCookie(&dns.EDNS0_COOKIE{Cookie: s}); ok {
+			t.Errorf("cookie %s should be malformed", s)
+		}
+	}
+}
@@ -21,6 +21,16 @@ package dnsutils
 
 import "github.com/miekg/dns"
 
+// ResponsePaddingBlockLen is the block length of responses recommended
+// by RFC 8467.
+const ResponsePaddingBlockLen = 468
+
+// HasPadding reports whether m has an EDNS0 Padding option.
+func HasPadding(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	return opt != nil && GetEDNS0Option(opt, dns.EDNS0PADDING) != nil
+}
+
 // PadToMinimum pads m to the minimum length.
 // If the length of m is larger than minLen, PadToMinimum won't do anything.
 // upgraded indicates the m was upgraded to an EDNS0 msg.
@@ -58,3 +68,23 @@ func PadToMinimum(m *dns.Msg, minLen int) (upgraded, newPadding bool) {
 	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, paddingLen)})
 	return true, true
 }
+
+// PadToBlock pads m to a multiple of blockLen, which is the Block-Length
+// Padding strategy of RFC 8467. An existing Padding option of m is
+// replaced. m will be upgraded to an EDNS0 msg if it is not. m is not
+// padded if the padded length would exceed dns.MaxMsgSize.
+// m.Compress should be set before PadToBlock is called.
+func PadToBlock(m *dns.Msg, blockLen int) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = UpgradeEDNS0(m)
+	}
+	RemoveEDNS0Option(opt, dns.EDNS0PADDING)
+
+	l := m.Len() + 4 // a Padding option has a 4 bytes header.
+	paddingLen := (blockLen - l%blockLen) % blockLen
+	if l+paddingLen > dns.MaxMsgSize {
+		return
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, paddingLen)})
+}
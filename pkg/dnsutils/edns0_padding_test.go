@@ -68,3 +68,37 @@ func TestPadToMinimum(t *testing.T) {
 		})
 	}
 }
+
+func TestPadToBlock(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	r.Compress = true
+
+	rPadded := r.Copy()
+	UpgradeEDNS0(rPadded).Option = append(rPadded.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 1000)})
+
+	rLarge := r.Copy()
+	for i := 0; i < 50; i++ {
+		rLarge.Answer = append(rLarge.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{strings.Repeat("a", 10)},
+		})
+	}
+
+	for _, m := range []*dns.Msg{r, rPadded, rLarge} {
+		PadToBlock(m, 468)
+		if l := m.Len(); l%468 != 0 {
+			t.Errorf("padded length %d is not a multiple of 468", l)
+		}
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != m.Len() {
+			t.Errorf("packed length %d != Len() %d", len(b), m.Len())
+		}
+		if n := len(m.IsEdns0().Option); n != 1 {
+			t.Errorf("want 1 edns0 option, got %d", n)
+		}
+	}
+}
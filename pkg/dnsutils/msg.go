@@ -8,6 +8,10 @@ import (
 )
 
 // GetMsgHash generates an 8-byte hash key for the message.
+// Only the question and the ECS option are hashed. Other EDNS0 options,
+// e.g. padding, do not affect the key. The ECS address is masked by its
+// source prefix length, so queries of the same subnet share the key even
+// if clients do not zero the bits beyond the prefix.
 // Pre-condition: Detailed validations (e.g., Question count, normalization)
 // are skipped here as they are strictly enforced by upstream pipeline plugins.
 func GetMsgHash(m *dns.Msg, salt uint16) uint64 {
@@ -21,19 +25,37 @@ func GetMsgHash(m *dns.Msg, salt uint16) uint64 {
 	b = append(b, byte(q.Qclass>>8), byte(q.Qclass))
 	b = append(b, byte(salt>>8), byte(salt))
 
-	if len(m.Extra) > 0 {
-		if opt, ok := m.Extra[0].(*dns.OPT); ok && len(opt.Option) > 0 {
-			if ecs, ok := opt.Option[0].(*dns.EDNS0_SUBNET); ok {
-				b = append(b, byte(ecs.Family>>8), byte(ecs.Family))
-				b = append(b, ecs.SourceNetmask)
-				b = append(b, ecs.Address...)
-			}
+	// The ECS option is not necessarily the first one. e.g. Padded
+	// queries may have the padding option before it.
+	if opt := m.IsEdns0(); opt != nil {
+		if ecs := GetECS(opt); ecs != nil {
+			b = append(b, byte(ecs.Family>>8), byte(ecs.Family))
+			b = append(b, ecs.SourceNetmask)
+			b = appendECSPrefix(b, ecs)
 		}
 	}
 
 	return xxhash.Sum64(b)
 }
 
+// appendECSPrefix appends the bytes of the address of ecs that are within
+// its source prefix length, with the bits beyond it zeroed.
+func appendECSPrefix(b []byte, ecs *dns.EDNS0_SUBNET) []byte {
+	addr := ecs.Address
+	if ecs.Family == 1 {
+		if a4 := addr.To4(); a4 != nil {
+			addr = a4
+		}
+	}
+	bits := min(int(ecs.SourceNetmask), len(addr)*8)
+	n := bits / 8
+	b = append(b, addr[:n]...)
+	if rem := bits % 8; rem != 0 {
+		b = append(b, addr[n]&^(0xff>>rem))
+	}
+	return b
+}
+
 // --- TTL Management ---
 
 // GetMinimalTTL returns the smallest TTL in the message, skipping OPT records.
@@ -57,6 +79,19 @@ func GetMinimalTTL(m *dns.Msg) uint32 {
 	return minTTL
 }
 
+// GetNegativeTTL returns the ttl of the negative (NXDOMAIN or NODATA)
+// response m as in RFC 2308 section 5, which is the smaller one of the
+// MINIMUM field of the SOA record in the authority section and the
+// minimal ttl of m. ok is false if m has no SOA record.
+func GetNegativeTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	for _, rr := range m.Ns {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			return min(soa.Minttl, GetMinimalTTL(m)), true
+		}
+	}
+	return 0, false
+}
+
 // applyTTL is a consolidated helper for Set/Max/Min TTL operations to reduce code duplication.
 func applyTTL(m *dns.Msg, ttl uint32, mode int) {
 	for _, section := range [...][]dns.RR{m.Answer, m.Ns, m.Extra} {
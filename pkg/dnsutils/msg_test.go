@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestGetNegativeTTL(t *testing.T) {
+	soa := func(ttl, minttl uint32) dns.RR {
+		return &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+			Ns:     "ns.example.com.",
+			Mbox:   "admin.example.com.",
+			Minttl: minttl,
+		}
+	}
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "a.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 10},
+		Target: "b.example.com.",
+	}
+
+	tests := []struct {
+		name   string
+		m      *dns.Msg
+		want   uint32
+		wantOk bool
+	}{
+		{"no soa", &dns.Msg{}, 0, false},
+		{"minimum", &dns.Msg{Ns: []dns.RR{soa(3600, 300)}}, 300, true},
+		{"soa ttl", &dns.Msg{Ns: []dns.RR{soa(60, 300)}}, 60, true},
+		{"cname", &dns.Msg{Answer: []dns.RR{cname}, Ns: []dns.RR{soa(3600, 300)}}, 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := GetNegativeTTL(tt.m)
+			if got != tt.want || ok != tt.wantOk {
+				t.Fatalf("GetNegativeTTL() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestGetMsgHash_ECS(t *testing.T) {
+	q := func(addr string, mask uint8) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		if len(addr) == 0 {
+			return m
+		}
+		ip := net.ParseIP(addr)
+		family := uint16(1)
+		if ip.To4() == nil {
+			family = 2
+		}
+		m.SetEdns0(1232, false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        family,
+			SourceNetmask: mask,
+			Address:       ip,
+		})
+		return m
+	}
+	key := func(m *dns.Msg) uint64 { return GetMsgHash(m, 0) }
+
+	if key(q("1.2.3.4", 24)) != key(q("1.2.3.0", 24)) {
+		t.Fatal("addresses of the same /24 have different keys")
+	}
+	if key(q("1.2.3.4", 20)) != key(q("1.2.15.255", 20)) {
+		t.Fatal("addresses of the same /20 have different keys")
+	}
+	if key(q("2001:db8::1", 56)) != key(q("2001:db8:0:ff::", 56)) {
+		t.Fatal("addresses of the same /56 have different keys")
+	}
+	for _, pair := range [][2]*dns.Msg{
+		{q("1.2.3.4", 24), q("1.2.4.4", 24)},
+		{q("1.2.3.0", 24), q("1.2.3.0", 23)},
+		{q("1.2.3.0", 24), q("", 0)},
+		{q("0.0.0.0", 0), q("::", 0)},
+	} {
+		if key(pair[0]) == key(pair[1]) {
+			t.Fatalf("%s and %s have the same key", pair[0].IsEdns0(), pair[1].IsEdns0())
+		}
+	}
+}
+
+func TestGetMsgHash_padding(t *testing.T) {
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IP{1, 2, 3, 0}}
+	q := func(padding bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.SetEdns0(1232, false)
+		opt := m.IsEdns0()
+		if padding {
+			// Before the ECS option.
+			opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 64)})
+		}
+		opt.Option = append(opt.Option, ecs)
+		return m
+	}
+
+	if GetMsgHash(q(true), 0) != GetMsgHash(q(false), 0) {
+		t.Fatal("padded and non-padded queries have different keys")
+	}
+	noECS := new(dns.Msg)
+	noECS.SetQuestion("example.com.", dns.TypeA)
+	if GetMsgHash(q(true), 0) == GetMsgHash(noECS, 0) {
+		t.Fatal("the ECS option after the padding is ignored")
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// Helpers of packed msgs. They patch the header and the ttls of a packed
+// msg in place, so it can be sent without being unpacked and packed again.
+
+const headerLen = 12
+
+var errInvalidPackedMsg = errors.New("invalid packed msg")
+
+// TTLOffsets returns the offsets of the ttl fields of the records in the
+// packed msg m, skipping OPT records, like GetMinimalTTL. The offsets can
+// be stored with m to patch its ttls later.
+func TTLOffsets(m []byte) ([]uint16, error) {
+	if len(m) < headerLen || len(m) > dns.MaxMsgSize {
+		return nil, errInvalidPackedMsg
+	}
+	qd := int(binary.BigEndian.Uint16(m[4:]))
+	rrs := int(binary.BigEndian.Uint16(m[6:])) + int(binary.BigEndian.Uint16(m[8:])) + int(binary.BigEndian.Uint16(m[10:]))
+
+	off := headerLen
+	var err error
+	for i := 0; i < qd; i++ {
+		if off, err = skipName(m, off); err != nil {
+			return nil, err
+		}
+		off += 4 // type and class
+	}
+
+	offsets := make([]uint16, 0, rrs)
+	for i := 0; i < rrs; i++ {
+		if off, err = skipName(m, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(m) {
+			return nil, errInvalidPackedMsg
+		}
+		if binary.BigEndian.Uint16(m[off:]) != dns.TypeOPT {
+			offsets = append(offsets, uint16(off+4))
+		}
+		off += 10 + int(binary.BigEndian.Uint16(m[off+8:]))
+	}
+	if off != len(m) {
+		return nil, errInvalidPackedMsg
+	}
+	return offsets, nil
+}
+
+// skipName returns the offset after the name at off of m.
+func skipName(m []byte, off int) (int, error) {
+	for {
+		if off >= len(m) {
+			return 0, errInvalidPackedMsg
+		}
+		l := int(m[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0: // compression pointer, which ends the name
+			return off + 2, nil
+		case l&0xc0 != 0:
+			return 0, errInvalidPackedMsg
+		}
+		off += 1 + l
+	}
+}
+
+// ValidTTLOffsets reports whether offsets can be the ttl offsets of the
+// packed msg m. It is a sanity check of stored offsets, which is cheaper
+// than TTLOffsets.
+func ValidTTLOffsets(m []byte, offsets []uint16) bool {
+	if len(m) < headerLen {
+		return false
+	}
+	prev := headerLen
+	for _, off := range offsets {
+		if int(off) < prev || int(off)+4 > len(m) {
+			return false
+		}
+		prev = int(off) + 4
+	}
+	return true
+}
+
+// SetRawID sets the id of the packed msg m.
+func SetRawID(m []byte, id uint16) {
+	binary.BigEndian.PutUint16(m, id)
+}
+
+// GetRawRcode returns the rcode in the header of the packed msg m. The
+// extended rcode bits in the OPT record are ignored.
+func GetRawRcode(m []byte) int {
+	return int(m[3] & 0x0f)
+}
+
+// SetRawRecursionAvailable sets the RA bit of the packed msg m.
+func SetRawRecursionAvailable(m []byte) {
+	m[3] |= 0x80
+}
+
+// SetRawTTL is SetTTL of the packed msg m and its ttl offsets.
+func SetRawTTL(m []byte, offsets []uint16, ttl uint32) {
+	for _, off := range offsets {
+		binary.BigEndian.PutUint32(m[off:], ttl)
+	}
+}
+
+// SubtractRawTTL is SubtractTTL of the packed msg m and its ttl offsets.
+func SubtractRawTTL(m []byte, offsets []uint16, delta uint32) (overflowed bool) {
+	for _, off := range offsets {
+		ttl := binary.BigEndian.Uint32(m[off:])
+		if ttl > delta {
+			ttl -= delta
+		} else {
+			ttl = 1
+			overflowed = true
+		}
+		binary.BigEndian.PutUint32(m[off:], ttl)
+	}
+	return
+}
+
+// GetMinimalRawTTL is GetMinimalTTL of the packed msg m and its ttl offsets.
+func GetMinimalRawTTL(m []byte, offsets []uint16) uint32 {
+	if len(offsets) == 0 {
+		return 0
+	}
+	minTTL := ^uint32(0)
+	for _, off := range offsets {
+		if ttl := binary.BigEndian.Uint32(m[off:]); ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+	return minTTL
+}
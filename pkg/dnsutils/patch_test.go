@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// patchTestMsg returns a packed response with records in all sections
+// and an OPT record.
+func patchTestMsg(t *testing.T, compress bool) []byte {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(q)
+	m.Compress = compress
+	hdr := func(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+	m.Answer = []dns.RR{
+		&dns.CNAME{Hdr: hdr("example.com.", dns.TypeCNAME, 300), Target: "www.example.com."},
+		&dns.A{Hdr: hdr("www.example.com.", dns.TypeA, 100), A: net.IPv4(1, 2, 3, 4)},
+	}
+	m.Ns = []dns.RR{&dns.NS{Hdr: hdr("example.com.", dns.TypeNS, 3600), Ns: "ns.example.com."}}
+	m.Extra = []dns.RR{&dns.A{Hdr: hdr("ns.example.com.", dns.TypeA, 200), A: net.IPv4(5, 6, 7, 8)}}
+	m.SetEdns0(1232, true)
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestTTLOffsets(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		b := patchTestMsg(t, compress)
+		offsets, err := TTLOffsets(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(offsets) != 4 {
+			t.Fatalf("want 4 offsets, got %v", offsets)
+		}
+		if !ValidTTLOffsets(b, offsets) {
+			t.Fatal("offsets are invalid")
+		}
+		if got := GetMinimalRawTTL(b, offsets); got != 100 {
+			t.Fatalf("want minimal ttl 100, got %d", got)
+		}
+
+		SetRawTTL(b, offsets, 50)
+		SetRawID(b, 1234)
+		SetRawRecursionAvailable(b)
+		m := new(dns.Msg)
+		if err := m.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		if m.Id != 1234 || !m.RecursionAvailable || GetRawRcode(b) != dns.RcodeSuccess {
+			t.Fatalf("invalid header %+v", m.MsgHdr)
+		}
+		for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+			for _, rr := range section {
+				if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl != 50 {
+					t.Fatalf("ttl is not patched, %s", rr)
+				}
+			}
+		}
+		if opt := m.IsEdns0(); opt == nil || opt.UDPSize() != 1232 || !opt.Do() {
+			t.Fatalf("opt is changed, %v", opt)
+		}
+
+		if !SubtractRawTTL(b, offsets, 60) {
+			t.Fatal("overflow is not reported")
+		}
+		if got := GetMinimalRawTTL(b, offsets); got != 1 {
+			t.Fatalf("want floor ttl 1, got %d", got)
+		}
+	}
+}
+
+func TestTTLOffsets_invalid(t *testing.T) {
+	b := patchTestMsg(t, true)
+	for _, m := range [][]byte{
+		nil,
+		b[:headerLen-1],
+		b[:len(b)-1],
+		append(b[:len(b):len(b)], 0),
+	} {
+		if _, err := TTLOffsets(m); err == nil {
+			t.Fatalf("invalid msg %v is accepted", m)
+		}
+	}
+	if ValidTTLOffsets(b, []uint16{uint16(len(b) - 2)}) {
+		t.Fatal("offset out of range is valid")
+	}
+	if ValidTTLOffsets(b, []uint16{40, 30}) {
+		t.Fatal("unordered offsets are valid")
+	}
+}
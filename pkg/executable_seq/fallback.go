@@ -46,13 +46,31 @@ type FallbackConfig struct {
 
 	// AlwaysStandby: secondary should always stand by in fast fallback.
 	AlwaysStandby bool `yaml:"always_standby"`
+
+	// PrimaryTimeout in milliseconds. If the primary does not finish in
+	// time, it is considered failed and the secondary is used.
+	// Zero means no timeout.
+	PrimaryTimeout int `yaml:"primary_timeout"`
+
+	// BadResponse is a condition expression, same as the "if" of a
+	// condition node, e.g. "poisoned_ip". If the response of the primary
+	// matches it, the primary is considered failed and the secondary
+	// is used.
+	BadResponse string `yaml:"bad_response"`
 }
 
+var (
+	errPrimaryTimeout     = errors.New("primary timed out")
+	errPrimaryBadResponse = errors.New("primary returned a bad response")
+)
+
 type FallbackNode struct {
 	primary              ExecutableChainNode
 	secondary            ExecutableChainNode
 	fastFallbackDuration time.Duration
 	alwaysStandby        bool
+	primaryTimeout       time.Duration
+	badResponse          Matcher // nil if not configured
 
 	primaryST *statusTracker // nil if normal fallback is disabled
 	logger    *zap.Logger    // not nil
@@ -136,6 +154,15 @@ func ParseFallbackNode(
 		secondary:            secondaryECS,
 		fastFallbackDuration: time.Duration(c.FastFallback) * time.Millisecond,
 		alwaysStandby:        c.AlwaysStandby,
+		primaryTimeout:       time.Duration(c.PrimaryTimeout) * time.Millisecond,
+	}
+
+	if len(c.BadResponse) > 0 {
+		m, err := newConditionMatcher(logger.Named("bad_response"), c.BadResponse, matchers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bad_response: %w", err)
+		}
+		fallbackECS.badResponse = m
 	}
 
 	if c.StatLength > 0 {
@@ -165,9 +192,13 @@ func (f *FallbackNode) exec(ctx context.Context, qCtx *query_context.Context) er
 	if f.primaryST == nil || f.primaryST.good() {
 		if f.fastFallbackDuration > 0 {
 			return f.doFastFallback(ctx, qCtx)
-		} else {
-			return f.doPrimary(ctx, qCtx)
 		}
+		err := f.isolateDoPrimary(ctx, qCtx)
+		if errors.Is(err, errPrimaryTimeout) || errors.Is(err, errPrimaryBadResponse) {
+			f.logger.Debug("primary failed, use secondary", qCtx.InfoField(), zap.Error(err))
+			return f.doSecondary(ctx, qCtx)
+		}
+		return err
 	}
 	f.logger.Debug("primary is not good", qCtx.InfoField())
 	return f.doFallback(ctx, qCtx)
@@ -176,12 +207,35 @@ func (f *FallbackNode) exec(ctx context.Context, qCtx *query_context.Context) er
 func (f *FallbackNode) isolateDoPrimary(ctx context.Context, qCtx *query_context.Context) (err error) {
 	qCtxCopy := qCtx.Copy()
 	err = f.doPrimary(ctx, qCtxCopy)
-	qCtx.SetResponse(qCtxCopy.R())
+	qCtx.SetResponseFrom(qCtxCopy)
 	return err
 }
 
+// doPrimary executes the primary. If the primary timed out or returned
+// a bad response, the response of qCtx is removed and errPrimaryTimeout
+// or errPrimaryBadResponse is returned.
 func (f *FallbackNode) doPrimary(ctx context.Context, qCtx *query_context.Context) (err error) {
-	err = ExecChainNode(ctx, qCtx, f.primary)
+	pCtx := ctx
+	if f.primaryTimeout > 0 {
+		var cancel context.CancelFunc
+		pCtx, cancel = context.WithTimeout(ctx, f.primaryTimeout)
+		defer cancel()
+	}
+
+	err = ExecChainNode(pCtx, qCtx, f.primary)
+	if ctx.Err() == nil && errors.Is(pCtx.Err(), context.DeadlineExceeded) {
+		qCtx.SetResponse(nil)
+		err = errPrimaryTimeout
+	}
+	if err == nil && qCtx.R() != nil && f.badResponse != nil {
+		bad, mErr := f.badResponse.Match(ctx, qCtx)
+		if mErr != nil {
+			f.logger.Warn("bad_response matcher failed", qCtx.InfoField(), zap.Error(mErr))
+		} else if bad {
+			qCtx.SetResponse(nil)
+			err = errPrimaryBadResponse
+		}
+	}
 	if f.primaryST != nil {
 		if err != nil || qCtx.R() == nil {
 			f.primaryST.update(1)
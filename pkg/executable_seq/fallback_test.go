@@ -211,3 +211,108 @@ func Test_statusTracker(t *testing.T) {
 		})
 	}
 }
+
+func Test_FallbackECS_primary_failure(t *testing.T) {
+	r1 := new(dns.Msg)
+	r2 := new(dns.Msg)
+
+	tests := []struct {
+		name    string
+		sleep   time.Duration
+		badResp bool
+		wantR   *dns.Msg
+		wantErr bool
+	}{
+		{"p succeed", 0, false, r1, false},
+		{"p timeout", time.Millisecond * 100, false, r2, false},
+		{"p bad response", 0, true, r2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &FallbackConfig{
+				Primary:        []interface{}{"p1"},
+				Secondary:      []interface{}{"p2"},
+				PrimaryTimeout: 50,
+				BadResponse:    "bad",
+			}
+			execs := map[string]Executable{
+				"p1": &DummyExecutable{WantR: r1, WantSleep: tt.sleep},
+				"p2": &DummyExecutable{WantR: r2},
+			}
+			matchers := map[string]Matcher{"bad": &DummyMatcher{Matched: tt.badResp}}
+			fallbackECS, err := ParseFallbackNode(conf, zap.NewNop(), execs, matchers)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			qCtx := query_context.NewContext(new(dns.Msg), nil)
+			err = ExecChainNode(context.Background(), qCtx, WrapExecutable(fallbackECS))
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("execCmd() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantR != qCtx.R() {
+				t.Fatalf("execCmd() qCtx.R() = %p, wantR %p", qCtx.R(), tt.wantR)
+			}
+		})
+	}
+}
+
+// rewriteExecutable rewrites the query and marks it, then waits until ctx
+// is done.
+type rewriteExecutable struct{}
+
+func (e *rewriteExecutable) Exec(ctx context.Context, qCtx *query_context.Context, _ ExecutableChainNode) error {
+	qCtx.Q().Question[0].Name = "rewritten.example.com."
+	qCtx.AddMark(1)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// recordExecutable records the query it gets and responds r.
+type recordExecutable struct {
+	r      *dns.Msg
+	qName  string
+	marked bool
+}
+
+func (e *recordExecutable) Exec(_ context.Context, qCtx *query_context.Context, _ ExecutableChainNode) error {
+	e.qName = qCtx.Q().Question[0].Name
+	e.marked = qCtx.HasMark(1)
+	qCtx.SetResponse(e.r)
+	return nil
+}
+
+func Test_FallbackECS_primary_isolated(t *testing.T) {
+	r := new(dns.Msg)
+	secondary := &recordExecutable{r: r}
+	conf := &FallbackConfig{
+		Primary:        []interface{}{"p1"},
+		Secondary:      []interface{}{"p2"},
+		PrimaryTimeout: 50,
+	}
+	execs := map[string]Executable{
+		"p1": &rewriteExecutable{},
+		"p2": secondary,
+	}
+	fallbackECS, err := ParseFallbackNode(conf, zap.NewNop(), execs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	if err := ExecChainNode(context.Background(), qCtx, WrapExecutable(fallbackECS)); err != nil {
+		t.Fatal(err)
+	}
+	if qCtx.R() != r {
+		t.Fatalf("qCtx.R() = %p, want the response of secondary %p", qCtx.R(), r)
+	}
+	if secondary.qName != "example.com." || secondary.marked {
+		t.Fatalf("secondary got the query of primary, name %s, marked %v", secondary.qName, secondary.marked)
+	}
+	if name := qCtx.Q().Question[0].Name; name != "example.com." {
+		t.Fatalf("primary rewrote the query of qCtx to %s", name)
+	}
+}
@@ -78,6 +78,15 @@ func ParseConditionNode(
 	return cn, nil
 }
 
+// ParseConditionMatcher parses s, a condition expression of matcher tags
+// like the one of ConditionNodeConfig.If, to a Matcher.
+func ParseConditionMatcher(logger *zap.Logger, s string, matchers map[string]Matcher) (Matcher, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return newConditionMatcher(logger, s, matchers)
+}
+
 type conditionMatcher struct {
 	lg           *zap.Logger
 	expr         *govaluate.EvaluableExpression
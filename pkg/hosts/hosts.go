@@ -22,7 +22,6 @@ package hosts
 import (
 	"errors"
 	"fmt"
-	"math/rand/v2"
 	"net/netip"
 	"strings"
 
@@ -30,6 +29,7 @@ import (
 
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
 type Hosts struct {
@@ -72,7 +72,7 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	r.RecursionAvailable = true
 	switch {
 	case typ == dns.TypeA && len(ipv4) > 0:
-		rand.Shuffle(len(ipv4), func(i, j int) {
+		utils.RandShuffle(len(ipv4), func(i, j int) {
 			ipv4[i], ipv4[j] = ipv4[j], ipv4[i]
 		})
 		for _, ip := range ipv4 {
@@ -88,7 +88,7 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 			r.Answer = append(r.Answer, rr)
 		}
 	case typ == dns.TypeAAAA && len(ipv6) > 0:
-		rand.Shuffle(len(ipv6), func(i, j int) {
+		utils.RandShuffle(len(ipv6), func(i, j int) {
 			ipv6[i], ipv6[j] = ipv6[j], ipv6[i]
 		})
 		for _, ip := range ipv6 {
@@ -0,0 +1,162 @@
+package lru
+
+import (
+	"fmt"
+)
+
+// ARC is an adaptive replacement cache (Megiddo and Modha, 2003). It keeps
+// entries that were hit once and entries that were hit more than once in
+// two LRU lists, and remembers the keys recently evicted from each list.
+// Hits on the remembered keys adapt the target size of the lists, so it
+// resists scans like a LFU and adapts to recency like a LRU.
+type ARC[K comparable, V any] struct {
+	maxSize int
+	onEvict func(key K, v V)
+	budget  budget[K, V]
+
+	p      int               // target size of t1
+	t1, t2 *LRU[K, V]        // entries hit once and hit more than once
+	b1, b2 *LRU[K, struct{}] // ghost keys recently evicted from t1 and t2
+}
+
+func NewARC[K comparable, V any](maxSize int, onEvict func(key K, v V)) *ARC[K, V] {
+	if maxSize <= 0 {
+		panic(fmt.Sprintf("ARC: invalid max size: %d", maxSize))
+	}
+	return &ARC[K, V]{
+		maxSize: maxSize,
+		onEvict: onEvict,
+		t1:      NewLRU[K, V](maxSize, nil),
+		t2:      NewLRU[K, V](maxSize, nil),
+		b1:      NewLRU[K, struct{}](maxSize, nil),
+		b2:      NewLRU[K, struct{}](maxSize, nil),
+	}
+}
+
+func (q *ARC[K, V]) SetMaxBytes(maxBytes int, sizeOf func(key K, v V) int) {
+	q.budget.set(maxBytes, sizeOf)
+}
+
+func (q *ARC[K, V]) Add(key K, v V) {
+	if old, ok := q.t1.remove(key); ok {
+		q.budget.sub(key, old)
+		q.t2.Add(key, v)
+	} else if old, ok := q.t2.remove(key); ok {
+		q.budget.sub(key, old)
+		q.t2.Add(key, v)
+	} else if _, ok := q.b1.m[key]; ok {
+		q.p = min(q.maxSize, q.p+max(q.b2.Len()/q.b1.Len(), 1))
+		q.b1.remove(key)
+		q.replace(false)
+		q.t2.Add(key, v)
+	} else if _, ok := q.b2.m[key]; ok {
+		q.p = max(0, q.p-max(q.b1.Len()/q.b2.Len(), 1))
+		q.b2.remove(key)
+		q.replace(true)
+		q.t2.Add(key, v)
+	} else {
+		l1 := q.t1.Len() + q.b1.Len()
+		l2 := q.t2.Len() + q.b2.Len()
+		if l1 >= q.maxSize {
+			if _, _, ok := q.b1.PopOldest(); ok {
+				q.replace(false)
+			} else if key, v, ok := q.t1.PopOldest(); ok {
+				q.evicted(key, v)
+			}
+		} else if l1+l2 >= q.maxSize {
+			if l1+l2-q.maxSize >= q.maxSize {
+				q.b2.PopOldest()
+			}
+			q.replace(false)
+		}
+		q.t1.Add(key, v)
+	}
+	q.budget.add(key, v)
+	for q.budget.exceeded() && q.evictOne(false) {
+	}
+	q.trimGhosts()
+}
+
+func (q *ARC[K, V]) Get(key K) (v V, ok bool) {
+	if v, ok = q.t1.remove(key); ok {
+		q.t2.Add(key, v)
+		return v, true
+	}
+	return q.t2.Get(key)
+}
+
+func (q *ARC[K, V]) Del(key K) {
+	v, ok := q.t1.remove(key)
+	if !ok {
+		v, ok = q.t2.remove(key)
+	}
+	if ok {
+		q.evicted(key, v)
+		q.trimGhosts()
+	}
+}
+
+func (q *ARC[K, V]) Clean(f func(key K, v V) bool) (removed int) {
+	wrapped := func(key K, v V) bool {
+		if f(key, v) {
+			q.evicted(key, v)
+			return true
+		}
+		return false
+	}
+	removed = q.t1.Clean(wrapped) + q.t2.Clean(wrapped)
+	q.trimGhosts()
+	return removed
+}
+
+func (q *ARC[K, V]) Len() int {
+	return q.t1.Len() + q.t2.Len()
+}
+
+func (q *ARC[K, V]) Bytes() int {
+	return q.budget.bytes
+}
+
+// replace evicts an entry if q is full.
+func (q *ARC[K, V]) replace(inB2 bool) {
+	if q.Len() >= q.maxSize {
+		q.evictOne(inB2)
+	}
+}
+
+// evictOne evicts the oldest entry of t1 if t1 is larger than its target
+// size, or the oldest entry of t2 otherwise, and remembers its key.
+// It returns false if q is empty.
+func (q *ARC[K, V]) evictOne(inB2 bool) bool {
+	if t1 := q.t1.Len(); t1 > 0 && (t1 > q.p || (inB2 && t1 == q.p) || q.t2.Len() == 0) {
+		key, v, _ := q.t1.PopOldest()
+		q.b1.Add(key, struct{}{})
+		q.evicted(key, v)
+		return true
+	}
+	if key, v, ok := q.t2.PopOldest(); ok {
+		q.b2.Add(key, struct{}{})
+		q.evicted(key, v)
+		return true
+	}
+	return false
+}
+
+// trimGhosts bounds the ghost keys by the number of entries, which only
+// matters when entries are deleted or evicted for maxBytes.
+func (q *ARC[K, V]) trimGhosts() {
+	for q.b1.Len()+q.b2.Len() > q.Len() {
+		if q.b1.Len() > q.b2.Len() {
+			q.b1.PopOldest()
+		} else {
+			q.b2.PopOldest()
+		}
+	}
+}
+
+func (q *ARC[K, V]) evicted(key K, v V) {
+	q.budget.sub(key, v)
+	if q.onEvict != nil {
+		q.onEvict(key, v)
+	}
+}
@@ -0,0 +1,90 @@
+package lru
+
+import (
+	"fmt"
+)
+
+// Cache is a cache with a fixed max size and an eviction policy.
+// It is not concurrent safe.
+type Cache[K comparable, V any] interface {
+	Add(key K, v V)
+	Get(key K) (v V, ok bool)
+	Del(key K)
+	Clean(f func(key K, v V) bool) (removed int)
+	Len() int
+
+	// SetMaxBytes bounds the total size of the entries, as measured by
+	// sizeOf, as well as their number. Entries are evicted by the policy
+	// when maxBytes is exceeded, so an entry larger than maxBytes is
+	// evicted once it is added. It must be called before any entry is added.
+	SetMaxBytes(maxBytes int, sizeOf func(key K, v V) int)
+
+	// Bytes returns the total size of the entries. It is always 0 if
+	// SetMaxBytes was not called.
+	Bytes() int
+}
+
+// Policy is the eviction policy of a Cache.
+type Policy string
+
+const (
+	PolicyLRU  Policy = "lru"
+	PolicyLFU  Policy = "lfu"
+	PolicyARC  Policy = "arc"
+	PolicySLRU Policy = "slru"
+)
+
+var (
+	_ Cache[int, int] = (*LRU[int, int])(nil)
+	_ Cache[int, int] = (*LFU[int, int])(nil)
+	_ Cache[int, int] = (*ARC[int, int])(nil)
+	_ Cache[int, int] = (*SLRU[int, int])(nil)
+)
+
+// NewCache returns a Cache of the policy. An empty policy is PolicyLRU.
+// onEvict is called when an entry is evicted or deleted.
+func NewCache[K comparable, V any](policy Policy, maxSize int, onEvict func(key K, v V)) (Cache[K, V], error) {
+	switch policy {
+	case "", PolicyLRU:
+		return NewLRU[K, V](maxSize, onEvict), nil
+	case PolicyLFU:
+		return NewLFU[K, V](maxSize, onEvict), nil
+	case PolicyARC:
+		return NewARC[K, V](maxSize, onEvict), nil
+	case PolicySLRU:
+		return NewSLRU[K, V](maxSize, onEvict), nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %s", policy)
+	}
+}
+
+// budget tracks the total size of the entries of a Cache.
+type budget[K comparable, V any] struct {
+	maxBytes int
+	sizeOf   func(key K, v V) int
+	bytes    int
+}
+
+func (b *budget[K, V]) set(maxBytes int, sizeOf func(key K, v V) int) {
+	if maxBytes <= 0 {
+		panic(fmt.Sprintf("lru: invalid max bytes: %d", maxBytes))
+	}
+	b.maxBytes = maxBytes
+	b.sizeOf = sizeOf
+}
+
+func (b *budget[K, V]) add(key K, v V) {
+	if b.sizeOf != nil {
+		b.bytes += b.sizeOf(key, v)
+	}
+}
+
+func (b *budget[K, V]) sub(key K, v V) {
+	if b.sizeOf != nil {
+		b.bytes -= b.sizeOf(key, v)
+	}
+}
+
+func (b *budget[K, V]) exceeded() bool {
+	return b.sizeOf != nil && b.bytes > b.maxBytes
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package lru
+
+import (
+	"math/rand"
+	"testing"
+)
+
+var policies = []Policy{PolicyLRU, PolicyLFU, PolicyARC, PolicySLRU}
+
+func Test_Cache_random(t *testing.T) {
+	for _, policy := range policies {
+		t.Run(string(policy), func(t *testing.T) {
+			const maxSize, maxBytes = 32, 512
+			shadow := make(map[int]int) // the entries that are not evicted
+			q, err := NewCache[int, int](policy, maxSize, func(key int, v int) {
+				if shadow[key] != v {
+					t.Fatalf("evicted key %d with v %d, want v %d", key, v, shadow[key])
+				}
+				delete(shadow, key)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.SetMaxBytes(maxBytes, func(_ int, v int) int { return v })
+
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 100000; i++ {
+				key := r.Intn(128)
+				switch op := r.Intn(100); {
+				case op < 50:
+					v := r.Intn(32) + 1
+					shadow[key] = v
+					q.Add(key, v)
+				case op < 95:
+					v, ok := q.Get(key)
+					if want, wantOK := shadow[key]; ok != wantOK || v != want {
+						t.Fatalf("get %d, want %d %v, got %d %v", key, want, wantOK, v, ok)
+					}
+				case op < 99:
+					q.Del(key)
+				default:
+					q.Clean(func(key int, _ int) bool { return key%2 == 0 })
+				}
+
+				if q.Len() > maxSize || q.Bytes() > maxBytes {
+					t.Fatalf("overflow, len %d, bytes %d", q.Len(), q.Bytes())
+				}
+				if q.Len() != len(shadow) {
+					t.Fatalf("len %d, want %d", q.Len(), len(shadow))
+				}
+				bytes := 0
+				for _, v := range shadow {
+					bytes += v
+				}
+				if q.Bytes() != bytes {
+					t.Fatalf("bytes %d, want %d", q.Bytes(), bytes)
+				}
+			}
+		})
+	}
+}
+
+func Test_Cache_scan(t *testing.T) {
+	for _, policy := range policies {
+		t.Run(string(policy), func(t *testing.T) {
+			q, err := NewCache[int, int](policy, 10, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key := 0; key < 5; key++ {
+				q.Add(key, key)
+				q.Get(key)
+			}
+			// A scan of keys that are used once.
+			for key := 100; key < 200; key++ {
+				q.Add(key, key)
+			}
+			hot := 0
+			for key := 0; key < 5; key++ {
+				if _, ok := q.Get(key); ok {
+					hot++
+				}
+			}
+			if policy == PolicyLRU {
+				if hot != 0 {
+					t.Fatalf("lru kept %d hot keys after the scan", hot)
+				}
+			} else if hot != 5 {
+				t.Fatalf("want all 5 hot keys kept, got %d", hot)
+			}
+		})
+	}
+}
+
+func Test_NewCache(t *testing.T) {
+	if _, err := NewCache[int, int]("", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCache[int, int]("fifo", 1, nil); err == nil {
+		t.Fatal("unknown policy should fail")
+	}
+}
@@ -0,0 +1,165 @@
+package lru
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// LFU evicts the least frequently used entry, or the least recently used
+// one among the least frequently used entries. To let entries that were
+// popular in the past be evicted eventually, all frequencies are halved
+// once there have been 8 times as many accesses as entries.
+type LFU[K comparable, V any] struct {
+	maxSize int
+	onEvict func(key K, v V)
+	budget  budget[K, V]
+
+	seq      uint64 // access counter
+	accesses int    // accesses since the last aging
+	h        lfuHeap[K, V]
+	m        map[K]*lfuEntry[K, V]
+}
+
+type lfuEntry[K comparable, V any] struct {
+	key   K
+	v     V
+	freq  uint64
+	seq   uint64 // seq of the last access
+	index int    // index in the heap
+}
+
+func NewLFU[K comparable, V any](maxSize int, onEvict func(key K, v V)) *LFU[K, V] {
+	if maxSize <= 0 {
+		panic(fmt.Sprintf("LFU: invalid max size: %d", maxSize))
+	}
+	return &LFU[K, V]{
+		maxSize: maxSize,
+		onEvict: onEvict,
+		m:       make(map[K]*lfuEntry[K, V]),
+	}
+}
+
+func (q *LFU[K, V]) SetMaxBytes(maxBytes int, sizeOf func(key K, v V) int) {
+	q.budget.set(maxBytes, sizeOf)
+}
+
+func (q *LFU[K, V]) Add(key K, v V) {
+	if e, ok := q.m[key]; ok {
+		q.budget.sub(key, e.v)
+		e.v = v
+		q.budget.add(key, v)
+		q.access(e)
+	} else {
+		if len(q.m) >= q.maxSize {
+			q.evictOne()
+		}
+		q.seq++
+		e := &lfuEntry[K, V]{key: key, v: v, freq: 1, seq: q.seq}
+		q.m[key] = e
+		heap.Push(&q.h, e)
+		q.budget.add(key, v)
+	}
+	for q.budget.exceeded() && q.evictOne() {
+	}
+}
+
+func (q *LFU[K, V]) Get(key K) (v V, ok bool) {
+	e, ok := q.m[key]
+	if !ok {
+		return
+	}
+	q.access(e)
+	return e.v, true
+}
+
+func (q *LFU[K, V]) Del(key K) {
+	if e, ok := q.m[key]; ok {
+		q.delEntry(e)
+	}
+}
+
+func (q *LFU[K, V]) Clean(f func(key K, v V) bool) (removed int) {
+	for _, e := range q.m {
+		if f(e.key, e.v) {
+			q.delEntry(e)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (q *LFU[K, V]) Len() int {
+	return len(q.m)
+}
+
+func (q *LFU[K, V]) Bytes() int {
+	return q.budget.bytes
+}
+
+func (q *LFU[K, V]) access(e *lfuEntry[K, V]) {
+	q.seq++
+	e.seq = q.seq
+	e.freq++
+	heap.Fix(&q.h, e.index)
+
+	q.accesses++
+	if q.accesses >= 8*min(q.maxSize, len(q.m)+1) {
+		q.accesses = 0
+		for _, e := range q.h {
+			e.freq = (e.freq + 1) / 2
+		}
+		heap.Init(&q.h)
+	}
+}
+
+// evictOne evicts the least frequently used entry. It returns false if
+// q is empty.
+func (q *LFU[K, V]) evictOne() bool {
+	if len(q.h) == 0 {
+		return false
+	}
+	q.delEntry(q.h[0])
+	return true
+}
+
+func (q *LFU[K, V]) delEntry(e *lfuEntry[K, V]) {
+	heap.Remove(&q.h, e.index)
+	delete(q.m, e.key)
+	q.budget.sub(e.key, e.v)
+	if q.onEvict != nil {
+		q.onEvict(e.key, e.v)
+	}
+}
+
+// lfuHeap implements heap.Interface. The top is the entry to be evicted.
+type lfuHeap[K comparable, V any] []*lfuEntry[K, V]
+
+func (h lfuHeap[K, V]) Len() int { return len(h) }
+
+func (h lfuHeap[K, V]) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h lfuHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap[K, V]) Push(x any) {
+	e := x.(*lfuEntry[K, V])
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap[K, V]) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
@@ -10,6 +10,8 @@ type LRU[K comparable, V any] struct {
 	maxSize int
 	onEvict func(key K, v V)
 
+	budget budget[K, V] // optional, see SetMaxBytes
+
 	l *list.List[KV[K, V]]
 	m map[K]*list.Elem[KV[K, V]]
 }
@@ -36,11 +38,20 @@ func NewLRU[K comparable, V any](maxSize int, onEvict func(key K, v V)) *LRU[K,
 	}
 }
 
+// SetMaxBytes implements Cache. The oldest entries are evicted when
+// maxBytes is exceeded.
+func (q *LRU[K, V]) SetMaxBytes(maxBytes int, sizeOf func(key K, v V) int) {
+	q.budget.set(maxBytes, sizeOf)
+}
+
 func (q *LRU[K, V]) Add(key K, v V) {
 	// Update existing
 	if e, ok := q.m[key]; ok {
+		q.budget.sub(e.Value.key, e.Value.v)
 		e.Value.v = v
+		q.budget.add(key, v)
 		q.l.MoveToBack(e)
+		q.evictBytes()
 		return
 	}
 
@@ -53,12 +64,15 @@ func (q *LRU[K, V]) Add(key K, v V) {
 		}
 
 		delete(q.m, e.Value.key)
+		q.budget.sub(e.Value.key, e.Value.v)
 
 		e.Value.key = key
 		e.Value.v = v
 
 		q.m[key] = e
+		q.budget.add(key, v)
 		q.l.MoveToBack(e)
+		q.evictBytes()
 		return
 	}
 
@@ -68,7 +82,9 @@ func (q *LRU[K, V]) Add(key K, v V) {
 		v:   v,
 	})
 	q.m[key] = e
+	q.budget.add(key, v)
 	q.l.PushBack(e)
+	q.evictBytes()
 }
 
 func (q *LRU[K, V]) Get(key K) (v V, ok bool) {
@@ -96,6 +112,7 @@ func (q *LRU[K, V]) PopOldest() (key K, v V, ok bool) {
 
 	q.l.PopElem(e)
 	delete(q.m, e.Value.key)
+	q.budget.sub(e.Value.key, e.Value.v)
 
 	key, v = e.Value.key, e.Value.v
 	ok = true
@@ -122,12 +139,41 @@ func (q *LRU[K, V]) Len() int {
 	return q.l.Len()
 }
 
+func (q *LRU[K, V]) Bytes() int {
+	return q.budget.bytes
+}
+
 func (q *LRU[K, V]) delElem(e *list.Elem[KV[K, V]]) {
 	key, v := e.Value.key, e.Value.v
 	q.l.PopElem(e)
 	delete(q.m, key)
+	q.budget.sub(key, v)
 
 	if q.onEvict != nil {
 		q.onEvict(key, v)
 	}
 }
+
+// remove removes the entry of key without calling onEvict.
+func (q *LRU[K, V]) remove(key K) (v V, ok bool) {
+	e := q.m[key]
+	if e == nil {
+		return
+	}
+	q.l.PopElem(e)
+	delete(q.m, key)
+	q.budget.sub(key, e.Value.v)
+	return e.Value.v, true
+}
+
+// evictBytes evicts the oldest entries until the total size of the
+// entries is within maxBytes.
+func (q *LRU[K, V]) evictBytes() {
+	for q.budget.exceeded() {
+		e := q.l.Front()
+		if e == nil {
+			return
+		}
+		q.delElem(e)
+	}
+}
@@ -135,4 +135,26 @@ func Test_lru(t *testing.T) {
 	add(1, 2, 3, 4) // 1 2 3 4
 	mustGet(2, 3)   // 1 4 2 3
 	mustPopOldest(1, 4, 2, 3)
+
+	// test max bytes, the size of an entry is its value
+	checkBytes := func(want int) {
+		t.Helper()
+		if want != q.Bytes() {
+			t.Fatalf("want bytes %v, got %v", want, q.Bytes())
+		}
+	}
+	reset(4)
+	q.SetMaxBytes(10, func(_ int, v int) int { return v })
+	add(1, 2, 3, 4) // 1 2 3 4
+	checkBytes(10)
+	add(5) // 4 5
+	checkLen(2)
+	checkBytes(9)
+	mustGet(4, 5)
+	q.Add(4, 1) // 5 4
+	checkBytes(6)
+	add(11) // larger than max bytes
+	emptyGet(11)
+	checkLen(0)
+	checkBytes(0)
 }
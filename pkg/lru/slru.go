@@ -0,0 +1,121 @@
+package lru
+
+import (
+	"fmt"
+)
+
+// SLRU is a segmented LRU. New entries are added to a probationary
+// segment, and are moved to a protected segment when they are hit.
+// Entries that fall out of the protected segment go back to the
+// probationary one, and only entries in the probationary segment are
+// evicted first. So entries that are only hit once, e.g. in a scan, are
+// evicted before the popular ones.
+type SLRU[K comparable, V any] struct {
+	maxSize       int
+	protectedSize int
+	onEvict       func(key K, v V)
+	budget        budget[K, V]
+
+	probation *LRU[K, V]
+	protected *LRU[K, V]
+}
+
+// NewSLRU returns a SLRU. 80% of maxSize is the protected segment.
+func NewSLRU[K comparable, V any](maxSize int, onEvict func(key K, v V)) *SLRU[K, V] {
+	if maxSize <= 0 {
+		panic(fmt.Sprintf("SLRU: invalid max size: %d", maxSize))
+	}
+	return &SLRU[K, V]{
+		maxSize:       maxSize,
+		protectedSize: max(maxSize/5*4, 1),
+		onEvict:       onEvict,
+		probation:     NewLRU[K, V](maxSize, nil),
+		protected:     NewLRU[K, V](maxSize, nil),
+	}
+}
+
+func (q *SLRU[K, V]) SetMaxBytes(maxBytes int, sizeOf func(key K, v V) int) {
+	q.budget.set(maxBytes, sizeOf)
+}
+
+func (q *SLRU[K, V]) Add(key K, v V) {
+	if old, ok := q.protected.remove(key); ok {
+		q.budget.sub(key, old)
+		q.protected.Add(key, v)
+	} else if old, ok := q.probation.remove(key); ok {
+		q.budget.sub(key, old)
+		q.probation.Add(key, v)
+	} else {
+		if q.Len() >= q.maxSize {
+			q.evictOne()
+		}
+		q.probation.Add(key, v)
+	}
+	q.budget.add(key, v)
+	for q.budget.exceeded() && q.evictOne() {
+	}
+}
+
+func (q *SLRU[K, V]) Get(key K) (v V, ok bool) {
+	if v, ok = q.protected.Get(key); ok {
+		return v, true
+	}
+	if v, ok = q.probation.remove(key); !ok {
+		return v, false
+	}
+	if q.protected.Len() >= q.protectedSize {
+		k, v, _ := q.protected.PopOldest()
+		q.probation.Add(k, v)
+	}
+	q.protected.Add(key, v)
+	return v, true
+}
+
+func (q *SLRU[K, V]) Del(key K) {
+	v, ok := q.protected.remove(key)
+	if !ok {
+		v, ok = q.probation.remove(key)
+	}
+	if ok {
+		q.evicted(key, v)
+	}
+}
+
+func (q *SLRU[K, V]) Clean(f func(key K, v V) bool) (removed int) {
+	wrapped := func(key K, v V) bool {
+		if f(key, v) {
+			q.evicted(key, v)
+			return true
+		}
+		return false
+	}
+	return q.probation.Clean(wrapped) + q.protected.Clean(wrapped)
+}
+
+func (q *SLRU[K, V]) Len() int {
+	return q.probation.Len() + q.protected.Len()
+}
+
+func (q *SLRU[K, V]) Bytes() int {
+	return q.budget.bytes
+}
+
+// evictOne evicts the oldest probationary entry, or the oldest protected
+// one if there is no probationary entry. It returns false if q is empty.
+func (q *SLRU[K, V]) evictOne() bool {
+	key, v, ok := q.probation.PopOldest()
+	if !ok {
+		key, v, ok = q.protected.PopOldest()
+	}
+	if ok {
+		q.evicted(key, v)
+	}
+	return ok
+}
+
+func (q *SLRU[K, V]) evicted(key K, v V) {
+	q.budget.sub(key, v)
+	if q.onEvict != nil {
+		q.onEvict(key, v)
+	}
+}
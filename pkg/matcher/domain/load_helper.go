@@ -159,6 +159,7 @@ func BatchLoadDomainProvider(
 				}
 			}
 			m := NewDynamicMatcher[struct{}](parseFunc)
+			m.lazyMatch = provider.LazyMatch()
 			if err := provider.LoadAndAddListener(m); err != nil {
 				return nil, fmt.Errorf("failed to load data from provider %s, %w", providerTag, err)
 			}
@@ -181,6 +182,7 @@ type DynamicMatcher[T any] struct {
 	parserFunc func(b []byte) (Matcher[T], error)
 	l          sync.RWMutex
 	m          Matcher[T]
+	lazyMatch  bool // the result of Match before the first Update
 }
 
 func NewDynamicMatcher[T any](parserFunc func(b []byte) (Matcher[T], error)) *DynamicMatcher[T] {
@@ -191,6 +193,9 @@ func (d *DynamicMatcher[T]) Match(s string) (v T, ok bool) {
 	d.l.RLock()
 	m := d.m
 	d.l.RUnlock()
+	if m == nil {
+		return v, d.lazyMatch
+	}
 	return m.Match(s)
 }
 
@@ -198,6 +203,9 @@ func (d *DynamicMatcher[T]) Len() int {
 	d.l.RLock()
 	m := d.m
 	d.l.RUnlock()
+	if m == nil {
+		return 0
+	}
 	return m.Len()
 }
 
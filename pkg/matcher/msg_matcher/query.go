@@ -48,6 +48,65 @@ func (m *ClientIPMatcher) Match(_ context.Context, qCtx *query_context.Context)
 	return m.ipMatcher.Match(clientAddr)
 }
 
+// ClientCertSubjectMatcher matches the subject of the tls client
+// certificate of the request.
+type ClientCertSubjectMatcher struct {
+	subjects map[string]struct{}
+}
+
+func NewClientCertSubjectMatcher(subjects []string) *ClientCertSubjectMatcher {
+	m := &ClientCertSubjectMatcher{subjects: make(map[string]struct{}, len(subjects))}
+	for _, s := range subjects {
+		m.subjects[s] = struct{}{}
+	}
+	return m
+}
+
+func (m *ClientCertSubjectMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, _ error) {
+	subject := qCtx.ReqMeta().GetClientCertSubject()
+	if len(subject) == 0 {
+		return false, nil
+	}
+	_, ok := m.subjects[subject]
+	return ok, nil
+}
+
+// ServerIPMatcher matches the local address where the request was
+// received.
+type ServerIPMatcher struct {
+	ipMatcher netlist.Matcher
+}
+
+func NewServerIPMatcher(ipMatcher netlist.Matcher) *ServerIPMatcher {
+	return &ServerIPMatcher{ipMatcher: ipMatcher}
+}
+
+func (m *ServerIPMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+	serverAddr := qCtx.ReqMeta().GetServerAddr()
+	if !serverAddr.IsValid() {
+		return false, nil
+	}
+	return m.ipMatcher.Match(serverAddr.Addr())
+}
+
+// ServerPortMatcher matches the local port where the request was
+// received.
+type ServerPortMatcher struct {
+	elemMatcher *elem.IntMatcher
+}
+
+func NewServerPortMatcher(elemMatcher *elem.IntMatcher) *ServerPortMatcher {
+	return &ServerPortMatcher{elemMatcher: elemMatcher}
+}
+
+func (m *ServerPortMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, _ error) {
+	serverAddr := qCtx.ReqMeta().GetServerAddr()
+	if !serverAddr.IsValid() {
+		return false, nil
+	}
+	return m.elemMatcher.Match(int(serverAddr.Port())), nil
+}
+
 type ClientECSMatcher struct {
 	ipMatcher netlist.Matcher
 }
@@ -174,3 +174,59 @@ func TestQClassMatcher_Match(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestClientCertSubjectMatcher_Match(t *testing.T) {
+	m := NewClientCertSubjectMatcher([]string{"CN=client1,O=example"})
+	msg := new(dns.Msg)
+	meta := C.NewRequestMeta(netip.MustParseAddr("127.0.0.1"))
+	if matched, _ := m.Match(context.Background(), C.NewContext(msg, meta)); matched {
+		t.Fatal("request without a client certificate should not match")
+	}
+	meta.SetClientCertSubject("CN=client1,O=example")
+	if matched, _ := m.Match(context.Background(), C.NewContext(msg, meta)); !matched {
+		t.Fatal("subject should match")
+	}
+	meta.SetClientCertSubject("CN=client2,O=example")
+	if matched, _ := m.Match(context.Background(), C.NewContext(msg, meta)); matched {
+		t.Fatal("subject should not match")
+	}
+}
+
+func TestServerAddrMatcher_Match(t *testing.T) {
+	nl := netlist.NewList()
+	if err := netlist.LoadFromText(nl, "192.168.10.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	nl.Sort()
+	ipMatcher := NewServerIPMatcher(nl)
+	portMatcher := NewServerPortMatcher(elem.NewIntMatcher([]int{5353}))
+
+	msg := new(dns.Msg)
+	meta := C.NewRequestMeta(netip.MustParseAddr("127.0.0.1"))
+	if matched, _ := ipMatcher.Match(context.Background(), C.NewContext(msg, meta)); matched {
+		t.Fatal("request without a server address should not match")
+	}
+	if matched, _ := portMatcher.Match(context.Background(), C.NewContext(msg, meta)); matched {
+		t.Fatal("request without a server address should not match")
+	}
+
+	tests := []struct {
+		addr     string
+		wantIP   bool
+		wantPort bool
+	}{
+		{"192.168.10.1:5353", true, true},
+		{"[::ffff:192.168.10.1]:53", true, false},
+		{"192.168.20.1:5353", false, true},
+	}
+	for _, tt := range tests {
+		meta.SetServerAddr(netip.MustParseAddrPort(tt.addr))
+		qCtx := C.NewContext(msg, meta)
+		if matched, _ := ipMatcher.Match(context.Background(), qCtx); matched != tt.wantIP {
+			t.Errorf("server ip %s matched = %v, want %v", tt.addr, matched, tt.wantIP)
+		}
+		if matched, _ := portMatcher.Match(context.Background(), qCtx); matched != tt.wantPort {
+			t.Errorf("server port %s matched = %v, want %v", tt.addr, matched, tt.wantPort)
+		}
+	}
+}
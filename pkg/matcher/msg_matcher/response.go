@@ -32,14 +32,24 @@ import (
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 )
 
+// AAAAAIPMatcher matches the ips of A/AAAA records in the answer section.
 type AAAAAIPMatcher struct {
-	ipMatcher netlist.Matcher
+	ipMatcher   netlist.Matcher
+	allSections bool
 }
 
 func NewAAAAAIPMatcher(ipMatcher netlist.Matcher) *AAAAAIPMatcher {
 	return &AAAAAIPMatcher{ipMatcher: ipMatcher}
 }
 
+// NewAllSectionsIPMatcher returns a AAAAAIPMatcher that also checks the
+// authority and additional sections (e.g. glue records) and the ip hints
+// of SVCB/HTTPS records, so ips cannot bypass it by being placed outside
+// the answer section.
+func NewAllSectionsIPMatcher(ipMatcher netlist.Matcher) *AAAAAIPMatcher {
+	return &AAAAAIPMatcher{ipMatcher: ipMatcher, allSections: true}
+}
+
 func (m *AAAAAIPMatcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
 	r := qCtx.R()
 	if r == nil {
@@ -50,28 +60,74 @@ func (m *AAAAAIPMatcher) Match(_ context.Context, qCtx *query_context.Context) (
 }
 
 func (m *AAAAAIPMatcher) MatchMsg(msg *dns.Msg) (bool, error) {
-	for _, rr := range msg.Answer {
-		var ip net.IP
+	if !m.allSections {
+		return m.matchRRs(msg.Answer)
+	}
+	for _, section := range [...][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		matched, err := m.matchRRs(section)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+func (m *AAAAAIPMatcher) matchRRs(rrs []dns.RR) (bool, error) {
+	for _, rr := range rrs {
 		switch rr := rr.(type) {
 		case *dns.A:
-			ip = rr.A
+			if matched, err := m.matchIP(rr.A); matched || err != nil {
+				return matched, err
+			}
 		case *dns.AAAA:
-			ip = rr.AAAA
+			if matched, err := m.matchIP(rr.AAAA); matched || err != nil {
+				return matched, err
+			}
+		case *dns.SVCB:
+			if m.allSections {
+				if matched, err := m.matchSVCBHints(rr.Value); matched || err != nil {
+					return matched, err
+				}
+			}
+		case *dns.HTTPS:
+			if m.allSections {
+				if matched, err := m.matchSVCBHints(rr.Value); matched || err != nil {
+					return matched, err
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+func (m *AAAAAIPMatcher) matchSVCBHints(kvs []dns.SVCBKeyValue) (bool, error) {
+	for _, kv := range kvs {
+		var hints []net.IP
+		switch kv := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			hints = kv.Hint
+		case *dns.SVCBIPv6Hint:
+			hints = kv.Hint
 		default:
 			continue
 		}
-		addr, _ := netip.AddrFromSlice(ip)
-		matched, err := m.ipMatcher.Match(addr)
-		if err != nil {
-			return false, err
-		}
-		if matched {
-			return true, nil
+		for _, ip := range hints {
+			if matched, err := m.matchIP(ip); matched || err != nil {
+				return matched, err
+			}
 		}
 	}
 	return false, nil
 }
 
+func (m *AAAAAIPMatcher) matchIP(ip net.IP) (bool, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false, nil
+	}
+	return m.ipMatcher.Match(addr.Unmap())
+}
+
 type CNameMatcher struct {
 	domainMatcher domain.Matcher[struct{}]
 }
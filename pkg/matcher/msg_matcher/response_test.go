@@ -55,3 +55,44 @@ func TestAAAAAIPMatcher_MatchMsg(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestAllSectionsIPMatcher_MatchMsg(t *testing.T) {
+	nl := netlist.NewList()
+	if err := netlist.LoadFromText(nl, "127.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	nl.Sort()
+	m := NewAllSectionsIPMatcher(nl)
+	answerOnly := NewAAAAAIPMatcher(nl)
+
+	ip1271 := net.ParseIP("127.0.0.1")
+	ip1281 := net.ParseIP("128.0.0.1")
+
+	tests := []struct {
+		name string
+		msg  *dns.Msg
+		want bool
+	}{
+		{"answer", &dns.Msg{Answer: []dns.RR{&dns.A{A: ip1281}, &dns.A{A: ip1271}}}, true},
+		{"no match", &dns.Msg{Answer: []dns.RR{&dns.A{A: ip1281}}, Extra: []dns.RR{&dns.A{A: ip1281}}}, false},
+		{"ns", &dns.Msg{Answer: []dns.RR{&dns.A{A: ip1281}}, Ns: []dns.RR{&dns.A{A: ip1271}}}, true},
+		{"extra glue", &dns.Msg{Extra: []dns.RR{&dns.A{A: ip1271}}}, true},
+		{"https hint", &dns.Msg{Answer: []dns.RR{&dns.HTTPS{SVCB: dns.SVCB{Value: []dns.SVCBKeyValue{&dns.SVCBIPv4Hint{Hint: []net.IP{ip1271}}}}}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched, err := m.MatchMsg(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matched != tt.want {
+				t.Fatalf("MatchMsg() = %v, want %v", matched, tt.want)
+			}
+		})
+	}
+
+	// The default matcher only checks the answer section.
+	if matched, _ := answerOnly.MatchMsg(&dns.Msg{Extra: []dns.RR{&dns.A{A: ip1271}}}); matched {
+		t.Fatal("answer only matcher matched the additional section")
+	}
+}
@@ -71,6 +71,7 @@ func (m *MatcherGroup) Close() error {
 type DynamicMatcher struct {
 	parseFunc func(in []byte) (*List, error)
 	v         atomic.Value
+	lazyMatch bool // the result of Match before the first Update
 }
 
 func NewDynamicMatcher(parseFunc func(in []byte) (*List, error)) *DynamicMatcher {
@@ -87,11 +88,19 @@ func (d *DynamicMatcher) Update(newData []byte) error {
 }
 
 func (d *DynamicMatcher) Match(addr netip.Addr) (bool, error) {
-	return d.v.Load().(*List).Match(addr)
+	l, _ := d.v.Load().(*List)
+	if l == nil {
+		return d.lazyMatch, nil
+	}
+	return l.Match(addr)
 }
 
 func (d *DynamicMatcher) Len() int {
-	return d.v.Load().(*List).Len()
+	l, _ := d.v.Load().(*List)
+	if l == nil {
+		return 0
+	}
+	return l.Len()
 }
 
 // BatchLoadProvider is a helper func to load multiple files using Load.
@@ -125,6 +134,7 @@ func BatchLoadProvider(e []string, dm *data_provider.DataManager) (*MatcherGroup
 				}
 			}
 			m := NewDynamicMatcher(parseFunc)
+			m.lazyMatch = provider.LazyMatch()
 			if err := provider.LoadAndAddListener(m); err != nil {
 				return nil, fmt.Errorf("failed to load data from provider %s, %w", providerName, err)
 			}
@@ -113,3 +113,32 @@ func TestIPNetList_New_And_Contains(t *testing.T) {
 		})
 	}
 }
+
+func TestDynamicMatcher_Lazy(t *testing.T) {
+	parseFunc := func(in []byte) (*List, error) {
+		l := NewList()
+		if err := LoadFromText(l, string(in)); err != nil {
+			return nil, err
+		}
+		l.Sort()
+		return l, nil
+	}
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	for _, lazyMatch := range []bool{false, true} {
+		m := NewDynamicMatcher(parseFunc)
+		m.lazyMatch = lazyMatch
+		if ok, _ := m.Match(addr); ok != lazyMatch {
+			t.Fatalf("Match() before update = %v, want %v", ok, lazyMatch)
+		}
+		if n := m.Len(); n != 0 {
+			t.Fatalf("Len() before update = %d, want 0", n)
+		}
+		if err := m.Update([]byte("10.0.0.0/8")); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := m.Match(addr); ok {
+			t.Fatal("Match() after update = true, want false")
+		}
+	}
+}
@@ -28,10 +28,15 @@ import (
 // Just give it a big buf and hope the buf will be reused in most scenes.
 const packBufSize = 4096
 
-// PackBuffer packs the dns msg m to wire format.
+// PackBuffer packs the dns msg m to wire format with compression.
 // Callers should release the buf after they have done with the wire []byte.
 func PackBuffer(m *dns.Msg) (wire []byte, buf *Buffer, err error) {
 	m.Compress = true
+	return PackMsg(m)
+}
+
+// PackMsg is like PackBuffer but it compresses m only if m.Compress is set.
+func PackMsg(m *dns.Msg) (wire []byte, buf *Buffer, err error) {
 	buf = GetBuf(packBufSize)
 	wire, err = m.PackBuffer(buf.Bytes())
 	if err != nil {
@@ -1,6 +1,7 @@
 package query_context
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/netip"
@@ -11,6 +12,7 @@ import (
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/mlog"
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 )
 
@@ -25,11 +27,17 @@ const (
 	ProtocolH3    = "h3"
 )
 
+// ErrDropQuery can be returned by executables to drop the query. Servers
+// will not respond to it.
+var ErrDropQuery = errors.New("query dropped")
+
 // RequestMeta represents some metadata about the request.
 type RequestMeta struct {
-	clientAddr netip.Addr
-	serverName string
-	protocol   string
+	clientAddr        netip.Addr
+	serverName        string
+	protocol          string
+	clientCertSubject string
+	serverAddr        netip.AddrPort
 }
 
 func NewRequestMeta(addr netip.Addr) *RequestMeta {
@@ -53,6 +61,21 @@ func (m *RequestMeta) SetServerName(serverName string) {
 	m.serverName = serverName
 }
 
+// SetClientCertSubject sets the subject of the verified tls client
+// certificate, in the form of pkix.Name.String().
+func (m *RequestMeta) SetClientCertSubject(subject string) {
+	m.clientCertSubject = subject
+}
+
+// SetServerAddr sets the local address and port where the request
+// was received.
+func (m *RequestMeta) SetServerAddr(addr netip.AddrPort) {
+	if addr.Addr().Is4In6() {
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	}
+	m.serverAddr = addr
+}
+
 func (m *RequestMeta) GetClientAddr() netip.Addr {
 	return m.clientAddr
 }
@@ -65,6 +88,18 @@ func (m *RequestMeta) GetServerName() string {
 	return m.serverName
 }
 
+// GetClientCertSubject returns the subject of the verified tls client
+// certificate. It is empty if the client did not send a certificate.
+func (m *RequestMeta) GetClientCertSubject() string {
+	return m.clientCertSubject
+}
+
+// GetServerAddr returns the local address and port where the request
+// was received. It is invalid if unknown.
+func (m *RequestMeta) GetServerAddr() netip.AddrPort {
+	return m.serverAddr
+}
+
 // Context is a query context that pass through plugins
 type Context struct {
 	startTime     time.Time
@@ -73,8 +108,10 @@ type Context struct {
 	id            uint32
 	reqMeta       *RequestMeta
 
-	r     *dns.Msg
-	marks map[uint]struct{}
+	r       *dns.Msg
+	rShared bool   // r may be referenced elsewhere, see SetSharedResponse.
+	rawR    []byte // packed response, see SetRawResponse. r is nil if it is set.
+	marks   map[uint]struct{}
 }
 
 var (
@@ -106,7 +143,7 @@ func NewContext(q *dns.Msg, meta *RequestMeta) *Context {
 func (ctx *Context) String() string {
 	q := ctx.q.Question[0]
 	return fmt.Sprintf("%s %s %s %d %d",
-		q.Name,
+		mlog.QName(q.Name),
 		dnsutils.QclassToString(q.Qclass),
 		dnsutils.QtypeToString(q.Qtype),
 		ctx.q.Id,
@@ -133,14 +170,83 @@ func (ctx *Context) ReqMeta() *RequestMeta {
 	return ctx.reqMeta
 }
 
-// R returns the response.
+// R returns the response. The response may be shared with other
+// Contexts (e.g. branches of a parallel node) or data structures.
+// Callers that modify the response must use MutableR instead.
+// A packed response, see SetRawResponse, is unpacked first.
 func (ctx *Context) R() *dns.Msg {
+	if ctx.rawR != nil {
+		ctx.unpackRawR()
+	}
 	return ctx.r
 }
 
-// SetResponse stores the response r to the context.
+// unpackRawR replaces the packed response with the unpacked one. The
+// response is removed if it cannot be unpacked.
+func (ctx *Context) unpackRawR() {
+	r := new(dns.Msg)
+	if err := r.Unpack(ctx.rawR); err != nil {
+		r = nil
+	}
+	ctx.r = r
+	ctx.rShared = false
+	ctx.rawR = nil
+}
+
+// RawR returns the packed response set by SetRawResponse. It returns nil
+// if the response is not packed, or it has been unpacked by R or MutableR.
+// The packed response is owned by the context and can be modified in
+// place, e.g. its id.
+func (ctx *Context) RawR() []byte {
+	return ctx.rawR
+}
+
+// MutableR returns the response that can be safely modified. If the
+// response is shared, it is copied first (copy-on-write).
+func (ctx *Context) MutableR() *dns.Msg {
+	if ctx.rawR != nil {
+		ctx.unpackRawR()
+	}
+	if ctx.r != nil && ctx.rShared {
+		ctx.r = ctx.r.Copy()
+		ctx.rShared = false
+	}
+	return ctx.r
+}
+
+// SetResponse stores the response r to the context. The context takes
+// the ownership of r. r must not be modified by others after this call.
 func (ctx *Context) SetResponse(r *dns.Msg) {
 	ctx.r = r
+	ctx.rShared = false
+	ctx.rawR = nil
+}
+
+// SetSharedResponse is like SetResponse but r (or its records) is still
+// referenced elsewhere, e.g. by a static record table. r will be copied
+// before it is modified.
+func (ctx *Context) SetSharedResponse(r *dns.Msg) {
+	ctx.r = r
+	ctx.rShared = true
+	ctx.rawR = nil
+}
+
+// SetRawResponse is like SetResponse but the response is the packed msg
+// raw, e.g. a cache hit. It is only unpacked if the response is read by
+// R or MutableR, so it can be sent as is. The context takes the ownership
+// of raw.
+func (ctx *Context) SetRawResponse(raw []byte) {
+	ctx.r = nil
+	ctx.rShared = false
+	ctx.rawR = raw
+}
+
+// SetResponseFrom moves the response of src to ctx. It keeps the
+// shared state of the response. src should not be used after this call.
+func (ctx *Context) SetResponseFrom(src *Context) {
+	ctx.r = src.r
+	ctx.rShared = src.rShared
+	ctx.rawR = src.rawR
 }
 
 // Id returns the Context id.
@@ -177,6 +283,8 @@ func (ctx *Context) ShallowCopyForBackground() *Context {
 }
 
 // CopyTo deep copies this Context to d.
+// The response is not copied but shared by both Contexts. It will be
+// copied when one of them calls MutableR.
 func (ctx *Context) CopyTo(d *Context) *Context {
 	d.startTime = ctx.startTime
 	d.q = ctx.q.Copy()
@@ -184,8 +292,14 @@ func (ctx *Context) CopyTo(d *Context) *Context {
 	d.reqMeta = ctx.reqMeta
 	d.id = ctx.id
 
-	if r := ctx.r; r != nil {
-		d.r = r.Copy()
+	if ctx.rawR != nil {
+		ctx.unpackRawR()
+	}
+	d.r = ctx.r
+	d.rawR = nil
+	if ctx.r != nil {
+		ctx.rShared = true
+		d.rShared = true
 	}
 	for m := range ctx.marks {
 		d.AddMark(m)
@@ -224,3 +338,21 @@ func AllocateMark() (uint, error) {
 	allocatedMark.u++
 	return m, nil
 }
+
+// Remaining returns the time budget left before the deadline of ctx.
+// ok is false if ctx has no deadline.
+func Remaining(ctx context.Context) (d time.Duration, ok bool) {
+	ddl, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(ddl), true
+}
+
+// HasBudget reports whether ctx has at least min time left before its
+// deadline. Plugins can use it to skip optional work when a query is about
+// to time out. It returns true if ctx has no deadline.
+func HasBudget(ctx context.Context, min time.Duration) bool {
+	d, ok := Remaining(ctx)
+	return !ok || d >= min
+}
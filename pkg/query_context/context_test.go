@@ -0,0 +1,109 @@
+package query_context
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHasBudget(t *testing.T) {
+	if !HasBudget(context.Background(), time.Hour) {
+		t.Fatal("context without deadline should always have budget")
+	}
+	if _, ok := Remaining(context.Background()); ok {
+		t.Fatal("Remaining() of context without deadline should not be ok")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if d, ok := Remaining(ctx); !ok || d <= 0 || d > time.Second {
+		t.Fatalf("Remaining() = %v, %v", d, ok)
+	}
+	if !HasBudget(ctx, 10*time.Millisecond) {
+		t.Fatal("HasBudget(10ms) should be true")
+	}
+	if HasBudget(ctx, time.Minute) {
+		t.Fatal("HasBudget(1m) should be false")
+	}
+}
+
+func TestContext_MutableR(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Owned response is not copied.
+	qCtx := NewContext(q, nil)
+	r := new(dns.Msg)
+	qCtx.SetResponse(r)
+	if qCtx.MutableR() != r {
+		t.Fatal("owned response should not be copied")
+	}
+
+	// Shared response is copied once.
+	qCtx.SetSharedResponse(r)
+	mr := qCtx.MutableR()
+	if mr == r {
+		t.Fatal("shared response should be copied")
+	}
+	if qCtx.MutableR() != mr {
+		t.Fatal("copied response should be owned")
+	}
+
+	// Copies share the response until one of them modifies it.
+	cp := qCtx.Copy()
+	if cp.R() != qCtx.R() {
+		t.Fatal("copy should share the response")
+	}
+	cp.MutableR().Rcode = dns.RcodeServerFailure
+	if qCtx.R().Rcode == dns.RcodeServerFailure {
+		t.Fatal("modification of the copy changed the original response")
+	}
+	if qCtx.MutableR() == cp.R() {
+		t.Fatal("original should copy the shared response")
+	}
+}
+
+func TestContext_SetRawResponse(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeNameError)
+	raw, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qCtx := NewContext(q, nil)
+	qCtx.SetRawResponse(raw)
+	if qCtx.RawR() == nil {
+		t.Fatal("RawR() is nil")
+	}
+	cp := qCtx.Copy()
+	if qCtx.RawR() != nil || cp.RawR() != nil {
+		t.Fatal("packed response is shared by copies")
+	}
+	if got := cp.R(); got == nil || got.Rcode != dns.RcodeNameError {
+		t.Fatalf("copy got response %v", got)
+	}
+
+	qCtx.SetRawResponse(raw)
+	if got := qCtx.R(); got == nil || got.Rcode != dns.RcodeNameError {
+		t.Fatalf("R() = %v", got)
+	}
+	if qCtx.RawR() != nil {
+		t.Fatal("RawR() is not nil after the response is unpacked")
+	}
+
+	qCtx.SetRawResponse(raw)
+	qCtx.SetResponse(r)
+	if qCtx.RawR() != nil || qCtx.R() != r {
+		t.Fatal("SetResponse() does not replace the packed response")
+	}
+
+	qCtx.SetRawResponse([]byte{1, 2, 3})
+	if qCtx.MutableR() != nil {
+		t.Fatal("invalid packed response is unpacked")
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package real_ip finds the real client address of requests that come
+// through proxies, from PROXY protocol headers of stream connections and
+// from forwarding headers of http requests, so that every protocol puts
+// the same client address into the request meta.
+package real_ip
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// Headers are the forwarding headers in the order they are checked.
+var Headers = []string{"True-Client-IP", "X-Real-IP", "X-Forwarded-For"}
+
+// TrustedProxies is a list of trusted proxy networks. Only trusted proxies
+// can send PROXY protocol headers and forwarding headers. A nil or empty
+// TrustedProxies trusts all peers.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// ParseTrustedProxies parses a list of CIDRs or IP addresses.
+func ParseTrustedProxies(s []string) (*TrustedProxies, error) {
+	t := new(TrustedProxies)
+	for _, e := range s {
+		var p netip.Prefix
+		var err error
+		if strings.Contains(e, "/") {
+			p, err = netip.ParsePrefix(e)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(e)
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s, %w", e, err)
+		}
+		t.prefixes = append(t.prefixes, p.Masked())
+	}
+	return t, nil
+}
+
+// Trusted reports whether addr is a trusted proxy. An invalid addr, e.g.
+// the peer of a unix socket, is always trusted.
+func (t *TrustedProxies) Trusted(addr netip.Addr) bool {
+	if t == nil || len(t.prefixes) == 0 || !addr.IsValid() {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, p := range t.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyProtocolPolicy returns the policy of PROXY protocol listeners.
+// Trusted peers must send a PROXY header, others must not.
+func (t *TrustedProxies) ProxyProtocolPolicy() proxyproto.ConnPolicyFunc {
+	return func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+		if t.Trusted(addrOf(opts.Upstream)) {
+			return proxyproto.REQUIRE, nil
+		}
+		return proxyproto.REJECT, nil
+	}
+}
+
+// FromHeaders returns the client address in the forwarding headers of a
+// request from peer. get returns the value of a header. customHeader is
+// an optional header that is checked after Headers. The X-Forwarded-For
+// list is read from right to left, and the first address that is not a
+// trusted proxy is the client. ok is false if peer is not trusted or no
+// header has a valid address.
+func (t *TrustedProxies) FromHeaders(peer netip.Addr, get func(string) string, customHeader string) (client netip.Addr, ok bool) {
+	if !t.Trusted(peer) {
+		return netip.Addr{}, false
+	}
+	for _, h := range Headers {
+		val := get(h)
+		if val == "" {
+			continue
+		}
+		if h == "X-Forwarded-For" {
+			if addr, ok := t.fromXFF(val); ok {
+				return addr, true
+			}
+			continue
+		}
+		if addr, err := netip.ParseAddr(strings.TrimSpace(val)); err == nil {
+			return addr.Unmap(), true
+		}
+	}
+	if customHeader != "" {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(get(customHeader))); err == nil {
+			return addr.Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+func (t *TrustedProxies) fromXFF(val string) (netip.Addr, bool) {
+	hops := strings.Split(val, ",")
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !t.Trusted(client) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+func addrOf(a net.Addr) netip.Addr {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		addr, _ := netip.AddrFromSlice(a.IP)
+		return addr.Unmap()
+	case *net.UDPAddr:
+		addr, _ := netip.AddrFromSlice(a.IP)
+		return addr.Unmap()
+	}
+	return netip.Addr{}
+}
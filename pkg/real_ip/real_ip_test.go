@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package real_ip
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestTrustedProxies_FromHeaders(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		trusted *TrustedProxies
+		peer    string
+		headers map[string]string
+		custom  string
+		want    string // empty means no client address
+	}{
+		{"untrusted peer", trusted, "1.1.1.1", map[string]string{"X-Real-IP": "2.2.2.2"}, "", ""},
+		{"trusted peer", trusted, "10.0.0.1", map[string]string{"X-Real-IP": "2.2.2.2"}, "", "2.2.2.2"},
+		{"trusted v6 peer", trusted, "2001:db8::1", map[string]string{"X-Real-IP": "2.2.2.2"}, "", "2.2.2.2"},
+		{"xff skips trusted hops", trusted, "10.0.0.1", map[string]string{"X-Forwarded-For": "3.3.3.3, 2.2.2.2, 10.0.0.2"}, "", "2.2.2.2"},
+		{"xff all trusted", trusted, "10.0.0.1", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"xff invalid", trusted, "10.0.0.1", map[string]string{"X-Forwarded-For": "bad"}, "", ""},
+		{"custom header", trusted, "10.0.0.1", map[string]string{"CF-Connecting-IP": "2.2.2.2"}, "CF-Connecting-IP", "2.2.2.2"},
+		{"nil trusts all", nil, "1.1.1.1", map[string]string{"X-Forwarded-For": "3.3.3.3, 2.2.2.2"}, "", "3.3.3.3"},
+		{"no header", nil, "1.1.1.1", nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.trusted.FromHeaders(netip.MustParseAddr(tt.peer), func(k string) string { return tt.headers[k] }, tt.custom)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("want no client, got %s", got)
+				}
+				return
+			}
+			if !ok || got != netip.MustParseAddr(tt.want) {
+				t.Fatalf("want %s, got %s %v", tt.want, got, ok)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_ProxyProtocolPolicy(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := trusted.ProxyProtocolPolicy()
+	check := func(addr net.Addr, want proxyproto.Policy) {
+		t.Helper()
+		got, err := policy(proxyproto.ConnPolicyOptions{Upstream: addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("%s: want %v, got %v", addr, want, got)
+		}
+	}
+	check(&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 53}, proxyproto.REQUIRE)
+	check(&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.1.1"), Port: 53}, proxyproto.REQUIRE)
+	check(&net.TCPAddr{IP: net.ParseIP("1.1.1.1"), Port: 53}, proxyproto.REJECT)
+	check(&net.UnixAddr{Name: "@", Net: "unix"}, proxyproto.REQUIRE)
+
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("invalid cidr should fail")
+	}
+}
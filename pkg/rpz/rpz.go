@@ -0,0 +1,254 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package rpz parses DNS Response Policy Zones (draft-vixie-dnsop-dns-rpz)
+// and matches query names against their QNAME triggers.
+package rpz
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Action is the policy action of a Rule.
+type Action uint8
+
+const (
+	ActionNXDomain  Action = iota + 1 // CNAME .
+	ActionNoData                      // CNAME *.
+	ActionPassthru                    // CNAME rpz-passthru.
+	ActionDrop                        // CNAME rpz-drop.
+	ActionTCPOnly                     // CNAME rpz-tcp-only.
+	ActionLocalData                   // any other records
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionNXDomain:
+		return "nxdomain"
+	case ActionNoData:
+		return "nodata"
+	case ActionPassthru:
+		return "passthru"
+	case ActionDrop:
+		return "drop"
+	case ActionTCPOnly:
+		return "tcp-only"
+	case ActionLocalData:
+		return "local-data"
+	default:
+		return fmt.Sprintf("action(%d)", uint8(a))
+	}
+}
+
+// Rule is the policy of a trigger.
+type Rule struct {
+	Action Action
+	// Data is the records of ActionLocalData. Their names are the
+	// trigger names, e.g. "*.example.com." for a wildcard trigger.
+	Data []dns.RR
+}
+
+// CNAME returns the CNAME of the local data, or nil.
+func (r *Rule) CNAME() *dns.CNAME {
+	for _, rr := range r.Data {
+		if c, ok := rr.(*dns.CNAME); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// Zone is a response policy zone. Only QNAME triggers are supported.
+// The records of other triggers (rpz-ip, rpz-nsdname, rpz-nsip and
+// rpz-client-ip) are counted by Skipped.
+type Zone struct {
+	Origin string
+	SOA    *dns.SOA
+	NS     []dns.RR
+
+	// Skipped is the number of records of unsupported triggers.
+	Skipped int
+
+	exact    map[string]*Rule
+	wildcard map[string]*Rule // keyed by the parent name of "*."
+}
+
+// Parse parses a zone file. origin is the origin of relative names before
+// the first $ORIGIN, it can be empty if the file has one. The origin of the
+// zone is the name of its SOA, which must be the first record as in zone
+// transfers.
+func Parse(r io.Reader, origin string) (*Zone, error) {
+	parser := dns.NewZoneParser(r, origin, "")
+	parser.SetDefaultTTL(3600)
+	var z *Zone
+	for {
+		rr, ok := parser.Next()
+		if !ok {
+			break
+		}
+		if z == nil {
+			soa, ok := rr.(*dns.SOA)
+			if !ok {
+				return nil, errors.New("the first record is not a SOA")
+			}
+			z = newZone(soa)
+			continue
+		}
+		z.add(rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if z == nil {
+		return nil, errors.New("empty zone")
+	}
+	return z, nil
+}
+
+// FromRRs builds a Zone from records, e.g. of a zone transfer. The first
+// record must be the SOA of the zone.
+func FromRRs(rrs []dns.RR) (*Zone, error) {
+	if len(rrs) == 0 {
+		return nil, errors.New("empty zone")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, errors.New("the first record is not a SOA")
+	}
+	z := newZone(soa)
+	for _, rr := range rrs[1:] {
+		if _, ok := rr.(*dns.SOA); ok {
+			continue // the trailing SOA of AXFR
+		}
+		z.add(rr)
+	}
+	return z, nil
+}
+
+func newZone(soa *dns.SOA) *Zone {
+	return &Zone{
+		Origin:   strings.ToLower(soa.Hdr.Name),
+		SOA:      soa,
+		exact:    make(map[string]*Rule),
+		wildcard: make(map[string]*Rule),
+	}
+}
+
+// unsupportedTriggers are the labels that end the owner names of
+// unsupported triggers.
+var unsupportedTriggers = map[string]struct{}{
+	"rpz-ip":        {},
+	"rpz-nsdname":   {},
+	"rpz-nsip":      {},
+	"rpz-client-ip": {},
+}
+
+func (z *Zone) add(rr dns.RR) {
+	h := rr.Header()
+	name := strings.ToLower(h.Name)
+	if name == z.Origin {
+		if h.Rrtype == dns.TypeNS {
+			z.NS = append(z.NS, rr)
+		}
+		return
+	}
+	rel, ok := strings.CutSuffix(name, "."+z.Origin)
+	if !ok {
+		if z.Origin != "." {
+			return // out of the zone
+		}
+		rel = strings.TrimSuffix(name, ".")
+	}
+	if i := strings.LastIndexByte(rel, '.'); i >= 0 {
+		if _, ok := unsupportedTriggers[rel[i+1:]]; ok {
+			z.Skipped++
+			return
+		}
+	}
+	trigger := rel + "."
+
+	rules := z.exact
+	key := trigger
+	if parent, ok := strings.CutPrefix(trigger, "*."); ok {
+		rules = z.wildcard
+		key = parent
+		if len(key) == 0 {
+			key = "." // "*" of the origin
+		}
+	}
+
+	action := ActionLocalData
+	if c, ok := rr.(*dns.CNAME); ok {
+		switch strings.ToLower(c.Target) {
+		case ".":
+			action = ActionNXDomain
+		case "*.":
+			action = ActionNoData
+		case "rpz-passthru.":
+			action = ActionPassthru
+		case "rpz-drop.":
+			action = ActionDrop
+		case "rpz-tcp-only.":
+			action = ActionTCPOnly
+		}
+	}
+
+	rule := rules[key]
+	if rule == nil {
+		rule = &Rule{Action: action}
+		rules[key] = rule
+	}
+	if action != ActionLocalData || rule.Action != ActionLocalData {
+		return // the first action wins
+	}
+	h.Name = trigger
+	rule.Data = append(rule.Data, rr)
+}
+
+// Len returns the number of triggers of z.
+func (z *Zone) Len() int {
+	return len(z.exact) + len(z.wildcard)
+}
+
+// Match returns the Rule of qname, which must be a lower case fqdn, or nil.
+// An exact trigger is preferred to wildcard triggers, and the wildcard
+// trigger of the closest parent is preferred to others. Wildcard triggers
+// do not match their parents.
+func (z *Zone) Match(qname string) *Rule {
+	if r := z.exact[qname]; r != nil {
+		return r
+	}
+	if len(z.wildcard) == 0 {
+		return nil
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(qname, off) {
+		if off == 0 {
+			continue
+		}
+		if r := z.wildcard[qname[off:]]; r != nil {
+			return r
+		}
+	}
+	return z.wildcard["."]
+}
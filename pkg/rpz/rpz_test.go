@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const data = `
+$TTL 300
+@                 SOA  localhost. root.localhost. 1 3600 600 86400 60
+                  NS   localhost.
+nx.example        CNAME .
+nodata.example    CNAME *.
+*.wild.example    CNAME .
+*.a.wild.example  CNAME rpz-passthru.
+pass.wild.example CNAME rpz-passthru.
+drop.example      CNAME rpz-drop.
+tcp.example       CNAME rpz-tcp-only.
+local.example     A    192.0.2.1
+local.example     TXT  "blocked"
+alias.example     CNAME safe.example.com.
+32.1.2.0.192.rpz-ip CNAME .
+ns.rpz-nsdname    CNAME .
+`
+
+func parse(t *testing.T) *Zone {
+	t.Helper()
+	z, err := Parse(strings.NewReader("$ORIGIN rpz.test.\n"+data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestParse(t *testing.T) {
+	z := parse(t)
+	if z.Origin != "rpz.test." || z.SOA == nil || len(z.NS) != 1 {
+		t.Fatalf("invalid zone apex, origin %s, soa %v, ns %v", z.Origin, z.SOA, z.NS)
+	}
+	if z.Skipped != 2 {
+		t.Fatalf("want 2 skipped records, got %d", z.Skipped)
+	}
+	if z.Len() != 9 {
+		t.Fatalf("want 9 triggers, got %d", z.Len())
+	}
+
+	if _, err := Parse(strings.NewReader("example. 300 A 192.0.2.1\n"), ""); err == nil {
+		t.Fatal("zone without soa is parsed")
+	}
+}
+
+func TestParse_origin(t *testing.T) {
+	z, err := Parse(strings.NewReader(data), "rpz.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z.Origin != "rpz.test." || z.Len() != 9 {
+		t.Fatalf("want 9 triggers of rpz.test., got %d of %s", z.Len(), z.Origin)
+	}
+	if r := z.Match("nx.example."); r == nil || r.Action != ActionNXDomain {
+		t.Fatalf("relative name is not parsed with the origin, got %v", r)
+	}
+}
+
+func TestZone_Match(t *testing.T) {
+	z := parse(t)
+	tests := []struct {
+		qname string
+		want  Action // 0 means no match
+	}{
+		{"nx.example.", ActionNXDomain},
+		{"sub.nx.example.", 0},
+		{"nodata.example.", ActionNoData},
+		{"wild.example.", 0},
+		{"b.wild.example.", ActionNXDomain},
+		{"c.b.wild.example.", ActionNXDomain},
+		{"x.a.wild.example.", ActionPassthru},
+		{"a.wild.example.", ActionNXDomain},
+		{"pass.wild.example.", ActionPassthru},
+		{"drop.example.", ActionDrop},
+		{"tcp.example.", ActionTCPOnly},
+		{"local.example.", ActionLocalData},
+		{"alias.example.", ActionLocalData},
+		{"example.", 0},
+	}
+	for _, tt := range tests {
+		r := z.Match(tt.qname)
+		var got Action
+		if r != nil {
+			got = r.Action
+		}
+		if got != tt.want {
+			t.Errorf("Match(%s) = %s, want %s", tt.qname, got, tt.want)
+		}
+	}
+
+	r := z.Match("local.example.")
+	if len(r.Data) != 2 || r.Data[0].Header().Name != "local.example." || r.CNAME() != nil {
+		t.Fatalf("invalid local data %v", r.Data)
+	}
+	if c := z.Match("alias.example.").CNAME(); c == nil || c.Target != "safe.example.com." {
+		t.Fatalf("invalid cname %v", c)
+	}
+}
+
+func TestFromRRs(t *testing.T) {
+	soa, _ := dns.NewRR("rpz.test. 300 SOA localhost. root.localhost. 1 3600 600 86400 60")
+	rr, _ := dns.NewRR("*.rpz.test. 300 CNAME .")
+	z, err := FromRRs([]dns.RR{soa, rr, dns.Copy(soa)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := z.Match("anything.example."); r == nil || r.Action != ActionNXDomain {
+		t.Fatalf("the wildcard of the origin does not match, got %v", r)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// isPKCS12 reports whether file is a PKCS#12 bundle by its extension.
+func isPKCS12(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".p12", ".pfx":
+		return true
+	}
+	return false
+}
+
+// keyPairLoader returns a func that loads a certificate like
+// tls.LoadX509KeyPair, but also accepts PKCS#12 bundles and encrypted
+// private keys. If certFile is a PKCS#12 bundle (see isPKCS12), keyFile
+// is ignored. Otherwise, keyFile may be an encrypted PKCS#8 key
+// ("ENCRYPTED PRIVATE KEY") or a legacy encrypted PEM key (with a
+// "Proc-Type: 4,ENCRYPTED" header). password is used to decrypt both.
+func keyPairLoader[T any](x509KeyPair func(certPEM, keyPEM []byte) (T, error), password string) func(certFile, keyFile string) (T, error) {
+	return func(certFile, keyFile string) (T, error) {
+		var zero T
+		certPEM, keyPEM, err := readKeyPair(certFile, keyFile, password)
+		if err != nil {
+			return zero, err
+		}
+		return x509KeyPair(certPEM, keyPEM)
+	}
+}
+
+func readKeyPair(certFile, keyFile, password string) (certPEM, keyPEM []byte, err error) {
+	if isPKCS12(certFile) {
+		return readPKCS12(certFile, password)
+	}
+
+	certPEM, err = os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = decryptKeyPEM(keyPEM, password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt private key, %w", err)
+	}
+	return certPEM, keyPEM, nil
+}
+
+// readPKCS12 reads the key and the certificate chain of a PKCS#12 bundle.
+func readPKCS12(file, password string) (certPEM, keyPEM []byte, err error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(b, password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode pkcs12 bundle, %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	for _, c := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return certPEM, keyPEM, nil
+}
+
+// LoadLeaf returns the leaf certificate of certFile, which can also be a
+// PKCS#12 bundle. password is only used by PKCS#12 bundles.
+func LoadLeaf(certFile, password string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if isPKCS12(certFile) {
+		_, leaf, _, err := pkcs12.DecodeChain(b, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode pkcs12 bundle, %w", err)
+		}
+		return leaf, nil
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in %s", certFile)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// decryptKeyPEM returns the unencrypted form of keyPEM. If keyPEM is not
+// encrypted, it is returned as is.
+func decryptKeyPEM(keyPEM []byte, password string) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		// Let x509KeyPair report the error.
+		return keyPEM, nil
+	}
+
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		if password == "" {
+			return nil, errors.New("private key is encrypted but no password is configured")
+		}
+		key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	case x509.IsEncryptedPEMBlock(block): // legacy rfc 1423 encryption
+		if password == "" {
+			return nil, errors.New("private key is encrypted but no password is configured")
+		}
+		der, err := x509.DecryptPEMBlock(block, []byte(password))
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+	default:
+		return keyPEM, nil
+	}
+}
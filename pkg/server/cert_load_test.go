@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func Test_keyPairLoader_pkcs12(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		password string
+		wantErr  bool
+	}{
+		{"password", "./testdata/test.test.p12", "test", false},
+		{"wrong password", "./testdata/test.test.p12", "wrong", true},
+		{"missing password", "./testdata/test.test.p12", "", true},
+		{"no password", "./testdata/test.test.nopass.p12", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The key file is ignored for PKCS#12 bundles.
+			c, err := keyPairLoader(tls.X509KeyPair, tt.password)(tt.file, "not_exist")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("load error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if c.PrivateKey == nil || len(c.Certificate) != 1 {
+				t.Fatalf("unexpected certificate %v", c)
+			}
+
+			leaf, err := LoadLeaf(tt.file, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := leaf.VerifyHostname("test.test"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
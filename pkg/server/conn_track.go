@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	eHttp "gitlab.com/go-extension/http"
+)
+
+// trackCloser decreases the ConnGauge once when it is closed.
+type trackCloser struct {
+	s    *Server
+	once sync.Once
+}
+
+// trackConn increases the ConnGauge for a new connection. The returned
+// trackCloser must be closed when the connection is closed.
+func (s *Server) trackConn() *trackCloser {
+	if s.opts.ConnGauge != nil {
+		s.opts.ConnGauge.Inc()
+	}
+	return &trackCloser{s: s}
+}
+
+func (t *trackCloser) Close() error {
+	t.once.Do(func() {
+		if t.s.opts.ConnGauge != nil {
+			t.s.opts.ConnGauge.Dec()
+		}
+	})
+	return nil
+}
+
+// streamOpened and streamClosed track DoQ streams and http requests.
+func (s *Server) streamOpened() {
+	if s.opts.StreamGauge != nil {
+		s.opts.StreamGauge.Inc()
+	}
+}
+
+func (s *Server) streamClosed() {
+	if s.opts.StreamGauge != nil {
+		s.opts.StreamGauge.Dec()
+	}
+}
+
+// trackedListener tracks the connections that it accepts. It hides the
+// type of the connections, so it is only used by cleartext listeners.
+type trackedListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &trackedConn{Conn: c, t: l.s.trackConn()}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	t *trackCloser
+}
+
+func (c *trackedConn) Close() error {
+	c.t.Close()
+	return c.Conn.Close()
+}
+
+// eHttpConnState tracks the connections of a http server that does not
+// hijack its connections.
+func (s *Server) eHttpConnState() func(net.Conn, eHttp.ConnState) {
+	var m sync.Map // net.Conn -> *trackCloser
+	return func(c net.Conn, state eHttp.ConnState) {
+		switch state {
+		case eHttp.StateNew:
+			m.Store(c, s.trackConn())
+		case eHttp.StateClosed, eHttp.StateHijacked:
+			if t, ok := m.LoadAndDelete(c); ok {
+				t.(*trackCloser).Close()
+			}
+		}
+	}
+}
+
+// quicConnContext tracks the connections of a http3 server.
+func (s *Server) quicConnContext(ctx context.Context, c *quic.Conn) context.Context {
+	t := s.trackConn()
+	go func() {
+		<-c.Context().Done()
+		t.Close()
+	}()
+	return ctx
+}
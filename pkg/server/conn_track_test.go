@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	H "github.com/pmkol/mosdns-x/pkg/server/http_handler"
+)
+
+// countGauge tracks its Inc and Dec calls.
+type countGauge struct {
+	prometheus.Gauge
+	n atomic.Int32
+}
+
+func (g *countGauge) Inc() { g.n.Add(1) }
+func (g *countGauge) Dec() { g.n.Add(-1) }
+
+// waitGauge waits until g is want.
+func waitGauge(t *testing.T, g *countGauge, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for g.n.Load() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("want gauge %d, got %d", want, g.n.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_trackCloser_Close(t *testing.T) {
+	g := new(countGauge)
+	s := NewServer(ServerOpts{ConnGauge: g})
+	tc := s.trackConn()
+	tc.Close()
+	tc.Close()
+	if got := g.n.Load(); got != 0 {
+		t.Fatalf("want gauge 0 after closing twice, got %d", got)
+	}
+}
+
+func Test_Server_ServeTCP_connGauge(t *testing.T) {
+	g := new(countGauge)
+	s := NewServer(ServerOpts{DNSHandler: replyHandler{}, ConnGauge: g})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTCP(l)
+	defer l.Close()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	waitGauge(t, g, 2)
+	for _, c := range conns {
+		c.Close()
+	}
+	waitGauge(t, g, 0)
+}
+
+func Test_Server_ServeH2C_streamGauge(t *testing.T) {
+	h := &blockingHandler{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	hh, err := H.NewHandler(H.HandlerOpts{DNSHandler: h, Path: "/dns-query"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns, streams := new(countGauge), new(countGauge)
+	s := NewServer(ServerOpts{HttpHandler: hh, ConnGauge: conns, StreamGauge: streams})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeH2C(l)
+	defer l.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	done := make(chan error, 1)
+	go func() {
+		resp, err := (&http.Client{Transport: tr}).Post("http://"+l.Addr().String()+"/dns-query", "application/dns-message", bytes.NewReader(b))
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	<-h.entered
+	if got := streams.n.Load(); got != 1 {
+		t.Fatalf("want 1 stream in progress, got %d", got)
+	}
+	waitGauge(t, conns, 1)
+	close(h.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	waitGauge(t, streams, 0)
+	tr.CloseIdleConnections()
+	waitGauge(t, conns, 0)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"crypto/rand"
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+func newCookieSecret(opts ServerOpts) *[dnsutils.CookieSecretLen]byte {
+	if !opts.Cookies {
+		return nil
+	}
+	secret := new([dnsutils.CookieSecretLen]byte)
+	if len(opts.CookieSecret) > 0 {
+		copy(secret[:], opts.CookieSecret)
+	} else {
+		_, _ = rand.Read(secret[:])
+	}
+	return secret
+}
+
+// checkCookie checks the cookie of the udp query q and removes it from q,
+// so it won't be forwarded to upstreams. If resp is not nil, q should
+// not be handled and resp is the response. Otherwise, clientCookie is the
+// client cookie of q, which is nil if q has no cookie. See setCookie.
+//
+// If RequireCookie is true, queries that have a client cookie but no valid
+// server cookie are answered with BADCOOKIE and a new server cookie, and
+// queries without a cookie are answered with TC, so they can only be
+// handled over TCP.
+func (s *Server) checkCookie(q *dns.Msg, clientAddr netip.Addr) (clientCookie []byte, resp *dns.Msg) {
+	c := dnsutils.GetMsgCookie(q)
+	if c == nil {
+		if s.opts.RequireCookie {
+			resp = new(dns.Msg)
+			resp.SetReply(q)
+			resp.Truncated = true
+			return nil, resp
+		}
+		return nil, nil
+	}
+	dnsutils.RemoveEDNS0Option(q.IsEdns0(), dns.EDNS0COOKIE)
+
+	clientCookie, serverCookie, ok := dnsutils.ParseCookie(c)
+	if !ok {
+		resp = new(dns.Msg)
+		resp.SetRcode(q, dns.RcodeFormatError)
+		return nil, resp
+	}
+	if s.opts.RequireCookie {
+		now := uint32(time.Now().Unix())
+		if !dnsutils.ValidServerCookie(s.cookieSecret, clientCookie, serverCookie, clientAddr, now) {
+			resp = new(dns.Msg)
+			resp.SetRcode(q, dns.RcodeBadCookie)
+			s.setCookie(resp, clientCookie, clientAddr)
+			return nil, resp
+		}
+	}
+	return clientCookie, nil
+}
+
+// setCookie sets the cookie of r with a new server cookie.
+func (s *Server) setCookie(r *dns.Msg, clientCookie []byte, clientAddr netip.Addr) {
+	serverCookie := dnsutils.NewServerCookie(s.cookieSecret, clientCookie, clientAddr, uint32(time.Now().Unix()))
+	dnsutils.SetCookie(r, clientCookie, serverCookie)
+}
@@ -0,0 +1,30 @@
+package dns_handler
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// Policies of queries from clients that are not in
+// EntryHandlerOpts.AllowedClients.
+const (
+	ClientDeniedRefuse = "refuse" // respond REFUSED (default)
+	ClientDeniedDrop   = "drop"   // return ErrClientDenied, servers will not respond
+)
+
+// ErrClientDenied is returned by EntryHandler.ServeDNS if the query is
+// dropped by the ClientDeniedDrop policy. It wraps
+// query_context.ErrDropQuery.
+var ErrClientDenied = fmt.Errorf("client is not allowed, %w", query_context.ErrDropQuery)
+
+// clientAllowed reports whether addr is in AllowedClients. Invalid
+// addresses, e.g. clients of unix sockets, are always allowed.
+func (h *EntryHandler) clientAllowed(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return true
+	}
+	ok, _ := h.opts.AllowedClients.Contains(addr.Unmap())
+	return ok
+}
@@ -0,0 +1,55 @@
+package dns_handler
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// Policies of queries beyond EntryHandlerOpts.MaxClientConcurrent.
+const (
+	ClientOverflowRefuse = "refuse" // respond REFUSED (default)
+	ClientOverflowDrop   = "drop"   // return ErrClientOverLimit, servers will not respond
+)
+
+// ErrClientOverLimit is returned by EntryHandler.ServeDNS if the query is
+// dropped by the ClientOverflowDrop policy. It wraps
+// query_context.ErrDropQuery.
+var ErrClientOverLimit = fmt.Errorf("too many concurrent queries from client, %w", query_context.ErrDropQuery)
+
+// clientLimiter tracks the in-flight queries of each client address.
+type clientLimiter struct {
+	max int
+
+	mu sync.Mutex
+	m  map[netip.Addr]int
+}
+
+func newClientLimiter(max int) *clientLimiter {
+	return &clientLimiter{max: max, m: make(map[netip.Addr]int)}
+}
+
+// acquire reports whether addr can start another query. If it returns
+// true, the caller must call release when the query is done.
+func (l *clientLimiter) acquire(addr netip.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.m[addr]
+	if n >= l.max {
+		return false
+	}
+	l.m[addr] = n + 1
+	return true
+}
+
+func (l *clientLimiter) release(addr netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := l.m[addr] - 1; n > 0 {
+		l.m[addr] = n
+	} else {
+		delete(l.m, addr)
+	}
+}
@@ -0,0 +1,82 @@
+package dns_handler
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DDRName is the name that clients query to discover the designated
+// resolvers. See RFC 9462.
+const DDRName = "_dns.resolver.arpa."
+
+const ddrTTL = 300
+
+// DDREndpoint is an encrypted transport of the designated resolver.
+type DDREndpoint struct {
+	ALPN    []string
+	Port    uint16
+	DoHPath string // Used by doh and doh3 endpoints, e.g. "/dns-query{?dns}".
+}
+
+// DDR answers the SVCB queries of DDRName with the endpoints of the
+// designated resolver. It is used by EntryHandler, after the client ACL
+// and limits, so denied clients do not discover the resolver.
+type DDR struct {
+	records []dns.RR
+}
+
+// NewDDR returns a DDR. target is the name of the designated resolver,
+// which is the name that its certificate is valid for.
+// The priorities of the endpoints are their orders.
+func NewDDR(target string, endpoints []DDREndpoint) *DDR {
+	target = dns.Fqdn(target)
+	records := make([]dns.RR, 0, len(endpoints))
+	for i, e := range endpoints {
+		rr := &dns.SVCB{
+			Hdr: dns.RR_Header{
+				Name:   DDRName,
+				Rrtype: dns.TypeSVCB,
+				Class:  dns.ClassINET,
+				Ttl:    ddrTTL,
+			},
+			Priority: uint16(i + 1),
+			Target:   target,
+		}
+		rr.Value = append(rr.Value, &dns.SVCBAlpn{Alpn: e.ALPN}, &dns.SVCBPort{Port: e.Port})
+		if len(e.DoHPath) > 0 {
+			rr.Value = append(rr.Value, &dns.SVCBDoHPath{Template: e.DoHPath})
+		}
+		records = append(records, rr)
+	}
+	return &DDR{records: records}
+}
+
+// isDDRQuery reports whether req is a query of DDRName.
+func isDDRQuery(req *dns.Msg) bool {
+	if len(req.Question) != 1 || req.Opcode != dns.OpcodeQuery || req.Response {
+		return false
+	}
+	q := req.Question[0]
+	return q.Qclass == dns.ClassINET && strings.EqualFold(q.Name, DDRName)
+}
+
+// response returns the response of req, or nil if req is not a DDR query.
+func (d *DDR) response(req *dns.Msg) *dns.Msg {
+	if !isDDRQuery(req) {
+		return nil
+	}
+	q := req.Question[0]
+	r := new(dns.Msg)
+	r.SetReply(req)
+	r.RecursionAvailable = true
+	if q.Qtype == dns.TypeSVCB {
+		r.Answer = make([]dns.RR, 0, len(d.records))
+		for _, rr := range d.records {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			r.Answer = append(r.Answer, rr)
+		}
+	}
+	return r
+}
@@ -0,0 +1,95 @@
+package dns_handler
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// countExec is replyExec that counts its queries.
+type countExec struct {
+	n *int
+}
+
+func (e countExec) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	*e.n++
+	return replyExec{}.Exec(ctx, qCtx, next)
+}
+
+func TestEntryHandler_DDR(t *testing.T) {
+	allowed := netlist.NewList()
+	allowed.Append(netip.MustParsePrefix("192.168.0.0/16"))
+	allowed.Sort()
+	ddr := NewDDR("dns.example", []DDREndpoint{
+		{ALPN: []string{"dot"}, Port: 853},
+		{ALPN: []string{"h2"}, Port: 443, DoHPath: "/dns-query{?dns}"},
+	})
+
+	for _, policy := range []string{ClientDeniedRefuse, ClientDeniedDrop} {
+		t.Run(policy, func(t *testing.T) {
+			var n int
+			h, err := NewEntryHandler(EntryHandlerOpts{
+				Entry:          countExec{n: &n},
+				AllowedClients: allowed,
+				ClientDenied:   policy,
+				DDR:            ddr,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			serve := func(client, name string, qtype uint16) (*dns.Msg, error) {
+				req := new(dns.Msg)
+				req.SetQuestion(name, qtype)
+				return h.ServeDNS(context.Background(), req, query_context.NewRequestMeta(netip.MustParseAddr(client)))
+			}
+
+			r, err := serve("192.168.1.1", DDRName, dns.TypeSVCB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{
+				"_dns.resolver.arpa.\t300\tIN\tSVCB\t1 dns.example. alpn=\"dot\" port=\"853\"",
+				"_dns.resolver.arpa.\t300\tIN\tSVCB\t2 dns.example. alpn=\"h2\" port=\"443\" dohpath=\"/dns-query{?dns}\"",
+			}
+			if len(r.Answer) != len(want) {
+				t.Fatalf("want %d answers, got %v", len(want), r.Answer)
+			}
+			for i, rr := range r.Answer {
+				if rr.String() != want[i] {
+					t.Fatalf("answer #%d, want %s, got %s", i, want[i], rr)
+				}
+			}
+			if r, err := serve("192.168.1.1", DDRName, dns.TypeA); err != nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+				t.Fatalf("want empty response, got %v, %v", r, err)
+			}
+			if n != 0 {
+				t.Fatalf("ddr queries are passed to the entry %d times", n)
+			}
+
+			// Other queries are passed to the entry.
+			if _, err := serve("192.168.1.1", "example.", dns.TypeSVCB); err != nil || n != 1 {
+				t.Fatalf("query was not passed to the entry, %v", err)
+			}
+
+			// Denied clients do not discover the resolver.
+			r, err = serve("10.0.0.1", DDRName, dns.TypeSVCB)
+			switch policy {
+			case ClientDeniedRefuse:
+				if err != nil || r.Rcode != dns.RcodeRefused || len(r.Answer) != 0 {
+					t.Fatalf("want refused, got %v, %v", r, err)
+				}
+			case ClientDeniedDrop:
+				if !errors.Is(err, ErrClientDenied) || r != nil {
+					t.Fatalf("want ErrClientDenied, got %v, %v", r, err)
+				}
+			}
+		})
+	}
+}
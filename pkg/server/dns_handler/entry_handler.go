@@ -3,13 +3,18 @@ package dns_handler
 import (
 	"context"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/pkg/allocaudit"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
@@ -18,12 +23,50 @@ const (
 	defaultQueryTimeout = time.Second * 5
 )
 
+// Policies of queries that do not have exactly one question.
+const (
+	QuestionPolicyRefuse  = "refuse"  // respond REFUSED (default)
+	QuestionPolicyFormErr = "formerr" // respond FORMERR
+	QuestionPolicyFirst   = "first"   // only process the first question, multi-question queries only
+)
+
 var nopLogger = zap.NewNop()
 
 type Handler interface {
 	ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error)
 }
 
+// RawHandler is a Handler that can respond packed msgs, e.g. cache hits,
+// so servers can send them without unpacking and packing them again.
+type RawHandler interface {
+	Handler
+	// ServeDNSRaw is like ServeDNS, but if raw is not nil, it is the
+	// packed response and r is nil. The caller owns raw.
+	ServeDNSRaw(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (r *dns.Msg, raw []byte, err error)
+}
+
+// ServeRaw calls h.ServeDNSRaw if h is a RawHandler, otherwise h.ServeDNS.
+func ServeRaw(ctx context.Context, h Handler, req *dns.Msg, meta *query_context.RequestMeta) (r *dns.Msg, raw []byte, err error) {
+	if rh, ok := h.(RawHandler); ok {
+		return rh.ServeDNSRaw(ctx, req, meta)
+	}
+	r, err = h.ServeDNS(ctx, req, meta)
+	return r, nil, err
+}
+
+// UnpackRaw returns r, or the unpacked raw if r is nil. It is used by
+// callers of ServeRaw that need the response as a msg.
+func UnpackRaw(r *dns.Msg, raw []byte) (*dns.Msg, error) {
+	if r != nil || raw == nil {
+		return r, nil
+	}
+	r = new(dns.Msg)
+	if err := r.Unpack(raw); err != nil {
+		return nil, fmt.Errorf("failed to unpack raw response, %w", err)
+	}
+	return r, nil
+}
+
 type EntryHandlerOpts struct {
 	Logger             *zap.Logger
 	Entry              executable_seq.Executable
@@ -36,6 +79,43 @@ type EntryHandlerOpts struct {
 	BlockHTTPS  bool
 	BlockNoDot  bool
 	StripEDNS0  bool
+
+	// ZeroQuestion is the policy of queries without question.
+	// Can be QuestionPolicyRefuse or QuestionPolicyFormErr.
+	ZeroQuestion string
+	// MultiQuestion is the policy of queries with more than one question.
+	// Can be QuestionPolicyRefuse, QuestionPolicyFormErr or QuestionPolicyFirst.
+	MultiQuestion string
+	// ZeroQuestionCounter and MultiQuestionCounter count such queries. Optional.
+	ZeroQuestionCounter  prometheus.Counter
+	MultiQuestionCounter prometheus.Counter
+
+	// MaxClientConcurrent is the max number of in-flight queries of a
+	// client address. Zero means no limit.
+	MaxClientConcurrent int
+	// ClientOverflow is the policy of queries beyond MaxClientConcurrent.
+	// Can be ClientOverflowRefuse or ClientOverflowDrop.
+	ClientOverflow string
+	// ClientOverflowCounter counts such queries. Optional.
+	ClientOverflowCounter prometheus.Counter
+
+	// ChaosVersion and ChaosHostname are the answers of TXT CH queries of
+	// "version.bind." ("version.server.") and "hostname.bind." ("id.server.").
+	// Such queries are refused like other non-IN queries if the answer is empty.
+	ChaosVersion  string
+	ChaosHostname string
+
+	// AllowedClients optionally limits the client addresses that can send
+	// queries. Queries from other clients are handled by ClientDenied,
+	// which can be ClientDeniedRefuse or ClientDeniedDrop.
+	AllowedClients *netlist.List
+	ClientDenied   string
+	// ClientDeniedCounter counts such queries. Optional.
+	ClientDeniedCounter prometheus.Counter
+
+	// DDR optionally answers the DDR queries (RFC 9462) of the clients
+	// that pass the client ACL and limits, instead of Entry.
+	DDR *DDR
 }
 
 func (opts *EntryHandlerOpts) Init() error {
@@ -46,21 +126,73 @@ func (opts *EntryHandlerOpts) Init() error {
 		return errors.New("nil entry")
 	}
 	utils.SetDefaultNum(&opts.QueryTimeout, defaultQueryTimeout)
+	switch opts.ZeroQuestion {
+	case "":
+		opts.ZeroQuestion = QuestionPolicyRefuse
+	case QuestionPolicyRefuse, QuestionPolicyFormErr:
+	default:
+		return fmt.Errorf("invalid zero question policy %s", opts.ZeroQuestion)
+	}
+	switch opts.MultiQuestion {
+	case "":
+		opts.MultiQuestion = QuestionPolicyRefuse
+	case QuestionPolicyRefuse, QuestionPolicyFormErr, QuestionPolicyFirst:
+	default:
+		return fmt.Errorf("invalid multi question policy %s", opts.MultiQuestion)
+	}
+	if opts.MaxClientConcurrent < 0 {
+		return fmt.Errorf("invalid max client concurrent %d", opts.MaxClientConcurrent)
+	}
+	switch opts.ClientOverflow {
+	case "":
+		opts.ClientOverflow = ClientOverflowRefuse
+	case ClientOverflowRefuse, ClientOverflowDrop:
+	default:
+		return fmt.Errorf("invalid client overflow policy %s", opts.ClientOverflow)
+	}
+	switch opts.ClientDenied {
+	case "":
+		opts.ClientDenied = ClientDeniedRefuse
+	case ClientDeniedRefuse, ClientDeniedDrop:
+	default:
+		return fmt.Errorf("invalid client denied policy %s", opts.ClientDenied)
+	}
 	return nil
 }
 
 type EntryHandler struct {
-	opts EntryHandlerOpts
+	opts          EntryHandlerOpts
+	clientLimiter *clientLimiter // nil if there is no limit
 }
 
 func NewEntryHandler(opts EntryHandlerOpts) (Handler, error) {
 	if err := opts.Init(); err != nil {
 		return nil, err
 	}
-	return &EntryHandler{opts: opts}, nil
+	h := &EntryHandler{opts: opts}
+	if opts.MaxClientConcurrent > 0 {
+		h.clientLimiter = newClientLimiter(opts.MaxClientConcurrent)
+	}
+	return h, nil
 }
 
 func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	r, raw, err := h.ServeDNSRaw(ctx, req, meta)
+	if err != nil {
+		return nil, err
+	}
+	return UnpackRaw(r, raw)
+}
+
+func (h *EntryHandler) ServeDNSRaw(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, []byte, error) {
+	defer allocaudit.Begin().End(allocaudit.Handler)
+
+	// 0. Client ACL
+	if h.opts.AllowedClients != nil && !h.clientAllowed(meta.GetClientAddr()) {
+		r, err := h.handleClientDenied(req)
+		return r, nil, err
+	}
+
 	// 1. Context & Deadline Setup
 	qCtx := ctx
 	cancel := func() {}
@@ -73,13 +205,14 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 
 	// 2. Optimized Structural & Protocol Validation
 	if len(req.Question) != 1 {
-		h.opts.Logger.Debug("refused: invalid question count", zap.Uint16("id", req.Id))
-		return h.responseRefused(req), nil
+		if r := h.handleQuestionCount(req); r != nil {
+			return r, nil, nil
+		}
 	}
 
 	if req.Opcode != dns.OpcodeQuery {
 		h.opts.Logger.Debug("refused: unusual opcode", zap.Uint16("id", req.Id))
-		return h.responseRefused(req), nil
+		return h.responseRefused(req), nil, nil
 	}
 
 	// 3. RFC 8482 & Early Noise Filtering
@@ -103,7 +236,7 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 		if h.opts.RecursionAvailable {
 			r.RecursionAvailable = true
 		}
-		return r, nil
+		return r, nil, nil
 	}
 
 	// Early Noise Filtering based on options
@@ -115,7 +248,7 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 		if h.opts.RecursionAvailable {
 			r.RecursionAvailable = true
 		}
-		return r, nil
+		return r, nil, nil
 	}
 
 	// 4. Domain Validation & Lowercase Check (Single Pass)
@@ -135,7 +268,7 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 
 	// Optional check for missing dot separator (e.g., "localhost.")
 	if h.opts.BlockNoDot && !hasDot {
-		return h.responseNXDomain(req), nil
+		return h.responseNXDomain(req), nil, nil
 	}
 
 	// Only perform allocation if uppercase characters were detected
@@ -144,15 +277,20 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 	}
 
 	// 5. Final Hygiene Checks
+	if q.Qclass == dns.ClassCHAOS {
+		if r := h.handleChaos(req); r != nil {
+			return r, nil, nil
+		}
+	}
 	if q.Qclass != dns.ClassINET {
 		h.opts.Logger.Debug("refused: unsupported qclass", zap.Uint16("id", req.Id))
-		return h.responseRefused(req), nil
+		return h.responseRefused(req), nil, nil
 	}
 
 	if req.Response || req.Authoritative || req.Truncated ||
 		req.RecursionAvailable || req.Zero || len(req.Answer) != 0 || len(req.Ns) != 0 {
 		h.opts.Logger.Debug("refused: malformed header flags or sections", zap.Uint16("id", req.Id))
-		return h.responseRefused(req), nil
+		return h.responseRefused(req), nil, nil
 	}
 
 	// 6. Strip EDNS0 before context creation
@@ -161,14 +299,33 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 	}
 
 	// 7. Execution Flow
+	if h.clientLimiter != nil {
+		if addr := meta.GetClientAddr(); addr.IsValid() {
+			if !h.clientLimiter.acquire(addr) {
+				r, err := h.handleClientOverflow(req)
+				return r, nil, err
+			}
+			defer h.clientLimiter.release(addr)
+		}
+	}
+
+	if h.opts.DDR != nil {
+		if r := h.opts.DDR.response(req); r != nil {
+			return r, nil, nil
+		}
+	}
+
 	origID := req.Id
 	queryCtx := query_context.NewContext(req, meta)
 
 	err := h.opts.Entry.Exec(qCtx, queryCtx, nil)
-	respMsg := queryCtx.R()
 
 	// 8. Logging
 	if err != nil {
+		if errors.Is(err, query_context.ErrDropQuery) {
+			h.opts.Logger.Debug("query dropped", queryCtx.InfoField(), zap.Error(err))
+			return nil, nil, err
+		}
 		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 			h.opts.Logger.Debug("query interrupted", queryCtx.InfoField(), zap.Error(err))
 		} else {
@@ -177,6 +334,16 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 	}
 
 	// 9. Response Finalization
+	// A packed response, e.g. a cache hit, is patched in place.
+	if raw := queryCtx.RawR(); raw != nil {
+		if h.opts.RecursionAvailable {
+			dnsutils.SetRawRecursionAvailable(raw)
+		}
+		dnsutils.SetRawID(raw, origID)
+		return nil, raw, nil
+	}
+
+	respMsg := queryCtx.MutableR()
 	if respMsg == nil {
 		if err == nil {
 			h.opts.Logger.Error("entry returned with nil response", queryCtx.InfoField())
@@ -197,7 +364,93 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 	}
 	respMsg.Id = origID
 
-	return respMsg, nil
+	return respMsg, nil, nil
+}
+
+// handleQuestionCount applies the question policies to req. It returns
+// the response if req should not be processed.
+func (h *EntryHandler) handleQuestionCount(req *dns.Msg) *dns.Msg {
+	policy := h.opts.MultiQuestion
+	counter := h.opts.MultiQuestionCounter
+	if len(req.Question) == 0 {
+		policy = h.opts.ZeroQuestion
+		counter = h.opts.ZeroQuestionCounter
+	}
+	if counter != nil {
+		counter.Inc()
+	}
+
+	switch policy {
+	case QuestionPolicyFirst:
+		req.Question = req.Question[:1]
+		return nil
+	case QuestionPolicyFormErr:
+		h.opts.Logger.Debug("formerr: invalid question count", zap.Uint16("id", req.Id))
+		res := h.responseRefused(req)
+		res.Rcode = dns.RcodeFormatError
+		return res
+	default:
+		h.opts.Logger.Debug("refused: invalid question count", zap.Uint16("id", req.Id))
+		return h.responseRefused(req)
+	}
+}
+
+// handleChaos returns the response of the CH query req, or nil if req
+// should be refused.
+func (h *EntryHandler) handleChaos(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	var txt string
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		txt = h.opts.ChaosVersion
+	case "hostname.bind.", "id.server.":
+		txt = h.opts.ChaosHostname
+	}
+	if len(txt) == 0 {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(req)
+	r.Authoritative = true
+	if h.opts.RecursionAvailable {
+		r.RecursionAvailable = true
+	}
+	if q.Qtype == dns.TypeTXT {
+		r.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassCHAOS,
+			},
+			Txt: []string{txt},
+		}}
+	}
+	return r
+}
+
+// handleClientOverflow applies the client overflow policy to req.
+func (h *EntryHandler) handleClientOverflow(req *dns.Msg) (*dns.Msg, error) {
+	if h.opts.ClientOverflowCounter != nil {
+		h.opts.ClientOverflowCounter.Inc()
+	}
+	if h.opts.ClientOverflow == ClientOverflowDrop {
+		return nil, ErrClientOverLimit
+	}
+	h.opts.Logger.Debug("refused: too many concurrent queries from client", zap.Uint16("id", req.Id))
+	return h.responseRefused(req), nil
+}
+
+// handleClientDenied applies the client denied policy to req.
+func (h *EntryHandler) handleClientDenied(req *dns.Msg) (*dns.Msg, error) {
+	if h.opts.ClientDeniedCounter != nil {
+		h.opts.ClientDeniedCounter.Inc()
+	}
+	if h.opts.ClientDenied == ClientDeniedDrop {
+		return nil, ErrClientDenied
+	}
+	h.opts.Logger.Debug("refused: client is not allowed", zap.Uint16("id", req.Id))
+	return h.responseRefused(req), nil
 }
 
 func (h *EntryHandler) responseRefused(req *dns.Msg) *dns.Msg {
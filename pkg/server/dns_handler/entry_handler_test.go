@@ -2,8 +2,12 @@ package dns_handler
 
 import (
 	"context"
+	"errors"
+	"net/netip"
 	"testing"
 	"github.com/miekg/dns"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 )
 
@@ -27,3 +31,254 @@ func (d *DummyServerHandler) ServeDNS(_ context.Context, req *dns.Msg, meta *que
 	}
 	return resp, nil
 }
+
+type replyExec struct{}
+
+func (replyExec) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func TestEntryHandler_QuestionPolicy(t *testing.T) {
+	q1 := dns.Question{Name: "a.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	q2 := dns.Question{Name: "b.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	tests := []struct {
+		name      string
+		opts      EntryHandlerOpts
+		questions []dns.Question
+		wantRcode int
+		wantQ     int
+	}{
+		{"zero default", EntryHandlerOpts{}, nil, dns.RcodeRefused, 0},
+		{"zero formerr", EntryHandlerOpts{ZeroQuestion: QuestionPolicyFormErr}, nil, dns.RcodeFormatError, 0},
+		{"multi default", EntryHandlerOpts{}, []dns.Question{q1, q2}, dns.RcodeRefused, 1},
+		{"multi formerr", EntryHandlerOpts{MultiQuestion: QuestionPolicyFormErr}, []dns.Question{q1, q2}, dns.RcodeFormatError, 1},
+		{"multi first", EntryHandlerOpts{MultiQuestion: QuestionPolicyFirst}, []dns.Question{q1, q2}, dns.RcodeSuccess, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Entry = replyExec{}
+			h, err := NewEntryHandler(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := new(dns.Msg)
+			req.Id = dns.Id()
+			req.Question = tt.questions
+			r, err := h.ServeDNS(context.Background(), req, query_context.NewRequestMeta(netip.Addr{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != tt.wantRcode || len(r.Question) != tt.wantQ {
+				t.Fatalf("got rcode %d with %d questions, want rcode %d with %d questions", r.Rcode, len(r.Question), tt.wantRcode, tt.wantQ)
+			}
+		})
+	}
+
+	if _, err := NewEntryHandler(EntryHandlerOpts{Entry: replyExec{}, ZeroQuestion: QuestionPolicyFirst}); err == nil {
+		t.Fatal("first policy should be invalid for zero question queries")
+	}
+}
+
+type blockExec struct {
+	started chan struct{}
+	done    chan struct{}
+}
+
+func (e blockExec) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	e.started <- struct{}{}
+	<-e.done
+	return replyExec{}.Exec(ctx, qCtx, next)
+}
+
+func TestEntryHandler_ClientConcurrent(t *testing.T) {
+	for _, policy := range []string{ClientOverflowRefuse, ClientOverflowDrop} {
+		t.Run(policy, func(t *testing.T) {
+			e := blockExec{started: make(chan struct{}, 4), done: make(chan struct{})}
+			h, err := NewEntryHandler(EntryHandlerOpts{Entry: e, MaxClientConcurrent: 1, ClientOverflow: policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			serve := func(addr string) (*dns.Msg, error) {
+				req := new(dns.Msg)
+				req.SetQuestion("example.", dns.TypeA)
+				return h.ServeDNS(context.Background(), req, query_context.NewRequestMeta(netip.MustParseAddr(addr)))
+			}
+
+			errC := make(chan error, 1)
+			go func() {
+				_, err := serve("127.0.0.1")
+				errC <- err
+			}()
+			<-e.started
+
+			r, err := serve("127.0.0.1")
+			switch policy {
+			case ClientOverflowRefuse:
+				if err != nil || r.Rcode != dns.RcodeRefused {
+					t.Fatalf("want refused, got %v, %v", r, err)
+				}
+			case ClientOverflowDrop:
+				if !errors.Is(err, ErrClientOverLimit) {
+					t.Fatalf("want ErrClientOverLimit, got %v, %v", r, err)
+				}
+			}
+
+			// Other clients are not limited.
+			go func() {
+				_, err := serve("127.0.0.2")
+				errC <- err
+			}()
+			<-e.started
+			close(e.done)
+			for i := 0; i < 2; i++ {
+				if err := <-errC; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The slot is released.
+			if r, err := serve("127.0.0.1"); err != nil || r.Rcode != dns.RcodeSuccess {
+				t.Fatalf("want success, got %v, %v", r, err)
+			}
+		})
+	}
+}
+
+func TestEntryHandler_AllowedClients(t *testing.T) {
+	allowed := netlist.NewList()
+	allowed.Append(netip.MustParsePrefix("192.168.0.0/16"), netip.MustParsePrefix("2001:db8::/32"))
+	allowed.Sort()
+
+	for _, policy := range []string{ClientDeniedRefuse, ClientDeniedDrop} {
+		t.Run(policy, func(t *testing.T) {
+			h, err := NewEntryHandler(EntryHandlerOpts{Entry: replyExec{}, AllowedClients: allowed, ClientDenied: policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			serve := func(addr netip.Addr) (*dns.Msg, error) {
+				req := new(dns.Msg)
+				req.SetQuestion("example.", dns.TypeA)
+				return h.ServeDNS(context.Background(), req, query_context.NewRequestMeta(addr))
+			}
+
+			for _, addr := range []string{"192.168.1.1", "::ffff:192.168.1.1", "2001:db8::1"} {
+				if r, err := serve(netip.MustParseAddr(addr)); err != nil || r.Rcode != dns.RcodeSuccess {
+					t.Fatalf("%s: want success, got %v, %v", addr, r, err)
+				}
+			}
+			// Clients without an ip address, e.g. of unix sockets, are allowed.
+			if r, err := serve(netip.Addr{}); err != nil || r.Rcode != dns.RcodeSuccess {
+				t.Fatalf("want success, got %v, %v", r, err)
+			}
+
+			r, err := serve(netip.MustParseAddr("10.0.0.1"))
+			switch policy {
+			case ClientDeniedRefuse:
+				if err != nil || r.Rcode != dns.RcodeRefused {
+					t.Fatalf("want refused, got %v, %v", r, err)
+				}
+			case ClientDeniedDrop:
+				if !errors.Is(err, ErrClientDenied) || !errors.Is(err, query_context.ErrDropQuery) {
+					t.Fatalf("want ErrClientDenied, got %v, %v", r, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEntryHandler_Chaos(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      EntryHandlerOpts
+		qname     string
+		qtype     uint16
+		wantRcode int
+		wantTxt   string
+	}{
+		{"refused by default", EntryHandlerOpts{}, "version.bind.", dns.TypeTXT, dns.RcodeRefused, ""},
+		{"version", EntryHandlerOpts{ChaosVersion: "v1"}, "VERSION.bind.", dns.TypeTXT, dns.RcodeSuccess, "v1"},
+		{"version.server", EntryHandlerOpts{ChaosVersion: "v1"}, "version.server.", dns.TypeTXT, dns.RcodeSuccess, "v1"},
+		{"hostname", EntryHandlerOpts{ChaosHostname: "ns1"}, "hostname.bind.", dns.TypeTXT, dns.RcodeSuccess, "ns1"},
+		{"id.server", EntryHandlerOpts{ChaosHostname: "ns1"}, "id.server.", dns.TypeTXT, dns.RcodeSuccess, "ns1"},
+		{"hostname not set", EntryHandlerOpts{ChaosVersion: "v1"}, "hostname.bind.", dns.TypeTXT, dns.RcodeRefused, ""},
+		{"no data", EntryHandlerOpts{ChaosVersion: "v1"}, "version.bind.", dns.TypeA, dns.RcodeSuccess, ""},
+		{"other names", EntryHandlerOpts{ChaosVersion: "v1"}, "example.", dns.TypeTXT, dns.RcodeRefused, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Entry = replyExec{}
+			h, err := NewEntryHandler(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, tt.qtype)
+			req.Question[0].Qclass = dns.ClassCHAOS
+			r, err := h.ServeDNS(context.Background(), req, query_context.NewRequestMeta(netip.Addr{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var txt string
+			if len(r.Answer) == 1 {
+				txt = r.Answer[0].(*dns.TXT).Txt[0]
+			}
+			if r.Rcode != tt.wantRcode || txt != tt.wantTxt {
+				t.Fatalf("got rcode %d with txt %q, want rcode %d with txt %q", r.Rcode, txt, tt.wantRcode, tt.wantTxt)
+			}
+		})
+	}
+}
+
+// rawReplyExec sets a packed response with a wrong id.
+type rawReplyExec struct{}
+
+func (rawReplyExec) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Id++
+	raw, err := r.Pack()
+	if err != nil {
+		return err
+	}
+	qCtx.SetRawResponse(raw)
+	return nil
+}
+
+func TestEntryHandler_ServeDNSRaw(t *testing.T) {
+	h, err := NewEntryHandler(EntryHandlerOpts{Entry: rawReplyExec{}, RecursionAvailable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	wantID := req.Id
+
+	// Wrappers pass the packed response through.
+	var sh Handler = NewSwappableHandler(h)
+	r, raw, err := ServeRaw(context.Background(), sh, req.Copy(), query_context.NewRequestMeta(netip.Addr{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != nil || raw == nil {
+		t.Fatalf("want a packed response, got %v, %v", r, raw)
+	}
+	r, err = UnpackRaw(nil, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != wantID || !r.RecursionAvailable {
+		t.Fatalf("packed response is not patched, %+v", r.MsgHdr)
+	}
+
+	// ServeDNS unpacks it.
+	r, err = sh.ServeDNS(context.Background(), req.Copy(), query_context.NewRequestMeta(netip.Addr{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || r.Id != wantID || !r.RecursionAvailable {
+		t.Fatalf("invalid response %v", r)
+	}
+}
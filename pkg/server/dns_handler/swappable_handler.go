@@ -0,0 +1,36 @@
+package dns_handler
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// SwappableHandler passes queries to a Handler that can be swapped
+// while it is serving, e.g. on a config reload.
+type SwappableHandler struct {
+	h atomic.Pointer[Handler]
+}
+
+func NewSwappableHandler(h Handler) *SwappableHandler {
+	s := new(SwappableHandler)
+	s.Swap(h)
+	return s
+}
+
+// Swap replaces the Handler. Queries that are being served by the old
+// Handler are not affected.
+func (s *SwappableHandler) Swap(h Handler) {
+	s.h.Store(&h)
+}
+
+func (s *SwappableHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	return (*s.h.Load()).ServeDNS(ctx, req, meta)
+}
+
+func (s *SwappableHandler) ServeDNSRaw(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, []byte, error) {
+	return ServeRaw(ctx, *s.h.Load(), req, meta)
+}
@@ -48,11 +48,27 @@ func (s *Server) ServeHTTP(l net.Listener) error {
 
 	hs := &http.Server{
 		Handler:           &eHttpHandlerWrapper{s},
-		ReadHeaderTimeout: defaultReadHeaderTimeout,
-		ReadTimeout:       defaultReadTimeout,
+		ReadHeaderTimeout: s.readHeaderTimeout(),
+		ReadTimeout:       s.readTimeout(),
+		WriteTimeout:      s.opts.WriteTimeout,
 		IdleTimeout:       idleTimeout,
 		MaxHeaderBytes:    defaultMaxHeaderBytes,
+		ConnState:         s.eHttpConnState(),
 	}
 
 	return hs.Serve(l)
 }
+
+func (s *Server) readHeaderTimeout() time.Duration {
+	if s.opts.ReadHeaderTimeout > 0 {
+		return s.opts.ReadHeaderTimeout
+	}
+	return defaultReadHeaderTimeout
+}
+
+func (s *Server) readTimeout() time.Duration {
+	if s.opts.ReadTimeout > 0 {
+		return s.opts.ReadTimeout
+	}
+	return defaultReadTimeout
+}
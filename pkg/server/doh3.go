@@ -25,6 +25,7 @@ func (s *Server) ServeH3(l *quic.EarlyListener) error {
 		Handler:        &httpHandlerWrapper{s},
 		IdleTimeout:    idleTimeout,
 		MaxHeaderBytes: 4096,
+		ConnContext:    s.quicConnContext,
 	}
 
 	return hs.ServeListener(l)
@@ -4,18 +4,29 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"sync/atomic"
 
+	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/mlog"
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/pool"
 	C "github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/server/dns_handler"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
+// DoQNextProtos are the ALPN tokens accepted by the DoQ listener. The
+// draft tokens are kept for older clients. Drafts before -03 do not
+// prefix messages with their length.
+var DoQNextProtos = []string{"doq", "doq-i11", "doq-i02"}
+
+const alpnDoQNoLengthPrefix = "doq-i02"
+
 type quicCloser struct {
 	closed atomic.Bool
 	conn   *quic.Conn
@@ -55,11 +66,15 @@ func (s *Server) ServeQUIC(l *quic.EarlyListener) error {
 		go func() {
 			defer closer.close(0)
 			defer cancelConn()
+			defer s.trackConn().Close()
 
 			clientAddr := utils.GetAddrFromAddr(c.RemoteAddr())
 			meta := C.NewRequestMeta(clientAddr)
 			meta.SetProtocol(C.ProtocolQUIC)
+			meta.SetServerAddr(utils.GetAddrPortFromAddr(c.LocalAddr()))
 			meta.SetServerName(c.ConnectionState().TLS.ServerName)
+			meta.SetClientCertSubject(clientCertSubject(c.ConnectionState().TLS.VerifiedChains))
+			noLengthPrefix := c.ConnectionState().TLS.NegotiatedProtocol == alpnDoQNoLengthPrefix
 
 			// Idle timeout và first-read timeout được quản lý hoàn toàn bởi
 			// quic-go qua MaxIdleTimeout trong quic.Config (cấu hình ở tls.go).
@@ -76,6 +91,9 @@ func (s *Server) ServeQUIC(l *quic.EarlyListener) error {
 				}
 
 				go func() {
+					s.streamOpened()
+					defer s.streamClosed()
+
 					readDone := false
 					defer func() {
 						if !readDone {
@@ -87,7 +105,7 @@ func (s *Server) ServeQUIC(l *quic.EarlyListener) error {
 					req := pool.GetMsg()
 					defer pool.ReleaseMsg(req)
 
-					_, err := dnsutils.ReadMsgFromTCP(stream, req)
+					err := readDoQMsg(stream, req, noLengthPrefix)
 					if err != nil {
 						stream.CancelRead(1)
 						stream.CancelWrite(1)
@@ -103,31 +121,69 @@ func (s *Server) ServeQUIC(l *quic.EarlyListener) error {
 						return
 					}
 
-					r, err := handler.ServeDNS(quicConnCtx, req, meta)
+					padding := dnsutils.HasPadding(req)
+					r, raw, err := dns_handler.ServeRaw(quicConnCtx, handler, req, meta)
+					if err == nil && raw != nil && padding {
+						r, err = dns_handler.UnpackRaw(nil, raw)
+						raw = nil
+					}
 					if err != nil {
 						stream.CancelWrite(1)
 						s.opts.Logger.Debug("handler err", zap.Error(err))
 						return
 					}
 
-					b, buf, err := pool.PackBuffer(r)
-					if err != nil {
-						stream.CancelWrite(1)
-						s.opts.Logger.Error("failed to pack handler's response", zap.Error(err), zap.Stringer("msg", r))
-						return
+					b := raw
+					if b == nil {
+						dnsutils.SetCompress(r, s.opts.Compression, dns.MaxMsgSize)
+						if padding {
+							dnsutils.PadToBlock(r, dnsutils.ResponsePaddingBlockLen)
+						}
+						var buf *pool.Buffer
+						b, buf, err = pool.PackMsg(r)
+						if err != nil {
+							stream.CancelWrite(1)
+							s.opts.Logger.Error("failed to pack handler's response", zap.Error(err), zap.Stringer("msg", r))
+							return
+						}
+						defer buf.Release()
 					}
-					defer buf.Release()
 
-					if _, err := dnsutils.WriteRawMsgToTCP(stream, b); err != nil {
+					if err := writeDoQMsg(stream, b, noLengthPrefix); err != nil {
 						stream.CancelWrite(1)
 						errStr := err.Error()
 						if errors.Is(err, context.Canceled) || strings.Contains(errStr, "0x1") {
 							return
 						}
-						s.opts.Logger.Debug("failed to write response", zap.Stringer("client", c.RemoteAddr()), zap.Error(err))
+						s.opts.Logger.Debug("failed to write response", mlog.ClientAddr("client", c.RemoteAddr()), zap.Error(err))
 					}
 				}()
 			}
 		}()
 	}
 }
+
+// readDoQMsg reads a query from stream. If noLengthPrefix is true, the
+// query is the whole stream.
+func readDoQMsg(stream io.Reader, m *dns.Msg, noLengthPrefix bool) error {
+	if !noLengthPrefix {
+		_, err := dnsutils.ReadMsgFromTCP(stream, m)
+		return err
+	}
+	buf := pool.GetBuf(dns.MaxMsgSize)
+	defer buf.Release()
+	n, err := io.ReadFull(stream, buf.Bytes())
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return m.Unpack(buf.Bytes()[:n])
+}
+
+func writeDoQMsg(stream io.Writer, b []byte, noLengthPrefix bool) error {
+	if !noLengthPrefix {
+		_, err := dnsutils.WriteRawMsgToTCP(stream, b)
+		return err
+	}
+	_, err := stream.Write(b)
+	return err
+}
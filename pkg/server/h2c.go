@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ServeH2C serves DoH over cleartext HTTP/2, for deployments where TLS is
+// terminated by a front proxy. HTTP/2 connections are accepted with prior
+// knowledge or upgraded from HTTP/1.1. Plain HTTP/1.1 requests are served
+// as well.
+func (s *Server) ServeH2C(l net.Listener) error {
+	defer l.Close()
+
+	if s.opts.HttpHandler == nil {
+		return errMissingHTTPHandler
+	}
+
+	idleTimeout := s.opts.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultTCPIdleTimeout
+	}
+
+	hs := &http.Server{
+		Handler:           h2c.NewHandler(&httpHandlerWrapper{s}, &http2.Server{IdleTimeout: idleTimeout}),
+		ReadHeaderTimeout: s.readHeaderTimeout(),
+		ReadTimeout:       s.readTimeout(),
+		WriteTimeout:      s.opts.WriteTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    defaultMaxHeaderBytes,
+	}
+
+	return hs.Serve(&trackedListener{Listener: l, s: s})
+}
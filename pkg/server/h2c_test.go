@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+
+	C "github.com/pmkol/mosdns-x/pkg/query_context"
+	H "github.com/pmkol/mosdns-x/pkg/server/http_handler"
+)
+
+type replyHandler struct{}
+
+func (replyHandler) ServeDNS(_ context.Context, q *dns.Msg, _ *C.RequestMeta) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	return r, nil
+}
+
+func Test_Server_ServeH2C(t *testing.T) {
+	hh, err := H.NewHandler(H.HandlerOpts{DNSHandler: replyHandler{}, Path: "/dns-query"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(ServerOpts{HttpHandler: hh})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeH2C(l)
+	defer l.Close()
+
+	priorKnowledge := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	}
+	defer priorKnowledge.CloseIdleConnections()
+	http1 := &http.Transport{}
+	defer http1.CloseIdleConnections()
+
+	tests := []struct {
+		name      string
+		transport http.RoundTripper
+		wantProto int
+	}{
+		{"http/2 prior knowledge", priorKnowledge, 2},
+		{"http/1.1", http1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			b, err := q.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodPost, "http://"+l.Addr().String()+"/dns-query", bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/dns-message")
+			resp, err := (&http.Client{Transport: tt.transport}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.ProtoMajor != tt.wantProto {
+				t.Fatalf("want status 200 over http/%d, got %d over %s", tt.wantProto, resp.StatusCode, resp.Proto)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := new(dns.Msg)
+			if err := r.Unpack(body); err != nil {
+				t.Fatal(err)
+			}
+			if r.Id != q.Id || !r.Response {
+				t.Fatalf("unexpected response %v", r)
+			}
+		})
+	}
+}
@@ -5,26 +5,29 @@ import (
 	"encoding/base64"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go/http3"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/mlog"
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/pool"
 	C "github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/real_ip"
 	"github.com/pmkol/mosdns-x/pkg/server/dns_handler"
+	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
 var nopLogger = zap.NewNop()
 
-var proxyHeaders = []string{"True-Client-IP", "X-Real-IP", "X-Forwarded-For"}
-
 type HandlerOpts struct {
 	DNSHandler  dns_handler.Handler
 	Path        string
@@ -32,6 +35,29 @@ type HandlerOpts struct {
 	HealthPath  string
 	RedirectURL string
 	Logger      *zap.Logger
+
+	// Ready reports whether the server is ready to serve. If it is not nil
+	// and returns false, the health path responds 503.
+	Ready func() bool
+
+	// HealthQuery optionally makes the health path send this query through
+	// DNSHandler. The health path responds 503 if the query fails, does not
+	// finish in HealthTimeout (default 2s) or its rcode is neither NOERROR
+	// nor NXDOMAIN. The rcode and the latency are in the response body.
+	HealthQuery   *dns.Question
+	HealthTimeout time.Duration
+
+	// Compression is the compression policy of responses,
+	// see dnsutils.SetCompress.
+	Compression string
+
+	// Routes maps additional url paths to their own dns handlers.
+	// Requests of these paths are handled by them instead of DNSHandler.
+	Routes map[string]dns_handler.Handler
+
+	// TrustedProxies are the peers whose forwarding headers and SrcIPHeader
+	// are used as the client address. Nil trusts all peers.
+	TrustedProxies *real_ip.TrustedProxies
 }
 
 func (opts *HandlerOpts) Init() error {
@@ -44,6 +70,9 @@ func (opts *HandlerOpts) Init() error {
 	if opts.HealthPath == "" {
 		opts.HealthPath = "/health"
 	}
+	if opts.HealthTimeout <= 0 {
+		opts.HealthTimeout = defaultHealthTimeout
+	}
 	return nil
 }
 
@@ -79,12 +108,14 @@ type Request interface {
 	RequestURI() string
 	GetRemoteAddr() string
 	SetRemoteAddr(addr string)
+	LocalAddr() net.Addr // nil if unknown
 }
 
 type TlsInfo struct {
 	Version            uint16
 	ServerName         string
 	NegotiatedProtocol string
+	ClientCertSubject  string // subject of the verified client certificate, if any
 }
 
 func (h *Handler) ServeHTTP(w ResponseWriter, req Request) {
@@ -95,13 +126,15 @@ func (h *Handler) ServeHTTP(w ResponseWriter, req Request) {
 	path := u.Path
 
 	// Address resolution and metadata initialization
-	addr, _ := getRemoteAddr(req, h.opts.SrcIPHeader)
+	addr, _ := getRemoteAddr(req, h.opts.SrcIPHeader, h.opts.TrustedProxies)
 	// CAPTURE remoteAddr after potential SetRemoteAddr in getRemoteAddr for accurate logging
 	remoteAddr := req.GetRemoteAddr() 
 	meta := C.NewRequestMeta(addr)
+	meta.SetServerAddr(utils.GetAddrPortFromAddr(req.LocalAddr()))
 
 	if tlsInfo := req.TLS(); tlsInfo != nil {
 		meta.SetServerName(tlsInfo.ServerName)
+		meta.SetClientCertSubject(tlsInfo.ClientCertSubject)
 		switch tlsInfo.NegotiatedProtocol {
 		case http3.NextProtoH3:
 			meta.SetProtocol(C.ProtocolH3)
@@ -116,13 +149,25 @@ func (h *Handler) ServeHTTP(w ResponseWriter, req Request) {
 
 	// 1. Health check - Fast path
 	if h.opts.HealthPath != "" && path == h.opts.HealthPath {
+		if h.opts.Ready != nil && !h.opts.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("NOT READY"))
+			return
+		}
+		if h.opts.HealthQuery != nil {
+			h.serveHealthQuery(w, req, meta)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("OK"))
 		return
 	}
 
 	// 2. Path & Root validation
-	if (h.opts.Path != "" && path != h.opts.Path) || path == "/" {
+	dnsHandler := h.opts.DNSHandler
+	if rh, ok := h.opts.Routes[path]; ok {
+		dnsHandler = rh
+	} else if (h.opts.Path != "" && path != h.opts.Path) || path == "/" {
 		if h.opts.RedirectURL != "" {
 			w.Header().Set("Location", h.opts.RedirectURL)
 			w.WriteHeader(http.StatusFound)
@@ -137,6 +182,12 @@ func (h *Handler) ServeHTTP(w ResponseWriter, req Request) {
 
 	switch method {
 	case http.MethodGet:
+		// Google/Cloudflare style JSON API.
+		if rawQueryGet(u.RawQuery, "dns") == "" && isJSONQuery(hdr, u.RawQuery) {
+			h.serveJSON(w, req, dnsHandler, meta, u.RawQuery, remoteAddr)
+			return
+		}
+
 		// RFC 8484 compliance: Check if Accept header contains the media type
 		if !strings.Contains(hdr.Get("Accept"), "application/dns-message") {
 			if h.opts.RedirectURL != "" {
@@ -163,7 +214,7 @@ func (h *Handler) ServeHTTP(w ResponseWriter, req Request) {
 		b, err = base64.RawURLEncoding.DecodeString(s)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			h.opts.Logger.Warn("decode base64 failed", zap.String("from", remoteAddr), zap.Error(err))
+			h.opts.Logger.Warn("decode base64 failed", zap.String("from", mlog.Addr(remoteAddr)), zap.Error(err))
 			return
 		}
 
@@ -198,34 +249,70 @@ func (h *Handler) ServeHTTP(w ResponseWriter, req Request) {
 	defer pool.ReleaseMsg(m)
 	if err := m.Unpack(b); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		h.opts.Logger.Warn("unpack dns msg failed", zap.String("from", remoteAddr), zap.Error(err))
+		h.opts.Logger.Warn("unpack dns msg failed", zap.String("from", mlog.Addr(remoteAddr)), zap.Error(err))
 		return
 	}
 
-	r, err := h.opts.DNSHandler.ServeDNS(req.Context(), m, meta)
+	// Responses of padded queries over https must be padded. See RFC 7830.
+	padding := meta.GetProtocol() != C.ProtocolHTTP && dnsutils.HasPadding(m)
+
+	r, raw, err := dns_handler.ServeRaw(req.Context(), dnsHandler, m, meta)
+	if err == nil && raw != nil && padding {
+		r, err = dns_handler.UnpackRaw(nil, raw)
+		raw = nil
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		h.opts.Logger.Warn("dns handler error", zap.String("from", remoteAddr), zap.Error(err))
+		h.serveDNSErr(w, err, remoteAddr)
 		return
 	}
 
-	// Reduce GC pressure by using the message pool for packing the response
-	resBytes, buf, err := pool.PackBuffer(r)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		h.opts.Logger.Warn("pack response failed", zap.String("from", remoteAddr), zap.Error(err))
-		return
+	resBytes := raw
+	var minTTL uint32
+	if resBytes != nil {
+		ttlOffsets, err := dnsutils.TTLOffsets(raw)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			h.opts.Logger.Warn("invalid raw response", zap.String("from", mlog.Addr(remoteAddr)), zap.Error(err))
+			return
+		}
+		minTTL = dnsutils.GetMinimalRawTTL(raw, ttlOffsets)
+	} else {
+		// Reduce GC pressure by using the message pool for packing the response
+		dnsutils.SetCompress(r, h.opts.Compression, dns.MaxMsgSize)
+		if padding {
+			dnsutils.PadToBlock(r, dnsutils.ResponsePaddingBlockLen)
+		}
+		var buf *pool.Buffer
+		resBytes, buf, err = pool.PackMsg(r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			h.opts.Logger.Warn("pack response failed", zap.String("from", mlog.Addr(remoteAddr)), zap.Error(err))
+			return
+		}
+		defer buf.Release()
+		minTTL = dnsutils.GetMinimalTTL(r)
 	}
-	defer buf.Release()
 
 	// Finalize Response
 	respHdr := w.Header()
 	respHdr.Set("Content-Type", "application/dns-message")
-	respHdr.Set("Cache-Control", "max-age="+strconv.Itoa(int(dnsutils.GetMinimalTTL(r))))
+	respHdr.Set("Cache-Control", "max-age="+strconv.Itoa(int(minTTL)))
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write(resBytes)
 }
 
+// serveDNSErr responds the error of the dns handler. Dropped queries,
+// see C.ErrDropQuery, get no response: it panics with http.ErrAbortHandler,
+// which resets the stream or closes the connection.
+func (h *Handler) serveDNSErr(w ResponseWriter, err error, remoteAddr string) {
+	if errors.Is(err, C.ErrDropQuery) {
+		h.opts.Logger.Debug("query dropped", zap.String("from", mlog.Addr(remoteAddr)), zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	h.opts.Logger.Warn("dns handler error", zap.String("from", mlog.Addr(remoteAddr)), zap.Error(err))
+}
+
 func rawQueryGet(rawQuery, key string) string {
 	for rawQuery != "" {
 		var part string
@@ -245,34 +332,15 @@ func rawQueryGet(rawQuery, key string) string {
 	return ""
 }
 
-func getRemoteAddr(req Request, customHeader string) (netip.Addr, error) {
-	hdr := req.Header()
-	for _, h := range proxyHeaders {
-		if val := hdr.Get(h); val != "" {
-			ipStr := val
-			if h == "X-Forwarded-For" {
-				ipStr, _, _ = strings.Cut(val, ",")
-			}
-			ipStr = strings.TrimSpace(ipStr)
-			if addr, err := netip.ParseAddr(ipStr); err == nil {
-				req.SetRemoteAddr(ipStr)
-				return addr, nil
-			}
-		}
-	}
-
-	if customHeader != "" {
-		if val := hdr.Get(customHeader); val != "" {
-			if addr, err := netip.ParseAddr(val); err == nil {
-				req.SetRemoteAddr(val)
-				return addr, nil
-			}
-		}
-	}
-
+func getRemoteAddr(req Request, customHeader string, trusted *real_ip.TrustedProxies) (netip.Addr, error) {
 	addrport, err := netip.ParseAddrPort(req.GetRemoteAddr())
+	peer := addrport.Addr().Unmap()
+	if client, ok := trusted.FromHeaders(peer, req.Header().Get, customHeader); ok {
+		req.SetRemoteAddr(client.String())
+		return client, nil
+	}
 	if err != nil {
 		return netip.Addr{}, err
 	}
-	return addrport.Addr(), nil
+	return peer, nil
 }
@@ -0,0 +1,210 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package http_handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/server/dns_handler"
+)
+
+// testDNSHandler replies to queries with rcode, or returns err.
+type testDNSHandler struct {
+	rcode int
+	err   error
+}
+
+func (d *testDNSHandler) ServeDNS(_ context.Context, req *dns.Msg, _ *query_context.RequestMeta) (*dns.Msg, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	r := new(dns.Msg)
+	r.SetRcode(req, d.rcode)
+	return r, nil
+}
+
+type testRequest struct{ r *http.Request }
+
+func (r *testRequest) URL() *url.URL             { return r.r.URL }
+func (r *testRequest) TLS() *TlsInfo             { return nil }
+func (r *testRequest) Body() io.ReadCloser       { return r.r.Body }
+func (r *testRequest) Header() Header            { return r.r.Header }
+func (r *testRequest) Method() string            { return r.r.Method }
+func (r *testRequest) Context() context.Context  { return r.r.Context() }
+func (r *testRequest) RequestURI() string        { return r.r.RequestURI }
+func (r *testRequest) GetRemoteAddr() string     { return r.r.RemoteAddr }
+func (r *testRequest) SetRemoteAddr(addr string) { r.r.RemoteAddr = addr }
+func (r *testRequest) LocalAddr() net.Addr       { return nil }
+
+type testResponseWriter struct{ *httptest.ResponseRecorder }
+
+func (w testResponseWriter) Header() Header { return w.ResponseRecorder.Header() }
+
+// wireRequest returns a RFC 8484 GET request of qname.
+func wireRequest(t *testing.T, path, qname string) *http.Request {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(qname, dns.TypeA)
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, path+"?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	req.Header.Set("Accept", "application/dns-message")
+	return req
+}
+
+// serve serves req by h. It returns the recorded response and the value
+// that h panicked with, if any.
+func serve(h *Handler, req *http.Request) (w *httptest.ResponseRecorder, panicked any) {
+	w = httptest.NewRecorder()
+	defer func() { panicked = recover() }()
+	h.ServeHTTP(testResponseWriter{w}, &testRequest{req})
+	return w, nil
+}
+
+func TestHandler_dnsHandlerErr(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantAbort  bool
+	}{
+		{"error", errors.New("upstream failed"), http.StatusInternalServerError, false},
+		{"dropped", query_context.ErrDropQuery, 0, true},
+		{"client denied", dns_handler.ErrClientDenied, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHandler(HandlerOpts{DNSHandler: &testDNSHandler{err: tt.err}, Path: "/dns-query"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, panicked := serve(h, wireRequest(t, "/dns-query", "example."))
+			if tt.wantAbort {
+				if panicked != http.ErrAbortHandler {
+					t.Fatalf("want abort, got panic %v, status %d", panicked, w.Code)
+				}
+				return
+			}
+			if panicked != nil {
+				t.Fatalf("unexpected panic %v", panicked)
+			}
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+type dropExec struct{}
+
+func (dropExec) Exec(context.Context, *query_context.Context, executable_seq.ExecutableChainNode) error {
+	return query_context.ErrDropQuery
+}
+
+// Queries dropped by executables, e.g. the drop action of rate_limit,
+// are aborted too.
+func TestHandler_execDrop(t *testing.T) {
+	entry, err := dns_handler.NewEntryHandler(dns_handler.EntryHandlerOpts{Entry: dropExec{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHandler(HandlerOpts{DNSHandler: entry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, panicked := serve(h, wireRequest(t, "/dns-query", "example.")); panicked != http.ErrAbortHandler {
+		t.Fatalf("want abort, got panic %v, status %d", panicked, w.Code)
+	}
+}
+
+func TestHandler_routes(t *testing.T) {
+	h, err := NewHandler(HandlerOpts{
+		DNSHandler: &testDNSHandler{rcode: dns.RcodeSuccess},
+		Path:       "/dns-query",
+		Routes: map[string]dns_handler.Handler{
+			"/family":  &testDNSHandler{rcode: dns.RcodeNameError},
+			"/dropped": &testDNSHandler{err: query_context.ErrDropQuery},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		req        *http.Request
+		wantStatus int
+		wantRcode  int
+	}{
+		{"default path", wireRequest(t, "/dns-query", "example."), http.StatusOK, dns.RcodeSuccess},
+		{"route", wireRequest(t, "/family", "example."), http.StatusOK, dns.RcodeNameError},
+		{"route json", httptest.NewRequest(http.MethodGet, "/family?name=example.", nil), http.StatusOK, dns.RcodeNameError},
+		{"route bad request", httptest.NewRequest(http.MethodGet, "/family?dns=%21", nil), http.StatusBadRequest, 0},
+		{"unknown path", wireRequest(t, "/other", "example."), http.StatusNotFound, 0},
+		{"route prefix", wireRequest(t, "/family/x", "example."), http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Header.Set("Accept", "application/dns-message")
+			w, panicked := serve(h, tt.req)
+			if panicked != nil || w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, panic %v, want status %d", w.Code, panicked, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var rcode int
+			if ct := w.Header().Get("Content-Type"); ct == jsonContentType {
+				resp := new(jsonResponse)
+				if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+					t.Fatal(err)
+				}
+				rcode = resp.Status
+			} else {
+				r := new(dns.Msg)
+				if err := r.Unpack(w.Body.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+				rcode = r.Rcode
+			}
+			if rcode != tt.wantRcode {
+				t.Fatalf("got rcode %d, want %d", rcode, tt.wantRcode)
+			}
+		})
+	}
+
+	if w, panicked := serve(h, wireRequest(t, "/dropped", "example.")); panicked != http.ErrAbortHandler {
+		t.Fatalf("dropped route: want abort, got panic %v, status %d", panicked, w.Code)
+	}
+}
@@ -0,0 +1,53 @@
+package http_handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	C "github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const defaultHealthTimeout = 2 * time.Second
+
+// serveHealthQuery sends HealthQuery through DNSHandler and responds with
+// its rcode and latency, so a wedged handler chain fails the health check.
+func (h *Handler) serveHealthQuery(w ResponseWriter, req Request, meta *C.RequestMeta) {
+	q := new(dns.Msg)
+	q.Id = dns.Id()
+	q.RecursionDesired = true
+	q.Question = []dns.Question{*h.opts.HealthQuery}
+
+	ctx, cancel := context.WithTimeout(req.Context(), h.opts.HealthTimeout)
+	defer cancel()
+	start := time.Now()
+	r, err := h.opts.DNSHandler.ServeDNS(ctx, q, meta)
+	latency := time.Since(start)
+	if err == nil && r == nil {
+		err = errors.New("no response")
+	}
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		h.opts.Logger.Warn("health query failed", zap.Duration("latency", latency), zap.Error(err))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintf(w, "FAIL %s %s", latency, err)
+		return
+	}
+
+	rcode := dns.RcodeToString[r.Rcode]
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		h.opts.Logger.Warn("health query failed", zap.Duration("latency", latency), zap.String("rcode", rcode))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintf(w, "FAIL %s %s", latency, rcode)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, "OK %s %s", latency, rcode)
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http_handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/server/dns_handler"
+)
+
+// slowDNSHandler replies to queries after their deadline.
+type slowDNSHandler struct{}
+
+func (slowDNSHandler) ServeDNS(ctx context.Context, req *dns.Msg, _ *query_context.RequestMeta) (*dns.Msg, error) {
+	<-ctx.Done()
+	r := new(dns.Msg)
+	r.SetReply(req)
+	return r, nil
+}
+
+func TestHandler_serveHealthQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		dnsHandler dns_handler.Handler
+		wantStatus int
+		wantBody   string
+	}{
+		{"noerror", &testDNSHandler{rcode: dns.RcodeSuccess}, http.StatusOK, "OK"},
+		{"nxdomain", &testDNSHandler{rcode: dns.RcodeNameError}, http.StatusOK, "OK"},
+		{"servfail", &testDNSHandler{rcode: dns.RcodeServerFailure}, http.StatusServiceUnavailable, "FAIL"},
+		{"error", &testDNSHandler{err: errors.New("upstream failed")}, http.StatusServiceUnavailable, "FAIL"},
+		{"timeout", slowDNSHandler{}, http.StatusServiceUnavailable, "FAIL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHandler(HandlerOpts{
+				DNSHandler:    tt.dnsHandler,
+				HealthQuery:   &dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				HealthTimeout: 10 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, panicked := serve(h, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if panicked != nil {
+				t.Fatalf("unexpected panic %v", panicked)
+			}
+			if w.Code != tt.wantStatus || !strings.HasPrefix(w.Body.String(), tt.wantBody) {
+				t.Fatalf("got %d %q, want %d %s", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandler_health_noQuery(t *testing.T) {
+	// The dns handler is not used without HealthQuery.
+	h, err := NewHandler(HandlerOpts{DNSHandler: &testDNSHandler{err: errors.New("upstream failed")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _ := serve(h, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "OK" {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+}
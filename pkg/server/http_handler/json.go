@@ -0,0 +1,145 @@
+package http_handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/mlog"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	C "github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/server/dns_handler"
+)
+
+const jsonContentType = "application/dns-json"
+
+// jsonResponse is the response of the JSON API, which is compatible with
+// the ones of Google and Cloudflare.
+type jsonResponse struct {
+	Status    int            `json:"Status"`
+	TC        bool           `json:"TC"`
+	RD        bool           `json:"RD"`
+	RA        bool           `json:"RA"`
+	AD        bool           `json:"AD"`
+	CD        bool           `json:"CD"`
+	Question  []jsonQuestion `json:"Question"`
+	Answer    []jsonRR       `json:"Answer,omitempty"`
+	Authority []jsonRR       `json:"Authority,omitempty"`
+	Comment   string         `json:"Comment,omitempty"`
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// isJSONQuery reports whether a GET request is a JSON API query, which has
+// a "name" parameter or accepts application/dns-json.
+func isJSONQuery(hdr Header, rawQuery string) bool {
+	return strings.Contains(hdr.Get("Accept"), jsonContentType) || rawQueryGet(rawQuery, "name") != ""
+}
+
+// newJSONQuery builds the query of the JSON API parameters "name", "type",
+// "do" and "cd". type can be a number or a mnemonic, and defaults to A.
+func newJSONQuery(rawQuery string) (*dns.Msg, bool) {
+	name := rawQueryGet(rawQuery, "name")
+	if _, ok := dns.IsDomainName(name); !ok || len(name) == 0 {
+		return nil, false
+	}
+
+	qtype := dns.TypeA
+	if s := rawQueryGet(rawQuery, "type"); s != "" {
+		if t, ok := dns.StringToType[strings.ToUpper(s)]; ok {
+			qtype = t
+		} else if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else {
+			return nil, false
+		}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	q.Id = 0
+	q.CheckingDisabled = jsonFlag(rawQueryGet(rawQuery, "cd"))
+	if jsonFlag(rawQueryGet(rawQuery, "do")) {
+		q.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return q, true
+}
+
+func jsonFlag(s string) bool {
+	return s == "1" || s == "true"
+}
+
+func (h *Handler) serveJSON(w ResponseWriter, req Request, dnsHandler dns_handler.Handler, meta *C.RequestMeta, rawQuery, remoteAddr string) {
+	q, ok := newJSONQuery(rawQuery)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r, err := dnsHandler.ServeDNS(req.Context(), q, meta)
+	if err != nil {
+		h.serveDNSErr(w, err, remoteAddr)
+		return
+	}
+
+	b, err := json.Marshal(newJSONResponse(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.opts.Logger.Warn("marshal json response failed", zap.String("from", mlog.Addr(remoteAddr)), zap.Error(err))
+		return
+	}
+
+	respHdr := w.Header()
+	respHdr.Set("Content-Type", jsonContentType)
+	respHdr.Set("Cache-Control", "max-age="+strconv.Itoa(int(dnsutils.GetMinimalTTL(r))))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
+}
+
+func newJSONResponse(r *dns.Msg) *jsonResponse {
+	resp := &jsonResponse{
+		Status:    r.Rcode,
+		TC:        r.Truncated,
+		RD:        r.RecursionDesired,
+		RA:        r.RecursionAvailable,
+		AD:        r.AuthenticatedData,
+		CD:        r.CheckingDisabled,
+		Answer:    newJSONRRs(r.Answer),
+		Authority: newJSONRRs(r.Ns),
+	}
+	for _, q := range r.Question {
+		resp.Question = append(resp.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	return resp
+}
+
+func newJSONRRs(rrs []dns.RR) []jsonRR {
+	var s []jsonRR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		s = append(s, jsonRR{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+	return s
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package http_handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// answerHandler answers A queries with 192.0.2.1 and records the query.
+type answerHandler struct {
+	q *dns.Msg
+}
+
+func (d *answerHandler) ServeDNS(_ context.Context, req *dns.Msg, _ *query_context.RequestMeta) (*dns.Msg, error) {
+	d.q = req.Copy()
+	r := new(dns.Msg)
+	r.SetReply(req)
+	if req.Question[0].Qtype == dns.TypeA {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	}
+	return r, nil
+}
+
+func TestHandler_serveJSON(t *testing.T) {
+	d := new(answerHandler)
+	h, err := NewHandler(HandlerOpts{DNSHandler: d, Path: "/resolve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, panicked := serve(h, httptest.NewRequest(http.MethodGet, "/resolve?name=example.com&do=1&cd=true", nil))
+	if panicked != nil || w.Code != http.StatusOK {
+		t.Fatalf("got status %d, panic %v", w.Code, panicked)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != jsonContentType {
+		t.Fatalf("got content type %s", ct)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "max-age=300" {
+		t.Fatalf("got cache control %s", cc)
+	}
+	resp := new(jsonResponse)
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != dns.RcodeSuccess || len(resp.Question) != 1 || resp.Question[0].Name != "example.com." || resp.Question[0].Type != dns.TypeA {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Data != "192.0.2.1" || resp.Answer[0].TTL != 300 {
+		t.Fatalf("unexpected answer %+v", resp.Answer)
+	}
+	if opt := d.q.IsEdns0(); opt == nil || !opt.Do() || !d.q.CheckingDisabled {
+		t.Fatalf("do and cd are not set in the query %v", d.q)
+	}
+
+	// Type by number and by mnemonic.
+	for _, typ := range []string{"28", "aaaa"} {
+		w, _ := serve(h, httptest.NewRequest(http.MethodGet, "/resolve?name=example.com&type="+typ, nil))
+		if w.Code != http.StatusOK || d.q.Question[0].Qtype != dns.TypeAAAA {
+			t.Fatalf("type %s: got status %d, query %v", typ, w.Code, d.q)
+		}
+	}
+	// Queries that accept json but have no name are bad requests.
+	req := httptest.NewRequest(http.MethodGet, "/resolve", nil)
+	req.Header.Set("Accept", jsonContentType)
+	if w, _ := serve(h, req); w.Code != http.StatusBadRequest {
+		t.Fatalf("json accept without a name: got status %d", w.Code)
+	}
+}
+
+func TestHandler_serveJSON_badInput(t *testing.T) {
+	h, err := NewHandler(HandlerOpts{DNSHandler: new(answerHandler)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		"name=example..com",
+		"name=example.com&type=notatype",
+		"name=example.com&type=65536",
+		"name=" + strings.Repeat("a", 64) + ".com",
+	} {
+		w, panicked := serve(h, httptest.NewRequest(http.MethodGet, "/dns-query?"+query, nil))
+		if panicked != nil || w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, panic %v", query, w.Code, panicked)
+		}
+	}
+}
+
+func TestHandler_serveJSON_dnsHandlerErr(t *testing.T) {
+	for _, tt := range []struct {
+		err        error
+		wantStatus int
+	}{
+		{errors.New("upstream failed"), http.StatusInternalServerError},
+		{query_context.ErrDropQuery, 0},
+	} {
+		h, err := NewHandler(HandlerOpts{DNSHandler: &testDNSHandler{err: tt.err}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, panicked := serve(h, httptest.NewRequest(http.MethodGet, "/dns-query?name=example.com", nil))
+		if tt.wantStatus == 0 {
+			if panicked != http.ErrAbortHandler {
+				t.Fatalf("%v: want abort, got panic %v, status %d", tt.err, panicked, w.Code)
+			}
+			continue
+		}
+		if panicked != nil || w.Code != tt.wantStatus {
+			t.Fatalf("%v: got status %d, panic %v", tt.err, w.Code, panicked)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Policies of the http requests that exceed HTTPMaxConcurrent.
+const (
+	HTTPOverflowUnavailable     = "503"
+	HTTPOverflowTooManyRequests = "429"
+	HTTPOverflowQueue           = "queue"
+)
+
+const defaultHTTPQueueTimeout = time.Second
+
+// acquireHTTP acquires a slot of HTTPMaxConcurrent for a http request.
+// If ok is false, the request should not be handled and be responded
+// with status. Otherwise, releaseHTTP must be called after the request
+// is handled.
+func (s *Server) acquireHTTP(ctx context.Context) (status int, ok bool) {
+	if s.httpSem == nil {
+		return 0, true
+	}
+	select {
+	case s.httpSem <- struct{}{}:
+		return 0, true
+	default:
+	}
+
+	switch s.opts.HTTPOverflowPolicy {
+	case HTTPOverflowQueue:
+		timeout := s.opts.HTTPQueueTimeout
+		if timeout <= 0 {
+			timeout = defaultHTTPQueueTimeout
+		}
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case s.httpSem <- struct{}{}:
+			return 0, true
+		case <-t.C:
+			status = http.StatusServiceUnavailable
+		case <-ctx.Done():
+			status = http.StatusServiceUnavailable
+		}
+	case HTTPOverflowTooManyRequests:
+		status = http.StatusTooManyRequests
+	default:
+		status = http.StatusServiceUnavailable
+	}
+	if c := s.opts.HTTPOverflowCounter; c != nil {
+		c.Inc()
+	}
+	return status, false
+}
+
+func (s *Server) releaseHTTP() {
+	if s.httpSem != nil {
+		<-s.httpSem
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_Server_acquireHTTP(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name        string
+		policy      string
+		ctx         context.Context
+		releaseIn   time.Duration // If not zero, the held slot is released after it.
+		wantStatus  int
+		wantOk      bool
+		wantCounted int32
+	}{
+		{"default", "", context.Background(), 0, http.StatusServiceUnavailable, false, 1},
+		{"429", HTTPOverflowTooManyRequests, context.Background(), 0, http.StatusTooManyRequests, false, 1},
+		{"queued", HTTPOverflowQueue, context.Background(), 10 * time.Millisecond, 0, true, 0},
+		{"queue timeout", HTTPOverflowQueue, context.Background(), 0, http.StatusServiceUnavailable, false, 1},
+		{"queue canceled", HTTPOverflowQueue, canceled, 0, http.StatusServiceUnavailable, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			overflow := new(countCounter)
+			s := NewServer(ServerOpts{
+				HTTPMaxConcurrent:   1,
+				HTTPOverflowPolicy:  tt.policy,
+				HTTPQueueTimeout:    50 * time.Millisecond,
+				HTTPOverflowCounter: overflow,
+			})
+			if _, ok := s.acquireHTTP(context.Background()); !ok {
+				t.Fatal("failed to acquire the first slot")
+			}
+			if tt.releaseIn > 0 {
+				time.AfterFunc(tt.releaseIn, s.releaseHTTP)
+			}
+
+			status, ok := s.acquireHTTP(tt.ctx)
+			if status != tt.wantStatus || ok != tt.wantOk {
+				t.Fatalf("acquireHTTP() = %d, %v, want %d, %v", status, ok, tt.wantStatus, tt.wantOk)
+			}
+			if got := overflow.n.Load(); got != tt.wantCounted {
+				t.Fatalf("want %d overflowed requests, got %d", tt.wantCounted, got)
+			}
+		})
+	}
+}
+
+func Test_Server_acquireHTTP_noLimit(t *testing.T) {
+	s := NewServer(ServerOpts{})
+	for i := 0; i < 10; i++ {
+		if _, ok := s.acquireHTTP(context.Background()); !ok {
+			t.Fatal("request is limited")
+		}
+	}
+}
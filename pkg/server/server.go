@@ -4,8 +4,10 @@ import (
 	"errors"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
 	H "github.com/pmkol/mosdns-x/pkg/server/http_handler"
 )
@@ -28,16 +30,124 @@ type ServerOpts struct {
 	// HttpHandler is the http handler required by HTTP, DoH server.
 	HttpHandler *H.Handler
 
-	// Certificate files to start DoT, DoH server.
-	Cert, Key string
+	// Certificate files to start DoT, DoH server. See CertPair.
+	Cert, Key   string
+	KeyPassword string
+
+	// Certs are additional certificates. The first certificate that is
+	// valid for the server name of the client hello is used. If there is
+	// none, the default certificate, which is Cert or the first of Certs,
+	// is used.
+	Certs []CertPair
+
+	// ClientCA is the file of the CA certificates that are used to verify
+	// tls client certificates. If RequireClientCert is true, clients must
+	// send a certificate that is signed by ClientCA. Otherwise, client
+	// certificates are optional but verified if sent.
+	ClientCA          string
+	RequireClientCert bool
+
+	// TLS parameters of DoT, DoH and DoQ servers. Zero values mean the
+	// defaults. QUIC always uses TLS 1.3, whose cipher suites are not
+	// configurable, so DoQ and DoH3 servers only use TLSCurves.
+	// See ParseTLSVersion, ParseCipherSuites and ParseCurves.
+	TLSMinVersion   uint16
+	TLSMaxVersion   uint16
+	TLSCipherSuites []uint16
+	TLSCurves       []uint16
+
+	// SessionTicketKeyRotation is the interval of rotating the session
+	// ticket key of DoT, DoH and DoQ servers. The previous key is still
+	// accepted until the next rotation. Zero disables the rotation.
+	SessionTicketKeyRotation time.Duration
+
+	// QUIC are the transport parameters of DoQ and DoH3 servers.
+	QUIC QUICOpts
 
 	// KernelTX and KernelRX control whether kernel TLS offloading is enabled.
 	KernelRX, KernelTX bool
 
 	// IdleTimeout limits the maximum time period that a connection can idle.
 	IdleTimeout time.Duration
+
+	// ReadHeaderTimeout and ReadTimeout limit the time of reading the
+	// headers and the whole request of DoH servers. Default 3s and 10s.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+
+	// WriteTimeout limits the time of writing a response of TCP, DoT and
+	// DoH servers. Zero means no limit.
+	WriteTimeout time.Duration
+
+	// FirstReadTimeout limits the time of reading the first query of a TCP
+	// or DoT connection. Default 500ms, and at most IdleTimeout.
+	FirstReadTimeout time.Duration
+
+	// UDPMaxConcurrent limits the number of udp queries that are handled
+	// concurrently. Zero means no limit.
+	UDPMaxConcurrent int
+
+	// UDPOverflowPolicy specifies how to handle the udp queries that exceed
+	// UDPMaxConcurrent. Can be OverflowDrop (default) or OverflowServfail.
+	UDPOverflowPolicy string
+
+	// UDPOverflowCounter optionally counts the udp queries that exceed
+	// UDPMaxConcurrent.
+	UDPOverflowCounter prometheus.Counter
+
+	// HTTPMaxConcurrent limits the number of http requests of DoH and DoH3
+	// servers that are handled concurrently. Zero means no limit.
+	HTTPMaxConcurrent int
+
+	// HTTPOverflowPolicy specifies how to handle the http requests that
+	// exceed HTTPMaxConcurrent. Can be HTTPOverflowUnavailable (default),
+	// HTTPOverflowTooManyRequests or HTTPOverflowQueue, which waits for at
+	// most HTTPQueueTimeout (default 1s) and responds 503 if it times out.
+	HTTPOverflowPolicy string
+	HTTPQueueTimeout   time.Duration
+
+	// HTTPOverflowCounter optionally counts the http requests that are
+	// rejected because of HTTPMaxConcurrent.
+	HTTPOverflowCounter prometheus.Counter
+
+	// Compression is the compression policy of responses. Can be
+	// dnsutils.CompressAlways (default) or dnsutils.CompressAuto.
+	// With CompressAuto, udp responses are only compressed if they exceed
+	// the udp size of the query, and responses of other protocols are only
+	// compressed if they exceed 65535 bytes.
+	Compression string
+
+	// Cookies enables DNS cookies (RFC 7873) on udp servers. Server cookies
+	// are generated as described in RFC 9018 with CookieSecret, which must
+	// be dnsutils.CookieSecretLen bytes. Servers behind the same anycast
+	// address should share the secret. A random secret is used if it is
+	// empty. If RequireCookie is true, queries without a valid server
+	// cookie are not handled. See Server.checkCookie.
+	Cookies       bool
+	CookieSecret  []byte
+	RequireCookie bool
+
+	// ConnGauge optionally counts the open connections of TCP, DoT, DoH,
+	// DoH3 and DoQ servers. StreamGauge optionally counts the DoQ streams
+	// and the http requests that are in progress.
+	ConnGauge   prometheus.Gauge
+	StreamGauge prometheus.Gauge
+}
+
+// CertPair is a pair of certificate and key files.
+// Cert can also be a PKCS#12 bundle (.p12 or .pfx), then Key is not
+// required. Password decrypts the bundle or an encrypted key.
+type CertPair struct {
+	Cert, Key string
+
+	Password string
 }
 
+const (
+	OverflowDrop     = "drop"
+	OverflowServfail = "servfail"
+)
+
 func (opts *ServerOpts) init() {
 	if opts.Logger == nil {
 		opts.Logger = nopLogger
@@ -49,12 +159,32 @@ func (opts *ServerOpts) init() {
 }
 
 type Server struct {
-	opts ServerOpts
+	opts         ServerOpts
+	cookieSecret *[dnsutils.CookieSecretLen]byte // nil if cookies are disabled
+	httpSem      chan struct{}                   // nil if no limit
+
+	ticketKeys *ticketKeyRotator // nil if rotation is disabled
 }
 
 func NewServer(opts ServerOpts) *Server {
 	opts.init()
-	return &Server{
-		opts: opts,
+	s := &Server{
+		opts:         opts,
+		cookieSecret: newCookieSecret(opts),
+	}
+	if opts.HTTPMaxConcurrent > 0 {
+		s.httpSem = make(chan struct{}, opts.HTTPMaxConcurrent)
+	}
+	if opts.SessionTicketKeyRotation > 0 {
+		s.ticketKeys = newTicketKeyRotator(opts.SessionTicketKeyRotation, opts.Logger)
+	}
+	return s
+}
+
+// Close stops the background tasks of the server, e.g. the session ticket
+// key rotation. It does not close the listeners that are being served.
+func (s *Server) Close() {
+	if s.ticketKeys != nil {
+		s.ticketKeys.stop()
 	}
 }
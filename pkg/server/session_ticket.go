@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ticketKeyRotator periodically replaces the session ticket key of the
+// tls configs of a server. The previous key stays valid for resumption
+// until the next rotation, so a ticket can be resumed for at most two
+// intervals. Keys are in memory only, the persistent key is only used
+// before the first rotation.
+type ticketKeyRotator struct {
+	interval time.Duration
+	logger   *zap.Logger
+
+	mu      sync.Mutex
+	keys    [][32]byte // keys[0] is the current key.
+	setters []func([][32]byte)
+	started bool
+	stopped bool
+
+	stopNotify chan struct{}
+	runDone    chan struct{}
+}
+
+func newTicketKeyRotator(interval time.Duration, logger *zap.Logger) *ticketKeyRotator {
+	loadKeys()
+	return &ticketKeyRotator{
+		interval: interval,
+		logger:   logger,
+		keys:     [][32]byte{tlsSessionTicketKey},
+
+		stopNotify: make(chan struct{}),
+		runDone:    make(chan struct{}),
+	}
+}
+
+// add registers the SetSessionTicketKeys func of a tls config and sets
+// the current keys.
+func (r *ticketKeyRotator) add(set func([][32]byte)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	set(r.keys)
+	r.setters = append(r.setters, set)
+	if !r.started && !r.stopped {
+		r.started = true
+		go r.run()
+	}
+}
+
+// stop stops the rotation and waits until it is stopped. The current keys
+// stay valid. It can be called multiple times.
+func (r *ticketKeyRotator) stop() {
+	r.mu.Lock()
+	started := r.started
+	if !r.stopped {
+		r.stopped = true
+		close(r.stopNotify)
+	}
+	r.mu.Unlock()
+	if started {
+		<-r.runDone
+	}
+}
+
+func (r *ticketKeyRotator) run() {
+	defer close(r.runDone)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.rotate(); err != nil {
+				r.logger.Error("failed to rotate session ticket key", zap.Error(err))
+			}
+		case <-r.stopNotify:
+			return
+		}
+	}
+}
+
+func (r *ticketKeyRotator) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = [][32]byte{key, r.keys[0]}
+	for _, set := range r.setters {
+		set(r.keys)
+	}
+	r.logger.Debug("session ticket key rotated")
+	return nil
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func Test_ticketKeyRotator_stop(t *testing.T) {
+	r := newTicketKeyRotator(time.Millisecond, zap.NewNop())
+	var sets atomic.Int32
+	r.add(func([][32]byte) { sets.Add(1) })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sets.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("keys are not rotated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r.stop()
+	r.stop()
+	n := sets.Load()
+	time.Sleep(20 * time.Millisecond)
+	if got := sets.Load(); got != n {
+		t.Fatalf("keys are rotated after stop, %d -> %d", n, got)
+	}
+
+	// A rotator stopped before any tls config is added never starts.
+	r = newTicketKeyRotator(time.Millisecond, zap.NewNop())
+	r.stop()
+	r.add(func([][32]byte) { sets.Add(1) })
+	n = sets.Load()
+	time.Sleep(20 * time.Millisecond)
+	if got := sets.Load(); got != n {
+		t.Fatal("a stopped rotator rotates keys")
+	}
+}
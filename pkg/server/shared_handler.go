@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 
@@ -17,6 +18,13 @@ type httpHandlerWrapper struct {
 }
 
 func (h *httpHandlerWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if status, ok := h.s.acquireHTTP(r.Context()); !ok {
+		w.WriteHeader(status)
+		return
+	}
+	defer h.s.releaseHTTP()
+	h.s.streamOpened()
+	defer h.s.streamClosed()
 	h.s.opts.HttpHandler.ServeHTTP(&responseWriterWrapper{w}, &requestWrapper{r})
 }
 
@@ -26,6 +34,23 @@ type eHttpHandlerWrapper struct {
 }
 
 func (h *eHttpHandlerWrapper) ServeHTTP(w eHttp.ResponseWriter, r *eHttp.Request) {
+	if status, ok := h.s.acquireHTTP(r.Context()); !ok {
+		w.WriteHeader(status)
+		return
+	}
+	defer h.s.releaseHTTP()
+	h.s.streamOpened()
+	defer h.s.streamClosed()
+	defer func() {
+		// The handler aborts with http.ErrAbortHandler, which is not the
+		// sentinel of eHttp.
+		if p := recover(); p != nil {
+			if p == http.ErrAbortHandler {
+				p = eHttp.ErrAbortHandler
+			}
+			panic(p)
+		}
+	}()
 	h.s.opts.HttpHandler.ServeHTTP(&eResponseWriterWrapper{w}, &eRequestWrapper{r})
 }
 
@@ -37,7 +62,12 @@ func (r *requestWrapper) TLS() *H.TlsInfo {
 	if r.r.TLS == nil {
 		return nil
 	}
-	return &H.TlsInfo{Version: r.r.TLS.Version, ServerName: r.r.TLS.ServerName, NegotiatedProtocol: r.r.TLS.NegotiatedProtocol}
+	return &H.TlsInfo{
+		Version:            r.r.TLS.Version,
+		ServerName:         r.r.TLS.ServerName,
+		NegotiatedProtocol: r.r.TLS.NegotiatedProtocol,
+		ClientCertSubject:  clientCertSubject(r.r.TLS.VerifiedChains),
+	}
 }
 func (r *requestWrapper) Body() io.ReadCloser       { return r.r.Body }
 func (r *requestWrapper) Header() H.Header          { return r.r.Header }
@@ -46,6 +76,10 @@ func (r *requestWrapper) Context() context.Context  { return r.r.Context() }
 func (r *requestWrapper) RequestURI() string        { return r.r.RequestURI }
 func (r *requestWrapper) GetRemoteAddr() string     { return r.r.RemoteAddr }
 func (r *requestWrapper) SetRemoteAddr(addr string) { r.r.RemoteAddr = addr }
+func (r *requestWrapper) LocalAddr() net.Addr {
+	addr, _ := r.r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
 
 type eRequestWrapper struct{ r *eHttp.Request }
 
@@ -54,7 +88,12 @@ func (r *eRequestWrapper) TLS() *H.TlsInfo {
 	if r.r.TLS == nil {
 		return nil
 	}
-	return &H.TlsInfo{Version: r.r.TLS.Version, ServerName: r.r.TLS.ServerName, NegotiatedProtocol: r.r.TLS.NegotiatedProtocol}
+	return &H.TlsInfo{
+		Version:            r.r.TLS.Version,
+		ServerName:         r.r.TLS.ServerName,
+		NegotiatedProtocol: r.r.TLS.NegotiatedProtocol,
+		ClientCertSubject:  clientCertSubject(r.r.TLS.VerifiedChains),
+	}
 }
 func (r *eRequestWrapper) Body() io.ReadCloser       { return r.r.Body }
 func (r *eRequestWrapper) Header() H.Header          { return r.r.Header }
@@ -63,6 +102,10 @@ func (r *eRequestWrapper) Context() context.Context  { return r.r.Context() }
 func (r *eRequestWrapper) RequestURI() string        { return r.r.RequestURI }
 func (r *eRequestWrapper) GetRemoteAddr() string     { return r.r.RemoteAddr }
 func (r *eRequestWrapper) SetRemoteAddr(addr string) { r.r.RemoteAddr = addr }
+func (r *eRequestWrapper) LocalAddr() net.Addr {
+	addr, _ := r.r.Context().Value(eHttp.LocalAddrContextKey).(net.Addr)
+	return addr
+}
 
 // ResponseWriter wrappers
 type responseWriterWrapper struct{ w http.ResponseWriter }
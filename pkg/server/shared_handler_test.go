@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/miekg/dns"
+	eHttp "gitlab.com/go-extension/http"
+	eHttptest "gitlab.com/go-extension/http/httptest"
+
+	C "github.com/pmkol/mosdns-x/pkg/query_context"
+	H "github.com/pmkol/mosdns-x/pkg/server/http_handler"
+)
+
+type dropHandler struct{}
+
+func (dropHandler) ServeDNS(context.Context, *dns.Msg, *C.RequestMeta) (*dns.Msg, error) {
+	return nil, C.ErrDropQuery
+}
+
+func Test_eHttpHandlerWrapper_abort(t *testing.T) {
+	hh, err := H.NewHandler(H.HandlerOpts{DNSHandler: dropHandler{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(ServerOpts{HttpHandler: hh})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := eHttptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	req.Header.Set("Accept", "application/dns-message")
+
+	defer func() {
+		if p := recover(); p != eHttp.ErrAbortHandler {
+			t.Fatalf("want eHttp.ErrAbortHandler, got %v", p)
+		}
+	}()
+	(&eHttpHandlerWrapper{s}).ServeHTTP(eHttptest.NewRecorder(), req)
+}
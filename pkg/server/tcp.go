@@ -17,6 +17,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/miekg/dns"
+	"github.com/pmkol/mosdns-x/mlog"
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/pool"
 	C "github.com/pmkol/mosdns-x/pkg/query_context"
@@ -27,7 +28,8 @@ import (
 type TCPConn struct {
 	sync.Mutex
 	net.Conn
-	handler dns_handler.Handler
+	handler      dns_handler.Handler
+	writeTimeout time.Duration // zero means no timeout
 }
 
 func (c *TCPConn) ServeDNS(ctx context.Context, req *dns.Msg, meta *C.RequestMeta) (*dns.Msg, error) {
@@ -37,12 +39,15 @@ func (c *TCPConn) ServeDNS(ctx context.Context, req *dns.Msg, meta *C.RequestMet
 func (c *TCPConn) WriteRawMsg(b []byte) (int, error) {
 	c.Lock()
 	defer c.Unlock()
+	if c.writeTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
 	return dnsutils.WriteRawMsgToTCP(c, b)
 }
 
 const (
-	defaultTCPIdleTimeout = time.Second * 10
-	tcpFirstReadTimeout   = time.Millisecond * 500
+	defaultTCPIdleTimeout      = time.Second * 10
+	defaultTCPFirstReadTimeout = time.Millisecond * 500
 )
 
 func (s *Server) ServeTCP(l net.Listener) error {
@@ -66,18 +71,20 @@ func (s *Server) ServeTCP(l net.Listener) error {
 			return fmt.Errorf("unexpected listener err: %w", err)
 		}
 
-		go s.handleConnectionTcp(ctx, &TCPConn{Conn: c, handler: handler})
+		go s.handleConnectionTcp(ctx, &TCPConn{Conn: c, handler: handler, writeTimeout: s.opts.WriteTimeout})
 	}
 }
 
 func (s *Server) handleConnectionTcp(ctx context.Context, c *TCPConn) {
 	defer c.Close()
+	defer s.trackConn().Close()
 
 	connCtx, connCancel := context.WithCancel(ctx)
 	defer connCancel()
 
 	clientAddr := utils.GetAddrFromAddr(c.RemoteAddr())
 	meta := C.NewRequestMeta(clientAddr)
+	meta.SetServerAddr(utils.GetAddrPortFromAddr(c.LocalAddr()))
 
 	protocol := C.ProtocolTCP
 	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
@@ -90,11 +97,13 @@ func (s *Server) handleConnectionTcp(ctx context.Context, c *TCPConn) {
 		defer cancel()
 
 		if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
-			s.opts.Logger.Debug("handshake failed", zap.Stringer("from", c.RemoteAddr()), zap.Error(err))
+			s.opts.Logger.Debug("handshake failed", mlog.ClientAddr("from", c.RemoteAddr()), zap.Error(err))
 			return
 		}
 
-		meta.SetServerName(tlsConn.ConnectionState().ServerName)
+		cs := tlsConn.ConnectionState()
+		meta.SetServerName(cs.ServerName)
+		meta.SetClientCertSubject(clientCertSubject(cs.VerifiedChains))
 		protocol = C.ProtocolTLS
 	}
 	meta.SetProtocol(protocol)
@@ -105,7 +114,11 @@ func (s *Server) handleConnectionTcp(ctx context.Context, c *TCPConn) {
 	}
 
 	// Use Go 1.21+ built-in min
-	c.SetReadDeadline(time.Now().Add(min(idleTimeout, tcpFirstReadTimeout)))
+	firstReadTimeout := s.opts.FirstReadTimeout
+	if firstReadTimeout <= 0 {
+		firstReadTimeout = defaultTCPFirstReadTimeout
+	}
+	c.SetReadDeadline(time.Now().Add(min(idleTimeout, firstReadTimeout)))
 
 	for {
 		req := pool.GetMsg()
@@ -124,13 +137,30 @@ func (s *Server) handleConnectionTcp(ctx context.Context, c *TCPConn) {
 func (s *Server) handleQueryTcp(ctx context.Context, c *TCPConn, req *dns.Msg, meta *C.RequestMeta) {
 	defer pool.ReleaseMsg(req)
 
-	r, err := c.ServeDNS(ctx, req, meta)
+	// Responses of padded queries over tls must be padded. See RFC 7830.
+	padding := meta.GetProtocol() == C.ProtocolTLS && dnsutils.HasPadding(req)
+
+	r, raw, err := dns_handler.ServeRaw(ctx, c.handler, req, meta)
+	if err == nil && raw != nil && padding {
+		r, err = dns_handler.UnpackRaw(nil, raw)
+		raw = nil
+	}
 	if err != nil {
 		s.opts.Logger.Debug("handler err", zap.Error(err))
 		return
 	}
+	if raw != nil {
+		if _, err := c.WriteRawMsg(raw); err != nil {
+			s.opts.Logger.Debug("failed to write response", mlog.ClientAddr("client", c.RemoteAddr()), zap.Error(err))
+		}
+		return
+	}
 
-	b, buf, err := pool.PackBuffer(r)
+	dnsutils.SetCompress(r, s.opts.Compression, dns.MaxMsgSize)
+	if padding {
+		dnsutils.PadToBlock(r, dnsutils.ResponsePaddingBlockLen)
+	}
+	b, buf, err := pool.PackMsg(r)
 	if err != nil {
 		s.opts.Logger.Error("failed to unpack handler's response", zap.Error(err), zap.Stringer("msg", r))
 		return
@@ -139,7 +169,7 @@ func (s *Server) handleQueryTcp(ctx context.Context, c *TCPConn, req *dns.Msg, m
 
 	_, err = c.WriteRawMsg(b)
 	if err != nil {
-		s.opts.Logger.Debug("failed to write response", zap.Stringer("client", c.RemoteAddr()), zap.Error(err))
+		s.opts.Logger.Debug("failed to write response", mlog.ClientAddr("client", c.RemoteAddr()), zap.Error(err))
 		return
 	}
 }
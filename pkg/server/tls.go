@@ -3,11 +3,15 @@ package server
 import (
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -17,37 +21,109 @@ import (
 	"go.uber.org/zap"
 )
 
-var statelessResetKey *quic.StatelessResetKey
-var tlsSessionTicketKey [32]byte
+// EnvKeyDir is the environment variable of the key directory. See SetKeyDir.
+const EnvKeyDir = "MOSDNS_KEY_DIR"
 
-func init() {
-	resetKey, sessionKey, err := loadOrCreateKeys()
-	if err != nil {
-		log.Printf("[WARN] Failed to load persistent keys: %v, using ephemeral keys", err)
+var (
+	keyDir   string
+	keysOnce sync.Once
 
-		var tmpResetKey quic.StatelessResetKey
-		if _, err := rand.Read(tmpResetKey[:]); err != nil {
-			log.Fatalf("[FATAL] Failed to generate ephemeral reset key: %v", err)
-		}
-		statelessResetKey = &tmpResetKey
+	statelessResetKey   *quic.StatelessResetKey
+	tlsSessionTicketKey [32]byte
+)
+
+// SetKeyDir sets the directory of the persistent stateless reset key and
+// session ticket key. It must be called before any server is created.
+// If dir is empty, EnvKeyDir is used. If neither is set, keys are stored
+// in the "key" directory next to the executable, or in the state directory
+// (see stateDir) if it is not writable. If all of them fail, ephemeral keys
+// are used.
+func SetKeyDir(dir string) {
+	keyDir = dir
+}
+
+// loadKeys loads the persistent keys once.
+func loadKeys() {
+	keysOnce.Do(func() {
+		resetKey, sessionKey, err := loadOrCreateKeys()
+		if err != nil {
+			log.Printf("[WARN] Failed to load persistent keys: %v, using ephemeral keys", err)
 
-		if _, err := rand.Read(tlsSessionTicketKey[:]); err != nil {
-			log.Fatalf("[FATAL] Failed to generate ephemeral session ticket key: %v", err)
+			var tmpResetKey quic.StatelessResetKey
+			if _, err := rand.Read(tmpResetKey[:]); err != nil {
+				log.Fatalf("[FATAL] Failed to generate ephemeral reset key: %v", err)
+			}
+			statelessResetKey = &tmpResetKey
+
+			if _, err := rand.Read(tlsSessionTicketKey[:]); err != nil {
+				log.Fatalf("[FATAL] Failed to generate ephemeral session ticket key: %v", err)
+			}
+		} else {
+			statelessResetKey = resetKey
+			copy(tlsSessionTicketKey[:], sessionKey)
 		}
-	} else {
-		statelessResetKey = resetKey
-		copy(tlsSessionTicketKey[:], sessionKey)
+	})
+}
+
+// keyDirs returns the candidate key directories in order.
+func keyDirs() ([]string, error) {
+	if keyDir != "" {
+		return []string{keyDir}, nil
 	}
+	if dir := os.Getenv(EnvKeyDir); dir != "" {
+		return []string{dir}, nil
+	}
+
+	var dirs []string
+	if execPath, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Join(filepath.Dir(execPath), "key"))
+	}
+	if dir := stateDir(); dir != "" {
+		dirs = append(dirs, filepath.Join(dir, "key"))
+	}
+	if len(dirs) == 0 {
+		return nil, errors.New("no available key directory")
+	}
+	return dirs, nil
+}
+
+// stateDir returns the state directory of mosdns. It is $STATE_DIRECTORY
+// (set by systemd's StateDirectory=), $XDG_STATE_HOME/mosdns or
+// ~/.local/state/mosdns. It returns an empty string if none is available.
+func stateDir() string {
+	if dir := os.Getenv("STATE_DIRECTORY"); dir != "" {
+		// It may be a colon-separated list.
+		return strings.Split(dir, ":")[0]
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "mosdns")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "mosdns")
+	}
+	return ""
 }
 
 func loadOrCreateKeys() (*quic.StatelessResetKey, []byte, error) {
-	execPath, err := os.Executable()
+	dirs, err := keyDirs()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	execDir := filepath.Dir(execPath)
-	keyDir := filepath.Join(execDir, "key")
+	var lastErr error
+	for _, dir := range dirs {
+		resetKey, sessionKey, err := loadOrCreateKeysIn(dir)
+		if err != nil {
+			log.Printf("[WARN] Failed to use key directory %s: %v", dir, err)
+			lastErr = err
+			continue
+		}
+		return resetKey, sessionKey, nil
+	}
+	return nil, nil, lastErr
+}
+
+func loadOrCreateKeysIn(keyDir string) (*quic.StatelessResetKey, []byte, error) {
 	resetKeyFile := filepath.Join(keyDir, ".mosdns_stateless_reset.key")
 	sessionKeyFile := filepath.Join(keyDir, ".mosdns_session_ticket.key")
 
@@ -111,6 +187,16 @@ func tryCreateWatchCert[T tls.Certificate | eTLS.Certificate](certFile string, k
 	cc := &cert[T]{}
 	cc.set(&c)
 
+	reload := func() error {
+		newCert, err := createFunc(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		cc.set(&newCert)
+		return nil
+	}
+	certReloaders.add(certFile, reload)
+
 	go func() {
 		watcher, err := fsnotify.NewWatcher()
 		if err != nil {
@@ -122,8 +208,10 @@ func tryCreateWatchCert[T tls.Certificate | eTLS.Certificate](certFile string, k
 		if err := watcher.Add(certFile); err != nil {
 			log.Printf("[WARN] Failed to watch certificate file %s: %v", certFile, err)
 		}
-		if err := watcher.Add(keyFile); err != nil {
-			log.Printf("[WARN] Failed to watch key file %s: %v", keyFile, err)
+		if keyFile != "" {
+			if err := watcher.Add(keyFile); err != nil {
+				log.Printf("[WARN] Failed to watch key file %s: %v", keyFile, err)
+			}
 		}
 
 		timer := time.NewTimer(0)
@@ -135,12 +223,10 @@ func tryCreateWatchCert[T tls.Certificate | eTLS.Certificate](certFile string, k
 		}
 
 		reloadCert := func() {
-			newCert, err := createFunc(certFile, keyFile)
-			if err != nil {
+			if err := reload(); err != nil {
 				logger.Error("failed to reload certificate", zap.String("file", certFile), zap.Error(err))
 				return
 			}
-			cc.set(&newCert)
 			logger.Info("certificate reloaded successfully", zap.String("file", certFile))
 		}
 
@@ -187,12 +273,14 @@ func tryCreateWatchCert[T tls.Certificate | eTLS.Certificate](certFile string, k
 				if needReWatch {
 					needReWatch = false
 					_ = watcher.Remove(certFile)
-					_ = watcher.Remove(keyFile)
 					if err := watcher.Add(certFile); err != nil {
 						log.Printf("[WARN] Failed to re-watch certFile %s: %v", certFile, err)
 					}
-					if err := watcher.Add(keyFile); err != nil {
-						log.Printf("[WARN] Failed to re-watch keyFile %s: %v", keyFile, err)
+					if keyFile != "" {
+						_ = watcher.Remove(keyFile)
+						if err := watcher.Add(keyFile); err != nil {
+							log.Printf("[WARN] Failed to re-watch keyFile %s: %v", keyFile, err)
+						}
 					}
 				}
 				reloadCert()
@@ -208,65 +296,193 @@ func tryCreateWatchCert[T tls.Certificate | eTLS.Certificate](certFile string, k
 	return cc, nil
 }
 
-func (s *Server) CreateQUICListner(conn net.PacketConn, nextProtos []string, allowedSNI string) (*quic.EarlyListener, error) {
-	if s.opts.Cert == "" || s.opts.Key == "" {
+// certReloaders are the reload funcs of all watched certificates.
+var certReloaders reloaderList
+
+type reloaderList struct {
+	mu    sync.Mutex
+	files []string
+	fns   []func() error
+}
+
+func (l *reloaderList) add(file string, fn func() error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.files = append(l.files, file)
+	l.fns = append(l.fns, fn)
+}
+
+// ReloadCerts reloads the certificates of all tls listeners immediately,
+// in addition to the reloads on file changes. It returns the number of
+// reloaded certificates. Certificates that fail to reload are kept, and
+// their errors are joined.
+func ReloadCerts() (int, error) {
+	certReloaders.mu.Lock()
+	defer certReloaders.mu.Unlock()
+	var errs []error
+	n := 0
+	for i, fn := range certReloaders.fns {
+		if err := fn(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", certReloaders.files[i], err))
+			continue
+		}
+		n++
+	}
+	return n, errors.Join(errs...)
+}
+
+// certSelector selects a certificate by the server name of the client
+// hello.
+type certSelector[T tls.Certificate | eTLS.Certificate] struct {
+	certs []*cert[T] // certs[0] is the default certificate.
+	leaf  func(*T) *x509.Certificate
+}
+
+func newCertSelector[T tls.Certificate | eTLS.Certificate](pairs []CertPair, x509KeyPair func([]byte, []byte) (T, error), leaf func(*T) *x509.Certificate, logger *zap.Logger) (*certSelector[T], error) {
+	if len(pairs) == 0 {
 		return nil, errors.New("missing certificate for tls listener")
 	}
+	s := &certSelector[T]{leaf: leaf}
+	for _, p := range pairs {
+		if p.Cert == "" || (p.Key == "" && !isPKCS12(p.Cert)) {
+			return nil, errors.New("missing certificate or key file")
+		}
+		c, err := tryCreateWatchCert(p.Cert, p.Key, keyPairLoader(x509KeyPair, p.Password), logger)
+		if err != nil {
+			return nil, err
+		}
+		s.certs = append(s.certs, c)
+	}
+	return s, nil
+}
+
+// get returns the first certificate that is valid for serverName.
+// If there is none, the default certificate is returned.
+func (s *certSelector[T]) get(serverName string) (*T, error) {
+	def := s.certs[0].get()
+	if serverName != "" && len(s.certs) > 1 {
+		for _, c := range s.certs {
+			cert := c.get()
+			if cert == nil {
+				continue
+			}
+			if leaf := s.leaf(cert); leaf != nil && leaf.VerifyHostname(serverName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	if def == nil {
+		return nil, errors.New("certificate not available")
+	}
+	return def, nil
+}
 
-	c, err := tryCreateWatchCert(s.opts.Cert, s.opts.Key, tls.LoadX509KeyPair, s.opts.Logger)
+// clientCAs loads ClientCA. It returns nil if ClientCA is not configured.
+func (s *Server) clientCAs() (*x509.CertPool, error) {
+	if s.opts.ClientCA == "" {
+		if s.opts.RequireClientCert {
+			return nil, errors.New("client ca is required to verify client certificates")
+		}
+		return nil, nil
+	}
+	b, err := os.ReadFile(s.opts.ClientCA)
 	if err != nil {
 		return nil, err
 	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no valid certificate in client ca file")
+	}
+	return pool, nil
+}
+
+// clientCertSubject returns the subject of the verified client certificate.
+func clientCertSubject(verifiedChains [][]*x509.Certificate) string {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return ""
+	}
+	return verifiedChains[0][0].Subject.String()
+}
+
+// certPairs returns the certificates of the server, the default one first.
+func (s *Server) certPairs() []CertPair {
+	var pairs []CertPair
+	if s.opts.Cert != "" || s.opts.Key != "" {
+		pairs = append(pairs, CertPair{Cert: s.opts.Cert, Key: s.opts.Key, Password: s.opts.KeyPassword})
+	}
+	return append(pairs, s.opts.Certs...)
+}
+
+func (s *Server) CreateQUICListner(conn net.PacketConn, nextProtos []string, allowedSNI string) (*quic.EarlyListener, error) {
+	loadKeys()
+	c, err := newCertSelector(s.certPairs(), tls.X509KeyPair, func(c *tls.Certificate) *x509.Certificate { return c.Leaf }, s.opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs, err := s.clientCAs()
+	if err != nil {
+		return nil, err
+	}
+	clientAuth := tls.NoClientCert
+	if clientCAs != nil {
+		clientAuth = tls.VerifyClientCertIfGiven
+		if s.opts.RequireClientCert {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
 
 	tr := &quic.Transport{
 	    Conn:                              conn,
 	    StatelessResetKey:                 statelessResetKey,
 	}
+	if s.opts.QUIC.RequireAddressValidation {
+		tr.VerifySourceAddress = func(net.Addr) bool { return true }
+	}
 
-	return tr.ListenEarly(&tls.Config{
+	tlsConfig := &tls.Config{
 		NextProtos:       nextProtos,
 		SessionTicketKey: tlsSessionTicketKey,
+		ClientCAs:        clientCAs,
+		ClientAuth:       clientAuth,
 
-		CurvePreferences: []tls.CurveID{
-			tls.X25519,
-			tls.CurveP256,
-		},
+		CurvePreferences: convertCurves[tls.CurveID](s.curves()),
 
 		GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			cert := c.get()
-			if cert == nil {
-				return nil, errors.New("certificate not available")
-			}
-
 		if allowedSNI != "" && chi.ServerName != allowedSNI {
 		    return nil, errors.New("invalid sni")
 		}
 
-			return cert, nil
+			return c.get(chi.ServerName)
 		},
-	}, &quic.Config{
-	    MaxIdleTimeout:                 s.opts.IdleTimeout,
-	    Allow0RTT:                      true,
-	    DisablePathMTUDiscovery:        true,
-	    InitialStreamReceiveWindow:     1252,
-	    MaxStreamReceiveWindow:         4 * 1024,
-	    InitialConnectionReceiveWindow: 8 * 1024,
-	    MaxConnectionReceiveWindow:     16 * 1024,
-	})
+	}
+	if s.ticketKeys != nil {
+		s.ticketKeys.add(tlsConfig.SetSessionTicketKeys)
+	}
+	return tr.ListenEarly(tlsConfig, s.quicConfig())
 }
 
 func (s *Server) CreateETLSListner(l net.Listener, nextProtos []string, allowedSNI string) (net.Listener, error) {
-	if s.opts.Cert == "" || s.opts.Key == "" {
-		return nil, errors.New("missing certificate for tls listener")
+	loadKeys()
+	c, err := newCertSelector(s.certPairs(), eTLS.X509KeyPair, func(c *eTLS.Certificate) *x509.Certificate { return c.Leaf }, s.opts.Logger)
+	if err != nil {
+		return nil, err
 	}
-
-	c, err := tryCreateWatchCert(s.opts.Cert, s.opts.Key, eTLS.LoadX509KeyPair, s.opts.Logger)
+	clientCAs, err := s.clientCAs()
 	if err != nil {
 		return nil, err
 	}
+	clientAuth := eTLS.NoClientCert
+	if clientCAs != nil {
+		clientAuth = eTLS.VerifyClientCertIfGiven
+		if s.opts.RequireClientCert {
+			clientAuth = eTLS.RequireAndVerifyClientCert
+		}
+	}
 
-	return eTLS.NewListener(l, &eTLS.Config{
+	tlsConfig := &eTLS.Config{
 		SessionTicketKey: tlsSessionTicketKey,
+		ClientCAs:        clientCAs,
+		ClientAuth:       clientAuth,
 		KernelTX:         s.opts.KernelTX,
 		KernelRX:         s.opts.KernelRX,
 		AllowEarlyData:   true,
@@ -278,10 +494,10 @@ func (s *Server) CreateETLSListner(l net.Listener, nextProtos []string, allowedS
 			eTLS.Zlib,
 		},
 
-		CurvePreferences: []eTLS.CurveID{
-			eTLS.X25519,
-			eTLS.CurveP256,
-		},
+		CurvePreferences: convertCurves[eTLS.CurveID](s.curves()),
+		MinVersion:       s.opts.TLSMinVersion,
+		MaxVersion:       s.opts.TLSMaxVersion,
+		CipherSuites:     s.opts.TLSCipherSuites,
 
 		Defaults: eTLS.Defaults{
 			AllSecureCipherSuites: false,
@@ -289,16 +505,15 @@ func (s *Server) CreateETLSListner(l net.Listener, nextProtos []string, allowedS
 		},
 
 		GetCertificate: func(chi *eTLS.ClientHelloInfo) (*eTLS.Certificate, error) {
-			cert := c.get()
-			if cert == nil {
-				return nil, errors.New("certificate not available")
-			}
-
 			if allowedSNI != "" && chi.ServerName != allowedSNI {
 			    return nil, errors.New("invalid sni")
 			}
 
-			return cert, nil
+			return c.get(chi.ServerName)
 		},
-	}), nil
+	}
+	if s.ticketKeys != nil {
+		s.ticketKeys.add(tlsConfig.SetSessionTicketKeys)
+	}
+	return eTLS.NewListener(l, tlsConfig), nil
 }
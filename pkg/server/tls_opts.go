@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	eTLS "gitlab.com/go-extension/tls"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// defaultCurves are the curve preferences of tls listeners if
+// ServerOpts.TLSCurves is empty.
+var defaultCurves = []uint16{uint16(eTLS.X25519), uint16(eTLS.CurveP256)}
+
+var tlsVersions = map[string]uint16{
+	"1.0": eTLS.VersionTLS10,
+	"1.1": eTLS.VersionTLS11,
+	"1.2": eTLS.VersionTLS12,
+	"1.3": eTLS.VersionTLS13,
+}
+
+// Curves that are supported by both crypto/tls and eTLS.
+var tlsCurves = map[string]eTLS.CurveID{
+	"x25519":         eTLS.X25519,
+	"p256":           eTLS.CurveP256,
+	"p384":           eTLS.CurveP384,
+	"p521":           eTLS.CurveP521,
+	"x25519mlkem768": eTLS.X25519MLKEM768,
+}
+
+// ParseTLSVersion parses a tls version, e.g. "1.2". An empty s returns 0,
+// which means the default version.
+func ParseTLSVersion(s string) (uint16, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("invalid tls version %s", s)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites parses the names of secure cipher suites,
+// e.g. "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256".
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid or insecure cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, cs := range eTLS.CipherSuites() {
+		if strings.EqualFold(cs.Name, name) {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
+
+// ParseCurves parses the names of curves, can be "X25519", "P256", "P384",
+// "P521" and "X25519MLKEM768".
+func ParseCurves(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		id, ok := tlsCurves[strings.ToLower(strings.ReplaceAll(name, "-", ""))]
+		if !ok {
+			return nil, fmt.Errorf("invalid curve %s", name)
+		}
+		ids = append(ids, uint16(id))
+	}
+	return ids, nil
+}
+
+func (s *Server) curves() []uint16 {
+	if len(s.opts.TLSCurves) > 0 {
+		return s.opts.TLSCurves
+	}
+	return defaultCurves
+}
+
+func convertCurves[T ~uint16](ids []uint16) []T {
+	c := make([]T, 0, len(ids))
+	for _, id := range ids {
+		c = append(c, T(id))
+	}
+	return c
+}
+
+// QUICOpts are the transport parameters of DoQ and DoH3 servers.
+// Zero values mean the defaults.
+type QUICOpts struct {
+	// Flow control windows in bytes. The defaults are small because dns
+	// messages are small: 1252, 4K, 8K and 16K.
+	InitialStreamReceiveWindow     uint64
+	MaxStreamReceiveWindow         uint64
+	InitialConnectionReceiveWindow uint64
+	MaxConnectionReceiveWindow     uint64
+
+	// MaxIncomingStreams is the max number of concurrent streams, which
+	// are queries, of a connection. Default is 100.
+	MaxIncomingStreams int64
+
+	// MaxIdleTimeout overrides ServerOpts.IdleTimeout for QUIC.
+	MaxIdleTimeout time.Duration
+
+	// RequireAddressValidation makes the server validate the addresses of
+	// all clients with a Retry before the handshake. It costs a round trip
+	// but limits the amplification of spoofed handshakes, which is
+	// otherwise 3x of the received bytes.
+	RequireAddressValidation bool
+}
+
+func (s *Server) quicConfig() *quic.Config {
+	o := s.opts.QUIC
+	utils.SetDefaultNum(&o.MaxIdleTimeout, s.opts.IdleTimeout)
+	utils.SetDefaultNum(&o.InitialStreamReceiveWindow, 1252)
+	utils.SetDefaultNum(&o.MaxStreamReceiveWindow, 4*1024)
+	utils.SetDefaultNum(&o.InitialConnectionReceiveWindow, 8*1024)
+	utils.SetDefaultNum(&o.MaxConnectionReceiveWindow, 16*1024)
+	return &quic.Config{
+		MaxIdleTimeout:                 o.MaxIdleTimeout,
+		Allow0RTT:                      true,
+		DisablePathMTUDiscovery:        true,
+		InitialStreamReceiveWindow:     o.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         o.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: o.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     o.MaxConnectionReceiveWindow,
+		MaxIncomingStreams:             o.MaxIncomingStreams,
+	}
+}
+
+// quicGSOEnv is read by quic-go when a transport is initialized, which is
+// the only way to disable GSO.
+const quicGSOEnv = "QUIC_GO_DISABLE_GSO"
+
+// DisableQUICGSO disables the generic segmentation offload of all QUIC
+// sockets created after it, including the ones of upstreams. quic-go has
+// no per-socket option, so it must be called once at startup, before any
+// QUIC socket is created. Some kernels and virtual nics drop or corrupt
+// segmented packets.
+func DisableQUICGSO() {
+	os.Setenv(quicGSOEnv, "true")
+}
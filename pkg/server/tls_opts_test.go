@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	eTLS "gitlab.com/go-extension/tls"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    uint16
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"1.2", eTLS.VersionTLS12, false},
+		{"TLS1.3", eTLS.VersionTLS13, false},
+		{"1.4", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTLSVersion(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Fatalf("ParseTLSVersion(%q) = %d, %v, want %d, wantErr %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	got, err := ParseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "tls_ecdhe_rsa_with_chacha20_poly1305_sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint16{eTLS.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, eTLS.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}
+	if !slices.Equal(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	for _, name := range []string{"TLS_RSA_WITH_RC4_128_SHA", "not_a_suite"} {
+		if _, err := ParseCipherSuites([]string{name}); err == nil {
+			t.Fatalf("%s is accepted", name)
+		}
+	}
+}
+
+func TestParseCurves(t *testing.T) {
+	got, err := ParseCurves([]string{"X25519MLKEM768", "P-256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint16{uint16(eTLS.X25519MLKEM768), uint16(eTLS.CurveP256)}; !slices.Equal(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if _, err := ParseCurves([]string{"P224"}); err == nil {
+		t.Fatal("invalid curve is accepted")
+	}
+}
+
+func Test_Server_curves(t *testing.T) {
+	if got := NewServer(ServerOpts{}).curves(); !slices.Equal(got, defaultCurves) {
+		t.Fatalf("want the default curves, got %v", got)
+	}
+	c := []uint16{uint16(eTLS.CurveP384)}
+	if got := NewServer(ServerOpts{TLSCurves: c}).curves(); !slices.Equal(got, c) {
+		t.Fatalf("want the configured curves, got %v", got)
+	}
+}
+
+func Test_Server_quicConfig(t *testing.T) {
+	c := NewServer(ServerOpts{IdleTimeout: 30 * time.Second}).quicConfig()
+	if c.MaxIdleTimeout != 30*time.Second || c.InitialStreamReceiveWindow != 1252 || c.MaxConnectionReceiveWindow != 16*1024 || c.MaxIncomingStreams != 0 {
+		t.Fatalf("unexpected default config %+v", c)
+	}
+
+	c = NewServer(ServerOpts{IdleTimeout: 30 * time.Second, QUIC: QUICOpts{
+		MaxStreamReceiveWindow: 64 * 1024,
+		MaxIncomingStreams:     10,
+		MaxIdleTimeout:         5 * time.Second,
+	}}).quicConfig()
+	if c.MaxIdleTimeout != 5*time.Second || c.MaxStreamReceiveWindow != 64*1024 || c.MaxIncomingStreams != 10 {
+		t.Fatalf("options are not applied, got %+v", c)
+	}
+	// Options that are not set keep the defaults.
+	if c.InitialStreamReceiveWindow != 1252 || c.InitialConnectionReceiveWindow != 8*1024 {
+		t.Fatalf("unexpected defaults %+v", c)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	eTLS "gitlab.com/go-extension/tls"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// writeTestCert writes a certificate of dnsName and its key to dir.
+func writeTestCert(t *testing.T, dir, dnsName string) CertPair {
+	t.Helper()
+	c, err := utils.GenerateCertificate(dnsName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := CertPair{Cert: filepath.Join(dir, dnsName+".cert"), Key: filepath.Join(dir, dnsName+".key")}
+	if err := os.WriteFile(p.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p.Key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func Test_certSelector_get(t *testing.T) {
+	dir := t.TempDir()
+	pairs := []CertPair{writeTestCert(t, dir, "a.test"), writeTestCert(t, dir, "b.test")}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"a.test", "a.test"},
+		{"b.test", "b.test"},
+		{"c.test", "a.test"}, // the default one
+		{"", "a.test"},
+	}
+
+	t.Run("tls", func(t *testing.T) {
+		s, err := newCertSelector(pairs, tls.X509KeyPair, func(c *tls.Certificate) *x509.Certificate { return c.Leaf }, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			c, err := s.get(tt.serverName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Leaf.Subject.CommonName; got != tt.want {
+				t.Fatalf("server name %q, want cert %s, got %s", tt.serverName, tt.want, got)
+			}
+		}
+	})
+	t.Run("etls", func(t *testing.T) {
+		s, err := newCertSelector(pairs, eTLS.X509KeyPair, func(c *eTLS.Certificate) *x509.Certificate { return c.Leaf }, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			c, err := s.get(tt.serverName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Leaf.Subject.CommonName; got != tt.want {
+				t.Fatalf("server name %q, want cert %s, got %s", tt.serverName, tt.want, got)
+			}
+		}
+	})
+}
+
+func Test_Server_certPairs(t *testing.T) {
+	extra := []CertPair{{Cert: "b.cert", Key: "b.key"}}
+	s := NewServer(ServerOpts{Cert: "a.cert", Key: "a.key", Certs: extra})
+	if got := s.certPairs(); len(got) != 2 || got[0].Cert != "a.cert" || got[1].Cert != "b.cert" {
+		t.Fatalf("want the default cert first, got %v", got)
+	}
+	s = NewServer(ServerOpts{Certs: extra})
+	if got := s.certPairs(); len(got) != 1 || got[0].Cert != "b.cert" {
+		t.Fatalf("want certs only, got %v", got)
+	}
+}
+
+func Test_keyDirs(t *testing.T) {
+	defer SetKeyDir("")
+	t.Setenv(EnvKeyDir, "/env/key")
+	t.Setenv("STATE_DIRECTORY", "/var/lib/mosdns:/var/lib/other")
+
+	SetKeyDir("/opt/key")
+	if dirs, _ := keyDirs(); len(dirs) != 1 || dirs[0] != "/opt/key" {
+		t.Fatalf("want the configured dir, got %v", dirs)
+	}
+	SetKeyDir("")
+	if dirs, _ := keyDirs(); len(dirs) != 1 || dirs[0] != "/env/key" {
+		t.Fatalf("want the dir of %s, got %v", EnvKeyDir, dirs)
+	}
+	t.Setenv(EnvKeyDir, "")
+	dirs, err := keyDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := dirs[len(dirs)-1]; last != "/var/lib/mosdns/key" {
+		t.Fatalf("want the state dir last, got %v", dirs)
+	}
+}
+
+func Test_stateDir(t *testing.T) {
+	t.Setenv("STATE_DIRECTORY", "")
+	t.Setenv("XDG_STATE_HOME", "/xdg")
+	if got := stateDir(); got != "/xdg/mosdns" {
+		t.Fatalf("want /xdg/mosdns, got %s", got)
+	}
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Setenv("HOME", "/home/u")
+	if got := stateDir(); got != "/home/u/.local/state/mosdns" {
+		t.Fatalf("want the home state dir, got %s", got)
+	}
+}
+
+func Test_loadOrCreateKeysIn(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "key")
+	resetKey, sessionKey, err := loadOrCreateKeysIn(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The created keys are loaded again.
+	resetKey2, sessionKey2, err := loadOrCreateKeysIn(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *resetKey != *resetKey2 || !bytes.Equal(sessionKey, sessionKey2) {
+		t.Fatal("keys are not persistent")
+	}
+
+	// Unusable directories fail.
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadOrCreateKeysIn(filepath.Join(file, "key")); err == nil {
+		t.Fatal("keys are created under a file")
+	}
+}
+
+func TestReloadCerts(t *testing.T) {
+	// Isolate the reloaders of this test.
+	certReloaders.mu.Lock()
+	files, fns := certReloaders.files, certReloaders.fns
+	certReloaders.files, certReloaders.fns = nil, nil
+	certReloaders.mu.Unlock()
+	t.Cleanup(func() {
+		certReloaders.mu.Lock()
+		certReloaders.files, certReloaders.fns = files, fns
+		certReloaders.mu.Unlock()
+	})
+
+	dir := t.TempDir()
+	p := writeTestCert(t, dir, "a.test")
+	c, err := tryCreateWatchCert(p.Cert, p.Key, tls.LoadX509KeyPair, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the files with a certificate of another name.
+	b := writeTestCert(t, dir, "b.test")
+	for src, dst := range map[string]string{b.Cert: p.Cert, b.Key: p.Key} {
+		if err := os.Rename(src, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := ReloadCerts()
+	if n != 1 || err != nil {
+		t.Fatalf("ReloadCerts() = %d, %v", n, err)
+	}
+	if got := c.get().Leaf.Subject.CommonName; got != "b.test" {
+		t.Fatalf("want the new certificate, got %s", got)
+	}
+
+	// Invalid files are reported, and the certificate is kept.
+	if err := os.WriteFile(p.Cert, []byte("invalid"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	n, err = ReloadCerts()
+	if n != 0 || err == nil || !strings.Contains(err.Error(), p.Cert) {
+		t.Fatalf("ReloadCerts() = %d, %v, want an error of %s", n, err, p.Cert)
+	}
+	if got := c.get().Leaf.Subject.CommonName; got != "b.test" {
+		t.Fatalf("want the certificate kept, got %s", got)
+	}
+}
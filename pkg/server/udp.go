@@ -21,18 +21,26 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
 
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/mlog"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/pool"
 	C "github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/server/dns_handler"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
 // cmcUDPConn can read and write cmsg.
+// On linux, packets are read and written in batches via recvmmsg and
+// sendmmsg.
 type cmcUDPConn interface {
 	readFrom(b []byte) (n int, dst net.IP, IfIndex int, src net.Addr, err error)
 	writeTo(b []byte, src net.IP, IfIndex int, dst net.Addr) (n int, err error)
@@ -55,15 +63,29 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 
 	var cmc cmcUDPConn
 	var err error
-	uc, ok := c.(*net.UDPConn)
-	if ok && uc.LocalAddr().(*net.UDPAddr).IP.IsUnspecified() {
-		cmc, err = newCmc(uc)
+	if uc, ok := c.(*net.UDPConn); ok {
+		// Only listeners on unspecified addresses need cmsg to
+		// reply from the address where the query was received.
+		cmc, err = newCmc(uc, uc.LocalAddr().(*net.UDPAddr).IP.IsUnspecified(), s.opts.Logger)
 		if err != nil {
 			return fmt.Errorf("failed to control socket cmsg, %w", err)
 		}
 	} else {
 		cmc = newDummyCmc(c)
 	}
+	if closer, ok := cmc.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// serverAddr is the address of the listener. If it listens on an
+	// unspecified address, the destination address of each query is
+	// used instead.
+	serverAddr := utils.GetAddrPortFromAddr(c.LocalAddr())
+
+	var sem chan struct{} // nil if no limit
+	if s.opts.UDPMaxConcurrent > 0 {
+		sem = make(chan struct{}, s.opts.UDPMaxConcurrent)
+	}
 
 	for {
 		n, localAddr, ifIndex, remoteAddr, err := cmc.readFrom(rb)
@@ -75,37 +97,112 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 		q := pool.GetMsg()
 		if err := q.Unpack(rb[:n]); err != nil {
 			pool.ReleaseMsg(q)
-			s.opts.Logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", rb[:n]), zap.Stringer("from", remoteAddr))
+			s.opts.Logger.Warn("invalid msg", zap.Error(err), mlog.RawMsg("msg", rb[:n]), mlog.ClientAddr("from", remoteAddr))
 			continue
 		}
 
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			default:
+				s.handleUDPOverflow(cmc, q, localAddr, ifIndex, remoteAddr)
+				pool.ReleaseMsg(q)
+				continue
+			}
+		}
+
 		// handle query
 		go func() {
 			defer pool.ReleaseMsg(q)
+			if sem != nil {
+				defer func() { <-sem }()
+			}
 			meta := C.NewRequestMeta(clientAddr)
 			meta.SetProtocol(C.ProtocolUDP)
+			meta.SetServerAddr(queryServerAddr(serverAddr, localAddr))
 
-			r, err := handler.ServeDNS(listenerCtx, q, meta)
-			if err != nil {
-				s.opts.Logger.Warn("handler err", zap.Error(err))
+			var r *dns.Msg
+			var raw []byte
+			var clientCookie []byte
+			if s.cookieSecret != nil {
+				clientCookie, r = s.checkCookie(q, clientAddr)
+			}
+			if r == nil {
+				var err error
+				r, raw, err = dns_handler.ServeRaw(listenerCtx, handler, q, meta)
+				if err == nil && raw != nil && (clientCookie != nil || len(raw) > getUDPSize(q)) {
+					// The packed response cannot be sent as is.
+					r, err = dns_handler.UnpackRaw(nil, raw)
+					raw = nil
+				}
+				if err != nil {
+					if errors.Is(err, C.ErrDropQuery) {
+						s.opts.Logger.Debug("query dropped", zap.Error(err))
+					} else {
+						s.opts.Logger.Warn("handler err", zap.Error(err))
+					}
+					return
+				}
+				if r != nil && clientCookie != nil {
+					s.setCookie(r, clientCookie, clientAddr)
+				}
+			}
+			if raw != nil {
+				if _, err := cmc.writeTo(raw, localAddr, ifIndex, remoteAddr); err != nil {
+					s.opts.Logger.Warn("failed to write response", mlog.ClientAddr("client", remoteAddr), zap.Error(err))
+				}
 				return
 			}
 			if r != nil {
+				// Truncate only compresses r if it does not fit, which is
+				// what dnsutils.CompressAuto does.
 				r.Truncate(getUDPSize(q))
-				b, buf, err := pool.PackBuffer(r)
+				if s.opts.Compression != dnsutils.CompressAuto {
+					r.Compress = true
+				}
+				b, buf, err := pool.PackMsg(r)
 				if err != nil {
 					s.opts.Logger.Error("failed to unpack handler's response", zap.Error(err), zap.Stringer("msg", r))
 					return
 				}
 				defer buf.Release()
 				if _, err := cmc.writeTo(b, localAddr, ifIndex, remoteAddr); err != nil {
-					s.opts.Logger.Warn("failed to write response", zap.Stringer("client", remoteAddr), zap.Error(err))
+					s.opts.Logger.Warn("failed to write response", mlog.ClientAddr("client", remoteAddr), zap.Error(err))
 				}
 			}
 		}()
 	}
 }
 
+// handleUDPOverflow handles the query q that exceeds UDPMaxConcurrent.
+func (s *Server) handleUDPOverflow(cmc cmcUDPConn, q *dns.Msg, localAddr net.IP, ifIndex int, remoteAddr net.Addr) {
+	if c := s.opts.UDPOverflowCounter; c != nil {
+		c.Inc()
+	}
+	if s.opts.UDPOverflowPolicy != OverflowServfail {
+		return
+	}
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeServerFailure)
+	b, buf, err := pool.PackBuffer(r)
+	if err != nil {
+		return
+	}
+	defer buf.Release()
+	if _, err := cmc.writeTo(b, localAddr, ifIndex, remoteAddr); err != nil {
+		s.opts.Logger.Warn("failed to write response", mlog.ClientAddr("client", remoteAddr), zap.Error(err))
+	}
+}
+
+// queryServerAddr returns the address where a query was received.
+// dst is the destination address read from cmsg, which may be nil.
+func queryServerAddr(listenerAddr netip.AddrPort, dst net.IP) netip.AddrPort {
+	if addr, ok := netip.AddrFromSlice(dst); ok && !addr.IsUnspecified() {
+		return netip.AddrPortFrom(addr, listenerAddr.Port())
+	}
+	return listenerAddr
+}
+
 func getUDPSize(m *dns.Msg) int {
 	var s uint16
 	if opt := m.IsEdns0(); opt != nil {
@@ -22,77 +22,208 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"sync"
 
+	"go.uber.org/zap"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/unix"
+
+	"github.com/pmkol/mosdns-x/mlog"
+	"github.com/pmkol/mosdns-x/pkg/pool"
 )
 
-type ipv4cmc struct {
-	c *ipv4.PacketConn
+// udpBatchSize is the max number of packets read or written by one
+// recvmmsg or sendmmsg call.
+const udpBatchSize = 32
+
+// batchConn is implemented by ipv4.PacketConn and ipv6.PacketConn.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
 }
 
-func newIpv4cmc(c *ipv4.PacketConn) *ipv4cmc {
-	return &ipv4cmc{c: c}
+// batchCmc is a cmcUDPConn that reads and writes packets in batches via
+// recvmmsg and sendmmsg.
+// Writes are asynchronous. writeTo queues the packet and returns, errors
+// are logged by the write loop.
+type batchCmc struct {
+	c      batchConn
+	v6     bool // socket is AF_INET6
+	cmsg   bool // socket has cmsg flags set
+	logger *zap.Logger
+
+	// Used by readFrom only. readFrom is called by one goroutine.
+	rMsgs []ipv4.Message
+	rn    int // number of msgs in rMsgs
+	rp    int // next msg to be returned
+
+	wq        chan queuedPacket
+	closeOnce sync.Once
+	closeChan chan struct{}
 }
 
-func (i *ipv4cmc) readFrom(b []byte) (n int, dst net.IP, IfIndex int, src net.Addr, err error) {
-	n, cm, src, err := i.c.ReadFrom(b)
-	if cm != nil {
-		dst, IfIndex = cm.Dst, cm.IfIndex
-	}
-	return
+type queuedPacket struct {
+	m   ipv4.Message
+	buf *pool.Buffer
 }
 
-func (i *ipv4cmc) writeTo(b []byte, src net.IP, IfIndex int, dst net.Addr) (n int, err error) {
-	cm := &ipv4.ControlMessage{
-		Src:     src,
-		IfIndex: IfIndex,
+func newBatchCmc(c batchConn, v6, cmsg bool, logger *zap.Logger) *batchCmc {
+	bc := &batchCmc{
+		c:         c,
+		v6:        v6,
+		cmsg:      cmsg,
+		logger:    logger,
+		rMsgs:     make([]ipv4.Message, udpBatchSize),
+		wq:        make(chan queuedPacket, udpBatchSize*4),
+		closeChan: make(chan struct{}),
+	}
+	for i := range bc.rMsgs {
+		bc.rMsgs[i].Buffers = [][]byte{make([]byte, 64*1024)}
+		if cmsg {
+			if v6 {
+				bc.rMsgs[i].OOB = ipv6.NewControlMessage(ipv6.FlagDst | ipv6.FlagInterface)
+			} else {
+				bc.rMsgs[i].OOB = ipv4.NewControlMessage(ipv4.FlagDst | ipv4.FlagInterface)
+			}
+		}
 	}
-	return i.c.WriteTo(b, cm, dst)
+	go bc.writeLoop()
+	return bc
 }
 
-type ipv6cmc struct {
-	c4 *ipv4.PacketConn // ipv4 entrypoint for sending ipv4 packages.
-	c6 *ipv6.PacketConn
+func (bc *batchCmc) readFrom(b []byte) (n int, dst net.IP, IfIndex int, src net.Addr, err error) {
+	if bc.rp >= bc.rn {
+		bc.rn, bc.rp = 0, 0
+		bc.rn, err = bc.c.ReadBatch(bc.rMsgs, 0)
+		if err != nil {
+			return 0, nil, 0, nil, err
+		}
+	}
+	m := &bc.rMsgs[bc.rp]
+	bc.rp++
+
+	n = copy(b, m.Buffers[0][:m.N])
+	src = m.Addr
+	if bc.cmsg && m.NN > 0 {
+		if bc.v6 {
+			cm := new(ipv6.ControlMessage)
+			if cm.Parse(m.OOB[:m.NN]) == nil {
+				dst, IfIndex = cm.Dst, cm.IfIndex
+			}
+		} else {
+			cm := new(ipv4.ControlMessage)
+			if cm.Parse(m.OOB[:m.NN]) == nil {
+				dst, IfIndex = cm.Dst, cm.IfIndex
+			}
+		}
+	}
+	return n, dst, IfIndex, src, nil
 }
 
-func newIpv6PacketConn(c4 *ipv4.PacketConn, c6 *ipv6.PacketConn) *ipv6cmc {
-	return &ipv6cmc{c4: c4, c6: c6}
+func (bc *batchCmc) writeTo(b []byte, src net.IP, IfIndex int, dst net.Addr) (n int, err error) {
+	buf := pool.GetBuf(len(b))
+	copy(buf.Bytes(), b)
+	p := queuedPacket{
+		m: ipv4.Message{
+			Buffers: [][]byte{buf.Bytes()},
+			OOB:     bc.oob(src, IfIndex),
+			Addr:    dst,
+		},
+		buf: buf,
+	}
+	select {
+	case bc.wq <- p:
+		return len(b), nil
+	case <-bc.closeChan:
+		buf.Release()
+		return 0, net.ErrClosed
+	}
 }
 
-func (i *ipv6cmc) readFrom(b []byte) (n int, dst net.IP, IfIndex int, src net.Addr, err error) {
-	n, cm, src, err := i.c6.ReadFrom(b)
-	if cm != nil {
-		dst, IfIndex = cm.Dst, cm.IfIndex
+func (bc *batchCmc) oob(src net.IP, IfIndex int) []byte {
+	if !bc.cmsg || src == nil {
+		return nil
 	}
-	return
+	// If src is ipv4, use IP_PKTINFO instead of IPV6_PKTINFO.
+	// Otherwise, sendmsg will raise "invalid argument" error.
+	// No official doc found.
+	if src4 := src.To4(); src4 != nil {
+		return (&ipv4.ControlMessage{Src: src4, IfIndex: IfIndex}).Marshal()
+	}
+	return (&ipv6.ControlMessage{Src: src, IfIndex: IfIndex}).Marshal()
 }
 
-func (i *ipv6cmc) writeTo(b []byte, src net.IP, IfIndex int, dst net.Addr) (n int, err error) {
-	if src != nil {
-		// If src is ipv4, use IP_PKTINFO instead of IPV6_PKTINFO.
-		// Otherwise, sendmsg will raise "invalid argument" error.
-		// No official doc found.
-		if src4 := src.To4(); src4 != nil {
-			cm4 := &ipv4.ControlMessage{
-				Src:     src4,
-				IfIndex: IfIndex,
+func (bc *batchCmc) writeLoop() {
+	ps := make([]queuedPacket, 0, udpBatchSize)
+	ms := make([]ipv4.Message, 0, udpBatchSize)
+	for {
+		ps = ps[:0]
+		select {
+		case p := <-bc.wq:
+			ps = append(ps, p)
+		case <-bc.closeChan:
+			return
+		}
+	collect:
+		for len(ps) < udpBatchSize {
+			select {
+			case p := <-bc.wq:
+				ps = append(ps, p)
+			default:
+				break collect
 			}
-			return i.c4.WriteTo(b, cm4, dst)
+		}
+
+		ms = ms[:0]
+		for _, p := range ps {
+			ms = append(ms, p.m)
+		}
+		bc.writeBatch(ms)
+		for i := range ps {
+			ps[i].buf.Release()
+			ps[i] = queuedPacket{}
 		}
 	}
-	cm6 := &ipv6.ControlMessage{
-		Src:     src,
-		IfIndex: IfIndex,
+}
+
+// writeBatch writes ms. If a packet cannot be written, it is dropped and
+// the rest are retried.
+func (bc *batchCmc) writeBatch(ms []ipv4.Message) {
+	for left := ms; len(left) > 0; {
+		n, err := bc.c.WriteBatch(left, 0)
+		left = left[max(n, 0):]
+		switch {
+		case err == nil && n > 0:
+		case len(left) == 0:
+		case errors.Is(err, net.ErrClosed):
+			bc.logger.Debug("socket is closed, responses dropped", zap.Int("dropped", len(left)))
+			return
+		case err == nil:
+			// sendmmsg wrote nothing without an error. Don't spin on it.
+			bc.logger.Warn("failed to write responses, no packet was sent", zap.Int("dropped", len(left)))
+			return
+		default:
+			bc.logger.Warn("failed to write response", mlog.ClientAddr("client", left[0].Addr), zap.Error(err))
+			left = left[1:]
+		}
 	}
-	return i.c6.WriteTo(b, cm6, dst)
 }
 
-func newCmc(c *net.UDPConn) (cmcUDPConn, error) {
+// Close stops the write loop. Queued packets are dropped.
+func (bc *batchCmc) Close() error {
+	bc.closeOnce.Do(func() { close(bc.closeChan) })
+	return nil
+}
+
+// newCmc returns a cmcUDPConn that reads and writes packets in batches.
+// If cmsg is true, the destination address and interface of received
+// packets are reported, and used as the source of the replies.
+func newCmc(c *net.UDPConn, cmsg bool, logger *zap.Logger) (cmcUDPConn, error) {
 	sc, err := c.SyscallConn()
 	if err != nil {
 		return nil, err
@@ -110,17 +241,21 @@ func newCmc(c *net.UDPConn) (cmcUDPConn, error) {
 		switch v {
 		case unix.AF_INET:
 			c4 := ipv4.NewPacketConn(c)
-			if err := c4.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
-				controlErr = fmt.Errorf("failed to set ipv4 cmsg flags, %w", err)
+			if cmsg {
+				if err := c4.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+					controlErr = fmt.Errorf("failed to set ipv4 cmsg flags, %w", err)
+				}
 			}
-			cmc = newIpv4cmc(c4)
+			cmc = newBatchCmc(c4, false, cmsg, logger)
 			return
 		case unix.AF_INET6:
 			c6 := ipv6.NewPacketConn(c)
-			if err := c6.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true); err != nil {
-				controlErr = fmt.Errorf("failed to set ipv6 cmsg flags, %w", err)
+			if cmsg {
+				if err := c6.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true); err != nil {
+					controlErr = fmt.Errorf("failed to set ipv6 cmsg flags, %w", err)
+				}
 			}
-			cmc = newIpv6PacketConn(ipv4.NewPacketConn(c), c6)
+			cmc = newBatchCmc(c6, true, cmsg, logger)
 			return
 		default:
 			controlErr = fmt.Errorf("socket protocol %d is not supported", v)
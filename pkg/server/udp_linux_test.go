@@ -0,0 +1,161 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestBatchCmc(t *testing.T, addr string) (*net.UDPConn, cmcUDPConn) {
+	t.Helper()
+	c, err := net.ListenUDP("udp", mustResolveUDPAddr(t, addr))
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	cmc, err := newCmc(c, true, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cmc.(*batchCmc).Close() })
+	return c, cmc
+}
+
+func Test_batchCmc(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		t.Run(addr, func(t *testing.T) {
+			c, cmc := newTestBatchCmc(t, addr)
+			client, err := net.DialUDP("udp", nil, c.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// More packets than a batch, and a large one.
+			var sent [][]byte
+			for i := 0; i < udpBatchSize*2; i++ {
+				sent = append(sent, bytes.Repeat([]byte{byte(i)}, i+1))
+			}
+			sent = append(sent, bytes.Repeat([]byte{0xff}, 60000))
+			for _, b := range sent {
+				if _, err := client.Write(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Echo the packets back, from the destination address of the
+			// queries, which is reported by the control messages.
+			b := make([]byte, 64*1024)
+			localIP := c.LocalAddr().(*net.UDPAddr).IP
+			for i, want := range sent {
+				n, dst, ifIndex, src, err := cmc.readFrom(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b[:n], want) {
+					t.Fatalf("packet #%d, want %d bytes, got %d", i, len(want), n)
+				}
+				if !dst.Equal(localIP) || ifIndex == 0 {
+					t.Fatalf("packet #%d, want dst %s and an interface, got %s %d", i, localIP, dst, ifIndex)
+				}
+				if _, err := cmc.writeTo(b[:n], dst, ifIndex, src); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rb := make([]byte, 64*1024)
+			for i, want := range sent {
+				n, err := client.Read(rb)
+				if err != nil {
+					t.Fatalf("reply #%d, %v", i, err)
+				}
+				if !bytes.Equal(rb[:n], want) {
+					t.Fatalf("reply #%d, want %d bytes, got %d", i, len(want), n)
+				}
+			}
+		})
+	}
+}
+
+func Test_batchCmc_truncatedRead(t *testing.T) {
+	c, cmc := newTestBatchCmc(t, "127.0.0.1:0")
+	client, err := net.DialUDP("udp", nil, c.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(bytes.Repeat([]byte{1}, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 512)
+	n, _, _, _, err := cmc.readFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) {
+		t.Fatalf("want a truncated read of %d bytes, got %d", len(b), n)
+	}
+}
+
+func Test_batchCmc_writeError(t *testing.T) {
+	c, cmc := newTestBatchCmc(t, "127.0.0.1:0")
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	dst := client.LocalAddr()
+	src := c.LocalAddr().(*net.UDPAddr).IP
+
+	// The oversized packet fails with EMSGSIZE. It is dropped, and the
+	// packets after it in the same batch are still sent.
+	for _, b := range [][]byte{{1}, make([]byte, 70000), {2}} {
+		if _, err := cmc.writeTo(b, src, 0, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rb := make([]byte, 64*1024)
+	for _, want := range []byte{1, 2} {
+		n, err := client.Read(rb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || rb[0] != want {
+			t.Fatalf("want packet %d, got %v", want, rb[:n])
+		}
+	}
+}
+
+func mustResolveUDPAddr(t *testing.T, addr string) *net.UDPAddr {
+	t.Helper()
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
@@ -21,8 +21,12 @@
 
 package server
 
-import "net"
+import (
+	"net"
 
-func newCmc(c *net.UDPConn) (cmcUDPConn, error) {
+	"go.uber.org/zap"
+)
+
+func newCmc(c *net.UDPConn, _ bool, _ *zap.Logger) (cmcUDPConn, error) {
 	return newDummyCmc(c), nil
 }
@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	C "github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// blockingHandler blocks queries until release is closed.
+type blockingHandler struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHandler) ServeDNS(_ context.Context, q *dns.Msg, _ *C.RequestMeta) (*dns.Msg, error) {
+	h.entered <- struct{}{}
+	<-h.release
+	r := new(dns.Msg)
+	r.SetReply(q)
+	return r, nil
+}
+
+// countCounter counts its Inc calls.
+type countCounter struct {
+	prometheus.Counter
+	n atomic.Int32
+}
+
+func (c *countCounter) Inc() { c.n.Add(1) }
+
+func Test_Server_ServeUDP_overflow(t *testing.T) {
+	tests := []struct {
+		policy    string
+		wantReply bool
+	}{
+		{"", false},
+		{OverflowDrop, false},
+		{OverflowServfail, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			h := &blockingHandler{entered: make(chan struct{}, 1), release: make(chan struct{})}
+			overflow := new(countCounter)
+			s := NewServer(ServerOpts{
+				DNSHandler:         h,
+				UDPMaxConcurrent:   1,
+				UDPOverflowPolicy:  tt.policy,
+				UDPOverflowCounter: overflow,
+			})
+			c, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.ServeUDP(c)
+			defer c.Close()
+
+			client, err := net.Dial("udp", c.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			conn := &dns.Conn{Conn: client}
+			send := func(id uint16) {
+				q := new(dns.Msg)
+				q.SetQuestion("example.com.", dns.TypeA)
+				q.Id = id
+				if err := conn.WriteMsg(q); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			send(1)
+			<-h.entered
+			send(2)
+
+			_ = client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			r, err := conn.ReadMsg()
+			if tt.wantReply {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.Id != 2 || r.Rcode != dns.RcodeServerFailure {
+					t.Fatalf("want a servfail of query 2, got %v", r)
+				}
+			} else if err == nil {
+				t.Fatalf("want the overflowed query dropped, got %v", r)
+			}
+			if got := overflow.n.Load(); got != 1 {
+				t.Fatalf("want 1 overflowed query, got %v", got)
+			}
+
+			// The handled query is still answered.
+			close(h.release)
+			_ = client.SetReadDeadline(time.Now().Add(time.Second))
+			r, err = conn.ReadMsg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Id != 1 || r.Rcode != dns.RcodeSuccess {
+				t.Fatalf("want the response of query 1, got %v", r)
+			}
+		})
+	}
+}
+
+// rawHandler responds packed msgs with n A records.
+type rawHandler struct {
+	n int
+}
+
+func (h *rawHandler) ServeDNS(ctx context.Context, q *dns.Msg, meta *C.RequestMeta) (*dns.Msg, error) {
+	panic("ServeDNSRaw should be used")
+}
+
+func (h *rawHandler) ServeDNSRaw(_ context.Context, q *dns.Msg, _ *C.RequestMeta) (*dns.Msg, []byte, error) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	for i := 0; i < h.n; i++ {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(10, 0, byte(i>>8), byte(i)),
+		})
+	}
+	raw, err := r.Pack()
+	return nil, raw, err
+}
+
+func Test_Server_ServeUDP_raw(t *testing.T) {
+	tests := []struct {
+		name          string
+		n             int
+		wantTruncated bool
+	}{
+		{"sent as is", 2, false},
+		{"truncated", 64, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &rawHandler{n: tt.n}
+			s := NewServer(ServerOpts{DNSHandler: h})
+			c, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.ServeUDP(c)
+			defer c.Close()
+
+			client, err := net.Dial("udp", c.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			conn := &dns.Conn{Conn: client}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			if err := conn.WriteMsg(q); err != nil {
+				t.Fatal(err)
+			}
+
+			_ = client.SetReadDeadline(time.Now().Add(time.Second))
+			b, err := conn.ReadMsgHeader(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := new(dns.Msg)
+			if err := r.Unpack(b); err != nil {
+				t.Fatal(err)
+			}
+			if r.Truncated != tt.wantTruncated {
+				t.Fatalf("want truncated %v, got %v", tt.wantTruncated, r.Truncated)
+			}
+			if !tt.wantTruncated {
+				_, raw, _ := h.ServeDNSRaw(context.Background(), q, nil)
+				if len(b) != len(raw) || len(r.Answer) != tt.n {
+					t.Fatalf("want the packed response of %d bytes, got %d bytes", len(raw), len(b))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package capture records the raw wire messages exchanged with upstreams
+// for diagnostics.
+package capture
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/pool"
+)
+
+const defaultSize = 256
+
+// Record is a captured wire message.
+type Record struct {
+	Time time.Time
+	Sent bool // true if the message was sent to the upstream
+	Wire []byte
+}
+
+// Capture keeps the latest captured messages in a ring buffer.
+// A nil *Capture is valid and captures nothing.
+type Capture struct {
+	match func(name string) bool // nil matches all names
+
+	mu   sync.Mutex
+	ring []Record
+	p    int // next write position
+	full bool
+}
+
+// New creates a Capture that keeps at most size records. If size <= 0,
+// a default size of 256 is used. match reports whether the messages of
+// the qname should be captured. A nil match captures all messages.
+func New(size int, match func(name string) bool) *Capture {
+	if size <= 0 {
+		size = defaultSize
+	}
+	return &Capture{
+		match: match,
+		ring:  make([]Record, size),
+	}
+}
+
+// Sent records the wire message that was sent. m is the message of wire.
+func (c *Capture) Sent(wire []byte, m *dns.Msg) {
+	c.add(true, wire, m)
+}
+
+// Received records the wire message that was received. m is the unpacked
+// message of wire. It can be nil if wire is not a valid dns message, in
+// which case the message is always recorded.
+func (c *Capture) Received(wire []byte, m *dns.Msg) {
+	c.add(false, wire, m)
+}
+
+func (c *Capture) add(sent bool, wire []byte, m *dns.Msg) {
+	if c == nil {
+		return
+	}
+	if c.match != nil && m != nil {
+		if len(m.Question) == 0 || !c.match(m.Question[0].Name) {
+			return
+		}
+	}
+
+	r := Record{Time: time.Now(), Sent: sent, Wire: append([]byte(nil), wire...)}
+	c.mu.Lock()
+	c.ring[c.p] = r
+	c.p++
+	if c.p >= len(c.ring) {
+		c.p = 0
+		c.full = true
+	}
+	c.mu.Unlock()
+}
+
+// Records returns the captured records, oldest first.
+func (c *Capture) Records() []Record {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.full {
+		return append([]Record(nil), c.ring[:c.p]...)
+	}
+	rs := make([]Record, 0, len(c.ring))
+	rs = append(rs, c.ring[c.p:]...)
+	return append(rs, c.ring[:c.p]...)
+}
+
+// WriteHex writes the captured records to w as a hex dump.
+func (c *Capture) WriteHex(w io.Writer) error {
+	b := new(bytes.Buffer)
+	for _, r := range c.Records() {
+		dir := "recv"
+		if r.Sent {
+			dir = "sent"
+		}
+		fmt.Fprintf(b, "%s %s %d bytes\n", r.Time.Format(time.RFC3339Nano), dir, len(r.Wire))
+		b.WriteString(hex.Dump(r.Wire))
+		b.WriteByte('\n')
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// WriteMsgToTCP is like dnsutils.WriteMsgToTCP but also records m.
+func (c *Capture) WriteMsgToTCP(w io.Writer, m *dns.Msg) (int, error) {
+	if c == nil {
+		return dnsutils.WriteMsgToTCP(w, m)
+	}
+	b, buf, err := pool.PackBuffer(m)
+	if err != nil {
+		return 0, err
+	}
+	defer buf.Release()
+	c.Sent(b, m)
+	return dnsutils.WriteRawMsgToTCP(w, b)
+}
+
+// ReadMsgFromTCP is like dnsutils.ReadMsgFromTCP but also records the
+// received msg.
+func (c *Capture) ReadMsgFromTCP(r io.Reader, m *dns.Msg) (int, error) {
+	if c == nil {
+		return dnsutils.ReadMsgFromTCP(r, m)
+	}
+	b, n, err := dnsutils.ReadRawMsgFromTCP(r)
+	if err != nil {
+		return n, err
+	}
+	defer b.Release()
+	if err := m.Unpack(b.Bytes()); err != nil {
+		c.Received(b.Bytes(), nil)
+		return n, err
+	}
+	c.Received(b.Bytes(), m)
+	return n, nil
+}
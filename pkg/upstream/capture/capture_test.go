@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package capture
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newQuery(name string) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	return q
+}
+
+func TestCapture_Ring(t *testing.T) {
+	c := New(2, nil)
+	for i := byte(0); i < 3; i++ {
+		c.Sent([]byte{i}, newQuery("example.com."))
+	}
+	rs := c.Records()
+	if len(rs) != 2 || rs[0].Wire[0] != 1 || rs[1].Wire[0] != 2 {
+		t.Fatalf("unexpected records %v", rs)
+	}
+
+	var nilCapture *Capture
+	nilCapture.Sent([]byte{0}, nil)
+	if nilCapture.Records() != nil {
+		t.Fatal("nil capture should not record")
+	}
+}
+
+func TestCapture_Match(t *testing.T) {
+	c := New(0, func(name string) bool { return name == "example.com." })
+	c.Sent([]byte{1}, newQuery("example.com."))
+	c.Sent([]byte{2}, newQuery("example.org."))
+	c.Received([]byte{3}, nil) // invalid msgs are always recorded.
+	rs := c.Records()
+	if len(rs) != 2 || rs[0].Wire[0] != 1 || rs[1].Wire[0] != 3 || rs[1].Sent {
+		t.Fatalf("unexpected records %v", rs)
+	}
+}
+
+func TestCapture_TCP(t *testing.T) {
+	c := New(0, nil)
+	q := newQuery("example.com.")
+	b := new(bytes.Buffer)
+	if _, err := c.WriteMsgToTCP(b, q); err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	if _, err := c.ReadMsgFromTCP(b, r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != q.Id {
+		t.Fatal("unexpected msg")
+	}
+
+	wire, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := c.Records()
+	if len(rs) != 2 || !rs[0].Sent || rs[1].Sent {
+		t.Fatalf("unexpected records %v", rs)
+	}
+	for _, rec := range rs {
+		if !bytes.Equal(rec.Wire, wire) {
+			t.Fatalf("captured wire %x, want %x", rec.Wire, wire)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	if err := c.WriteHex(out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("sent")) || !bytes.Contains(out.Bytes(), []byte("recv")) {
+		t.Fatalf("unexpected hex dump %s", out)
+	}
+}
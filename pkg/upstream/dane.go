@@ -0,0 +1,231 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	minTLSARecordTTL  = time.Minute
+	tlsaLookupTimeout = time.Second * 5
+)
+
+// daneVerifier verifies server certificates against the TLSA records
+// of the server (RFC 6698, RFC 7671).
+// If the server has no TLSA record, the certificate is verified as usual.
+// DANE-TA(2) and DANE-EE(3) records are trust anchors in addition to the
+// root CAs. PKIX-TA(0) and PKIX-EE(1) records constrain the PKIX chain.
+// The records are only used if the bootstrap server, which must be a
+// validating resolver, set the AD bit of the answer. Otherwise, the
+// certificate is verified as usual.
+type daneVerifier struct {
+	name       string // e.g. "_853._tcp.dns.example."
+	serverName string
+	bootstrap  string
+	insecure   bool
+	rootCAs    *x509.CertPool
+
+	mu        sync.Mutex
+	cached    []*dns.TLSA
+	validated bool // the cached records were validated by the bootstrap server
+	expireAt  time.Time
+}
+
+// newDANEVerifier creates a daneVerifier for serverName. network is
+// "tcp" or "udp".
+func newDANEVerifier(serverName, port, network string, opt *Opt) *daneVerifier {
+	return &daneVerifier{
+		name:       fmt.Sprintf("_%s._%s.%s", port, network, dns.Fqdn(serverName)),
+		serverName: serverName,
+		bootstrap:  bootstrapAddr(opt.Bootstrap),
+		insecure:   opt.Insecure,
+		rootCAs:    opt.RootCAs,
+	}
+}
+
+// VerifyPeerCertificate can be used as the VerifyPeerCertificate of a
+// tls.Config or an eTLS.Config that has InsecureSkipVerify set.
+func (v *daneVerifier) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no server certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, b := range rawCerts {
+		c, err := x509.ParseCertificate(b)
+		if err != nil {
+			return fmt.Errorf("invalid server certificate, %w", err)
+		}
+		certs = append(certs, c)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsaLookupTimeout)
+	defer cancel()
+	records, validated, err := v.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	pkixErr := v.verifyPKIX(certs, nil)
+	if len(records) == 0 || !validated {
+		return pkixErr
+	}
+	for _, r := range records {
+		if v.match(r, certs, pkixErr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("server certificate does not match the tlsa records of %s", v.name)
+}
+
+func (v *daneVerifier) match(r *dns.TLSA, certs []*x509.Certificate, pkixErr error) bool {
+	switch r.Usage {
+	case 0: // PKIX-TA
+		if pkixErr != nil {
+			return false
+		}
+		for _, c := range certs[1:] {
+			if tlsaMatch(r, c) {
+				return true
+			}
+		}
+	case 1: // PKIX-EE
+		return pkixErr == nil && tlsaMatch(r, certs[0])
+	case 2: // DANE-TA
+		for _, c := range certs[1:] {
+			if tlsaMatch(r, c) {
+				roots := x509.NewCertPool()
+				roots.AddCert(c)
+				if v.verifyPKIX(certs, roots) == nil {
+					return true
+				}
+			}
+		}
+	case 3: // DANE-EE, the name and the validity period are not checked (RFC 7671 5.1).
+		return tlsaMatch(r, certs[0])
+	}
+	return false
+}
+
+// verifyPKIX verifies the chain. If roots is nil, v.rootCAs is used.
+func (v *daneVerifier) verifyPKIX(certs []*x509.Certificate, roots *x509.CertPool) error {
+	if v.insecure && roots == nil {
+		return nil
+	}
+	if roots == nil {
+		roots = v.rootCAs
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       v.serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+func tlsaMatch(r *dns.TLSA, c *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case 0:
+		data = c.Raw
+	case 1:
+		data = c.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch r.MatchingType {
+	case 0:
+	case 1:
+		h := sha256.Sum256(data)
+		data = h[:]
+	case 2:
+		h := sha512.Sum512(data)
+		data = h[:]
+	default:
+		return false
+	}
+	return strings.EqualFold(hex.EncodeToString(data), r.Certificate)
+}
+
+func (v *daneVerifier) get(ctx context.Context) ([]*dns.TLSA, bool, error) {
+	v.mu.Lock()
+	if time.Now().Before(v.expireAt) {
+		records, validated := v.cached, v.validated
+		v.mu.Unlock()
+		return records, validated, nil
+	}
+	v.mu.Unlock()
+
+	records, validated, ttl, err := v.lookup(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to lookup tlsa records, %w", err)
+	}
+	v.mu.Lock()
+	v.cached = records
+	v.validated = validated
+	v.expireAt = time.Now().Add(max(ttl, minTLSARecordTTL))
+	v.mu.Unlock()
+	return records, validated, nil
+}
+
+// lookup returns the tlsa records and whether they were validated, that
+// is, the AD bit of the response.
+func (v *daneVerifier) lookup(ctx context.Context) ([]*dns.TLSA, bool, time.Duration, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(v.name, dns.TypeTLSA)
+	q.AuthenticatedData = true
+	q.SetEdns0(1232, true)
+	r, err := bootstrapExchange(ctx, v.bootstrap, q)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, false, 0, fmt.Errorf("unexpected rcode %s", dns.RcodeToString[r.Rcode])
+	}
+
+	var records []*dns.TLSA
+	var ttl time.Duration
+	for _, rr := range r.Answer {
+		if tlsa, ok := rr.(*dns.TLSA); ok {
+			records = append(records, tlsa)
+			if t := time.Duration(tlsa.Hdr.Ttl) * time.Second; ttl == 0 || t < ttl {
+				ttl = t
+			}
+		}
+	}
+	return records, r.AuthenticatedData, ttl, nil
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_daneVerifier(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example"},
+		DNSNames:     []string{"dns.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	records := map[string]string{
+		"_853._tcp.dns.example.":     hex.EncodeToString(spkiHash[:]),
+		"_853._tcp.wrong.example.":   hex.EncodeToString(make([]byte, 32)),
+		"_853._tcp.spoofed.example.": hex.EncodeToString(spkiHash[:]),
+	}
+	addr, shutdown := newUDPTestServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.AuthenticatedData = q.IsEdns0().Do() && q.Question[0].Name != "_853._tcp.spoofed.example."
+		if data, ok := records[q.Question[0].Name]; ok {
+			r.Answer = append(r.Answer, &dns.TLSA{
+				Hdr:          dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTLSA, Class: dns.ClassINET, Ttl: 300},
+				Usage:        3,
+				Selector:     1,
+				MatchingType: 1,
+				Certificate:  data,
+			})
+		}
+		w.WriteMsg(r)
+	}))
+	defer shutdown()
+
+	tests := []struct {
+		name    string
+		host    string
+		wantErr bool
+	}{
+		{"dane-ee match", "dns.example", false},
+		{"dane-ee mismatch", "wrong.example", true},
+		{"dane-ee match, not validated", "spoofed.example", true},
+		{"no record, untrusted cert", "none.example", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newDANEVerifier(tt.host, "853", "tcp", &Opt{Bootstrap: addr})
+			err := v.VerifyPeerCertificate([][]byte{der}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyPeerCertificate() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
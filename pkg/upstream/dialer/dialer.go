@@ -21,6 +21,7 @@ package dialer
 
 import (
 	"context"
+	"errors"
 	"net"
 )
 
@@ -33,12 +34,18 @@ type DialerOpts struct {
 	SocksAddr  string
 	S5Username string
 	S5Password string
+	HTTPProxy  string
 }
 
 func NewDialer(opts DialerOpts) (Dialer, error) {
-	if len(opts.SocksAddr) == 0 {
-		return newPlainDialer(opts.Dialer), nil
-	} else {
+	switch {
+	case len(opts.SocksAddr) > 0 && len(opts.HTTPProxy) > 0:
+		return nil, errors.New("socks5 and http proxy cannot be used at the same time")
+	case len(opts.SocksAddr) > 0:
 		return newSocksDialer(opts.Dialer, opts.SocksAddr, opts.S5Username, opts.S5Password)
+	case len(opts.HTTPProxy) > 0:
+		return newHTTPDialer(opts.Dialer, opts.HTTPProxy)
+	default:
+		return newPlainDialer(opts.Dialer), nil
 	}
 }
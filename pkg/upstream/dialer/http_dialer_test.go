@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func Test_newHTTPDialer(t *testing.T) {
+	tests := []struct {
+		proxy    string
+		wantAddr string
+		wantAuth string
+		wantErr  bool
+	}{
+		{"http://127.0.0.1:8080", "127.0.0.1:8080", "", false},
+		{"127.0.0.1:8080", "127.0.0.1:8080", "", false},
+		{"http://proxy.example", "proxy.example:80", "", false},
+		{"http://u:p@127.0.0.1:8080", "127.0.0.1:8080", "Basic " + base64.StdEncoding.EncodeToString([]byte("u:p")), false},
+		{"https://127.0.0.1:8080", "", "", true},
+	}
+	for _, tt := range tests {
+		d, err := newHTTPDialer(new(net.Dialer), tt.proxy)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: error = %v, wantErr %v", tt.proxy, err, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if d.addr != tt.wantAddr || d.auth != tt.wantAuth {
+			t.Fatalf("%s: got addr %s auth %s", tt.proxy, d.addr, d.auth)
+		}
+	}
+}
+
+// startHTTPProxy starts a CONNECT proxy that answers with status, sends
+// "hello" right after the response, and then echoes. It records the
+// target and the auth header of the request.
+func startHTTPProxy(t *testing.T, status int) (addr string, got chan *http.Request) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	got = make(chan *http.Request, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				got <- req
+				res := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+				if err := res.Write(c); err != nil || status != http.StatusOK {
+					return
+				}
+				c.Write([]byte("hello"))
+				io.Copy(c, br)
+			}()
+		}
+	}()
+	return l.Addr().String(), got
+}
+
+func TestHTTPDialer_DialContext(t *testing.T) {
+	addr, got := startHTTPProxy(t, http.StatusOK)
+	d, err := newHTTPDialer(new(net.Dialer), "http://u:p@"+addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp", "dns.example:853")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := <-got
+	if req.Method != http.MethodConnect || req.Host != "dns.example:853" {
+		t.Fatalf("unexpected request %s %s", req.Method, req.Host)
+	}
+	if auth := req.Header.Get("Proxy-Authorization"); auth != d.auth {
+		t.Fatalf("unexpected auth %s", auth)
+	}
+
+	// Data sent right after the response must not be lost.
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 9)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "helloping" {
+		t.Fatalf("got %q", b)
+	}
+
+	if _, err := d.DialContext(context.Background(), "udp", "dns.example:53"); err == nil {
+		t.Fatal("udp should not be supported")
+	}
+}
+
+func TestHTTPDialer_DialContext_refused(t *testing.T) {
+	addr, _ := startHTTPProxy(t, http.StatusProxyAuthRequired)
+	d, err := newHTTPDialer(new(net.Dialer), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := d.DialContext(context.Background(), "tcp", "dns.example:853"); err == nil {
+		c.Close()
+		t.Fatal("want an error for status 407")
+	}
+}
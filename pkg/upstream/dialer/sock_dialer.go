@@ -26,6 +26,7 @@ import (
 	"net"
 	"net/netip"
 	"slices"
+	"time"
 )
 
 type SocksDialer struct {
@@ -51,6 +52,9 @@ func (d *SocksDialer) DialContext(ctx context.Context, network, addr string) (ne
 	if err != nil {
 		return nil, fmt.Errorf("dial faile: %v", err)
 	}
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
 	methods := []byte{MethodNoAuth}
 	if d.username != "" || d.password != "" {
 		methods = append(methods, MethodUserPass)
@@ -129,7 +133,13 @@ func (d *SocksDialer) DialContext(ctx context.Context, network, addr string) (ne
 		conn.Close()
 		return nil, fmt.Errorf("parse socks addr failed: %v", err)
 	}
-	dialReq := slices.Concat([]byte{Version5, cmd, Reversed}, sAddr.Slice())
+	reqAddr := sAddr
+	if network == "udp" {
+		// The address that the client will send datagrams from is unknown
+		// (may be behind a NAT), so use an unspecified address.
+		reqAddr = SocksAddrFromAddrPort(netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	}
+	dialReq := slices.Concat([]byte{Version5, cmd, Reversed}, reqAddr.Slice())
 	_, err = conn.Write(dialReq)
 	if err != nil {
 		conn.Close()
@@ -230,9 +240,14 @@ func (d *SocksDialer) DialContext(ctx context.Context, network, addr string) (ne
 		return nil, fmt.Errorf("parse bind port failed: bind port too short")
 	}
 	bindAddr.SetPort(binary.BigEndian.Uint16(rawPort))
+	conn.SetDeadline(time.Time{})
 	if network == "tcp" {
 		return conn, nil
 	}
+	if len(bindAddr.fqdn) == 0 && bindAddr.addr.IsUnspecified() {
+		// The relay is on the same host as the proxy server.
+		bindAddr.addr, bindAddr.fqdn = d.addr.addr, d.addr.fqdn
+	}
 	c, err := d.dialer.DialContext(context.Background(), "udp", bindAddr.String())
 	if err != nil {
 		conn.Close()
@@ -256,6 +271,7 @@ func (d *SocksDialer) DialContext(ctx context.Context, network, addr string) (ne
 	if !sAddr.addr.IsUnspecified() && sAddr.port != 0 {
 		spc.dest = sAddr
 	}
+	go spc.watchControlConn()
 	return spc, nil
 }
 
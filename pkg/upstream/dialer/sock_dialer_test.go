@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dialer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startSocksUDPRelay starts a socks5 server that only supports UDP
+// ASSOCIATE without auth. Its relay echoes the payloads back. The request
+// address of the association is sent to reqAddr. The control connection
+// is closed when closeCtrl is closed.
+func startSocksUDPRelay(t *testing.T) (addr string, reqAddr chan []byte, closeCtrl chan struct{}) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		relay.Close()
+	})
+
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, from, err := relay.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			relay.WriteToUDP(b[:n], from) // The header has the destination, which is the source of the reply.
+		}
+	}()
+
+	reqAddr = make(chan []byte, 1)
+	closeCtrl = make(chan struct{})
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(c, b); err != nil || !bytes.Equal(b, []byte{Version5, 1, MethodNoAuth}) {
+			return
+		}
+		c.Write([]byte{Version5, MethodNoAuth})
+		req := make([]byte, 10) // ver, cmd, rsv, ipv4, port
+		if _, err := io.ReadFull(c, req); err != nil || req[1] != CMDASSOCIATE || req[3] != TypeIPv4 {
+			return
+		}
+		reqAddr <- req[4:]
+		res := []byte{Version5, DialSucceeded, Reversed, TypeIPv4, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(res[8:], uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+		c.Write(res)
+		<-closeCtrl
+	}()
+	return l.Addr().String(), reqAddr, closeCtrl
+}
+
+func TestSocksDialer_udpAssociate(t *testing.T) {
+	addr, reqAddr, closeCtrl := startSocksUDPRelay(t)
+	d, err := newSocksDialer(new(net.Dialer), addr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := d.DialContext(ctx, "udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The client address is unknown, e.g. behind a NAT.
+	if a := <-reqAddr; !bytes.Equal(a, make([]byte, 6)) {
+		t.Fatalf("want an unspecified request address, got %v", a)
+	}
+
+	// The unspecified bind address is replaced by the proxy address.
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 512)
+	n, from, err := c.(*SocksPacketConn).ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "ping" || from.String() != "192.0.2.1:53" {
+		t.Fatalf("got %q from %s", b[:n], from)
+	}
+
+	// The association ends with the control connection.
+	close(closeCtrl)
+	start := time.Now()
+	c.SetDeadline(start.Add(5 * time.Second))
+	if _, err := c.Read(b); err == nil || time.Since(start) > 4*time.Second {
+		t.Fatalf("relay is not closed with the control connection, %v", err)
+	}
+}
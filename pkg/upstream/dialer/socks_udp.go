@@ -22,6 +22,7 @@ package dialer
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"net/netip"
 	"slices"
@@ -52,6 +53,13 @@ func (s *SocksPacketConn) RemoteAddr() net.Addr {
 	return s.inner.RemoteAddr()
 }
 
+// watchControlConn closes the udp relay once the tcp control connection
+// is closed, because the association terminates with it (RFC 1928 section 7).
+func (s *SocksPacketConn) watchControlConn() {
+	_, _ = io.Copy(io.Discard, s.conn)
+	s.inner.Close()
+}
+
 func (s *SocksPacketConn) pack(b []byte, addr net.Addr) ([]byte, error) {
 	sAddr, err := ParseSocksAddr(addr.String())
 	if err != nil {
@@ -82,26 +90,29 @@ func (s *SocksPacketConn) unpack(b []byte) ([]byte, net.Addr, error) {
 		port := binary.BigEndian.Uint16(b[8:10])
 		return b[10:], net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
 	case TypeFqdn:
-		addrLen := uint8(s.cache[4])
-		if len(b) < int(addrLen+7) {
+		if len(b) < 5 {
+			return nil, nil, fmt.Errorf("fqdn address incomplete")
+		}
+		addrLen := int(b[4])
+		if len(b) < addrLen+7 {
 			return nil, nil, fmt.Errorf("fqdn address incomplete")
 		}
-		fqdn := string(s.cache[5 : 5+addrLen])
-		port := binary.BigEndian.Uint16(s.cache[5+addrLen : 7+addrLen])
+		fqdn := string(b[5 : 5+addrLen])
+		port := binary.BigEndian.Uint16(b[5+addrLen : 7+addrLen])
 		fqdnAddr := UDPFqdnAddr(fmt.Sprintf("%s:%d", fqdn, port))
 		return b[7+addrLen:], &fqdnAddr, nil
 	case TypeIPv6:
 		if len(b) < 22 {
 			return nil, nil, fmt.Errorf("ipv6 address incomplete")
 		}
-		addr, ok := netip.AddrFromSlice(s.cache[4:20])
+		addr, ok := netip.AddrFromSlice(b[4:20])
 		if !ok {
 			return nil, nil, fmt.Errorf("invalid ipv6 address")
 		}
-		port := binary.BigEndian.Uint16(s.cache[20:22])
+		port := binary.BigEndian.Uint16(b[20:22])
 		return b[22:], net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
 	default:
-		return nil, nil, fmt.Errorf("invalid address type: %v", s.cache[3])
+		return nil, nil, fmt.Errorf("invalid address type: %v", b[3])
 	}
 }
 
@@ -13,6 +13,7 @@ import (
 
 	C "github.com/pmkol/mosdns-x/constant"
 	"github.com/pmkol/mosdns-x/pkg/pool"
+	"github.com/pmkol/mosdns-x/pkg/upstream/capture"
 )
 
 const dnsContentType = "application/dns-message"
@@ -22,6 +23,7 @@ var defaultUserAgent = fmt.Sprintf("mosdns-x/%s", C.Version)
 type Upstream struct {
 	urlStr    string
 	transport *http.Transport
+	capture   *capture.Capture // nil if capture is disabled
 }
 
 func NewUpstream(url *url.URL, transport *http.Transport) *Upstream {
@@ -31,6 +33,12 @@ func NewUpstream(url *url.URL, transport *http.Transport) *Upstream {
 	}
 }
 
+// SetCapture makes u record the wire messages to c. It must be called
+// before u is used.
+func (u *Upstream) SetCapture(c *capture.Capture) {
+	u.capture = c
+}
+
 func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	q.Id = 0
 	wire, buf, err := pool.PackBuffer(q)
@@ -38,6 +46,7 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 		return nil, err
 	}
 	defer buf.Release()
+	u.capture.Sent(wire, q)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.urlStr, bytes.NewReader(wire))
 	if err != nil {
@@ -76,8 +85,10 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 
 	r := new(dns.Msg)
 	if err := r.Unpack(respBytes); err != nil {
+		u.capture.Received(respBytes, nil)
 		return nil, err
 	}
+	u.capture.Received(respBytes, r)
 	return r, nil
 }
 
@@ -15,6 +15,7 @@ import (
 
 	C "github.com/pmkol/mosdns-x/constant"
 	"github.com/pmkol/mosdns-x/pkg/pool"
+	"github.com/pmkol/mosdns-x/pkg/upstream/capture"
 )
 
 const dnsContentType = "application/dns-message"
@@ -24,6 +25,7 @@ var defaultUserAgent = fmt.Sprintf("mosdns-x/%s", C.Version)
 type Upstream struct {
 	urlStr    string
 	transport *http3.Transport
+	capture   *capture.Capture // nil if capture is disabled
 }
 
 func NewUpstream(url *url.URL, transport *http3.Transport) *Upstream {
@@ -33,6 +35,12 @@ func NewUpstream(url *url.URL, transport *http3.Transport) *Upstream {
 	}
 }
 
+// SetCapture makes u record the wire messages to c. It must be called
+// before u is used.
+func (u *Upstream) SetCapture(c *capture.Capture) {
+	u.capture = c
+}
+
 func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	// Only add timeout if parent context has no deadline
 	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
@@ -47,6 +55,7 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 		return nil, err
 	}
 	defer buf.Release()
+	u.capture.Sent(wire, q)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.urlStr, bytes.NewReader(wire))
 	if err != nil {
@@ -87,8 +96,10 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 
 	r := new(dns.Msg)
 	if err := r.Unpack(respBytes); err != nil {
+		u.capture.Received(respBytes, nil)
 		return nil, err
 	}
+	u.capture.Received(respBytes, r)
 	return r, nil
 }
 
@@ -0,0 +1,164 @@
+package doh3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// raceWinnerTTL is how long the winner of a race is remembered.
+const raceWinnerTTL = 10 * time.Minute
+
+// DialFunc dials a QUIC connection to addr, which is a literal "ip:port".
+// The io.Closer closes what quic-go does not own, e.g. the net.PacketConn
+// passed to quic.DialEarly. It must be closed after the connection.
+type DialFunc func(ctx context.Context, addr string) (*quic.Conn, io.Closer, error)
+
+// RacingDialer dials QUIC connections to a host that has both IPv4 and
+// IPv6 addresses. It races the two address families and remembers the
+// winner for a while, so a silently blackholed family won't stall
+// every new connection until the handshake times out.
+type RacingDialer struct {
+	host   string
+	port   string
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+
+	mu        sync.Mutex
+	winner    netip.Addr
+	winnerExp time.Time
+}
+
+// NewRacingDialer creates a RacingDialer for addr ("host:port").
+// If resolver is nil, net.DefaultResolver will be used.
+func NewRacingDialer(addr string, resolver *net.Resolver) (*RacingDialer, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	lookup := func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return resolver.LookupNetIP(ctx, "ip", host)
+	}
+	return &RacingDialer{host: host, port: port, lookup: lookup}, nil
+}
+
+// Dial dials a connection with dial. The io.Closer is the one of the
+// connection, see DialFunc.
+func (d *RacingDialer) Dial(ctx context.Context, dial DialFunc) (*quic.Conn, io.Closer, error) {
+	if addr, err := netip.ParseAddr(d.host); err == nil {
+		return dial(ctx, d.join(addr))
+	}
+
+	if winner, ok := d.getWinner(); ok {
+		c, closer, err := dial(ctx, d.join(winner))
+		if err == nil {
+			return c, closer, nil
+		}
+		d.clearWinner(winner)
+		if ctx.Err() != nil {
+			return nil, nil, err
+		}
+	}
+
+	addrs, err := d.lookup(ctx, d.host)
+	if err != nil {
+		return nil, nil, err
+	}
+	var v4, v6 netip.Addr
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.Is4() && !v4.IsValid() {
+			v4 = addr
+		} else if addr.Is6() && !v6.IsValid() {
+			v6 = addr
+		}
+	}
+	switch {
+	case v4.IsValid() && v6.IsValid():
+		return d.race(ctx, dial, v6, v4)
+	case v4.IsValid():
+		return dial(ctx, d.join(v4))
+	case v6.IsValid():
+		return dial(ctx, d.join(v6))
+	default:
+		return nil, nil, fmt.Errorf("no address found for %s", d.host)
+	}
+}
+
+type raceResult struct {
+	addr   netip.Addr
+	c      *quic.Conn
+	closer io.Closer
+	err    error
+}
+
+func (d *RacingDialer) race(ctx context.Context, dial DialFunc, addrs ...netip.Addr) (*quic.Conn, io.Closer, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resChan := make(chan raceResult, len(addrs))
+	for _, addr := range addrs {
+		go func(addr netip.Addr) {
+			c, closer, err := dial(ctx, d.join(addr))
+			resChan <- raceResult{addr: addr, c: c, closer: closer, err: err}
+		}(addr)
+	}
+
+	var errs []error
+	for i := range addrs {
+		res := <-resChan
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+		d.setWinner(res.addr)
+		// Close the losers that are connected anyway.
+		go func(n int) {
+			for ; n > 0; n-- {
+				if res := <-resChan; res.err == nil {
+					res.c.CloseWithError(0, "")
+					res.closer.Close()
+				}
+			}
+		}(len(addrs) - i - 1)
+		return res.c, res.closer, nil
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+func (d *RacingDialer) join(addr netip.Addr) string {
+	return net.JoinHostPort(addr.String(), d.port)
+}
+
+func (d *RacingDialer) getWinner() (netip.Addr, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.winner.IsValid() || time.Now().After(d.winnerExp) {
+		return netip.Addr{}, false
+	}
+	return d.winner, true
+}
+
+func (d *RacingDialer) setWinner(addr netip.Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.winner = addr
+	d.winnerExp = time.Now().Add(raceWinnerTTL)
+}
+
+func (d *RacingDialer) clearWinner(addr netip.Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.winner == addr {
+		d.winner = netip.Addr{}
+	}
+}
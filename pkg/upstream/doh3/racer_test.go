@@ -0,0 +1,145 @@
+package doh3
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+func TestRacingDialer(t *testing.T) {
+	d, err := NewRacingDialer("dns.example:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.1")}, nil
+	}
+
+	// IPv6 is blackholed.
+	var dialed6 atomic.Int32
+	dial := func(ctx context.Context, addr string) (*quic.Conn, io.Closer, error) {
+		if strings.HasPrefix(addr, "[") {
+			dialed6.Add(1)
+			<-ctx.Done()
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, nil
+	}
+	if _, _, err := d.Dial(context.Background(), dial); err != nil {
+		t.Fatal(err)
+	}
+	winner, ok := d.getWinner()
+	if !ok || !winner.Is4() {
+		t.Fatalf("unexpected winner %s", winner)
+	}
+
+	// The winner is dialed directly.
+	if _, _, err := d.Dial(context.Background(), dial); err != nil {
+		t.Fatal(err)
+	}
+	if n := dialed6.Load(); n > 1 {
+		t.Fatalf("ipv6 dialed %d times, want at most 1", n)
+	}
+
+	// A failed winner is forgotten.
+	failDial := func(ctx context.Context, addr string) (*quic.Conn, io.Closer, error) {
+		return nil, nil, errors.New("failed")
+	}
+	if _, _, err := d.Dial(context.Background(), failDial); err == nil {
+		t.Fatal("want err")
+	}
+	if _, ok := d.getWinner(); ok {
+		t.Fatal("winner should be cleared")
+	}
+
+	d, _ = NewRacingDialer("127.0.0.1:443", nil)
+	if _, _, err := d.Dial(context.Background(), func(ctx context.Context, addr string) (*quic.Conn, io.Closer, error) {
+		if netip.MustParseAddrPort(addr).Addr() != netip.MustParseAddr("127.0.0.1") {
+			t.Fatalf("unexpected addr %s", addr)
+		}
+		return nil, nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+func TestRacingDialer_closeLoser(t *testing.T) {
+	cert, err := utils.GenerateCertificate("dns.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h3"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(context.Background()); err != nil {
+				return
+			}
+		}
+	}()
+
+	d, err := NewRacingDialer("dns.example:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.1")}, nil
+	}
+
+	// IPv6 connects after IPv4 has won.
+	won := make(chan struct{})
+	closed := make(chan string, 2)
+	dial := func(ctx context.Context, addr string) (*quic.Conn, io.Closer, error) {
+		if strings.HasPrefix(addr, "[") {
+			<-won
+		}
+		pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return nil, nil, err
+		}
+		c, err := quic.DialEarly(context.Background(), pc, l.Addr(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h3"}}, nil)
+		if err != nil {
+			pc.Close()
+			return nil, nil, err
+		}
+		return c, closerFunc(func() error {
+			closed <- addr
+			return pc.Close()
+		}), nil
+	}
+
+	c, closer, err := d.Dial(context.Background(), dial)
+	close(won)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	defer c.CloseWithError(0, "")
+
+	select {
+	case addr := <-closed:
+		if !strings.HasPrefix(addr, "[") {
+			t.Fatalf("the closer of the winner %s is closed", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the closer of the loser is not closed")
+	}
+}
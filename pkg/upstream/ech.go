@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	eTLS "gitlab.com/go-extension/tls"
+)
+
+const (
+	// ECHAuto makes the upstream fetch the ECH config from the HTTPS record
+	// of its server name.
+	ECHAuto = "auto"
+
+	minECHConfigTTL = time.Minute
+)
+
+// echSource provides the ECHConfigList of an upstream.
+type echSource struct {
+	static []byte
+
+	// For ECHAuto.
+	host      string
+	bootstrap string
+
+	mu       sync.Mutex
+	cached   []byte
+	expireAt time.Time
+}
+
+// newECHSource parses s, which is a base64 encoded ECHConfigList or ECHAuto.
+// host is the server name. bootstrap is the dns server used to look up
+// the HTTPS record. If it is empty, the first nameserver in /etc/resolv.conf
+// is used.
+func newECHSource(s, host, bootstrap string) (*echSource, error) {
+	if s == ECHAuto {
+		return &echSource{host: dns.Fqdn(host), bootstrap: bootstrapAddr(bootstrap)}, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ech config, %w", err)
+	}
+	return &echSource{static: b}, nil
+}
+
+func (e *echSource) get(ctx context.Context) ([]byte, error) {
+	if e.static != nil {
+		return e.static, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cached != nil && time.Now().Before(e.expireAt) {
+		return e.cached, nil
+	}
+	b, ttl, err := e.lookup(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch ech config, %w", err)
+	}
+	e.cached = b
+	e.expireAt = time.Now().Add(max(ttl, minECHConfigTTL))
+	return b, nil
+}
+
+func (e *echSource) lookup(ctx context.Context) ([]byte, time.Duration, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(e.host, dns.TypeHTTPS)
+	q.SetEdns0(1232, false)
+	r, err := bootstrapExchange(ctx, e.bootstrap, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, rr := range r.Answer {
+		https, ok := rr.(*dns.HTTPS)
+		if !ok {
+			continue
+		}
+		for _, kv := range https.Value {
+			if ech, ok := kv.(*dns.SVCBECHConfig); ok && len(ech.ECH) > 0 {
+				return ech.ECH, time.Duration(https.Hdr.Ttl) * time.Second, nil
+			}
+		}
+	}
+	return nil, 0, fmt.Errorf("no ech config in the https record of %s", e.host)
+}
+
+// bootstrapAddr adds the default port to the bootstrap server address.
+func bootstrapAddr(bootstrap string) string {
+	if len(bootstrap) > 0 {
+		if _, _, err := net.SplitHostPort(bootstrap); err != nil {
+			bootstrap = net.JoinHostPort(strings.Trim(bootstrap, "[]"), "53")
+		}
+	}
+	return bootstrap
+}
+
+// bootstrapExchange sends q to the bootstrap server. If server is empty,
+// the first nameserver in /etc/resolv.conf is used.
+func bootstrapExchange(ctx context.Context, server string, q *dns.Msg) (*dns.Msg, error) {
+	if len(server) == 0 {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+		if len(conf.Servers) == 0 {
+			return nil, errors.New("no nameserver available")
+		}
+		server = net.JoinHostPort(conf.Servers[0], conf.Port)
+	}
+
+	c := &dns.Client{Net: "udp"}
+	r, _, err := c.ExchangeContext(ctx, q, server)
+	if err == nil && r.Truncated {
+		c.Net = "tcp"
+		r, _, err = c.ExchangeContext(ctx, q, server)
+	}
+	return r, err
+}
+
+// eTLSConfigWithECH returns a copy of c with the ECHConfigList set.
+// If e is nil, c is returned.
+func eTLSConfigWithECH(ctx context.Context, c *eTLS.Config, e *echSource) (*eTLS.Config, error) {
+	if e == nil {
+		return c, nil
+	}
+	b, err := e.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c = c.Clone()
+	c.EncryptedClientHelloConfigList = b
+	return c, nil
+}
+
+// tlsConfigWithECH is like eTLSConfigWithECH but for tls.Config.
+func tlsConfigWithECH(ctx context.Context, c *tls.Config, e *echSource) (*tls.Config, error) {
+	if e == nil {
+		return c, nil
+	}
+	b, err := e.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c = c.Clone()
+	c.EncryptedClientHelloConfigList = b
+	return c, nil
+}
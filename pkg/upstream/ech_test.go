@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_echSource(t *testing.T) {
+	echConfig := []byte{0, 1, 2, 3}
+	addr, shutdown := newUDPTestServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if q.Question[0].Name == "dns.example." && q.Question[0].Qtype == dns.TypeHTTPS {
+			r.Answer = append(r.Answer, &dns.HTTPS{SVCB: dns.SVCB{
+				Hdr:      dns.RR_Header{Name: "dns.example.", Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300},
+				Priority: 1,
+				Target:   ".",
+				Value:    []dns.SVCBKeyValue{&dns.SVCBECHConfig{ECH: echConfig}},
+			}})
+		}
+		w.WriteMsg(r)
+	}))
+	defer shutdown()
+
+	e, err := newECHSource(ECHAuto, "dns.example", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, echConfig) {
+		t.Fatalf("got ech config %v, want %v", b, echConfig)
+	}
+
+	e, _ = newECHSource(ECHAuto, "no-ech.example", addr)
+	if _, err := e.get(context.Background()); err == nil {
+		t.Fatal("want err for missing ech config")
+	}
+
+	e, err = newECHSource("AAECAw==", "dns.example", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := e.get(context.Background()); !bytes.Equal(b, echConfig) {
+		t.Fatalf("got static ech config %v, want %v", b, echConfig)
+	}
+}
@@ -23,11 +23,15 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 
-	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/upstream/capture"
+	"github.com/pmkol/mosdns-x/pkg/upstream/transport"
+	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
 var _ error = (*closedConnError)(nil)
@@ -42,6 +46,9 @@ type Conn struct {
 	conn       *quic.Conn
 	closed     chan struct{}
 	handshaked chan struct{}
+	createdAt  time.Time
+	inFlight   atomic.Int64
+	served     atomic.Uint64
 	sync.RWMutex
 }
 
@@ -50,6 +57,7 @@ func NewConn(conn *quic.Conn) *Conn {
 		conn:       conn,
 		closed:     make(chan struct{}),
 		handshaked: make(chan struct{}),
+		createdAt:  time.Now(),
 	}
 	go func() {
 		select {
@@ -106,36 +114,68 @@ func (c *Conn) openStreamSync(ctx context.Context) (*quic.Stream, error) {
 	return conn.OpenStreamSync(ctx)
 }
 
+// retiredConnGracePeriod is the time that a connection which reached its
+// max lifetime stays open for its ongoing queries.
+const retiredConnGracePeriod = time.Second * 10
+
 type Upstream struct {
-	conn     *Conn
-	dialFunc func(ctx context.Context) (*Conn, error)
+	conn        *Conn
+	connMaxAge  time.Duration
+	dialFunc    func(ctx context.Context) (*Conn, error)
+	maxLifetime time.Duration
+	capture     *capture.Capture // nil if capture is disabled
 	sync.RWMutex
 }
 
-func NewQUICUpstream(addr string, dialFunc func(ctx context.Context) (*Conn, error)) *Upstream {
+// NewQUICUpstream creates a new Upstream. If maxLifetime > 0, a new
+// connection will be dialed once the current connection has been used
+// for maxLifetime (with a small random jitter).
+func NewQUICUpstream(addr string, maxLifetime time.Duration, dialFunc func(ctx context.Context) (*Conn, error)) *Upstream {
 	return &Upstream{
-		dialFunc: dialFunc,
+		dialFunc:    dialFunc,
+		maxLifetime: maxLifetime,
+	}
+}
+
+// SetCapture makes h record the wire messages to c. It must be called
+// before h is used.
+func (h *Upstream) SetCapture(c *capture.Capture) {
+	h.capture = c
+}
+
+func (h *Upstream) usable(c *Conn) bool {
+	if c == nil || !c.isActive() {
+		return false
 	}
+	return h.connMaxAge <= 0 || time.Since(c.createdAt) < h.connMaxAge
 }
 
 func (h *Upstream) offer(ctx context.Context) (*Conn, error) {
 	h.RLock()
 	outer := h.conn
+	usable := h.usable(outer)
 	h.RUnlock()
-	if outer != nil && outer.isActive() {
+	if usable {
 		return outer, nil
 	}
 	h.Lock()
 	defer h.Unlock()
 	outer = h.conn
-	if outer != nil && outer.isActive() {
+	if h.usable(outer) {
 		return outer, nil
 	}
 	conn, err := h.dialFunc(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if outer != nil && outer.isActive() {
+		// Retired by its max lifetime. Give its ongoing queries some time.
+		time.AfterFunc(retiredConnGracePeriod, func() { outer.closeWithError(0, "") })
+	}
 	h.conn = conn
+	if h.maxLifetime > 0 {
+		h.connMaxAge = time.Duration(float64(h.maxLifetime) * (1 - utils.RandFloat64()*0.1))
+	}
 	return conn, nil
 }
 
@@ -149,6 +189,26 @@ func (h *Upstream) Close() error {
 	return nil
 }
 
+// ConnInfo returns the info of the current connection.
+func (h *Upstream) ConnInfo() []transport.ConnInfo {
+	h.RLock()
+	c := h.conn
+	h.RUnlock()
+	if c == nil || !c.isActive() {
+		return nil
+	}
+	c.RLock()
+	remoteAddr := c.conn.RemoteAddr().String()
+	c.RUnlock()
+	return []transport.ConnInfo{{
+		Protocol:   "quic",
+		RemoteAddr: remoteAddr,
+		Age:        time.Since(c.createdAt),
+		InFlight:   int(c.inFlight.Load()),
+		Served:     c.served.Load(),
+	}}
+}
+
 func (h *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	q.Id = 0
 	var err error
@@ -159,7 +219,7 @@ func (h *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 			return nil, err
 		}
 		var resp *dns.Msg
-		resp, err = exchangeMsg(ctx, conn, q)
+		resp, err = exchangeMsg(ctx, conn, q, h.capture)
 		if err == nil {
 			return resp, err
 		}
@@ -167,25 +227,29 @@ func (h *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 	return nil, err
 }
 
-func exchangeMsg(ctx context.Context, conn *Conn, q *dns.Msg) (*dns.Msg, error) {
-	resp, err := exchange(ctx, conn, q)
+func exchangeMsg(ctx context.Context, conn *Conn, q *dns.Msg, c *capture.Capture) (*dns.Msg, error) {
+	resp, err := exchange(ctx, conn, q, c)
 	if errors.Is(err, quic.Err0RTTRejected) {
 		select {
 		case <-conn.closed:
 			return nil, &closedConnError{}
 		case <-conn.handshaked:
-			return exchange(ctx, conn, q)
+			return exchange(ctx, conn, q, c)
 		}
 	}
 	return resp, err
 }
 
-func exchange(ctx context.Context, conn *Conn, q *dns.Msg) (*dns.Msg, error) {
+func exchange(ctx context.Context, conn *Conn, q *dns.Msg, c *capture.Capture) (*dns.Msg, error) {
+	conn.served.Add(1)
+	conn.inFlight.Add(1)
+	defer conn.inFlight.Add(-1)
+
 	stream, err := conn.openStreamSync(ctx)
 	if err != nil {
 		return nil, err
 	}
-	_, err = dnsutils.WriteMsgToTCP(stream, q)
+	_, err = c.WriteMsgToTCP(stream, q)
 	if err != nil {
 		stream.CancelRead(1)
 		stream.CancelWrite(1)
@@ -193,7 +257,7 @@ func exchange(ctx context.Context, conn *Conn, q *dns.Msg) (*dns.Msg, error) {
 	}
 	stream.Close()
 	r := new(dns.Msg)
-	_, err = dnsutils.ReadMsgFromTCP(stream, r)
+	_, err = c.ReadMsgFromTCP(stream, r)
 	if err != nil {
 		stream.CancelRead(1)
 		return nil, err
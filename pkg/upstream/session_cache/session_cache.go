@@ -0,0 +1,278 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package session_cache provides a TLS client session cache that is
+// persisted to disk, so upstreams can resume TLS sessions (and send 0-RTT
+// data over QUIC) right after a restart.
+package session_cache
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	eTLS "gitlab.com/go-extension/tls"
+)
+
+const (
+	maxEntries = 256
+
+	// maxEntryAge is the maximum lifetime of a TLS 1.3 ticket (RFC 8446 4.6.1).
+	maxEntryAge = 7 * 24 * time.Hour
+
+	// saveDelay batches multiple updates into one write.
+	saveDelay = 10 * time.Second
+)
+
+type entry struct {
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+	Time   int64  `json:"time"` // unix time when the entry was stored
+}
+
+// Store stores TLS session tickets in memory and saves them to a file.
+type Store struct {
+	path string
+	refs int // guarded by storesMu
+
+	mu        sync.Mutex
+	m         map[string]*entry
+	saveTimer *time.Timer
+}
+
+var (
+	storesMu sync.Mutex
+	stores   = make(map[string]*Store)
+)
+
+// Open returns the Store of file path. Upstreams using the same path
+// share the same Store. Each Open must be paired with a Store.Close.
+func Open(path string) (*Store, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if s := stores[path]; s != nil {
+		s.refs++
+		return s, nil
+	}
+	s := &Store{path: path, refs: 1, m: make(map[string]*entry)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	stores[path] = s
+	return s, nil
+}
+
+// Close releases s. When the last user of the Store closes it, the
+// changes that are not saved yet are saved to the file.
+func (s *Store) Close() error {
+	storesMu.Lock()
+	s.refs--
+	last := s.refs == 0
+	if last {
+		delete(stores, s.path)
+	}
+	storesMu.Unlock()
+	if !last {
+		return nil
+	}
+
+	s.mu.Lock()
+	pending := s.saveTimer != nil && s.saveTimer.Stop()
+	s.saveTimer = nil
+	s.mu.Unlock()
+	if !pending {
+		return nil
+	}
+	return s.save()
+}
+
+func (s *Store) load() error {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read session cache file, %w", err)
+	}
+	m := make(map[string]*entry)
+	if err := json.Unmarshal(b, &m); err != nil {
+		// A broken cache is not fatal. It will be overwritten.
+		return nil
+	}
+	now := time.Now()
+	for k, e := range m {
+		if now.Sub(time.Unix(e.Time, 0)) < maxEntryAge {
+			s.m[k] = e
+		}
+	}
+	return nil
+}
+
+func (s *Store) get(key string) (*entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(time.Unix(e.Time, 0)) >= maxEntryAge {
+		delete(s.m, key)
+		return nil, false
+	}
+	return e, true
+}
+
+func (s *Store) put(key string, e *entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e == nil {
+		delete(s.m, key)
+	} else {
+		if _, ok := s.m[key]; !ok && len(s.m) >= maxEntries {
+			s.evictOldest()
+		}
+		s.m[key] = e
+	}
+	if s.saveTimer == nil {
+		s.saveTimer = time.AfterFunc(saveDelay, func() { _ = s.save() })
+	}
+}
+
+func (s *Store) evictOldest() {
+	var oldestKey string
+	var oldest int64
+	for k, e := range s.m {
+		if len(oldestKey) == 0 || e.Time < oldest {
+			oldestKey, oldest = k, e.Time
+		}
+	}
+	delete(s.m, oldestKey)
+}
+
+func (s *Store) save() error {
+	s.mu.Lock()
+	s.saveTimer = nil
+	b, err := json.Marshal(s.m)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a crash won't leave a broken file.
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("failed to save session cache file, %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// TLS returns a tls.ClientSessionCache backed by s. alpn separates
+// sessions of different protocols to the same server.
+func (s *Store) TLS(alpn string) tls.ClientSessionCache {
+	return &tlsCache{s: s, prefix: "tls|" + alpn + "|"}
+}
+
+// ETLS is like TLS but returns an eTLS.ClientSessionCache.
+func (s *Store) ETLS(alpn string) eTLS.ClientSessionCache {
+	return &eTLSCache{s: s, prefix: "etls|" + alpn + "|"}
+}
+
+type tlsCache struct {
+	s      *Store
+	prefix string
+}
+
+func (c *tlsCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	e, ok := c.s.get(c.prefix + sessionKey)
+	if !ok {
+		return nil, false
+	}
+	state, err := tls.ParseSessionState(e.State)
+	if err != nil {
+		return nil, false
+	}
+	cs, err := tls.NewResumptionState(e.Ticket, state)
+	if err != nil {
+		return nil, false
+	}
+	return cs, true
+}
+
+func (c *tlsCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	if cs == nil {
+		c.s.put(c.prefix+sessionKey, nil)
+		return
+	}
+	ticket, state, err := cs.ResumptionState()
+	if err != nil || state == nil {
+		return
+	}
+	b, err := state.Bytes()
+	if err != nil {
+		return
+	}
+	c.s.put(c.prefix+sessionKey, &entry{Ticket: ticket, State: b, Time: time.Now().Unix()})
+}
+
+type eTLSCache struct {
+	s      *Store
+	prefix string
+}
+
+func (c *eTLSCache) Get(sessionKey string) (*eTLS.ClientSessionState, bool) {
+	e, ok := c.s.get(c.prefix + sessionKey)
+	if !ok {
+		return nil, false
+	}
+	state, err := eTLS.ParseSessionState(e.State)
+	if err != nil {
+		return nil, false
+	}
+	cs, err := eTLS.NewResumptionState(e.Ticket, state)
+	if err != nil {
+		return nil, false
+	}
+	return cs, true
+}
+
+func (c *eTLSCache) Put(sessionKey string, cs *eTLS.ClientSessionState) {
+	if cs == nil {
+		c.s.put(c.prefix+sessionKey, nil)
+		return
+	}
+	ticket, state, err := cs.ResumptionState()
+	if err != nil || state == nil {
+		return
+	}
+	b, err := state.Bytes()
+	if err != nil {
+		return
+	}
+	c.s.put(c.prefix+sessionKey, &entry{Ticket: ticket, State: b, Time: time.Now().Unix()})
+}
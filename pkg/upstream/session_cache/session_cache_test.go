@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package session_cache
+
+import (
+	"crypto/tls"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+func TestStore_TLS(t *testing.T) {
+	cert, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write([]byte{1}) // Tickets are sent along with the first write.
+				io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "sessions")
+	handshake := func(s *Store) bool {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "example.com",
+			ClientSessionCache: s.TLS("dot"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if _, err := c.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		return c.ConnectionState().DidResume
+	}
+
+	s1, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handshake(s1) {
+		t.Fatal("first handshake should not resume")
+	}
+	s1.save()
+
+	// Simulates a restart.
+	s2 := &Store{path: s1.path, m: make(map[string]*entry)}
+	if err := s2.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !handshake(s2) {
+		t.Fatal("session is not resumed after reload")
+	}
+}
+
+func TestStore_Close(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions")
+	s1, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s1 != s2 {
+		t.Fatal("stores of the same path are not shared")
+	}
+	s1.put("k", &entry{Ticket: []byte("ticket"), Time: time.Now().Unix()})
+
+	// Not saved until the last user closes it.
+	if err := s1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("file is saved before the last close, %v", err)
+	}
+	if err := s2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s3, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3.Close()
+	if s3 == s1 {
+		t.Fatal("a closed store is reused")
+	}
+	if e, ok := s3.get("k"); !ok || string(e.Ticket) != "ticket" {
+		t.Fatalf("session is not saved on close, got %v", e)
+	}
+}
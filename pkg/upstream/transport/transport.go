@@ -12,6 +12,7 @@ import (
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/pool"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
@@ -32,6 +33,11 @@ const (
 
 	writeTimeout        = time.Second
 	connTooOldThreshold = time.Millisecond * 1500
+
+	// connCloseJitter is the maximum fraction that idle timeouts and
+	// lifetimes of connections are randomly shortened by. So connections
+	// that were dialed at the same time will not be closed at the same time.
+	connCloseJitter = 0.1
 )
 
 // Opts for Transport,
@@ -73,6 +79,21 @@ type Opts struct {
 	// can handle. The connection will be closed if it reached the limit.
 	// Default is defaultMaxQueryPerConn.
 	MaxQueryPerConn uint16
+
+	// EnableKeepalive makes the Transport send the edns-tcp-keepalive option
+	// (RFC 7828) with queries that have an OPT record. The idle timeout
+	// advertised by the server will replace IdleTimeout for that connection.
+	// The option is removed from responses, it is a hop-by-hop option.
+	EnableKeepalive bool
+
+	// MinIdleTimeout is the lower bound of the idle timeout of connections,
+	// including the timeout advertised by the server via edns-tcp-keepalive.
+	MinIdleTimeout time.Duration
+
+	// MaxLifetime is the maximum amount of time a connection can be used
+	// for new queries since it was created. The connection will be closed
+	// after its ongoing queries finished. Zero means no limit.
+	MaxLifetime time.Duration
 }
 
 // init check and set defaults for this Opts.
@@ -278,6 +299,7 @@ func (t *Transport) getReusableConn() (c *dnsConn, reused bool, err error) {
 		delete(t.idledReusableConns, c)
 		if c.isClosed() || t.connTooOld(c) {
 			delete(t.reusableConns, c)
+			c.closeWithErr(errEOL)
 			continue
 		}
 		return c, true, nil
@@ -339,6 +361,11 @@ func (t *Transport) getPipelineConn() (
 	for c, status := range t.pipelineConns {
 		if c.isClosed() || t.connTooOld(c) {
 			delete(t.pipelineConns, c)
+			// Close it after all its queries finished.
+			go func() {
+				status.wg.Wait()
+				c.closeWithErr(errEOL)
+			}()
 			continue
 		}
 		conn = c
@@ -377,14 +404,41 @@ func (t *Transport) getPipelineConn() (
 	return
 }
 
+// ConnInfo returns the info of all live connections of this Transport.
+func (t *Transport) ConnInfo() []ConnInfo {
+	t.m.Lock()
+	conns := make([]*dnsConn, 0, len(t.pipelineConns)+len(t.reusableConns))
+	for c := range t.pipelineConns {
+		conns = append(conns, c)
+	}
+	for c := range t.reusableConns {
+		conns = append(conns, c)
+	}
+	t.m.Unlock()
+
+	info := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		if ci, ok := c.info(); ok {
+			info = append(info, ci)
+		}
+	}
+	return info
+}
+
 // connTooOld returns true if c's last read time is close to
-// its idle deadline.
+// its idle deadline or c has reached its max lifetime.
 func (t *Transport) connTooOld(c *dnsConn) bool {
+	if c.keepaliveClosing.Load() {
+		return true
+	}
+	if !c.retireAt.IsZero() && time.Now().After(c.retireAt) {
+		return true
+	}
 	lrt := c.getLastReadTime()
 	if lrt.IsZero() {
 		return false
 	}
-	if tooOldTimeout := t.opts.IdleTimeout - connTooOldThreshold; tooOldTimeout > 0 {
+	if tooOldTimeout := c.getIdleTimeout() - connTooOldThreshold; tooOldTimeout > 0 {
 		tooOldDdl := lrt.Add(tooOldTimeout)
 		return time.Now().After(tooOldDdl)
 	}
@@ -406,6 +460,24 @@ type dnsConn struct {
 
 	statMu   sync.Mutex
 	lastRead time.Time
+
+	// idleTimeout is the idle timeout of this connection. It is
+	// opts.IdleTimeout or the value advertised by the server via
+	// edns-tcp-keepalive.
+	idleTimeout atomic.Int64
+	// keepaliveClosing is set if the server advertised a zero keepalive
+	// timeout. The connection must not be used for new queries.
+	keepaliveClosing atomic.Bool
+
+	createdAt time.Time
+	served    atomic.Uint64 // number of queries sent through this connection
+
+	// jitter is the factor in (1-connCloseJitter, 1] that idle timeout and
+	// lifetime of this connection are multiplied by.
+	jitter float64
+	// retireAt is the time that this connection reaches its max lifetime.
+	// Zero means no limit.
+	retireAt time.Time
 }
 
 func newDNSConn(t *Transport) *dnsConn {
@@ -414,6 +486,12 @@ func newDNSConn(t *Transport) *dnsConn {
 		dialFinishedNotify: make(chan struct{}),
 		queue:              make(map[uint16]chan *dns.Msg),
 		closeNotify:        make(chan struct{}),
+		createdAt:          time.Now(),
+	}
+	dc.jitter = 1 - utils.RandFloat64()*connCloseJitter
+	dc.setIdleTimeout(t.opts.IdleTimeout)
+	if t.opts.MaxLifetime > 0 {
+		dc.retireAt = time.Now().Add(time.Duration(float64(t.opts.MaxLifetime) * dc.jitter))
 	}
 	go dc.dialAndRead()
 	return dc
@@ -443,10 +521,15 @@ func (dc *dnsConn) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 		return nil, ctx.Err()
 	}
 
+	if dc.t.opts.EnableKeepalive {
+		q = withKeepaliveOption(q)
+	}
+
 	qid := q.Id
 	resChan := make(chan *dns.Msg, 1)
 	dc.addQueueC(qid, resChan)
 	defer dc.deleteQueueC(qid)
+	dc.served.Add(1)
 
 	dc.c.SetWriteDeadline(time.Now().Add(writeTimeout))
 	_, err := dc.t.opts.WriteFunc(dc.c, q)
@@ -504,7 +587,7 @@ func (dc *dnsConn) dialAndRead() {
 }
 
 func (dc *dnsConn) readLoop() {
-	dc.c.SetReadDeadline(time.Now().Add(dc.t.opts.IdleTimeout))
+	dc.c.SetReadDeadline(time.Now().Add(dc.getIdleTimeout()))
 	for {
 		r := pool.GetMsg()
 		_, err := dc.t.opts.ReadFunc(dc.c, r)
@@ -514,11 +597,14 @@ func (dc *dnsConn) readLoop() {
 			return
 		}
 
-		dc.c.SetReadDeadline(time.Now().Add(dc.t.opts.IdleTimeout))
+		if dc.t.opts.EnableKeepalive {
+			dc.handleKeepaliveOption(r)
+		}
+		dc.c.SetReadDeadline(time.Now().Add(dc.getIdleTimeout()))
 		dc.updateReadTime()
 
 		resChan := dc.getQueueC(r.Id)
-		
+
 		sent := false
 		if resChan != nil {
 			select {
@@ -536,6 +622,30 @@ func (dc *dnsConn) readLoop() {
 	}
 }
 
+// info returns the ConnInfo of dc. It returns false if dc is not
+// dialed yet or is closed.
+func (dc *dnsConn) info() (ConnInfo, bool) {
+	dc.connMu.Lock()
+	c, closed := dc.c, dc.closed
+	dc.connMu.Unlock()
+	if c == nil || closed {
+		return ConnInfo{}, false
+	}
+
+	protocol := "tcp"
+	// Both crypto/tls and gitlab.com/go-extension/tls conns have this method.
+	if _, ok := c.(interface{ Handshake() error }); ok {
+		protocol = "tls"
+	}
+	return ConnInfo{
+		Protocol:   protocol,
+		RemoteAddr: c.RemoteAddr().String(),
+		Age:        time.Since(dc.createdAt),
+		InFlight:   dc.queueLen(),
+		Served:     dc.served.Load(),
+	}, true
+}
+
 func (dc *dnsConn) isClosed() bool {
 	dc.connMu.Lock()
 	defer dc.connMu.Unlock()
@@ -594,3 +704,37 @@ func (dc *dnsConn) getLastReadTime() time.Time {
 	defer dc.statMu.Unlock()
 	return dc.lastRead
 }
+
+func (dc *dnsConn) getIdleTimeout() time.Duration {
+	return time.Duration(dc.idleTimeout.Load())
+}
+
+// setIdleTimeout sets the idle timeout of this connection to d with
+// jitter applied. The result is no less than opts.MinIdleTimeout.
+func (dc *dnsConn) setIdleTimeout(d time.Duration) {
+	d = time.Duration(float64(d) * dc.jitter)
+	d = max(d, dc.t.opts.MinIdleTimeout)
+	dc.idleTimeout.Store(int64(d))
+}
+
+// handleKeepaliveOption removes the edns-tcp-keepalive option from r
+// and applies the timeout that the server advertised.
+func (dc *dnsConn) handleKeepaliveOption(r *dns.Msg) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+	ka, ok := dnsutils.GetEDNS0Option(opt, dns.EDNS0TCPKEEPALIVE).(*dns.EDNS0_TCP_KEEPALIVE)
+	if !ok {
+		return
+	}
+	dnsutils.RemoveEDNS0Option(opt, dns.EDNS0TCPKEEPALIVE)
+
+	// RFC 7828 3.3.2: A zero timeout means the server wants the client
+	// to close the connection.
+	if ka.Timeout == 0 {
+		dc.keepaliveClosing.Store(true)
+		return
+	}
+	dc.setIdleTimeout(time.Duration(ka.Timeout) * time.Millisecond * 100)
+}
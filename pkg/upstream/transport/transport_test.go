@@ -371,3 +371,83 @@ func TestTransport_Exchange(t *testing.T) {
 		})
 	}
 }
+
+func TestTransport_Keepalive(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+
+	qk := withKeepaliveOption(q)
+	if dnsutils.GetEDNS0Option(q.IsEdns0(), dns.EDNS0TCPKEEPALIVE) != nil {
+		t.Fatal("original query was modified")
+	}
+	if dnsutils.GetEDNS0Option(qk.IsEdns0(), dns.EDNS0TCPKEEPALIVE) == nil {
+		t.Fatal("keepalive option was not added")
+	}
+
+	noEDNS := new(dns.Msg)
+	noEDNS.SetQuestion("example.com.", dns.TypeA)
+	if withKeepaliveOption(noEDNS) != noEDNS {
+		t.Fatal("query without OPT should not be modified")
+	}
+
+	tr, err := NewTransport(Opts{
+		DialFunc:        func(ctx context.Context) (net.Conn, error) { return nil, errors.New("no dial") },
+		WriteFunc:       dnsutils.WriteMsgToTCP,
+		ReadFunc:        dnsutils.ReadMsgFromTCP,
+		EnableKeepalive: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := &dnsConn{t: tr, jitter: 1}
+	dc.setIdleTimeout(tr.opts.IdleTimeout)
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.SetEdns0(1232, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: 1200})
+	dc.handleKeepaliveOption(r)
+	if got := dc.getIdleTimeout(); got != time.Second*120 {
+		t.Fatalf("want idle timeout 120s, got %s", got)
+	}
+	if dnsutils.GetEDNS0Option(r.IsEdns0(), dns.EDNS0TCPKEEPALIVE) != nil {
+		t.Fatal("keepalive option was not removed from the response")
+	}
+
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	dc.handleKeepaliveOption(r)
+	if !tr.connTooOld(dc) {
+		t.Fatal("connection should not be reused after a zero keepalive timeout")
+	}
+}
+
+func TestTransport_ConnLifetime(t *testing.T) {
+	tr, err := NewTransport(Opts{
+		DialFunc:       func(ctx context.Context) (net.Conn, error) { return nil, errors.New("no dial") },
+		WriteFunc:      dnsutils.WriteMsgToTCP,
+		ReadFunc:       dnsutils.ReadMsgFromTCP,
+		IdleTimeout:    time.Second,
+		MinIdleTimeout: time.Second * 5,
+		MaxLifetime:    time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := newDNSConn(tr)
+	defer dc.closeWithErr(errEOL)
+	if got := dc.getIdleTimeout(); got != time.Second*5 {
+		t.Fatalf("idle timeout should be raised to min idle timeout, got %s", got)
+	}
+	if life := time.Until(dc.retireAt); life > time.Minute || life < time.Duration(float64(time.Minute)*(1-connCloseJitter))-time.Second {
+		t.Fatalf("unexpected lifetime %s", life)
+	}
+	if tr.connTooOld(dc) {
+		t.Fatal("new connection should not be too old")
+	}
+	dc.retireAt = time.Now().Add(-time.Millisecond)
+	if !tr.connTooOld(dc) {
+		t.Fatal("connection should be retired after its max lifetime")
+	}
+}
@@ -26,6 +26,15 @@ import (
 	"github.com/miekg/dns"
 )
 
+// ConnInfo describes a live upstream connection.
+type ConnInfo struct {
+	Protocol   string
+	RemoteAddr string
+	Age        time.Duration
+	InFlight   int    // the number of queries waiting for responses
+	Served     uint64 // the number of queries sent through this connection
+}
+
 // getContextDeadline tries to get the deadline of ctx or return a default
 // deadline.
 func getContextDeadline(ctx context.Context, defTimeout time.Duration) time.Time {
@@ -41,3 +50,32 @@ func shadowCopy(m *dns.Msg) *dns.Msg {
 	*nm = *m
 	return nm
 }
+
+// withKeepaliveOption returns a shadow copy of m that has an
+// edns-tcp-keepalive option in its OPT record. m is not modified.
+// If m has no OPT record, m is returned as it is.
+func withKeepaliveOption(m *dns.Msg) *dns.Msg {
+	for i, rr := range m.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0TCPKEEPALIVE {
+				return m
+			}
+		}
+
+		newOpt := &dns.OPT{Hdr: opt.Hdr}
+		newOpt.Option = make([]dns.EDNS0, 0, len(opt.Option)+1)
+		newOpt.Option = append(newOpt.Option, opt.Option...)
+		newOpt.Option = append(newOpt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+
+		nm := shadowCopy(m)
+		nm.Extra = make([]dns.RR, len(m.Extra))
+		copy(nm.Extra, m.Extra)
+		nm.Extra[i] = newOpt
+		return nm
+	}
+	return m
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2025, pmkol
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package udp
+
+import (
+	"sync"
+	"time"
+)
+
+// bufSizeLevels are the EDNS0 udp sizes that bufSizeProber advertises.
+var bufSizeLevels = []uint16{1232, 1024, 512}
+
+const (
+	// bufSizeTimeoutThreshold is the number of consecutive timeouts that
+	// makes the prober step down.
+	bufSizeTimeoutThreshold = 3
+	// bufSizeProbeInterval is how long the prober waits before it
+	// probes the larger size again.
+	bufSizeProbeInterval = 10 * time.Minute
+)
+
+// bufSizeProber adjusts the advertised EDNS0 udp size of an upstream.
+// Consecutive timeouts usually mean that large fragmented responses are
+// dropped somewhere on the path. The prober steps down to a smaller size
+// on them and probes the larger size again after a while.
+type bufSizeProber struct {
+	mu       sync.Mutex
+	level    int // index of bufSizeLevels
+	timeouts int
+	changed  time.Time
+}
+
+// size returns the size that should be advertised now.
+func (p *bufSizeProber) size(now time.Time) uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.level > 0 && now.Sub(p.changed) >= bufSizeProbeInterval {
+		p.level--
+		p.timeouts = 0
+		p.changed = now
+	}
+	return bufSizeLevels[p.level]
+}
+
+// onTimeout records a timed out query that advertised size.
+func (p *bufSizeProber) onTimeout(size uint16, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if size != bufSizeLevels[p.level] {
+		return // outdated
+	}
+	p.timeouts++
+	if p.timeouts >= bufSizeTimeoutThreshold && p.level < len(bufSizeLevels)-1 {
+		p.level++
+		p.timeouts = 0
+		p.changed = now
+	}
+}
+
+// onSuccess records a query that got a response.
+func (p *bufSizeProber) onSuccess() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeouts = 0
+}
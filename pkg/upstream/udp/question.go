@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020-2025, pmkol
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package udp
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// wireQuestion returns the question section (name, type and class) of
+// the wire msg b. ok is false if b does not have exactly one question or
+// the question name is compressed.
+func wireQuestion(b []byte) (q []byte, ok bool) {
+	if len(b) < 12 || binary.BigEndian.Uint16(b[4:6]) != 1 {
+		return nil, false
+	}
+	off := 12
+	for {
+		if off >= len(b) {
+			return nil, false
+		}
+		l := int(b[off])
+		if l == 0 {
+			off++
+			break
+		}
+		if l&0xc0 != 0 { // pointer or extended label
+			return nil, false
+		}
+		off += 1 + l
+	}
+	if off+4 > len(b) {
+		return nil, false
+	}
+	return b[12 : off+4], true
+}
+
+// questionMatched reports whether the wire msg resp echoes the question
+// section sent, which is from wireQuestion. If caseSensitive is false,
+// ASCII letters in the name are compared case-insensitively.
+// Error responses without a question are accepted.
+func questionMatched(resp, sent []byte, caseSensitive bool) bool {
+	rq, ok := wireQuestion(resp)
+	if !ok {
+		return len(resp) >= 12 &&
+			binary.BigEndian.Uint16(resp[4:6]) == 0 &&
+			resp[3]&0x0f != dns.RcodeSuccess
+	}
+	if len(rq) != len(sent) {
+		return false
+	}
+	if caseSensitive {
+		return string(rq) == string(sent)
+	}
+	nameEnd := len(sent) - 4
+	for i := range sent {
+		a, b := rq[i], sent[i]
+		if i < nameEnd {
+			// Label lengths are < 64, so they are never changed by the folding.
+			a, b = toLowerASCII(a), toLowerASCII(b)
+		}
+		if a != b {
+			return false
+		}
+	}
+	return true
+}
+
+func toLowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// randomizeCase randomizes the case of ASCII letters in name (dns 0x20).
+func randomizeCase(name string) string {
+	b := []byte(name)
+	var bits uint32
+	for i, c := range b {
+		if i%32 == 0 {
+			bits = utils.RandUint32()
+		}
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+			c = toLowerASCII(c)
+			if bits&1 == 1 {
+				c -= 'a' - 'A'
+			}
+			b[i] = c
+		}
+		bits >>= 1
+	}
+	return string(b)
+}
+
+// restoreName replaces the names in r that are equal to name
+// case-insensitively with name.
+func restoreName(r *dns.Msg, name string) {
+	for i := range r.Question {
+		if strings.EqualFold(r.Question[i].Name, name) {
+			r.Question[i].Name = name
+		}
+	}
+	for _, section := range [...][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); strings.EqualFold(h.Name, name) {
+				h.Name = name
+			}
+		}
+	}
+}
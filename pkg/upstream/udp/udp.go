@@ -31,8 +31,10 @@ import (
 
 	"github.com/miekg/dns"
 
-	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/pool"
+	"github.com/pmkol/mosdns-x/pkg/upstream/capture"
 	"github.com/pmkol/mosdns-x/pkg/upstream/transport"
+	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
 const (
@@ -49,6 +51,7 @@ var bufPool = sync.Pool{
 type pendingEntry struct {
 	ch       chan *dns.Msg
 	deadline time.Time
+	question []byte // wire question section of the query, see wireQuestion
 }
 
 type Upstream struct {
@@ -57,6 +60,7 @@ type Upstream struct {
 
 	mu         sync.Mutex
 	conn       net.Conn
+	connTime   time.Time
 	readerOn   bool
 	connecting int32
 	connDone   chan struct{}
@@ -68,8 +72,16 @@ type Upstream struct {
 	writeMu sync.Mutex
 	rr      uint32
 	closed  int32
+	served  atomic.Uint64
+
+	bufSize *bufSizeProber   // nil if adaptive bufsize is disabled
+	capture *capture.Capture // nil if capture is disabled
+
+	use0x20 bool
 }
 
+// NewUDPUpstream creates a udp Upstream. tcpTransport is used to retry
+// truncated responses. If it is nil, truncated responses are returned as is.
 func NewUDPUpstream(dialFunc func(ctx context.Context) (net.Conn, error), tcpTransport *transport.Transport) (*Upstream, error) {
 	if dialFunc == nil {
 		return nil, errors.New("dialFunc required")
@@ -79,11 +91,33 @@ func NewUDPUpstream(dialFunc func(ctx context.Context) (net.Conn, error), tcpTra
 		tcpTransport: tcpTransport,
 		pending:      make(map[uint16]*pendingEntry),
 		wakeup:       make(chan struct{}, 1),
+		rr:           utils.RandUint32(),
 	}
 	go u.pendingJanitor()
 	return u, nil
 }
 
+// EnableAdaptiveBufSize makes u adjust the EDNS0 udp size of queries
+// according to the timeouts of this upstream. It must be called before
+// u is used.
+func (u *Upstream) EnableAdaptiveBufSize() {
+	u.bufSize = new(bufSizeProber)
+}
+
+// EnableRandomizeCase makes u randomize the case of question names
+// (dns 0x20) and only accept responses that echo the exact name. Without
+// it, the echoed question is still verified but case-insensitively.
+// It must be called before u is used.
+func (u *Upstream) EnableRandomizeCase() {
+	u.use0x20 = true
+}
+
+// SetCapture makes u record the wire messages to c. It must be called
+// before u is used.
+func (u *Upstream) SetCapture(c *capture.Capture) {
+	u.capture = c
+}
+
 func (u *Upstream) Close() error {
 	if !atomic.CompareAndSwapInt32(&u.closed, 0, 1) {
 		return nil
@@ -177,6 +211,7 @@ func (u *Upstream) ensureConn(ctx context.Context) error {
 				return errors.New("udp upstream closed")
 			}
 			u.conn = conn
+			u.connTime = time.Now()
 			u.readerOn = true
 			u.mu.Unlock()
 
@@ -219,7 +254,12 @@ func (u *Upstream) reader(conn net.Conn) {
 		if n > 0 {
 			msg := new(dns.Msg)
 			if err := msg.Unpack(b[:n]); err == nil {
-				u.removePendingAndNotify(msg.Id, msg)
+				u.capture.Received(b[:n], msg)
+				if u.questionMatched(msg.Id, b[:n]) {
+					u.removePendingAndNotify(msg.Id, msg)
+				}
+			} else {
+				u.capture.Received(b[:n], nil)
 			}
 		}
 	}
@@ -265,6 +305,30 @@ func (u *Upstream) handleConnClosed(conn net.Conn, _ error) {
 	}
 }
 
+// questionMatched reports whether the wire response resp echoes the
+// question of the pending query. Responses that don't are dropped as they
+// may be spoofed.
+func (u *Upstream) questionMatched(id uint16, resp []byte) bool {
+	u.pendingMu.Lock()
+	var sent []byte
+	if entry, ok := u.pending[id]; ok {
+		sent = entry.question
+	}
+	u.pendingMu.Unlock()
+	if sent == nil { // not pending, or the query has an unusual question.
+		return true
+	}
+	return questionMatched(resp, sent, u.use0x20)
+}
+
+func (u *Upstream) setPendingQuestion(id uint16, q []byte) {
+	u.pendingMu.Lock()
+	if entry, ok := u.pending[id]; ok {
+		entry.question = q
+	}
+	u.pendingMu.Unlock()
+}
+
 func (u *Upstream) removePendingAndNotify(id uint16, msg *dns.Msg) {
 	u.pendingMu.Lock()
 	entry, ok := u.pending[id]
@@ -311,6 +375,21 @@ func (u *Upstream) unclaimID(id uint16) {
 	}
 }
 
+// writeMsg writes m to conn and records its question to the pending
+// entry of m.Id.
+func (u *Upstream) writeMsg(conn net.Conn, m *dns.Msg) (int, error) {
+	b, buf, err := pool.PackBuffer(m)
+	if err != nil {
+		return 0, err
+	}
+	defer buf.Release()
+	if q, ok := wireQuestion(b); ok {
+		u.setPendingQuestion(m.Id, append([]byte(nil), q...))
+	}
+	u.capture.Sent(b, m)
+	return conn.Write(b)
+}
+
 func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	if atomic.LoadInt32(&u.closed) == 1 {
 		return nil, errors.New("udp upstream closed")
@@ -334,6 +413,7 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 		return nil, errors.New("udp connection closed")
 	}
 
+	u.served.Add(1)
 	u.writeMu.Lock()
 	var dlSet bool
 	if dl, ok := ctx.Deadline(); ok {
@@ -342,7 +422,19 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 	}
 	cq := q.Copy()
 	cq.Id = id
-	_, err = dnsutils.WriteMsgToUDP(conn, cq)
+	if u.use0x20 && len(cq.Question) == 1 {
+		cq.Question[0].Name = randomizeCase(cq.Question[0].Name)
+	}
+	var bufSize uint16 // the probed size that cq advertises, if any
+	if u.bufSize != nil {
+		if opt := cq.IsEdns0(); opt != nil {
+			if s := u.bufSize.size(time.Now()); opt.UDPSize() > s {
+				opt.SetUDPSize(s)
+			}
+			bufSize = opt.UDPSize()
+		}
+	}
+	_, err = u.writeMsg(conn, cq)
 	if dlSet {
 		_ = conn.SetWriteDeadline(time.Time{})
 	}
@@ -361,69 +453,76 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 
 	select {
 	case resp := <-respCh:
-		if resp == nil {
-			return nil, errors.New("connection closed or read error")
-		}
-		if resp.Truncated {
-			if u.tcpTransport == nil {
-				return nil, errors.New("truncated response but tcpTransport is nil")
-			}
-			resp, err := u.tcpTransport.ExchangeContext(ctx, q)
-			if err != nil {
-				return nil, err
-			}
-			resp.Id = origID
-			return resp, nil
-		}
-		resp.Id = origID
-		return resp, nil
-	default:
-	}
-
-	select {
-	case resp := <-respCh:
-		if resp == nil {
-			return nil, errors.New("connection closed or read error")
-		}
-		if resp.Truncated {
-			if u.tcpTransport == nil {
-				return nil, errors.New("truncated response but tcpTransport is nil")
-			}
-			resp, err := u.tcpTransport.ExchangeContext(ctx, q)
-			if err != nil {
-				return nil, err
-			}
-			resp.Id = origID
-			return resp, nil
-		}
-		resp.Id = origID
-		return resp, nil
+		return u.handleResp(ctx, q, resp, origID)
 	case <-ctx.Done():
 		// Double-check: response may have arrived during context cancellation
 		select {
 		case resp := <-respCh:
-			if resp == nil {
-				return nil, errors.New("connection closed or read error")
-			}
-			if resp.Truncated {
-				if u.tcpTransport == nil {
-					return nil, errors.New("truncated response but tcpTransport is nil")
-				}
-				resp, err := u.tcpTransport.ExchangeContext(ctx, q)
-				if err != nil {
-					return nil, err
-				}
-				resp.Id = origID
-				return resp, nil
-			}
-			resp.Id = origID
-			return resp, nil
+			return u.handleResp(ctx, q, resp, origID)
 		default:
+			if bufSize > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				u.bufSize.onTimeout(bufSize, time.Now())
+			}
 			return nil, ctx.Err()
 		}
 	}
 }
 
+// handleResp retries truncated responses via the fallback transport.
+// If there is no fallback transport, the truncated response is returned.
+func (u *Upstream) handleResp(ctx context.Context, q, resp *dns.Msg, origID uint16) (*dns.Msg, error) {
+	if resp == nil {
+		return nil, errors.New("connection closed or read error")
+	}
+	if u.bufSize != nil {
+		u.bufSize.onSuccess()
+	}
+	if resp.Truncated && u.tcpTransport != nil {
+		r, err := u.tcpTransport.ExchangeContext(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		resp = r
+	}
+	if u.use0x20 && len(q.Question) == 1 {
+		restoreName(resp, q.Question[0].Name)
+	}
+	resp.Id = origID
+	return resp, nil
+}
+
+// ConnInfo returns the info of the udp socket and the connections of the
+// tcp fallback transport.
+func (u *Upstream) ConnInfo() []transport.ConnInfo {
+	var info []transport.ConnInfo
+	if ci, ok := u.udpConnInfo(); ok {
+		info = append(info, ci)
+	}
+	if u.tcpTransport != nil {
+		info = append(info, u.tcpTransport.ConnInfo()...)
+	}
+	return info
+}
+
+func (u *Upstream) udpConnInfo() (transport.ConnInfo, bool) {
+	u.mu.Lock()
+	conn, connTime := u.conn, u.connTime
+	u.mu.Unlock()
+	if conn == nil {
+		return transport.ConnInfo{}, false
+	}
+	u.pendingMu.Lock()
+	inFlight := len(u.pending)
+	u.pendingMu.Unlock()
+	return transport.ConnInfo{
+		Protocol:   "udp",
+		RemoteAddr: conn.RemoteAddr().String(),
+		Age:        time.Since(connTime),
+		InFlight:   inFlight,
+		Served:     u.served.Load(),
+	}, true
+}
+
 func (u *Upstream) pendingJanitor() {
 	var timer *time.Timer
 	for {
@@ -479,38 +578,224 @@ func (u *Upstream) pendingJanitor() {
 	}
 }
 
+const (
+	// poolGrowThreshold is the number of in-flight queries per socket
+	// that makes the pool grow.
+	poolGrowThreshold = 32
+	// poolCheckInterval is the interval of pool pressure checks.
+	poolCheckInterval  = 10 * time.Second
+	defaultPoolIdleTTL = 60 * time.Second
+)
+
+// PoolOpts configures an UpstreamPool.
+type PoolOpts struct {
+	// MinSize is the minimum number of sockets. Default is 1.
+	MinSize int
+	// MaxSize is the maximum number of sockets. Default is runtime.NumCPU() * 2.
+	MaxSize int
+	// IdleTimeout is how long the pressure must stay low before the
+	// pool starts to shrink. Default is 60s.
+	IdleTimeout time.Duration
+	// AdaptiveBufSize enables adaptive EDNS0 udp size for all sockets.
+	// See Upstream.EnableAdaptiveBufSize.
+	AdaptiveBufSize bool
+	// Capture optionally records the wire messages of all sockets.
+	Capture *capture.Capture
+	// RandomizeCase enables dns 0x20 for all sockets.
+	// See Upstream.EnableRandomizeCase.
+	RandomizeCase bool
+}
+
+func (opts *PoolOpts) init() {
+	if opts.MinSize <= 0 {
+		opts.MinSize = 1
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = runtime.NumCPU() * 2
+	}
+	if opts.MaxSize < opts.MinSize {
+		opts.MaxSize = opts.MinSize
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = defaultPoolIdleTTL
+	}
+}
+
+// UpstreamPool is a pool of udp sockets. It grows when the number of
+// in-flight queries per socket is high and shrinks when the pressure
+// stays low for PoolOpts.IdleTimeout.
 type UpstreamPool struct {
-	upstreams []*Upstream
-	next      uint32
+	dialFunc     func(ctx context.Context) (net.Conn, error)
+	tcpTransport *transport.Transport
+	opts         PoolOpts
+	bufSize      *bufSizeProber // shared by all sockets, nil if disabled
+
+	mu        sync.Mutex // serializes resizing
+	lowSince  time.Time  // guarded by mu
+	upstreams atomic.Pointer[[]*Upstream]
+	next      atomic.Uint32
+	inFlight  atomic.Int32
+	peak      atomic.Int32 // peak of inFlight since the last check
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
 }
 
-func NewUpstreamPool(dialFunc func(ctx context.Context) (net.Conn, error), tcpTransport *transport.Transport) (*UpstreamPool, error) {
-	num := runtime.NumCPU() * 2
+func NewUpstreamPool(dialFunc func(ctx context.Context) (net.Conn, error), tcpTransport *transport.Transport, opts PoolOpts) (*UpstreamPool, error) {
+	opts.init()
 	pool := &UpstreamPool{
-		upstreams: make([]*Upstream, num),
+		dialFunc:     dialFunc,
+		tcpTransport: tcpTransport,
+		opts:         opts,
+		closeNotify:  make(chan struct{}),
+	}
+	if opts.AdaptiveBufSize {
+		pool.bufSize = new(bufSizeProber)
 	}
-	for i := 0; i < num; i++ {
-		u, err := NewUDPUpstream(dialFunc, tcpTransport)
+	ups := make([]*Upstream, 0, opts.MinSize)
+	for i := 0; i < opts.MinSize; i++ {
+		u, err := pool.newUpstream()
 		if err != nil {
-			for j := 0; j < i; j++ {
-				_ = pool.upstreams[j].Close()
+			for _, u := range ups {
+				_ = u.Close()
 			}
 			return nil, err
 		}
-		pool.upstreams[i] = u
+		ups = append(ups, u)
 	}
+	pool.upstreams.Store(&ups)
+	go pool.resizeLoop()
 	return pool, nil
 }
 
 func (p *UpstreamPool) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
-	i := atomic.AddUint32(&p.next, 1)
-	u := p.upstreams[i%uint32(len(p.upstreams))]
+	n := p.inFlight.Add(1)
+	defer p.inFlight.Add(-1)
+	for {
+		peak := p.peak.Load()
+		if n <= peak || p.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+
+	ups := *p.upstreams.Load()
+	if int(n) > len(ups)*poolGrowThreshold && len(ups) < p.opts.MaxSize {
+		ups = p.grow(len(ups))
+	}
+	u := ups[p.next.Add(1)%uint32(len(ups))]
 	return u.ExchangeContext(ctx, q)
 }
 
+// grow adds a socket to the pool if the pool still has seen sockets.
+func (p *UpstreamPool) grow(seen int) []*Upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ups := *p.upstreams.Load()
+	if len(ups) != seen || p.isClosed() {
+		return ups
+	}
+	u, err := p.newUpstream()
+	if err != nil {
+		return ups
+	}
+	nu := make([]*Upstream, len(ups), len(ups)+1)
+	copy(nu, ups)
+	nu = append(nu, u)
+	p.upstreams.Store(&nu)
+	p.lowSince = time.Time{}
+	return nu
+}
+
+func (p *UpstreamPool) newUpstream() (*Upstream, error) {
+	u, err := NewUDPUpstream(p.dialFunc, p.tcpTransport)
+	if err != nil {
+		return nil, err
+	}
+	u.bufSize = p.bufSize
+	u.capture = p.opts.Capture
+	u.use0x20 = p.opts.RandomizeCase
+	return u, nil
+}
+
+func (p *UpstreamPool) resizeLoop() {
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeNotify:
+			return
+		case now := <-ticker.C:
+			p.check(now)
+		}
+	}
+}
+
+// check removes one socket from the pool if the peak pressure since
+// the last check has been low for opts.IdleTimeout.
+func (p *UpstreamPool) check(now time.Time) {
+	peak := int(p.peak.Swap(p.inFlight.Load()))
+	want := (peak + poolGrowThreshold - 1) / poolGrowThreshold
+	if want < p.opts.MinSize {
+		want = p.opts.MinSize
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ups := *p.upstreams.Load()
+	if len(ups) <= want || p.isClosed() {
+		p.lowSince = time.Time{}
+		return
+	}
+	if p.lowSince.IsZero() {
+		p.lowSince = now
+	}
+	if now.Sub(p.lowSince) < p.opts.IdleTimeout {
+		return
+	}
+
+	nu := make([]*Upstream, len(ups)-1)
+	copy(nu, ups)
+	p.upstreams.Store(&nu)
+	// Queries that are using the removed socket won't wait longer than pendingTTL.
+	removed := ups[len(ups)-1]
+	time.AfterFunc(pendingTTL, func() { _ = removed.Close() })
+}
+
+// Size returns the current number of sockets in the pool.
+func (p *UpstreamPool) Size() int {
+	return len(*p.upstreams.Load())
+}
+
+func (p *UpstreamPool) isClosed() bool {
+	select {
+	case <-p.closeNotify:
+		return true
+	default:
+		return false
+	}
+}
+
+// ConnInfo returns the info of the udp sockets and the connections of the
+// tcp fallback transport.
+func (p *UpstreamPool) ConnInfo() []transport.ConnInfo {
+	var info []transport.ConnInfo
+	for _, u := range *p.upstreams.Load() {
+		if ci, ok := u.udpConnInfo(); ok {
+			info = append(info, ci)
+		}
+	}
+	if p.tcpTransport != nil {
+		info = append(info, p.tcpTransport.ConnInfo()...)
+	}
+	return info
+}
+
 func (p *UpstreamPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeOnce.Do(func() { close(p.closeNotify) })
 	var firstErr error
-	for _, u := range p.upstreams {
+	for _, u := range *p.upstreams.Load() {
 		if err := u.Close(); err != nil && firstErr == nil {
 			firstErr = err
 		}
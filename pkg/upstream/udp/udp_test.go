@@ -0,0 +1,205 @@
+/*
+ * Copyright (C) 2020-2025, pmkol
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package udp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamPool_Resize(t *testing.T) {
+	dialFunc := func(ctx context.Context) (net.Conn, error) {
+		return nil, errors.New("no network")
+	}
+	p, err := NewUpstreamPool(dialFunc, nil, PoolOpts{MinSize: 1, MaxSize: 3, IdleTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Simulate pressure.
+	p.inFlight.Store(poolGrowThreshold * 10)
+	for i := 0; i < 5; i++ {
+		_, _ = p.ExchangeContext(context.Background(), q)
+	}
+	if n := p.Size(); n != 3 {
+		t.Fatalf("pool size under pressure = %d, want 3", n)
+	}
+
+	// Pressure goes away.
+	p.inFlight.Store(0)
+	now := time.Now()
+	p.check(now) // resets peak
+	p.check(now)
+	if n := p.Size(); n != 3 {
+		t.Fatalf("pool shrank before idle timeout, size = %d", n)
+	}
+	p.check(now.Add(time.Minute))
+	p.check(now.Add(time.Minute + poolCheckInterval))
+	p.check(now.Add(time.Minute + 2*poolCheckInterval))
+	if n := p.Size(); n != 1 {
+		t.Fatalf("idle pool size = %d, want 1", n)
+	}
+}
+
+func TestUpstream_TruncatedWithoutFallback(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(b[:n]); err != nil {
+				continue
+			}
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Truncated = true
+			out, _ := r.Pack()
+			_, _ = pc.WriteTo(out, addr)
+		}
+	}()
+
+	u, err := NewUDPUpstream(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("udp", pc.LocalAddr().String())
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r, err := u.ExchangeContext(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Truncated || r.Id != q.Id {
+		t.Fatalf("unexpected response %v", r)
+	}
+}
+
+func Test_bufSizeProber(t *testing.T) {
+	p := new(bufSizeProber)
+	now := time.Now()
+	if s := p.size(now); s != 1232 {
+		t.Fatalf("initial size = %d, want 1232", s)
+	}
+
+	for i := 0; i < bufSizeTimeoutThreshold-1; i++ {
+		p.onTimeout(1232, now)
+	}
+	p.onSuccess() // resets the counter
+	for i := 0; i < bufSizeTimeoutThreshold-1; i++ {
+		p.onTimeout(1232, now)
+	}
+	if s := p.size(now); s != 1232 {
+		t.Fatalf("size after sporadic timeouts = %d, want 1232", s)
+	}
+
+	for i := 0; i < bufSizeTimeoutThreshold*len(bufSizeLevels); i++ {
+		p.onTimeout(p.size(now), now)
+	}
+	if s := p.size(now); s != 512 {
+		t.Fatalf("size after persistent timeouts = %d, want 512", s)
+	}
+
+	if s := p.size(now.Add(bufSizeProbeInterval)); s != 1024 {
+		t.Fatalf("probed size = %d, want 1024", s)
+	}
+}
+
+func Test_questionMatched(t *testing.T) {
+	pack := func(m *dns.Msg) []byte {
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("ExAmple.com.", dns.TypeA)
+	sent, ok := wireQuestion(pack(q))
+	if !ok {
+		t.Fatal("failed to parse question")
+	}
+
+	lower := new(dns.Msg)
+	lower.SetQuestion("example.com.", dns.TypeA)
+	aaaa := new(dns.Msg)
+	aaaa.SetQuestion("ExAmple.com.", dns.TypeAAAA)
+	noQuestion := new(dns.Msg)
+	noQuestion.Rcode = dns.RcodeServerFailure
+
+	tests := []struct {
+		name          string
+		resp          *dns.Msg
+		caseSensitive bool
+		want          bool
+	}{
+		{"exact", q, true, true},
+		{"case insensitive", lower, false, true},
+		{"case sensitive", lower, true, false},
+		{"type mismatched", aaaa, false, false},
+		{"error without question", noQuestion, true, true},
+		{"success without question", new(dns.Msg), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := questionMatched(pack(tt.resp), sent, tt.caseSensitive); got != tt.want {
+				t.Errorf("questionMatched() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_randomizeCase(t *testing.T) {
+	name := "www.example-123.com."
+	r := randomizeCase(name)
+	if !strings.EqualFold(r, name) {
+		t.Fatalf("randomized name %s is not equal to %s", r, name)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(r, dns.TypeA)
+	m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: r, Rrtype: dns.TypeA, Class: dns.ClassINET}}}
+	restoreName(m, name)
+	if m.Question[0].Name != name || m.Answer[0].Header().Name != name {
+		t.Fatalf("names are not restored, %v", m)
+	}
+}
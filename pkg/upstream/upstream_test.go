@@ -20,8 +20,10 @@
 package upstream
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
@@ -211,3 +213,66 @@ func (s *vServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	time.Sleep(s.latency)
 	w.WriteMsg(r)
 }
+
+func Test_dot_clientCert(t *testing.T) {
+	serverCert, err := utils.GenerateCertificate("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := utils.GenerateCertificate("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if !bytes.Equal(rawCerts[0], clientCert.Certificate[0]) {
+				return errors.New("unknown client cert")
+			}
+			return nil
+		},
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := dns.Server{Net: "tcp-tls", Listener: l, TLSConfig: tlsConfig, Handler: &vServer{}}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	exchange := func(cert *tls.Certificate) error {
+		u, err := NewUpstream("tls://"+l.Addr().String(), &Opt{Insecure: true, ClientCert: cert})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer u.Close()
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err = u.ExchangeContext(ctx, q)
+		return err
+	}
+
+	if err := exchange(&clientCert); err != nil {
+		t.Fatalf("exchange with client cert: %v", err)
+	}
+	if err := exchange(nil); err == nil {
+		t.Fatal("exchange without client cert succeeded")
+	}
+}
+
+func Test_createTLSConfig_clientCert(t *testing.T) {
+	cert, err := utils.GenerateCertificate("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := createTLSConfig(&Opt{ClientCert: &cert}, "doq", "example.com")
+	if len(c.Certificates) != 1 || !bytes.Equal(c.Certificates[0].Certificate[0], cert.Certificate[0]) {
+		t.Fatalf("client cert is not set, got %d certs", len(c.Certificates))
+	}
+	if c := createTLSConfig(&Opt{}, "doq", "example.com"); len(c.Certificates) != 0 {
+		t.Fatal("unexpected client cert")
+	}
+}
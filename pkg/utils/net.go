@@ -48,6 +48,19 @@ func GetAddrFromAddr(addr net.Addr) netip.Addr {
 	return a
 }
 
+// GetAddrPortFromAddr returns netip.AddrPort from net.Addr.
+// addr can be *net.TCPAddr or *net.UDPAddr. Will return an invalid
+// netip.AddrPort otherwise.
+func GetAddrPortFromAddr(addr net.Addr) netip.AddrPort {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.AddrPort()
+	case *net.UDPAddr:
+		return v.AddrPort()
+	}
+	return netip.AddrPort{}
+}
+
 // SplitSchemeAndHost splits addr to protocol and host.
 func SplitSchemeAndHost(addr string) (protocol, host string) {
 	if protocol, host, ok := SplitString2(addr, "://"); ok {
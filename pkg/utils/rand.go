@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+)
+
+// lockedRand is a rand.Rand that is safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// globalRand is the random source used by shuffling, jitters and
+// id allocations. If it is nil, the math/rand/v2 global source is used.
+var globalRand atomic.Pointer[lockedRand]
+
+// SetRandSeed makes the global random source deterministic. The same seed
+// always produces the same sequence, which makes tests reproducible.
+// A zero seed restores the default non-deterministic source.
+// It should be called before any other component is initialized.
+func SetRandSeed(seed uint64) {
+	if seed == 0 {
+		globalRand.Store(nil)
+		return
+	}
+	globalRand.Store(&lockedRand{r: rand.New(rand.NewPCG(seed, seed))})
+}
+
+// RandFloat64 returns a float64 in [0.0, 1.0) from the global random source.
+func RandFloat64() float64 {
+	lr := globalRand.Load()
+	if lr == nil {
+		return rand.Float64()
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return lr.r.Float64()
+}
+
+// RandIntN returns an int in [0, n) from the global random source.
+// It panics if n <= 0.
+func RandIntN(n int) int {
+	lr := globalRand.Load()
+	if lr == nil {
+		return rand.IntN(n)
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return lr.r.IntN(n)
+}
+
+// RandUint32 returns an uint32 from the global random source.
+func RandUint32() uint32 {
+	lr := globalRand.Load()
+	if lr == nil {
+		return rand.Uint32()
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return lr.r.Uint32()
+}
+
+// RandShuffle shuffles n elements using the global random source.
+func RandShuffle(n int, swap func(i, j int)) {
+	lr := globalRand.Load()
+	if lr == nil {
+		rand.Shuffle(n, swap)
+		return
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	lr.r.Shuffle(n, swap)
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"testing"
+)
+
+func TestSetRandSeed(t *testing.T) {
+	defer SetRandSeed(0)
+
+	sample := func() []uint32 {
+		s := []uint32{RandUint32(), uint32(RandIntN(1000)), uint32(RandFloat64() * 1000)}
+		x := []uint32{1, 2, 3, 4, 5}
+		RandShuffle(len(x), func(i, j int) { x[i], x[j] = x[j], x[i] })
+		return append(s, x...)
+	}
+
+	SetRandSeed(1)
+	s1 := sample()
+	SetRandSeed(1)
+	s2 := sample()
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			t.Fatalf("same seed produced different sequences, %v, %v", s1, s2)
+		}
+	}
+}
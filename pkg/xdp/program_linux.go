@@ -0,0 +1,366 @@
+//go:build linux && xdp
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xdp
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+// Return codes of XDP programs.
+const (
+	xdpDrop = 1
+	xdpPass = 2
+	xdpTx   = 3
+)
+
+// Offsets of the query packet: ethernet, ipv4 without options, udp, dns.
+const (
+	offEthType  = 12
+	offIP       = 14
+	offIPLen    = 16
+	offIPFrag   = 20
+	offIPTTL    = 22
+	offIPProto  = 23
+	offIPCsum   = 24
+	offIPSrc    = 26
+	offIPDst    = 30
+	offUDPSrc   = 34
+	offUDPDst   = 36
+	offUDPLen   = 38
+	offUDPCsum  = 40
+	offDNS      = 42
+	offQuestion = offDNS + 12
+
+	headersLen = offDNS - offIP // ip and udp headers
+	optLen     = 11             // OPT record without options
+)
+
+// Offsets of the fields of entryValue.
+const (
+	offValueExpire     = 0
+	offValueStored     = 8
+	offValueLen        = 16
+	offValueNTTL       = 18
+	offValueTTLOffsets = 20
+	offValueMsg        = 56
+)
+
+// Stack slots of the program. The key is zeroed before the name is
+// copied into it, so it matches the zero padded stored keys.
+const (
+	stackKey      = -104
+	stackID       = -112
+	stackElapsed  = -128
+	stackStatsKey = -136
+	stackQueryLen = -144
+)
+
+// Labels of the program.
+const (
+	labelPass     = "pass"
+	labelDrop     = "drop"
+	labelNameDone = "name_done"
+	labelNoEDNS0  = "no_edns0"
+	labelLookup   = "lookup"
+	labelTTLDone  = "ttl_done"
+	labelTx       = "tx"
+)
+
+// le16 returns the value of the wire (big endian) uint16 v loaded by a
+// little endian host.
+func le16(v uint16) int32 {
+	return int32(v>>8 | v<<8&0xff00)
+}
+
+// buildProgram returns the instructions of the program. The program looks
+// up the question of a udp query to port in entries, and turns the packet
+// into the stored response if there is a fresh one, counting the answered
+// queries in stats.
+//
+// The registers are: R6 the context, R7 and R8 the start and the end of
+// the packet, R9 the name length, then the looked up value.
+func buildProgram(entries, stats *ebpf.Map, port uint16) asm.Instructions {
+	var insns asm.Instructions
+	emit := func(ins ...asm.Instruction) { insns = append(insns, ins...) }
+
+	loadPacket := func() {
+		emit(
+			asm.LoadMem(asm.R7, asm.R6, 0, asm.Word), // xdp_md.data
+			asm.LoadMem(asm.R8, asm.R6, 4, asm.Word), // xdp_md.data_end
+		)
+	}
+	// packetAtLeast jumps to label if the packet is shorter than n.
+	packetAtLeast := func(n int32, label string) {
+		emit(
+			asm.Mov.Reg(asm.R2, asm.R7),
+			asm.Add.Imm(asm.R2, n),
+			asm.JGT.Reg(asm.R2, asm.R8, label),
+		)
+	}
+
+	emit(asm.Mov.Reg(asm.R6, asm.R1))
+	loadPacket()
+	packetAtLeast(offQuestion, labelPass)
+
+	// ipv4, no options, no fragments, udp to port.
+	emit(
+		asm.LoadMem(asm.R2, asm.R7, offEthType, asm.Half),
+		asm.JNE.Imm(asm.R2, le16(0x0800), labelPass),
+		asm.LoadMem(asm.R2, asm.R7, offIP, asm.Byte),
+		asm.JNE.Imm(asm.R2, 0x45, labelPass),
+		asm.LoadMem(asm.R2, asm.R7, offIPFrag, asm.Half),
+		asm.And.Imm(asm.R2, le16(0x3fff)), // MF and fragment offset
+		asm.JNE.Imm(asm.R2, 0, labelPass),
+		asm.LoadMem(asm.R2, asm.R7, offIPProto, asm.Byte),
+		asm.JNE.Imm(asm.R2, 17, labelPass),
+		asm.LoadMem(asm.R2, asm.R7, offUDPDst, asm.Half),
+		asm.JNE.Imm(asm.R2, le16(port), labelPass),
+	)
+
+	// A standard query of one question, and maybe an OPT record.
+	emit(
+		asm.LoadMem(asm.R2, asm.R7, offDNS+2, asm.Byte),
+		asm.And.Imm(asm.R2, 0xfa), // QR, opcode and TC
+		asm.JNE.Imm(asm.R2, 0, labelPass),
+		asm.LoadMem(asm.R2, asm.R7, offDNS+4, asm.Half),
+		asm.JNE.Imm(asm.R2, le16(1), labelPass),
+		asm.LoadMem(asm.R2, asm.R7, offDNS+6, asm.Word), // ancount and nscount
+		asm.JNE.Imm(asm.R2, 0, labelPass),
+		asm.LoadMem(asm.R2, asm.R7, offDNS, asm.Half),
+		asm.StoreMem(asm.RFP, stackID, asm.R2, asm.DWord),
+	)
+
+	emit(asm.Mov.Imm(asm.R2, 0))
+	for off := int16(stackKey); off < 0; off += 8 {
+		emit(asm.StoreMem(asm.RFP, off, asm.R2, asm.DWord))
+	}
+
+	// Copy the name into the key. It is not parsed, stored names never have
+	// compression pointers, so a name with one does not match any key.
+	for i := int32(0); i < maxNameLen; i++ {
+		packetAtLeast(offQuestion+i+1, labelPass)
+		emit(
+			asm.LoadMem(asm.R3, asm.R7, int16(offQuestion+i), asm.Byte),
+			asm.StoreMem(asm.RFP, int16(stackKey+i), asm.R3, asm.Byte),
+			asm.Mov.Imm(asm.R9, i+1),
+			asm.JEq.Imm(asm.R3, 0, labelNameDone),
+		)
+	}
+	emit(asm.Ja.Label(labelPass))
+
+	// R2 points to the question minus offQuestion, R3 to its end.
+	emit(
+		asm.Mov.Reg(asm.R2, asm.R7).WithSymbol(labelNameDone),
+		asm.Add.Reg(asm.R2, asm.R9),
+		asm.Mov.Reg(asm.R3, asm.R2),
+		asm.Add.Imm(asm.R3, offQuestion+4),
+		asm.JGT.Reg(asm.R3, asm.R8, labelPass),
+		asm.LoadMem(asm.R4, asm.R2, offQuestion+2, asm.Half),
+		asm.JNE.Imm(asm.R4, le16(1), labelPass), // class IN
+		asm.LoadMem(asm.R4, asm.R2, offQuestion, asm.Half),
+		asm.StoreMem(asm.RFP, stackKey+maxNameLen, asm.R4, asm.Half),
+		asm.LoadMem(asm.R4, asm.R7, offDNS+3, asm.Byte),
+		asm.And.Imm(asm.R4, 0x10), // CD
+		asm.RSh.Imm(asm.R4, 2),    // flagCD
+		asm.Mov.Reg(asm.R5, asm.R9),
+		asm.Add.Imm(asm.R5, offQuestion-offDNS+4),
+		asm.LoadMem(asm.R0, asm.R7, offDNS+10, asm.Half),
+		asm.JEq.Imm(asm.R0, 0, labelNoEDNS0),
+		asm.JNE.Imm(asm.R0, le16(1), labelPass),
+	)
+
+	// The OPT record must be the last one, without options.
+	emit(
+		asm.Mov.Reg(asm.R0, asm.R3),
+		asm.Add.Imm(asm.R0, optLen),
+		asm.JGT.Reg(asm.R0, asm.R8, labelPass),
+		asm.JLT.Reg(asm.R0, asm.R8, labelPass),
+		asm.LoadMem(asm.R0, asm.R2, offQuestion+4, asm.Byte),
+		asm.JNE.Imm(asm.R0, 0, labelPass), // root
+		asm.LoadMem(asm.R0, asm.R2, offQuestion+5, asm.Half),
+		asm.JNE.Imm(asm.R0, le16(41), labelPass),
+		asm.LoadMem(asm.R0, asm.R2, offQuestion+10, asm.Byte),
+		asm.JNE.Imm(asm.R0, 0, labelPass), // version
+		asm.LoadMem(asm.R0, asm.R2, offQuestion+13, asm.Half),
+		asm.JNE.Imm(asm.R0, 0, labelPass), // rdlen
+		asm.LoadMem(asm.R0, asm.R2, offQuestion+11, asm.Byte),
+		asm.And.Imm(asm.R0, 0x80), // DO
+		asm.RSh.Imm(asm.R0, 6),    // flagDO
+		asm.Or.Reg(asm.R4, asm.R0),
+		asm.Or.Imm(asm.R4, flagEDNS0),
+		asm.Add.Imm(asm.R5, optLen),
+		asm.Ja.Label(labelLookup),
+	)
+
+	emit(
+		asm.JLT.Reg(asm.R3, asm.R8, labelPass).WithSymbol(labelNoEDNS0),
+		asm.StoreMem(asm.RFP, stackKey+maxNameLen+2, asm.R4, asm.Byte).WithSymbol(labelLookup),
+		asm.StoreMem(asm.RFP, stackQueryLen, asm.R5, asm.DWord),
+		asm.LoadMapPtr(asm.R1, entries.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, stackKey),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, labelPass),
+		asm.Mov.Reg(asm.R9, asm.R0),
+	)
+
+	// Fresh entries only, the elapsed seconds are subtracted from the ttls.
+	emit(
+		asm.FnKtimeGetNs.Call(),
+		asm.LoadMem(asm.R1, asm.R9, offValueExpire, asm.DWord),
+		asm.JGE.Reg(asm.R0, asm.R1, labelPass),
+		asm.LoadMem(asm.R1, asm.R9, offValueStored, asm.DWord),
+		asm.Sub.Reg(asm.R0, asm.R1),
+		asm.Div.Imm(asm.R0, 1e9),
+		asm.StoreMem(asm.RFP, stackElapsed, asm.R0, asm.DWord),
+	)
+
+	// Resize the packet to the response.
+	emit(
+		asm.LoadMem(asm.R2, asm.R9, offValueLen, asm.Half),
+		asm.JLT.Imm(asm.R2, 12, labelPass),
+		asm.JGT.Imm(asm.R2, maxMsgSize, labelPass),
+		asm.LoadMem(asm.R3, asm.RFP, stackQueryLen, asm.DWord),
+		asm.Sub.Reg(asm.R2, asm.R3),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.FnXdpAdjustTail.Call(),
+		asm.JNE.Imm(asm.R0, 0, labelPass),
+	)
+	loadPacket()
+	packetAtLeast(offDNS+2, labelDrop)
+
+	// Swap the addresses and the ports, and rewrite the lengths.
+	for _, off := range []int16{0, 2, 4} {
+		emit(
+			asm.LoadMem(asm.R2, asm.R7, off, asm.Half),
+			asm.LoadMem(asm.R3, asm.R7, off+6, asm.Half),
+			asm.StoreMem(asm.R7, off, asm.R3, asm.Half),
+			asm.StoreMem(asm.R7, off+6, asm.R2, asm.Half),
+		)
+	}
+	emit(
+		asm.LoadMem(asm.R2, asm.R7, offIPSrc, asm.Word),
+		asm.LoadMem(asm.R3, asm.R7, offIPDst, asm.Word),
+		asm.StoreMem(asm.R7, offIPSrc, asm.R3, asm.Word),
+		asm.StoreMem(asm.R7, offIPDst, asm.R2, asm.Word),
+		asm.LoadMem(asm.R2, asm.R7, offUDPSrc, asm.Half),
+		asm.LoadMem(asm.R3, asm.R7, offUDPDst, asm.Half),
+		asm.StoreMem(asm.R7, offUDPSrc, asm.R3, asm.Half),
+		asm.StoreMem(asm.R7, offUDPDst, asm.R2, asm.Half),
+		asm.LoadMem(asm.R2, asm.R9, offValueLen, asm.Half),
+		asm.Mov.Reg(asm.R3, asm.R2),
+		asm.Add.Imm(asm.R3, headersLen),
+		asm.HostTo(asm.BE, asm.R3, asm.Half),
+		asm.StoreMem(asm.R7, offIPLen, asm.R3, asm.Half),
+		asm.Mov.Reg(asm.R3, asm.R2),
+		asm.Add.Imm(asm.R3, offDNS-offUDPSrc),
+		asm.HostTo(asm.BE, asm.R3, asm.Half),
+		asm.StoreMem(asm.R7, offUDPLen, asm.R3, asm.Half),
+		asm.StoreImm(asm.R7, offUDPCsum, 0, asm.Half), // optional for ipv4
+		asm.StoreImm(asm.R7, offIPTTL, 64, asm.Byte),
+		asm.StoreImm(asm.R7, offIPCsum, 0, asm.Half),
+		asm.Mov.Imm(asm.R2, 0),
+	)
+	for off := int16(offIP); off < offUDPSrc; off += 2 {
+		emit(
+			asm.LoadMem(asm.R3, asm.R7, off, asm.Half),
+			asm.Add.Reg(asm.R2, asm.R3),
+		)
+	}
+	for i := 0; i < 2; i++ {
+		emit(
+			asm.Mov.Reg(asm.R3, asm.R2),
+			asm.RSh.Imm(asm.R3, 16),
+			asm.And.Imm(asm.R2, 0xffff),
+			asm.Add.Reg(asm.R2, asm.R3),
+		)
+	}
+	emit(
+		asm.Xor.Imm(asm.R2, 0xffff),
+		asm.StoreMem(asm.R7, offIPCsum, asm.R2, asm.Half),
+	)
+
+	// Copy the response and set the id of the query.
+	emit(
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Imm(asm.R2, offDNS),
+		asm.Mov.Reg(asm.R3, asm.R9),
+		asm.Add.Imm(asm.R3, offValueMsg),
+		asm.LoadMem(asm.R4, asm.R9, offValueLen, asm.Half),
+		asm.JLT.Imm(asm.R4, 12, labelDrop),
+		asm.JGT.Imm(asm.R4, maxMsgSize, labelDrop),
+		asm.FnXdpStoreBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, labelDrop),
+	)
+	loadPacket()
+	packetAtLeast(offDNS+2, labelDrop)
+	emit(
+		asm.LoadMem(asm.R2, asm.RFP, stackID, asm.DWord),
+		asm.StoreMem(asm.R7, offDNS, asm.R2, asm.Half),
+		asm.LoadMem(asm.R5, asm.RFP, stackElapsed, asm.DWord),
+	)
+
+	for i := int32(0); i < maxTTLs; i++ {
+		emit(
+			asm.LoadMem(asm.R2, asm.R9, offValueNTTL, asm.Half),
+			asm.JLE.Imm(asm.R2, i, labelTTLDone),
+			asm.LoadMem(asm.R3, asm.R9, int16(offValueTTLOffsets+2*i), asm.Half),
+			asm.JGT.Imm(asm.R3, maxMsgSize-4, labelDrop),
+			asm.Mov.Reg(asm.R4, asm.R7),
+			asm.Add.Reg(asm.R4, asm.R3),
+			asm.Mov.Reg(asm.R2, asm.R4),
+			asm.Add.Imm(asm.R2, offDNS+4),
+			asm.JGT.Reg(asm.R2, asm.R8, labelDrop),
+			asm.Mov.Reg(asm.R1, asm.R9),
+			asm.Add.Reg(asm.R1, asm.R3),
+			asm.LoadMem(asm.R0, asm.R1, offValueMsg, asm.Word),
+			asm.HostTo(asm.BE, asm.R0, asm.Word),
+			asm.Sub.Reg(asm.R0, asm.R5),
+			asm.JSGT.Imm(asm.R0, 0, fmt.Sprintf("ttl_%d", i)),
+			asm.Mov.Imm(asm.R0, 1),
+			asm.HostTo(asm.BE, asm.R0, asm.Word).WithSymbol(fmt.Sprintf("ttl_%d", i)),
+			asm.StoreMem(asm.R4, offDNS, asm.R0, asm.Word),
+		)
+	}
+
+	emit(
+		asm.StoreImm(asm.RFP, stackStatsKey, 0, asm.Word).WithSymbol(labelTTLDone),
+		asm.LoadMapPtr(asm.R1, stats.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, stackStatsKey),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, labelTx),
+		asm.LoadMem(asm.R1, asm.R0, 0, asm.DWord),
+		asm.Add.Imm(asm.R1, 1),
+		asm.StoreMem(asm.R0, 0, asm.R1, asm.DWord),
+		asm.Mov.Imm(asm.R0, xdpTx).WithSymbol(labelTx),
+		asm.Return(),
+		asm.Mov.Imm(asm.R0, xdpPass).WithSymbol(labelPass),
+		asm.Return(),
+		asm.Mov.Imm(asm.R0, xdpDrop).WithSymbol(labelDrop),
+		asm.Return(),
+	)
+	return insns
+}
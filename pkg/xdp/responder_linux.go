@@ -0,0 +1,175 @@
+//go:build linux && xdp
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// Responder loads the program and stores the responses that it answers.
+type Responder struct {
+	entries *ebpf.Map
+	stats   *ebpf.Map
+	prog    *ebpf.Program
+	link    link.Link // nil if the program is not attached
+}
+
+// New loads the program and attaches it to opts.Iface, if it is set.
+func New(opts Opts) (*Responder, error) {
+	if opts.Port == 0 {
+		opts.Port = 53
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaultMaxEntries
+	}
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, fmt.Errorf("failed to remove memlock limit, %w", err)
+	}
+
+	r := new(Responder)
+	var err error
+	defer func() {
+		if err != nil {
+			r.Close()
+		}
+	}()
+
+	r.entries, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "mosdns_entries",
+		Type:       ebpf.LRUHash,
+		KeySize:    uint32(binary.Size(entryKey{})),
+		ValueSize:  uint32(binary.Size(entryValue{})),
+		MaxEntries: uint32(opts.MaxEntries),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create entry map, %w", err)
+	}
+	r.stats, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "mosdns_stats",
+		Type:       ebpf.PerCPUArray,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stats map, %w", err)
+	}
+	r.prog, err = ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "mosdns_xdp",
+		Type:         ebpf.XDP,
+		Instructions: buildProgram(r.entries, r.stats, opts.Port),
+		License:      "GPL",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load program, %w", err)
+	}
+
+	if len(opts.Iface) > 0 {
+		var iface *net.Interface
+		iface, err = net.InterfaceByName(opts.Iface)
+		if err != nil {
+			return nil, err
+		}
+		r.link, err = link.AttachXDP(link.XDPOptions{Program: r.prog, Interface: iface.Index})
+		if err != nil {
+			return nil, fmt.Errorf("failed to attach program to %s, %w", opts.Iface, err)
+		}
+	}
+	return r, nil
+}
+
+// Store stores the response resp of query q, if the program can answer
+// q with it. Otherwise, it is a noop.
+func (r *Responder) Store(q, resp *dns.Msg) error {
+	k, v, ok := newEntry(q, resp, monotonicNow())
+	if !ok {
+		return nil
+	}
+	return r.entries.Update(&k, &v, ebpf.UpdateAny)
+}
+
+// Flush deletes all stored responses.
+func (r *Responder) Flush() error {
+	var keys []entryKey
+	var k entryKey
+	var v entryValue
+	iter := r.entries.Iterate()
+	for iter.Next(&k, &v) {
+		keys = append(keys, k)
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for i := range keys {
+		if err := r.entries.Delete(&keys[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hits returns the number of queries that the program has answered.
+func (r *Responder) Hits() (uint64, error) {
+	var perCPU []uint64
+	if err := r.stats.Lookup(uint32(0), &perCPU); err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, v := range perCPU {
+		n += v
+	}
+	return n, nil
+}
+
+// Close detaches and unloads the program.
+func (r *Responder) Close() error {
+	var errs []error
+	if r.link != nil {
+		errs = append(errs, r.link.Close())
+	}
+	if r.prog != nil {
+		errs = append(errs, r.prog.Close())
+	}
+	if r.stats != nil {
+		errs = append(errs, r.stats.Close())
+	}
+	if r.entries != nil {
+		errs = append(errs, r.entries.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// monotonicNow returns CLOCK_MONOTONIC in ns, the clock of bpf_ktime_get_ns.
+func monotonicNow() uint64 {
+	var ts unix.Timespec
+	_ = unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return uint64(ts.Nano())
+}
@@ -0,0 +1,248 @@
+//go:build linux && xdp
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xdp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/miekg/dns"
+)
+
+func newTestResponder(t *testing.T) *Responder {
+	t.Helper()
+	r, err := New(Opts{})
+	if err != nil {
+		t.Skipf("cannot load xdp program: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// queryPacket returns the ethernet frame of the udp query q to port 53.
+func queryPacket(t *testing.T, q *dns.Msg) []byte {
+	t.Helper()
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, offDNS+len(b))
+	copy(p[0:6], []byte{2, 0, 0, 0, 0, 1})
+	copy(p[6:12], []byte{2, 0, 0, 0, 0, 2})
+	binary.BigEndian.PutUint16(p[offEthType:], 0x0800)
+	p[offIP] = 0x45
+	binary.BigEndian.PutUint16(p[offIPLen:], uint16(len(p)-offIP))
+	p[offIPTTL] = 64
+	p[offIPProto] = 17
+	copy(p[offIPSrc:], net.IPv4(10, 0, 0, 2).To4())
+	copy(p[offIPDst:], net.IPv4(10, 0, 0, 1).To4())
+	binary.BigEndian.PutUint16(p[offUDPSrc:], 40000)
+	binary.BigEndian.PutUint16(p[offUDPDst:], 53)
+	binary.BigEndian.PutUint16(p[offUDPLen:], uint16(len(p)-offUDPSrc))
+	copy(p[offDNS:], b)
+	return p
+}
+
+// run runs the program with the packet p. The output is not truncated to
+// the output packet.
+func run(t *testing.T, r *Responder, p []byte) (uint32, []byte) {
+	t.Helper()
+	out := make([]byte, 2048)
+	ret, err := r.prog.Run(&ebpf.RunOptions{Data: p, DataOut: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret, out
+}
+
+func ipChecksum(h []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(h); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(h[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func testResponse(q *dns.Msg, ttl uint32) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer,
+		&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.IPv4(1, 2, 3, 4)},
+		&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl + 100}, A: net.IPv4(1, 2, 3, 5)},
+	)
+	return r
+}
+
+func TestResponder(t *testing.T) {
+	r := newTestResponder(t)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if err := r.Store(q, testResponse(q, 300)); err != nil {
+		t.Fatal(err)
+	}
+	qEDNS0 := new(dns.Msg)
+	qEDNS0.SetQuestion("edns0.example.com.", dns.TypeA)
+	qEDNS0.SetEdns0(4096, true)
+	if err := r.Store(qEDNS0, testResponse(qEDNS0, 300)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		q    *dns.Msg
+		edns bool
+	}{
+		{"plain", q, false},
+		{"edns0", qEDNS0, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.q.Id = 0x1234
+			p := queryPacket(t, tt.q)
+			ret, out := run(t, r, p)
+			if ret != xdpTx {
+				t.Fatalf("want XDP_TX, got %d", ret)
+			}
+			ipLen := int(binary.BigEndian.Uint16(out[offIPLen:]))
+			out = out[:offIP+ipLen]
+			if got := ipChecksum(out[offIP:offUDPSrc]); got != 0 {
+				t.Fatalf("invalid ip checksum, %x", got)
+			}
+			if string(out[0:6]) != string(p[6:12]) || string(out[6:12]) != string(p[0:6]) {
+				t.Fatal("macs are not swapped")
+			}
+			if string(out[offIPSrc:offIPDst]) != string(p[offIPDst:offIPDst+4]) {
+				t.Fatal("ips are not swapped")
+			}
+			if binary.BigEndian.Uint16(out[offUDPDst:]) != 40000 || int(binary.BigEndian.Uint16(out[offUDPLen:])) != len(out)-offUDPSrc {
+				t.Fatal("invalid udp header")
+			}
+
+			resp := new(dns.Msg)
+			if err := resp.Unpack(out[offDNS:]); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Id != 0x1234 || !resp.Response || len(resp.Answer) != 2 {
+				t.Fatalf("unexpected response %v", resp)
+			}
+			if ttl := resp.Answer[0].Header().Ttl; ttl > 300 || ttl < 299 {
+				t.Fatalf("unexpected ttl %d", ttl)
+			}
+			if ttl := resp.Answer[1].Header().Ttl; ttl > 400 || ttl < 399 {
+				t.Fatalf("unexpected ttl %d", ttl)
+			}
+			if opt := resp.IsEdns0(); (opt != nil) != tt.edns || (tt.edns && !opt.Do()) {
+				t.Fatalf("unexpected opt %v", opt)
+			}
+		})
+	}
+
+	hits, err := r.Hits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits != 2 {
+		t.Fatalf("want 2 hits, got %d", hits)
+	}
+
+	t.Run("elapsed", func(t *testing.T) {
+		q := new(dns.Msg)
+		q.SetQuestion("elapsed.example.com.", dns.TypeA)
+		k, v, ok := newEntry(q, testResponse(q, 300), monotonicNow()-10e9)
+		if !ok {
+			t.Fatal("entry is not built")
+		}
+		if err := r.entries.Update(&k, &v, ebpf.UpdateAny); err != nil {
+			t.Fatal(err)
+		}
+		ret, out := run(t, r, queryPacket(t, q))
+		if ret != xdpTx {
+			t.Fatalf("want XDP_TX, got %d", ret)
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(out[offDNS : offIP+int(binary.BigEndian.Uint16(out[offIPLen:]))]); err != nil {
+			t.Fatal(err)
+		}
+		if ttl := resp.Answer[0].Header().Ttl; ttl > 290 || ttl < 289 {
+			t.Fatalf("unexpected ttl %d", ttl)
+		}
+
+		k, v, _ = newEntry(q, testResponse(q, 300), monotonicNow()-300e9)
+		if err := r.entries.Update(&k, &v, ebpf.UpdateAny); err != nil {
+			t.Fatal(err)
+		}
+		if ret, _ := run(t, r, queryPacket(t, q)); ret != xdpPass {
+			t.Fatalf("expired: want XDP_PASS, got %d", ret)
+		}
+	})
+
+	t.Run("pass", func(t *testing.T) {
+		miss := func(m func(q *dns.Msg)) *dns.Msg {
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			m(q)
+			return q
+		}
+		for name, q := range map[string]*dns.Msg{
+			"not stored":  miss(func(q *dns.Msg) { q.Question[0].Name = "example.org." }),
+			"other type":  miss(func(q *dns.Msg) { q.Question[0].Qtype = dns.TypeAAAA }),
+			"other case":  miss(func(q *dns.Msg) { q.Question[0].Name = "Example.com." }),
+			"other flags": miss(func(q *dns.Msg) { q.CheckingDisabled = true }),
+			"edns0":       miss(func(q *dns.Msg) { q.SetEdns0(1232, false) }),
+			"edns0 options": miss(func(q *dns.Msg) {
+				q.SetEdns0(1232, false)
+				q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+			}),
+			"response": miss(func(q *dns.Msg) { q.Response = true }),
+			"answer":   miss(func(q *dns.Msg) { q.Answer = testResponse(q, 1).Answer }),
+		} {
+			if ret, _ := run(t, r, queryPacket(t, q)); ret != xdpPass {
+				t.Errorf("%s: want XDP_PASS, got %d", name, ret)
+			}
+		}
+
+		p := queryPacket(t, q)
+		binary.BigEndian.PutUint16(p[offUDPDst:], 5353)
+		if ret, _ := run(t, r, p); ret != xdpPass {
+			t.Errorf("other port: want XDP_PASS, got %d", ret)
+		}
+		p = queryPacket(t, q)
+		p = append(p, 0)
+		if ret, _ := run(t, r, p); ret != xdpPass {
+			t.Errorf("trailing data: want XDP_PASS, got %d", ret)
+		}
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		if err := r.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if ret, _ := run(t, r, queryPacket(t, q)); ret != xdpPass {
+			t.Fatalf("want XDP_PASS, got %d", ret)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+//go:build !linux || !xdp
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xdp
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Responder is not supported on this platform or without the xdp build
+// tag. New always returns ErrNotSupported.
+type Responder struct{}
+
+func New(opts Opts) (*Responder, error) {
+	return nil, ErrNotSupported
+}
+
+func (r *Responder) Store(q, resp *dns.Msg) error { return nil }
+func (r *Responder) Flush() error                 { return nil }
+func (r *Responder) Hits() (uint64, error)        { return 0, nil }
+func (r *Responder) Close() error                 { return nil }
@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package xdp answers udp queries of cached responses in the kernel with
+// an XDP program, before they reach the server. Queries that the program
+// cannot answer are passed to the kernel stack as usual.
+//
+// The program only answers ipv4 udp queries of one question, without
+// EDNS0 options, whose names are stored in lower case, and whose responses
+// fit in 512 bytes. The ttls of the responses are reduced by the time they
+// have been stored, like the cache hits. XDP is Linux only, and mosdns
+// must be built with the "xdp" tag.
+package xdp
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+const (
+	maxNameLen = 96  // max wire length of the names of stored queries
+	maxMsgSize = 512 // max size of stored responses
+	maxTTLs    = 16  // max number of records of stored responses
+
+	defaultMaxEntries = 65536
+)
+
+// Bits of entryKey.Flags.
+const (
+	flagEDNS0 = 1 << iota
+	flagDO
+	flagCD
+)
+
+// EDNS0 udp size of the responses of queries with EDNS0.
+const responseUDPSize = 1232
+
+var ErrNotSupported = errors.New("xdp is not supported, it needs linux and the xdp build tag")
+
+type Opts struct {
+	// Iface is the network interface that the program is attached to.
+	Iface string
+	// Port is the udp port of the queries. Default is 53.
+	Port uint16
+	// MaxEntries is the max number of stored responses. The least
+	// recently used ones are evicted. Default is 65536.
+	MaxEntries int
+}
+
+// entryKey is the key of a stored response. It is built by the program
+// from the query packet.
+type entryKey struct {
+	Name  [maxNameLen]byte // wire format, zero padded
+	Qtype [2]byte          // big endian, as in the query
+	Flags uint8
+	_     uint8
+}
+
+// entryValue is a stored response. The layout must match the offsets
+// used by the program.
+type entryValue struct {
+	ExpireNs   uint64 // CLOCK_MONOTONIC
+	StoredNs   uint64
+	Len        uint16
+	NTTL       uint16
+	TTLOffsets [maxTTLs]uint16
+	_          [4]byte
+	Msg        [maxMsgSize]byte
+}
+
+// newEntry returns the entry of the response r of query q, or ok is false
+// if the program cannot answer q with r. nowNs is the current
+// CLOCK_MONOTONIC time.
+func newEntry(q, r *dns.Msg, nowNs uint64) (k entryKey, v entryValue, ok bool) {
+	if len(q.Question) != 1 || len(r.Question) != 1 || r.Truncated {
+		return k, v, false
+	}
+	question := q.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return k, v, false
+	}
+	n, err := dns.PackDomainName(question.Name, k.Name[:], 0, nil, false)
+	if err != nil || n > maxNameLen {
+		return k, v, false
+	}
+	for _, c := range k.Name[:n] {
+		if c >= 'A' && c <= 'Z' {
+			return k, v, false // the program does not lower the case of queries
+		}
+	}
+	k.Qtype = [2]byte{byte(question.Qtype >> 8), byte(question.Qtype)}
+	if q.CheckingDisabled {
+		k.Flags |= flagCD
+	}
+
+	resp := r.Copy()
+	resp.Id = 0
+	resp.Compress = true
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+	if opt := q.IsEdns0(); opt != nil {
+		if len(opt.Option) > 0 {
+			return k, v, false // e.g. ecs, the response may be specific to it
+		}
+		k.Flags |= flagEDNS0
+		if opt.Do() {
+			k.Flags |= flagDO
+		}
+		resp.SetEdns0(responseUDPSize, opt.Do())
+	}
+
+	ttl := dnsutils.GetMinimalTTL(resp)
+	if ttl == 0 {
+		return k, v, false
+	}
+	b, err := resp.Pack()
+	if err != nil || len(b) > maxMsgSize {
+		return k, v, false
+	}
+	offsets, err := dnsutils.TTLOffsets(b)
+	if err != nil || len(offsets) > maxTTLs {
+		return k, v, false
+	}
+
+	v.StoredNs = nowNs
+	v.ExpireNs = nowNs + uint64(ttl)*1e9
+	v.Len = uint16(len(b))
+	v.NTTL = uint16(len(offsets))
+	copy(v.TTLOffsets[:], offsets)
+	copy(v.Msg[:], b)
+	return k, v, true
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xdp
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_newEntry(t *testing.T) {
+	newQ := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeAAAA)
+		return q
+	}
+	newR := func(q *dns.Msg, ttl uint32, n int) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		for i := 0; i < n; i++ {
+			r.Answer = append(r.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: net.ParseIP("2001:db8::1"),
+			})
+		}
+		return r
+	}
+
+	q := newQ("example.com.")
+	q.CheckingDisabled = true
+	q.SetEdns0(4096, true)
+	r := newR(q, 300, 2)
+	k, v, ok := newEntry(q, r, 1e9)
+	if !ok {
+		t.Fatal("entry is not built")
+	}
+	if k.Name[0] != 7 || string(k.Name[1:8]) != "example" || k.Name[13] != 0 {
+		t.Fatalf("unexpected key name %v", k.Name[:14])
+	}
+	if binary.BigEndian.Uint16(k.Qtype[:]) != dns.TypeAAAA || k.Flags != flagEDNS0|flagDO|flagCD {
+		t.Fatalf("unexpected key %+v", k)
+	}
+	if v.StoredNs != 1e9 || v.ExpireNs != 301e9 || v.NTTL != 2 {
+		t.Fatalf("unexpected value %d %d %d", v.StoredNs, v.ExpireNs, v.NTTL)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(v.Msg[:v.Len]); err != nil {
+		t.Fatal(err)
+	}
+	if opt := resp.IsEdns0(); opt == nil || opt.UDPSize() != responseUDPSize || !opt.Do() {
+		t.Fatalf("unexpected opt %v", opt)
+	}
+	for _, off := range v.TTLOffsets[:v.NTTL] {
+		if binary.BigEndian.Uint32(v.Msg[off:]) != 300 {
+			t.Fatalf("invalid ttl offset %d", off)
+		}
+	}
+
+	ecs := newQ("example.com.")
+	ecs.SetEdns0(1232, false)
+	ecs.IsEdns0().Option = append(ecs.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(1, 2, 3, 0)})
+	upper := newQ("Example.com.")
+	long := newQ(strings.Repeat("a.", 48))
+	large := newR(q, 300, 1)
+	large.Answer = append(large.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+		Txt: []string{strings.Repeat("a", 255), strings.Repeat("b", 255)},
+	})
+	truncated := newR(newQ("example.com."), 300, 1)
+	truncated.Truncated = true
+	for name, tt := range map[string][2]*dns.Msg{
+		"edns0 options": {ecs, newR(ecs, 300, 1)},
+		"upper case":    {upper, newR(upper, 300, 1)},
+		"long name":     {long, newR(long, 300, 1)},
+		"zero ttl":      {q, newR(q, 0, 1)},
+		"large":         {q, large},
+		"too many ttls": {q, newR(q, 300, maxTTLs+1)},
+		"truncated":     {newQ("example.com."), truncated},
+	} {
+		if _, _, ok := newEntry(tt[0], tt[1], 0); ok {
+			t.Errorf("%s: entry should not be built", name)
+		}
+	}
+}
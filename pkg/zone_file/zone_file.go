@@ -22,10 +22,15 @@ package zone_file
 import (
 	"io"
 	"os"
+	"slices"
+	"strings"
 
 	"github.com/miekg/dns"
 )
 
+// maxCNAMEChain is the max number of CNAMEs that Reply follows.
+const maxCNAMEChain = 8
+
 type Matcher struct {
 	m map[dns.Question][]dns.RR
 }
@@ -54,7 +59,7 @@ func (m *Matcher) Load(r io.Reader) error {
 		}
 		h := rr.Header()
 		q := dns.Question{
-			Name:   h.Name,
+			Name:   strings.ToLower(h.Name),
 			Qtype:  h.Rrtype,
 			Qclass: h.Class,
 		}
@@ -67,10 +72,13 @@ func (m *Matcher) Search(q dns.Question) []dns.RR {
 	return m.m[q]
 }
 
+// Reply returns a response of q with the records of its questions, or nil
+// if there are no records. If a name has no records of the qtype but has a
+// CNAME, the CNAME and the records of its target are used.
 func (m *Matcher) Reply(q *dns.Msg) *dns.Msg {
 	var r *dns.Msg
 	for _, question := range q.Question {
-		rr := m.Search(question)
+		rr := m.lookup(question)
 		if rr != nil {
 			if r == nil {
 				r = new(dns.Msg)
@@ -81,3 +89,31 @@ func (m *Matcher) Reply(q *dns.Msg) *dns.Msg {
 	}
 	return r
 }
+
+// lookup returns the records of q. If there are none, it follows the
+// CNAMEs of the name in m and returns them, followed by the records of
+// the last target if there are. A CNAME loop stops at the first target
+// that is already in the chain.
+func (m *Matcher) lookup(q dns.Question) []dns.RR {
+	if rr := m.m[q]; rr != nil || q.Qtype == dns.TypeCNAME {
+		return rr
+	}
+	var chain []dns.RR
+	visited := []string{strings.ToLower(q.Name)}
+	for range maxCNAMEChain {
+		rr := m.m[dns.Question{Name: q.Name, Qtype: dns.TypeCNAME, Qclass: q.Qclass}]
+		if len(rr) == 0 {
+			break
+		}
+		chain = append(chain, rr[0])
+		q.Name = strings.ToLower(rr[0].(*dns.CNAME).Target)
+		if slices.Contains(visited, q.Name) {
+			break
+		}
+		visited = append(visited, q.Name)
+		if rr := m.m[q]; rr != nil {
+			return append(chain, rr...)
+		}
+	}
+	return chain
+}
@@ -30,6 +30,11 @@ const data = `
 $TTL 3600
 example.com.  IN  A     192.0.2.1
 1.example.com.  IN  AAAA     2001:db8:10::1
+www.example.com.  IN  CNAME     Example.com.
+txt.example.com.  IN  TXT     "hello"
+loop.example.com.  IN  CNAME     loop.example.com.
+loop1.example.com. IN  CNAME     loop2.example.com.
+loop2.example.com. IN  CNAME     LOOP1.example.com.
 `
 
 func TestMatcher(t *testing.T) {
@@ -59,3 +64,44 @@ func TestMatcher(t *testing.T) {
 		t.Fatalf("want ip 2001:db8:10::1, got %s", got)
 	}
 }
+
+func TestMatcher_CNAME(t *testing.T) {
+	m := new(Matcher)
+	if err := m.Load(strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	r := m.Reply(q)
+	if r == nil || len(r.Answer) != 2 {
+		t.Fatalf("want cname and a, got %v", r)
+	}
+	if _, ok := r.Answer[0].(*dns.CNAME); !ok {
+		t.Fatalf("want cname first, got %s", r.Answer[0])
+	}
+	if got := r.Answer[1].(*dns.A).A.String(); got != "192.0.2.1" {
+		t.Fatalf("want ip 192.0.2.1, got %s", got)
+	}
+
+	// The target has no AAAA, so only the cname is answered.
+	q.SetQuestion("www.example.com.", dns.TypeAAAA)
+	if r := m.Reply(q); r == nil || len(r.Answer) != 1 {
+		t.Fatalf("want cname only, got %v", r)
+	}
+
+	// Loops stop at the first repeated name.
+	q.SetQuestion("loop.example.com.", dns.TypeA)
+	if r := m.Reply(q); r == nil || len(r.Answer) != 1 {
+		t.Fatalf("want a single cname, got %v", r)
+	}
+	q.SetQuestion("loop1.example.com.", dns.TypeA)
+	if r := m.Reply(q); r == nil || len(r.Answer) != 2 {
+		t.Fatalf("want 2 cnames, got %v", r)
+	}
+
+	q.SetQuestion("txt.example.com.", dns.TypeA)
+	if r := m.Reply(q); r != nil {
+		t.Fatalf("want no reply, got %v", r)
+	}
+}
@@ -25,23 +25,28 @@ import (
 	_ "github.com/pmkol/mosdns-x/plugin/executable/blackhole"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/bufsize"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/cache"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/cache_warmup"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/client_limiter"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/dual_selector"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/ecs"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/edns0_filter"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/fast_forward"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/hosts"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/ip_rewrite"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/ipset"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/marker"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/metrics_collector"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/misc_optm"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/nftset"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/no_cname"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/nptv6"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/padding"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/query_summary"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/rate_limit"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/redirect"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/reject_any"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/reverse_lookup"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/rpz"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/sequence"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/sleep"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/ttl"
@@ -20,11 +20,16 @@
 package arbitrary
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
 
 	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/data_provider"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 	"github.com/pmkol/mosdns-x/pkg/zone_file"
@@ -36,6 +41,13 @@ func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
 }
 
+// Args of arbitrary. RR is records in the zone file format, e.g.
+// "example.com. 300 IN TXT hello", or zone files of data providers, e.g.
+// "provider:my_zone", which are reloaded if the providers are. Records
+// without a ttl have a ttl of 3600. Queries of names that have a CNAME
+// but no records of the qtype are answered with the CNAME and the records
+// of its target in the same zone. The inline records are one zone and are
+// searched first, then the files in order.
 type Args struct {
 	RR []string `yaml:"rr"`
 }
@@ -44,29 +56,90 @@ var _ coremain.ExecutablePlugin = (*arbitraryPlugin)(nil)
 
 type arbitraryPlugin struct {
 	*coremain.BP
-	m *zone_file.Matcher
+	m       *zone_file.Matcher
+	dynamic []*dynamicZone
+	closers []func()
 }
 
 func (p *arbitraryPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
-	if r := p.m.Reply(qCtx.Q()); r != nil {
-		qCtx.SetResponse(r)
+	if r := p.reply(qCtx); r != nil {
+		// The records of r are shared with the zone.
+		qCtx.SetSharedResponse(r)
 		return nil
 	}
 	return executable_seq.ExecChainNode(ctx, qCtx, next)
 }
 
+func (p *arbitraryPlugin) reply(qCtx *query_context.Context) *dns.Msg {
+	if r := p.m.Reply(qCtx.Q()); r != nil {
+		return r
+	}
+	for _, z := range p.dynamic {
+		if m := z.m.Load(); m != nil {
+			if r := m.Reply(qCtx.Q()); r != nil {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+func (p *arbitraryPlugin) Close() error {
+	for _, f := range p.closers {
+		f()
+	}
+	return nil
+}
+
 func Init(bp *coremain.BP, v interface{}) (p coremain.Plugin, err error) {
 	args := v.(*Args)
-	m := new(zone_file.Matcher)
-
-	// TODO: Support data provider
+	ap := &arbitraryPlugin{
+		BP: bp,
+		m:  new(zone_file.Matcher),
+	}
 	for i, s := range args.RR {
-		if err := m.Load(strings.NewReader(s)); err != nil {
+		if providerTag, ok := strings.CutPrefix(s, "provider:"); ok {
+			if err := ap.loadProvider(providerTag, bp.M().GetDataManager()); err != nil {
+				ap.Close()
+				return nil, err
+			}
+			continue
+		}
+		if err := ap.m.Load(strings.NewReader(s)); err != nil {
+			ap.Close()
 			return nil, fmt.Errorf("failed to load rr #%d [%s], %w", i, s, err)
 		}
 	}
-	return &arbitraryPlugin{
-		BP: bp,
-		m:  m,
-	}, nil
+	return ap, nil
+}
+
+func (p *arbitraryPlugin) loadProvider(tag string, dm *data_provider.DataManager) error {
+	provider := dm.GetDataProvider(tag)
+	if provider == nil {
+		return fmt.Errorf("cannot find provider %s", tag)
+	}
+	z := new(dynamicZone)
+	if err := provider.LoadAndAddListener(z); err != nil {
+		return fmt.Errorf("failed to load data from provider %s, %w", tag, err)
+	}
+	p.dynamic = append(p.dynamic, z)
+	p.closers = append(p.closers, func() {
+		provider.DeleteListener(z)
+	})
+	return nil
+}
+
+// dynamicZone is a zone file of a data provider.
+type dynamicZone struct {
+	m atomic.Pointer[zone_file.Matcher]
+}
+
+// Update implements data_provider.DataListener.
+func (z *dynamicZone) Update(b []byte) error {
+	m := new(zone_file.Matcher)
+	if err := m.Load(bytes.NewReader(b)); err != nil {
+		return err
+	}
+	z.m.Store(m)
+	return nil
 }
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/cache"
+)
+
+// ServeHTTP serves the cache api.
+// POST flush: deletes all entries.
+// POST flush?domain=example.com: deletes the entries of the exact domain.
+// POST flush?suffix=example.com: deletes the entries of the domain and
+// its subdomains.
+// domain and suffix can be repeated and combined, an entry is deleted if
+// it matches any of them.
+func (c *cachePlugin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasSuffix(req.URL.Path, "/flush") {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	f, ok := c.backend.(cache.Flusher)
+	if !ok {
+		http.Error(w, "cache backend does not support flush", http.StatusNotImplemented)
+		return
+	}
+	query := req.URL.Query()
+	match := c.newFlushMatcher(query["domain"], query["suffix"])
+	n, err := f.Flush(req.Context(), match)
+	if c.xdp != nil {
+		// The xdp program has no index of names, all of its responses are
+		// deleted.
+		if err := c.xdp.Flush(); err != nil {
+			c.L().Warn("failed to flush xdp", zap.Error(err))
+		}
+	}
+	if err != nil {
+		c.L().Warn("failed to flush cache", zap.Int("flushed", n), zap.Error(err))
+		http.Error(w, fmt.Sprintf("flushed %d entries, %s", n, err), http.StatusInternalServerError)
+		return
+	}
+	c.L().Info("cache flushed", zap.Strings("domain", query["domain"]), zap.Strings("suffix", query["suffix"]), zap.Int("flushed", n))
+	fmt.Fprintf(w, "ok, %d entries flushed\n", n)
+}
+
+// newFlushMatcher returns a func that matches the cached responses by
+// their question names. It returns nil, which matches all, if both
+// domains and suffixes are empty.
+func (c *cachePlugin) newFlushMatcher(domains, suffixes []string) func(key uint64, v []byte) bool {
+	if len(domains) == 0 && len(suffixes) == 0 {
+		return nil
+	}
+	for i := range domains {
+		domains[i] = dns.Fqdn(domains[i])
+	}
+	for i := range suffixes {
+		suffixes[i] = dns.Fqdn(suffixes[i])
+	}
+	return func(_ uint64, v []byte) bool {
+		m, err := c.unpackMsg(v)
+		if err != nil || len(m.Question) == 0 {
+			return false
+		}
+		name := m.Question[0].Name
+		for _, d := range domains {
+			if strings.EqualFold(name, d) {
+				return true
+			}
+		}
+		for _, s := range suffixes {
+			if dns.IsSubDomain(s, name) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -2,23 +2,27 @@ package cache
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/miekg/dns"
-	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"golang.org/x/sync/singleflight"
 
 	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/allocaudit"
 	"github.com/pmkol/mosdns-x/pkg/cache"
+	"github.com/pmkol/mosdns-x/pkg/cache/bolt_cache"
 	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
 	"github.com/pmkol/mosdns-x/pkg/cache/redis_cache"
+	"github.com/pmkol/mosdns-x/pkg/cache/tiered_cache"
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/lru"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+	"github.com/pmkol/mosdns-x/pkg/xdp"
 )
 
 const (
@@ -34,19 +38,172 @@ func init() {
 }
 
 const (
-	defaultLazyUpdateTimeout = time.Second * 5
-	defaultEmptyAnswerTTL    = time.Second * 5
+	defaultLazyUpdateTimeout  = time.Second * 5
+	defaultEmptyAnswerTTL     = time.Second * 5
+	defaultStaleAnswerTimeout = 1800 // ms, rfc 8767 client response timer
+	defaultMaxNegativeTTL     = 300  // sec
 )
 
 var _ coremain.ExecutablePlugin = (*cachePlugin)(nil)
 
 type Args struct {
+	// If Size or MaxMemory and Redis or Disk are set, a memory cache is
+	// used in front of redis or the disk, and their hits are promoted to it.
 	Size              int    `yaml:"size"`
-	Redis             string `yaml:"redis"`
+	Redis             string `yaml:"redis"` // see redis_cache.NewClient
 	RedisTimeout      int    `yaml:"redis_timeout"`
 	LazyCacheTTL      int    `yaml:"lazy_cache_ttl"`
 	LazyCacheReplyTTL int    `yaml:"lazy_cache_reply_ttl"`
 	CleanerInterval   *int   `yaml:"cleaner_interval"`
+
+	// MaxMemory (MiB) bounds the memory used by the memory cache, in
+	// addition to Size. Zero means no limit. If it is set without Size,
+	// the number of entries is not limited.
+	MaxMemory int `yaml:"max_memory"`
+	// Eviction is the eviction policy of the memory cache, one of "lru"
+	// (default), "lfu", "arc" and "slru". The last three keep popular
+	// entries better than lru when many names are queried only once.
+	Eviction string `yaml:"eviction"`
+
+	// DebugInfo attaches an EDE (RFC 8914) option that reports the
+	// age and the remaining ttl of the cached response to cache hits.
+	// Only queries with EDNS0 will get it.
+	DebugInfo bool `yaml:"debug_info"`
+
+	// RedisStartDegraded starts the cache without waiting for redis.
+	// Redis is used once it becomes reachable.
+	RedisStartDegraded bool `yaml:"redis_start_degraded"`
+	// RedisFallbackSize enables an in-memory cache with this size that is
+	// used while redis is unavailable. Zero disables it.
+	RedisFallbackSize int `yaml:"redis_fallback_size"`
+	// RedisPrefix is prepended to redis keys, so multiple instances can
+	// share one redis db, and the flush api only deletes their own keys.
+	RedisPrefix string `yaml:"redis_prefix"`
+	// RedisWriteBehind (ms) queues redis stores and sends them in batches
+	// of up to RedisWriteBehindSize (default 256) every RedisWriteBehind,
+	// so queries do not wait for redis stores. Zero disables it.
+	RedisWriteBehind     int `yaml:"redis_write_behind"`
+	RedisWriteBehindSize int `yaml:"redis_write_behind_size"`
+
+	// Disk is the path of a db file to cache entries on the disk, for
+	// devices with little memory. It cannot be used with Redis. Expired
+	// entries are deleted every minute, and the entries that expire soonest
+	// are evicted if the size of the cached responses exceeds DiskMaxSize
+	// (MiB, default 64). The file is kept open across reloads. During an
+	// upgrade, the new process misses until the old one releases it.
+	Disk        string `yaml:"disk"`
+	DiskMaxSize int    `yaml:"disk_max_size"`
+
+	// PrefetchHits enables prefetch. Cached entries that are hit at least
+	// PrefetchHits times are refreshed in background when their remaining
+	// ttl is not more than PrefetchTTL (sec, default 10). PrefetchSize
+	// (default 1024) is the max number of entries whose hits are counted,
+	// the least hit one is replaced by new entries when it is full.
+	PrefetchHits int `yaml:"prefetch_hits"`
+	PrefetchTTL  int `yaml:"prefetch_ttl"`
+	PrefetchSize int `yaml:"prefetch_size"`
+
+	// Serve-stale (RFC 8767) options of the lazy cache.
+	// MaxStale (sec) bounds how long an answer can be served after it has
+	// expired. It defaults to lazy_cache_ttl, and enables the lazy cache
+	// with the same window if lazy_cache_ttl is not set.
+	// StaleIfError makes expired entries be refreshed before they are
+	// served. Stale answers are only served if the refresh fails, or takes
+	// more than StaleAnswerTimeout (ms, default 1800), in which case the
+	// refresh continues in background.
+	// StaleRefreshJitter (ms) delays the background refreshes of expired
+	// entries by a random time up to it, so entries that expire together
+	// are not refreshed in a burst. It is not used by StaleIfError.
+	MaxStale           int  `yaml:"max_stale"`
+	StaleIfError       bool `yaml:"stale_if_error"`
+	StaleAnswerTimeout int  `yaml:"stale_answer_timeout"`
+	StaleRefreshJitter int  `yaml:"stale_refresh_jitter"`
+
+	// Background updates of the lazy cache, serve-stale and prefetch are
+	// run by up to LazyUpdateWorkers (default 32) goroutines. Pending
+	// updates wait in a queue of LazyUpdateQueue (default 1024). If it is
+	// full, the oldest update is dropped.
+	LazyUpdateWorkers int `yaml:"lazy_update_workers"`
+	LazyUpdateQueue   int `yaml:"lazy_update_queue"`
+
+	// ServfailTTL (sec) caches SERVFAIL responses and failed queries, e.g.
+	// upstream exchange errors, as SERVFAIL for this long (RFC 9520), so
+	// retries of clients do not hit a broken upstream. Zero disables it.
+	// Canceled, timed out and dropped queries are not cached. Failures
+	// never replace usable entries and are not served by the lazy cache.
+	ServfailTTL int `yaml:"servfail_ttl"`
+
+	// Negative responses (NODATA, and NXDOMAIN if CacheNXDomain) are cached
+	// for the ttl in their SOA records (RFC 2308), up to MaxNegativeTTL
+	// (sec, default 300). Responses without SOA are cached for 5s.
+	// NXDOMAIN is not cached by default, see tryStoreMsg.
+	CacheNXDomain  bool `yaml:"cache_nxdomain"`
+	MaxNegativeTTL int  `yaml:"max_negative_ttl"`
+
+	// TTL and TTLRules override the ttls of responses by the query name
+	// before they are cached. A TTL rule is "pattern ttl" or "pattern
+	// min_ttl max_ttl", e.g. "full:ddns.example.com 30". Patterns without
+	// a prefix are full matches. TTL rules are matched before TTLRules,
+	// and the first matched rule is used.
+	TTL      []string  `yaml:"ttl"`
+	TTLRules []TTLRule `yaml:"ttl_rules"`
+
+	// MinTTL and MaxTTL (sec) clamp the ttls of responses that match no
+	// TTL rule before they are cached, so clients get the clamped ttls
+	// too. e.g. MinTTL extends the tiny ttls of CDNs. Zero means no limit.
+	MinTTL uint32 `yaml:"min_ttl"`
+	MaxTTL uint32 `yaml:"max_ttl"`
+
+	// Compress compresses cached messages, which saves memory and redis
+	// storage at the cost of cpu. It can be "snappy" or "zstd". ZstdDict is
+	// an optional zstd dictionary file, which can be trained from dns wire
+	// messages by `zstd --train`. Cached entries are not readable after
+	// these options are changed, they are cache misses and will be replaced.
+	Compress string `yaml:"compress"`
+	ZstdDict string `yaml:"zstd_dict"`
+
+	// Cache keys include the DO and CD bits of queries. DNSSECKeyOptOut is
+	// the qtypes whose keys do not, so clients with and without DNSSEC
+	// share their entries. KeyPayloadClass makes keys include the class of
+	// the udp payload size of queries, see payloadClass.
+	// Keys of queries with ECS include the subnet of ECS, so per-subnet
+	// answers are cached for each subnet. To share entries among the
+	// clients of a subnet, add ECS with a fixed mask, e.g. by the ecs
+	// plugin with mask4 24, before the cache. Or remove ECS, e.g. by
+	// _no_ecs, if the upstreams do not use it.
+	DNSSECKeyOptOut []uint16 `yaml:"dnssec_key_opt_out"`
+	KeyPayloadClass bool     `yaml:"key_payload_class"`
+
+	// NoStore is a condition of matcher tags, in the syntax of the "if"
+	// of sequences, e.g. "bogus_ip || !has_answer". Responses that match
+	// it are not cached. Matchers are run after the response is received,
+	// so response matchers can be used.
+	NoStore string `yaml:"no_store"`
+
+	// ClientGroups partition the cache into views of client groups, e.g.
+	// filtered and unfiltered clients. A query belongs to the first group
+	// whose condition it matches, and only gets the answers cached for
+	// the queries of the same group. Queries of no group share a view.
+	ClientGroups []ClientGroup `yaml:"client_groups"`
+
+	// Singleflight collapses concurrent misses of the same entry. Only one
+	// of the queries runs the rest of the sequence, and the others get a
+	// copy of its response.
+	Singleflight bool `yaml:"singleflight"`
+
+	// XDP answers the udp queries of fresh cached responses in the kernel,
+	// see package xdp. It needs linux and mosdns built with the "xdp" tag.
+	// The answers bypass the server, e.g. its allowed clients and limits,
+	// and the whole sequence, so only use it if the cache is the first
+	// plugin that the queries of the server run. It cannot be used with
+	// ClientGroups. A flush api call deletes all of its responses.
+	XDP *XDPArgs `yaml:"xdp"`
+}
+
+type XDPArgs struct {
+	Iface      string `yaml:"iface"`       // Required.
+	Port       uint16 `yaml:"port"`        // Default is 53.
+	MaxEntries int    `yaml:"max_entries"` // Default is 65536.
 }
 
 type cachePlugin struct {
@@ -56,14 +213,35 @@ type cachePlugin struct {
 	lazyEnabled   bool
 	lazyWindowSec int64
 	lazyReplyTTL  uint32
+	debugInfo     bool
+
+	maxStaleSec        int64
+	staleIfError       bool
+	staleAnswerTimeout time.Duration
+	staleRefreshJitter int // ms
+
+	servfailTTL int64
+
+	cacheNXDomain  bool
+	maxNegativeTTL uint32
+
+	ttlRules *ttlRules // nil if there is no rule
+	codec    msgCodec  // nil if no compression
+
+	dnssecKeyOptOut map[uint16]struct{}
+	keyPayloadClass bool
+
+	noStore      executable_seq.Matcher // nil if no_store is not set
+	clientGroups []clientGroup
+
+	missGroup *singleflight.Group // nil if singleflight is disabled
+	xdp       *xdp.Responder      // nil if xdp is disabled
 
-	backend      cache.Backend
-	lazyUpdateSF singleflight.Group
+	backend     cache.Backend
+	updateQueue *updateQueue
+	prefetcher  *prefetcher // nil if prefetch is disabled
 
-	queryTotal   prometheus.Counter
-	hitTotal     prometheus.Counter
-	lazyHitTotal prometheus.Counter
-	size         prometheus.GaugeFunc
+	metrics metrics
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -77,187 +255,435 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 	if args.LazyCacheReplyTTL <= 0 {
 		args.LazyCacheReplyTTL = 5
 	}
+	if args.MaxStale < 0 {
+		return nil, fmt.Errorf("max_stale must >= 0")
+	}
+	if args.LazyCacheTTL == 0 {
+		args.LazyCacheTTL = args.MaxStale
+	}
+	if args.StaleAnswerTimeout <= 0 {
+		args.StaleAnswerTimeout = defaultStaleAnswerTimeout
+	}
+	if args.MaxNegativeTTL <= 0 {
+		args.MaxNegativeTTL = defaultMaxNegativeTTL
+	}
+	if args.ServfailTTL < 0 {
+		return nil, fmt.Errorf("servfail_ttl must >= 0")
+	}
+	if args.PrefetchHits < 0 {
+		return nil, fmt.Errorf("prefetch_hits must >= 0")
+	}
+	if args.PrefetchTTL <= 0 {
+		args.PrefetchTTL = defaultPrefetchTTL
+	}
+	if args.PrefetchSize <= 0 {
+		args.PrefetchSize = defaultPrefetchSize
+	}
+	if args.LazyUpdateWorkers <= 0 {
+		args.LazyUpdateWorkers = defaultLazyUpdateWorkers
+	}
+	if args.LazyUpdateQueue <= 0 {
+		args.LazyUpdateQueue = defaultLazyUpdateQueue
+	}
 
+	cleanerSec := 60
+	if args.CleanerInterval != nil {
+		cleanerSec = *args.CleanerInterval
+	}
+	var cleanerInterval time.Duration
+	if cleanerSec > 0 {
+		cleanerInterval = time.Duration(cleanerSec) * time.Second
+	}
+
+	codec, err := newMsgCodec(args.Compress, args.ZstdDict)
+	if err != nil {
+		return nil, err
+	}
+	ttlRules, err := newTTLRules(args.TTL, args.TTLRules, args.MinTTL, args.MaxTTL, bp.M().GetDataManager())
+	if err != nil {
+		return nil, err
+	}
+	var noStore executable_seq.Matcher
+	if len(args.NoStore) != 0 {
+		noStore, err = executable_seq.ParseConditionMatcher(bp.L().Named("no_store"), args.NoStore, bp.M().GetMatchers())
+		if err != nil {
+			return nil, fmt.Errorf("invalid no_store, %w", err)
+		}
+	}
+	clientGroups, err := newClientGroups(args.ClientGroups, bp.L().Named("client_groups"), bp.M().GetMatchers())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args.Redis) != 0 && len(args.Disk) != 0 {
+		return nil, errors.New("redis and disk cannot be both set")
+	}
+	if args.XDP != nil {
+		if len(args.XDP.Iface) == 0 {
+			return nil, errors.New("xdp iface is required")
+		}
+		if len(args.ClientGroups) != 0 {
+			return nil, errors.New("xdp and client_groups cannot be both set")
+		}
+	}
 	var c cache.Backend
 	if len(args.Redis) != 0 {
-		opt, err := redis.ParseURL(args.Redis)
+		r, err := redis_cache.NewClient(args.Redis, -1)
 		if err != nil {
 			return nil, fmt.Errorf("invalid redis url, %w", err)
 		}
-		opt.MaxRetries = -1
-		r := redis.NewClient(opt)
 		rcOpts := redis_cache.RedisCacheOpts{
 			Client:        r,
 			ClientCloser:  r,
 			ClientTimeout: time.Duration(args.RedisTimeout) * time.Millisecond,
 			Logger:        bp.L(),
+			StartDisabled: args.RedisStartDegraded,
+			KeyPrefix:     args.RedisPrefix,
+
+			WriteBehindInterval: time.Duration(args.RedisWriteBehind) * time.Millisecond,
+			WriteBehindSize:     args.RedisWriteBehindSize,
+		}
+		if args.RedisFallbackSize > 0 {
+			rcOpts.Fallback = mem_cache.NewMemCache(args.RedisFallbackSize, cleanerInterval)
 		}
 		rc, err := redis_cache.NewRedisCache(rcOpts)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init redis cache, %w", err)
 		}
 		c = rc
-	} else {
-		cleanerSec := 60
-		if args.CleanerInterval != nil {
-			cleanerSec = *args.CleanerInterval
+	} else if len(args.Disk) != 0 {
+		bc, err := bolt_cache.NewBoltCache(bolt_cache.BoltCacheOpts{
+			Path:    args.Disk,
+			MaxSize: int64(args.DiskMaxSize) << 20,
+			Logger:  bp.L(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to init disk cache, %w", err)
+		}
+		c = bc
+	}
+	if c == nil || args.Size > 0 || args.MaxMemory > 0 {
+		mc, err := mem_cache.NewMemCacheWithOpts(mem_cache.MemCacheOpts{
+			Size:            args.Size,
+			MaxBytes:        args.MaxMemory << 20,
+			CleanerInterval: cleanerInterval,
+			Policy:          lru.Policy(args.Eviction),
+		})
+		if err != nil {
+			if c != nil {
+				_ = c.Close()
+			}
+			return nil, err
+		}
+		if c == nil {
+			c = mc
+		} else {
+			c = tiered_cache.NewTieredCache(mc, c)
 		}
-		var interval time.Duration
-		if cleanerSec > 0 {
-			interval = time.Duration(cleanerSec) * time.Second
+	}
+
+	var xr *xdp.Responder
+	if args.XDP != nil {
+		xr, err = xdp.New(xdp.Opts{Iface: args.XDP.Iface, Port: args.XDP.Port, MaxEntries: args.XDP.MaxEntries})
+		if err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("failed to init xdp, %w", err)
 		}
-		c = mem_cache.NewMemCache(args.Size, interval)
 	}
 
 	p := &cachePlugin{
 		BP:      bp,
 		backend: c,
+		xdp:     xr,
 
 		lazyEnabled:   args.LazyCacheTTL > 0,
 		lazyWindowSec: int64(args.LazyCacheTTL),
 		lazyReplyTTL:  uint32(args.LazyCacheReplyTTL),
+		debugInfo:     args.DebugInfo,
 
-		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "query_total",
-			Help: "The total number of processed queries",
-		}),
-		hitTotal: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "hit_total",
-			Help: "The total number of queries that hit the cache",
-		}),
-		lazyHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "lazy_hit_total",
-			Help: "The total number of queries that hit the expired cache",
-		}),
-		size: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
-			Name: "cache_size",
-			Help: "Current cache size in records",
-		}, func() float64 {
-			return float64(c.Len())
-		}),
-	}
-	bp.GetMetricsReg().MustRegister(p.queryTotal, p.hitTotal, p.lazyHitTotal, p.size)
+		maxStaleSec:        int64(args.MaxStale),
+		staleIfError:       args.StaleIfError,
+		staleAnswerTimeout: time.Duration(args.StaleAnswerTimeout) * time.Millisecond,
+		staleRefreshJitter: args.StaleRefreshJitter,
+
+		servfailTTL: int64(args.ServfailTTL),
+
+		cacheNXDomain:  args.CacheNXDomain,
+		maxNegativeTTL: uint32(args.MaxNegativeTTL),
+
+		ttlRules: ttlRules,
+		codec:    codec,
+
+		dnssecKeyOptOut: make(map[uint16]struct{}, len(args.DNSSECKeyOptOut)),
+		keyPayloadClass: args.KeyPayloadClass,
+
+		noStore:      noStore,
+		clientGroups: clientGroups,
+	}
+	if args.Singleflight {
+		p.missGroup = new(singleflight.Group)
+	}
+	for _, qtype := range args.DNSSECKeyOptOut {
+		p.dnssecKeyOptOut[qtype] = struct{}{}
+	}
+	p.updateQueue = newUpdateQueue(args.LazyUpdateWorkers, args.LazyUpdateQueue, p.runBackgroundUpdate)
+	bp.GetMetricsReg().MustRegister(p.metrics.collectors(c, p.updateQueue, xr)...)
+	if args.PrefetchHits > 0 {
+		p.prefetcher = newPrefetcher(args.PrefetchHits, int64(args.PrefetchTTL), args.PrefetchSize, p.doPrefetch)
+	}
 	return p, nil
 }
 
 func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
-	c.queryTotal.Inc()
+	if qCtx.HasMark(noCacheMark) {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	c.metrics.query.Add(1)
 	q := qCtx.Q()
 
 	nowUnix := time.Now().Unix()
-	msgKey := dnsutils.GetMsgHash(q, 0)
-	cachedResp, lazyHit, err := c.lookupCache(msgKey, nowUnix)
+	salt, err := c.msgKeySalt(ctx, qCtx)
 	if err != nil {
-		c.L().Error("lookup cache", qCtx.InfoField(), zap.Error(err))
+		c.L().Warn("bypass cache", qCtx.InfoField(), zap.Error(err))
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	msgKey := dnsutils.GetMsgHash(q, salt)
+	cachedResp, lazyHit, storedTimeUnix, dnsExpireAtUnix := c.lookupCache(msgKey, nowUnix)
+
+	if cachedResp != nil && lazyHit && c.staleIfError {
+		if r := c.refreshExpired(ctx, msgKey, qCtx, next); r != nil {
+			r.Id = q.Id
+			qCtx.SetResponse(r)
+			return nil
+		}
+		if c.L().Core().Enabled(zap.DebugLevel) {
+			c.L().Debug("refresh failed or timed out, serving stale answer", qCtx.InfoField())
+		}
 	}
 
 	if cachedResp != nil {
 		if lazyHit {
-			c.lazyHitTotal.Inc()
-			c.doLazyUpdate(msgKey, qCtx, next)
+			c.metrics.lazyHit.Add(1)
+			if !c.staleIfError {
+				c.doLazyUpdate(msgKey, qCtx, next)
+			}
+		} else if c.prefetcher != nil {
+			c.prefetcher.hit(msgKey, dnsExpireAtUnix, qCtx, next)
 		}
-		c.hitTotal.Inc()
-		cachedResp.Id = q.Id
+		c.metrics.hit.Add(1)
+		dnsutils.SetRawID(cachedResp, q.Id)
 		if c.L().Core().Enabled(zap.DebugLevel) {
 			c.L().Debug("cache hit", qCtx.InfoField(), zap.Int64("now", nowUnix))
 		}
-		qCtx.SetResponse(cachedResp)
+		qCtx.SetRawResponse(cachedResp)
+		if c.debugInfo {
+			if r := qCtx.MutableR(); r != nil {
+				addCacheDebugInfo(q, r, nowUnix-storedTimeUnix, lazyHit)
+			}
+		}
 		return nil
 	}
 
 	if c.L().Core().Enabled(zap.DebugLevel) {
 		c.L().Debug("cache miss", qCtx.InfoField(), zap.Int64("now", nowUnix))
 	}
-	err = executable_seq.ExecChainNode(ctx, qCtx, next)
-	r := qCtx.R()
+	if c.missGroup != nil {
+		return c.execSharedMiss(ctx, msgKey, qCtx, next, nowUnix)
+	}
+	_, err = c.execMiss(ctx, msgKey, qCtx, next, nowUnix)
+	return err
+}
+
+// execMiss runs next for a cache miss and stores the response. It returns
+// the response of qCtx, which may be nil, and the error of next.
+func (c *cachePlugin) execMiss(ctx context.Context, msgKey uint64, qCtx *query_context.Context, next executable_seq.ExecutableChainNode, nowUnix int64) (*dns.Msg, error) {
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+	r := c.applyTTLRules(qCtx)
+	if c.skipStore(ctx, qCtx) {
+		return r, err
+	}
 	if r != nil {
 		if err := c.tryStoreMsg(msgKey, r, nowUnix); err != nil {
 			c.L().Error("cache store", qCtx.InfoField(), zap.Error(err))
 		}
+		c.storeXDP(qCtx.Q(), r)
 	}
-	return err
+	if c.servfailTTL > 0 && upstreamFailed(r, err) {
+		if err := c.storeServfail(msgKey, qCtx.Q(), nowUnix); err != nil {
+			c.L().Error("cache store", qCtx.InfoField(), zap.Error(err))
+		}
+	}
+	return r, err
 }
 
-func (c *cachePlugin) lookupCache(msgKey uint64, nowUnix int64) (r *dns.Msg, lazyHit bool, err error) {
+// lookupCache returns the packed cached response of msgKey, with its ttls
+// patched. dnsExpireAtUnix is when the dns ttl of the cached response
+// expires.
+func (c *cachePlugin) lookupCache(msgKey uint64, nowUnix int64) (r []byte, lazyHit bool, storedTimeUnix, dnsExpireAtUnix int64) {
+	defer allocaudit.Begin().End(allocaudit.CacheLookup)
+
 	v, storedTimeUnix, backendExpireAtUnix := c.backend.Get(msgKey)
 	if v == nil {
-		return nil, false, nil
+		return nil, false, 0, 0
 	}
 
-	r = new(dns.Msg)
-	if err := r.Unpack(v); err != nil {
-		return nil, false, fmt.Errorf("failed to unpack cached data, %w", err)
+	r, offsets, err := c.decodeEntry(v)
+	if err != nil {
+		// Entries stored with other compress options cannot be decoded,
+		// see Args.Compress. They are misses, which replace them.
+		if c.L().Core().Enabled(zap.DebugLevel) {
+			c.L().Debug("discard undecodable cached data", zap.Uint64("key", msgKey), zap.Error(err))
+		}
+		return nil, false, 0, 0
 	}
 
 	// Logic to divide cache status into 3 zones: Fresh, Stale (Lazy), and Expired.
 	// Backend expiration = DNS TTL + Pre-computed Lazy Window.
-	dnsExpireAtUnix := backendExpireAtUnix - c.lazyWindowSec
+	dnsExpireAtUnix = backendExpireAtUnix - c.lazyWindowSec
+	if dnsutils.GetRawRcode(r) == dns.RcodeServerFailure {
+		// Cached failures have no lazy window, see storeServfail.
+		dnsExpireAtUnix = backendExpireAtUnix
+	}
 
 	if nowUnix < dnsExpireAtUnix {
 		// Zone 1: Fresh.
 		if elapsed := nowUnix - storedTimeUnix; elapsed > 0 {
-			dnsutils.SubtractTTL(r, uint32(elapsed))
+			dnsutils.SubtractRawTTL(r, offsets, uint32(elapsed))
 		}
-		return r, false, nil
+		return r, false, storedTimeUnix, dnsExpireAtUnix
 	}
 
-	if c.lazyEnabled && nowUnix < backendExpireAtUnix {
+	if c.lazyEnabled && nowUnix < backendExpireAtUnix &&
+		(c.maxStaleSec == 0 || nowUnix-dnsExpireAtUnix < c.maxStaleSec) {
 		// Zone 2: Stale (Lazy hit).
-		dnsutils.SetTTL(r, c.lazyReplyTTL)
-		return r, true, nil
+		dnsutils.SetRawTTL(r, offsets, c.lazyReplyTTL)
+		return r, true, storedTimeUnix, dnsExpireAtUnix
+	}
+
+	return nil, false, 0, 0
+}
+
+// addCacheDebugInfo attaches an EDE option to the cached response r that
+// reports its age and remaining ttl, e.g. "cache hit, age 12s, ttl 288s".
+// Lazy hits use the "Stale Answer" info code.
+func addCacheDebugInfo(q, r *dns.Msg, age int64, lazyHit bool) {
+	qOpt := q.IsEdns0()
+	if qOpt == nil {
+		return
+	}
+	rOpt := r.IsEdns0()
+	if rOpt == nil {
+		rOpt = dnsutils.UpgradeEDNS0(r)
+		rOpt.SetUDPSize(qOpt.UDPSize())
 	}
 
-	return nil, false, nil
+	ede := &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther}
+	if lazyHit {
+		ede.InfoCode = dns.ExtendedErrorCodeStaleAnswer
+		ede.ExtraText = fmt.Sprintf("cache lazy hit, age %ds, expired", age)
+	} else {
+		ede.ExtraText = fmt.Sprintf("cache hit, age %ds, ttl %ds", age, dnsutils.GetMinimalTTL(r))
+	}
+	rOpt.Option = append(rOpt.Option, ede)
 }
 
 func (c *cachePlugin) doLazyUpdate(msgKey uint64, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) {
-	lazyQCtx := qCtx.ShallowCopyForBackground()
-	var b [8]byte
-	binary.LittleEndian.PutUint64(b[:], msgKey)
-	strKey := string(b[:])
-	lazyUpdateFunc := func() (interface{}, error) {
-		if c.L().Core().Enabled(zap.DebugLevel) {
-			c.L().Debug("start lazy cache update", lazyQCtx.InfoField())
-		}
-		defer c.lazyUpdateSF.Forget(strKey)
-		lazyCtx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
-		defer cancel()
+	var delay time.Duration
+	if c.staleRefreshJitter > 0 {
+		delay = time.Duration(utils.RandIntN(c.staleRefreshJitter)) * time.Millisecond
+	}
+	c.doBackgroundUpdate(msgKey, qCtx.ShallowCopyForBackground(), next, delay)
+}
 
-		err := executable_seq.ExecChainNode(lazyCtx, lazyQCtx, next)
-		if err != nil {
-			c.L().Warn("failed to update lazy cache", lazyQCtx.InfoField(), zap.Error(err))
-		}
+// doPrefetch refreshes a hot entry before it expires. qCtx is already
+// a background copy.
+func (c *cachePlugin) doPrefetch(msgKey uint64, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) {
+	c.metrics.prefetch.Add(1)
+	if c.L().Core().Enabled(zap.DebugLevel) {
+		c.L().Debug("prefetch hot cache entry", qCtx.InfoField())
+	}
+	c.doBackgroundUpdate(msgKey, qCtx, next, 0)
+}
 
-		r := lazyQCtx.R()
-		if r != nil {
-			if err := c.tryStoreMsg(msgKey, r, time.Now().Unix()); err != nil {
-				c.L().Error("cache store", lazyQCtx.InfoField(), zap.Error(err))
-			}
-		}
-		if c.L().Core().Enabled(zap.DebugLevel) {
-			c.L().Debug("lazy cache updated", lazyQCtx.InfoField())
+// doBackgroundUpdate executes next with lazyQCtx in background after delay
+// and stores the response. Updates of the same msgKey are merged.
+func (c *cachePlugin) doBackgroundUpdate(msgKey uint64, lazyQCtx *query_context.Context, next executable_seq.ExecutableChainNode, delay time.Duration) <-chan updateResult {
+	return c.updateQueue.submit(msgKey, lazyQCtx, next, delay)
+}
+
+// runBackgroundUpdate runs a job of doBackgroundUpdate.
+func (c *cachePlugin) runBackgroundUpdate(job *updateJob) updateResult {
+	lazyQCtx := job.qCtx
+	if c.L().Core().Enabled(zap.DebugLevel) {
+		c.L().Debug("start lazy cache update", lazyQCtx.InfoField())
+	}
+	lazyCtx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
+	defer cancel()
+
+	err := executable_seq.ExecChainNode(lazyCtx, lazyQCtx, job.next)
+	if err != nil {
+		c.L().Warn("failed to update lazy cache", lazyQCtx.InfoField(), zap.Error(err))
+	}
+
+	r := c.applyTTLRules(lazyQCtx)
+	if r != nil && !c.skipStore(lazyCtx, lazyQCtx) {
+		if err := c.tryStoreMsg(job.key, r, time.Now().Unix()); err != nil {
+			c.L().Error("cache store", lazyQCtx.InfoField(), zap.Error(err))
 		}
-		return nil, nil
+		c.storeXDP(lazyQCtx.Q(), r)
 	}
-	c.lazyUpdateSF.DoChan(strKey, lazyUpdateFunc)
+	if c.L().Core().Enabled(zap.DebugLevel) {
+		c.L().Debug("lazy cache updated", lazyQCtx.InfoField())
+	}
+	return updateResult{r: r, err: err}
 }
 
-func (c *cachePlugin) tryStoreMsg(key uint64, r *dns.Msg, nowUnix int64) error {
-	// NOTE: NXDOMAIN (RcodeNameError) is intentionally not cached.
+// skipStore reports whether qCtx was marked by _no_cache during next, or
+// its response matches no_store. The response is not stored if the
+// matcher fails.
+func (c *cachePlugin) skipStore(ctx context.Context, qCtx *query_context.Context) bool {
+	if qCtx.HasMark(noCacheMark) {
+		return true
+	}
+	if c.noStore == nil {
+		return false
+	}
+	matched, err := c.noStore.Match(ctx, qCtx)
+	if err != nil {
+		c.L().Warn("no_store matcher failed", qCtx.InfoField(), zap.Error(err))
+		return true
+	}
+	return matched
+}
+
+// cacheable reports whether r can be stored by tryStoreMsg.
+func (c *cachePlugin) cacheable(r *dns.Msg) bool {
+	// NOTE: NXDOMAIN (RcodeNameError) is not cached unless cacheNXDomain.
 	// Caching NXDOMAIN can cause video buffering issues (e.g. *.googlevideo.com)
 	// when upstream returns transient NXDOMAIN responses.
-	if r.Rcode != dns.RcodeSuccess || r.Truncated {
+	if r.Truncated {
+		return false
+	}
+	return r.Rcode == dns.RcodeSuccess || (r.Rcode == dns.RcodeNameError && c.cacheNXDomain)
+}
+
+func (c *cachePlugin) tryStoreMsg(key uint64, r *dns.Msg, nowUnix int64) error {
+	if !c.cacheable(r) {
 		return nil
 	}
 
-	v, err := r.Pack()
+	v, err := c.packMsg(r)
 	if err != nil {
+		c.metrics.storeError.Add(1)
 		return fmt.Errorf("failed to pack response msg, %w", err)
 	}
 
 	var msgTTL time.Duration
-	if len(r.Answer) == 0 {
+	if r.Rcode == dns.RcodeNameError || len(r.Answer) == 0 {
 		msgTTL = defaultEmptyAnswerTTL
+		if ttl, ok := dnsutils.GetNegativeTTL(r); ok {
+			msgTTL = time.Duration(min(ttl, c.maxNegativeTTL)) * time.Second
+		}
 	} else {
 		msgTTL = time.Duration(dnsutils.GetMinimalTTL(r)) * time.Second
 	}
@@ -269,10 +695,107 @@ func (c *cachePlugin) tryStoreMsg(key uint64, r *dns.Msg, nowUnix int64) error {
 	// Backend expiration = DNS TTL + Pre-computed Lazy Window.
 	expirationTimeUnix := nowUnix + int64(msgTTL/time.Second) + c.lazyWindowSec
 
-	c.backend.Store(key, v, nowUnix, expirationTimeUnix)
+	c.store(key, v, nowUnix, expirationTimeUnix)
+	return nil
+}
+
+// packMsg packs r into an entry, see packEntry, and compresses it if
+// compression is enabled.
+func (c *cachePlugin) packMsg(r *dns.Msg) ([]byte, error) {
+	v, err := packEntry(r)
+	if err != nil || c.codec == nil {
+		return v, err
+	}
+	return c.codec.encode(v), nil
+}
+
+// decodeEntry is the reverse of packMsg, but it returns the packed msg and
+// its ttl offsets. msg is not shared with v, so it can be patched.
+func (c *cachePlugin) decodeEntry(v []byte) (msg []byte, offsets []uint16, err error) {
+	if c.codec != nil {
+		if v, err = c.codec.decode(v); err != nil {
+			return nil, nil, fmt.Errorf("failed to decompress, %w", err)
+		}
+	} else {
+		v = append([]byte(nil), v...)
+	}
+	return parseEntry(v)
+}
+
+// unpackMsg is the reverse of packMsg.
+func (c *cachePlugin) unpackMsg(v []byte) (*dns.Msg, error) {
+	msg, _, err := c.decodeEntry(v)
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(msg); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// upstreamFailed reports whether next failed to get a usable response from
+// upstream, that is, r is a SERVFAIL or next failed without a response.
+// Queries that were canceled, timed out or dropped are not failures of
+// upstream, and should not be cached as SERVFAIL for other clients.
+func upstreamFailed(r *dns.Msg, err error) bool {
+	if r != nil {
+		return r.Rcode == dns.RcodeServerFailure
+	}
+	return err != nil &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded) &&
+		!errors.Is(err, query_context.ErrDropQuery)
+}
+
+// storeServfail caches a SERVFAIL response of q for servfailTTL. It is only
+// called on cache misses, so it won't replace a usable (stale) entry.
+func (c *cachePlugin) storeServfail(key uint64, q *dns.Msg, nowUnix int64) error {
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeServerFailure)
+	v, err := c.packMsg(r)
+	if err != nil {
+		c.metrics.storeError.Add(1)
+		return fmt.Errorf("failed to pack servfail msg, %w", err)
+	}
+	c.store(key, v, nowUnix, nowUnix+c.servfailTTL)
 	return nil
 }
 
+// storeXDP stores r in the xdp program, if it is enabled and r is
+// cacheable. The program only answers fresh responses, so it is not
+// stored if its ttl is 0.
+func (c *cachePlugin) storeXDP(q, r *dns.Msg) {
+	if c.xdp == nil || !c.cacheable(r) {
+		return
+	}
+	if err := c.xdp.Store(q, r); err != nil {
+		c.L().Warn("xdp store", zap.Error(err))
+	}
+}
+
+func (c *cachePlugin) store(key uint64, v []byte, storedTime, expirationTime int64) {
+	c.metrics.store.Add(1)
+	c.metrics.storeBytes.Add(uint64(len(v)))
+	c.backend.Store(key, v, storedTime, expirationTime)
+}
+
 func (c *cachePlugin) Shutdown() error {
+	c.updateQueue.close()
+	if c.prefetcher != nil {
+		c.prefetcher.close()
+	}
+	if c.ttlRules != nil {
+		c.ttlRules.close()
+	}
+	if c.codec != nil {
+		c.codec.close()
+	}
+	if c.xdp != nil {
+		if err := c.xdp.Close(); err != nil {
+			c.L().Warn("failed to close xdp", zap.Error(err))
+		}
+	}
 	return c.backend.Close()
 }
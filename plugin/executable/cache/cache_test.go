@@ -0,0 +1,415 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func newTestCache(t *testing.T, args *Args) *cachePlugin {
+	t.Helper()
+	c, err := newCachePlugin(coremain.NewBP("cache", PluginType, nil, coremain.NewTestMosdns(nil, nil)), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Shutdown() })
+	return c
+}
+
+// testReply returns a NOERROR response of q with an A record.
+func testReply(q *dns.Msg, ttl uint32) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   []byte{192, 0, 2, 1},
+	})
+	return r
+}
+
+// execCache runs a query of name through c with next, and returns the
+// response and the error.
+func execCache(c *cachePlugin, name string, next *executable_seq.DummyExecutable) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	err := c.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(next))
+	return qCtx.R(), err
+}
+
+func Test_cachePlugin_servfail(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	servfail := new(dns.Msg)
+	servfail.SetRcode(q, dns.RcodeServerFailure)
+
+	tests := []struct {
+		name       string
+		next       *executable_seq.DummyExecutable
+		wantCached bool
+	}{
+		{"servfail response", &executable_seq.DummyExecutable{WantR: servfail}, true},
+		{"exchange error", &executable_seq.DummyExecutable{WantErr: errors.New("connection refused")}, true},
+		{"client canceled", &executable_seq.DummyExecutable{WantErr: context.Canceled}, false},
+		{"deadline exceeded", &executable_seq.DummyExecutable{WantErr: context.DeadlineExceeded}, false},
+		{"dropped", &executable_seq.DummyExecutable{WantErr: query_context.ErrDropQuery}, false},
+		{"wrapped drop", &executable_seq.DummyExecutable{WantErr: errors.Join(errors.New("rpz"), query_context.ErrDropQuery)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, &Args{ServfailTTL: 30})
+			_, _ = execCache(c, "example.com.", tt.next)
+
+			r, err := execCache(c, "example.com.", &executable_seq.DummyExecutable{WantR: testReply(q, 300)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cached := r.Rcode == dns.RcodeServerFailure; cached != tt.wantCached {
+				t.Fatalf("servfail cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+// msgKey returns the cache key of q in c.
+func msgKey(t *testing.T, c *cachePlugin, q *dns.Msg) uint64 {
+	t.Helper()
+	salt, err := c.msgKeySalt(context.Background(), query_context.NewContext(q, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dnsutils.GetMsgHash(q, salt)
+}
+
+// storeExpired stores r of q in c as an entry that expired 10s ago.
+func storeExpired(t *testing.T, c *cachePlugin, q, r *dns.Msg) {
+	t.Helper()
+	ttl := int64(dnsutils.GetMinimalTTL(r))
+	if err := c.tryStoreMsg(msgKey(t, c, q), r, time.Now().Unix()-ttl-10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_cachePlugin_staleIfError(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	nxdomain := new(dns.Msg)
+	nxdomain.SetRcode(q, dns.RcodeNameError)
+	servfail := new(dns.Msg)
+	servfail.SetRcode(q, dns.RcodeServerFailure)
+
+	tests := []struct {
+		name      string
+		next      *executable_seq.DummyExecutable
+		wantRcode int
+		wantStale bool
+	}{
+		{"refreshed", &executable_seq.DummyExecutable{WantR: testReply(q, 300)}, dns.RcodeSuccess, false},
+		{"nxdomain not cached", &executable_seq.DummyExecutable{WantR: nxdomain}, dns.RcodeNameError, false},
+		{"servfail", &executable_seq.DummyExecutable{WantR: servfail}, dns.RcodeSuccess, true},
+		{"exchange error", &executable_seq.DummyExecutable{WantErr: errors.New("connection refused")}, dns.RcodeSuccess, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, &Args{MaxStale: 300, StaleIfError: true})
+			storeExpired(t, c, q, testReply(q, 10))
+
+			r, err := execCache(c, "example.com.", tt.next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("got rcode %d, want %d", r.Rcode, tt.wantRcode)
+			}
+			// Stale answers have the ttl of the lazy cache, refreshed
+			// answers have theirs.
+			if stale := r.Rcode == dns.RcodeSuccess && r.Answer[0].Header().Ttl != 300; stale != tt.wantStale {
+				t.Fatalf("stale = %v, want %v, answer %v", stale, tt.wantStale, r.Answer)
+			}
+		})
+	}
+}
+
+func Test_cachePlugin_debugInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		edns0    bool
+		lazy     bool
+		wantCode uint16
+		wantText []string // The clock may tick between storing and the lookup.
+	}{
+		{"no edns0", false, false, 0, nil},
+		{"fresh", true, false, dns.ExtendedErrorCodeOther, []string{"cache hit, age 12s, ttl 288s", "cache hit, age 13s, ttl 287s"}},
+		{"lazy", true, true, dns.ExtendedErrorCodeStaleAnswer, []string{"cache lazy hit, age 310s, expired", "cache lazy hit, age 311s, expired"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, &Args{LazyCacheTTL: 300, LazyCacheReplyTTL: 5, DebugInfo: true})
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			if tt.edns0 {
+				q.SetEdns0(1232, false)
+			}
+			if tt.lazy {
+				storeExpired(t, c, q, testReply(q, 300))
+			} else if err := c.tryStoreMsg(msgKey(t, c, q), testReply(q, 300), time.Now().Unix()-12); err != nil {
+				t.Fatal(err)
+			}
+
+			qCtx := query_context.NewContext(q, nil)
+			next := &executable_seq.DummyExecutable{WantR: testReply(q, 300)}
+			if err := c.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(next)); err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			opt := r.IsEdns0()
+			if !tt.edns0 {
+				if opt != nil {
+					t.Fatalf("unexpected opt %v", opt)
+				}
+				return
+			}
+			if opt == nil || len(opt.Option) != 1 {
+				t.Fatalf("want one edns0 option, got %v", opt)
+			}
+			ede, ok := opt.Option[0].(*dns.EDNS0_EDE)
+			if !ok {
+				t.Fatalf("want ede, got %T", opt.Option[0])
+			}
+			if ede.InfoCode != tt.wantCode {
+				t.Fatalf("got info code %d, want %d", ede.InfoCode, tt.wantCode)
+			}
+			if !slices.Contains(tt.wantText, ede.ExtraText) {
+				t.Fatalf("got text %q, want one of %q", ede.ExtraText, tt.wantText)
+			}
+		})
+	}
+}
+
+func Test_cachePlugin_ttlRules(t *testing.T) {
+	c := newTestCache(t, &Args{
+		TTL:      []string{"ddns.example.com 30", "domain:cdn.example.com 60 120"},
+		TTLRules: []TTLRule{{Domain: []string{"domain:example.com"}, MaxTTL: 100}},
+		MinTTL:   600,
+	})
+
+	tests := []struct {
+		name    string
+		qname   string
+		ttl     uint32
+		wantTTL uint32
+	}{
+		{"static ttl", "ddns.example.com.", 300, 30},
+		{"static range max", "a.cdn.example.com.", 300, 120},
+		{"static range min", "b.cdn.example.com.", 10, 60},
+		{"ttl rule", "www.example.com.", 300, 100},
+		{"no rule matched", "example.org.", 300, 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, dns.TypeA)
+			next := &executable_seq.DummyExecutable{WantR: testReply(q, tt.ttl)}
+			r, err := execCache(c, tt.qname, next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Answer[0].Header().Ttl; got != tt.wantTTL {
+				t.Fatalf("want ttl %d, got %d", tt.wantTTL, got)
+			}
+
+			// The cached response has the same ttl.
+			r, err = execCache(c, tt.qname, &executable_seq.DummyExecutable{WantErr: errors.New("not cached")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Answer[0].Header().Ttl; got > tt.wantTTL || got < tt.wantTTL-1 {
+				t.Fatalf("want cached ttl %d, got %d", tt.wantTTL, got)
+			}
+		})
+	}
+}
+
+func Test_newTTLRules_invalid(t *testing.T) {
+	for _, args := range []*Args{
+		{TTL: []string{"example.com"}},
+		{TTL: []string{"example.com 60 30"}},
+		{TTL: []string{"example.com -1"}},
+		{TTLRules: []TTLRule{{Domain: []string{"example.com"}, MinTTL: 60, MaxTTL: 30}}},
+		{MinTTL: 60, MaxTTL: 30},
+	} {
+		if _, err := newCachePlugin(coremain.NewBP("cache", PluginType, nil, coremain.NewTestMosdns(nil, nil)), args); err == nil {
+			t.Fatalf("invalid ttl rules are accepted, %+v", args)
+		}
+	}
+}
+
+func Test_cachePlugin_xdpInvalid(t *testing.T) {
+	matchers := map[string]executable_seq.Matcher{"m": &markMatcher{mark: 1}}
+	for _, args := range []*Args{
+		{XDP: &XDPArgs{}},
+		{XDP: &XDPArgs{Iface: "lo"}, ClientGroups: []ClientGroup{{Name: "a", If: "m"}}},
+		{XDP: &XDPArgs{Iface: "mosdns-missing0"}},
+	} {
+		if _, err := newCachePlugin(coremain.NewBP("cache", PluginType, nil, coremain.NewTestMosdns(nil, matchers)), args); err == nil {
+			t.Fatalf("invalid xdp args are accepted, %+v", args)
+		}
+	}
+}
+
+func Test_cachePlugin_minMaxTTL(t *testing.T) {
+	c := newTestCache(t, &Args{TTL: []string{"ddns.example.com 5"}, MinTTL: 60, MaxTTL: 3600})
+	tests := []struct {
+		qname   string
+		ttl     uint32
+		wantTTL uint32
+	}{
+		{"low.example.com.", 10, 60},
+		{"high.example.com.", 7200, 3600},
+		{"ok.example.com.", 300, 300},
+		{"ddns.example.com.", 300, 5}, // rules are not clamped
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.qname, dns.TypeA)
+		r, err := execCache(c, tt.qname, &executable_seq.DummyExecutable{WantR: testReply(q, tt.ttl)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Answer[0].Header().Ttl; got != tt.wantTTL {
+			t.Fatalf("%s, want ttl %d, got %d", tt.qname, tt.wantTTL, got)
+		}
+	}
+}
+
+// rcodeMatcher matches responses of rcode, or returns err.
+type rcodeMatcher struct {
+	rcode int
+	err   error
+}
+
+func (m *rcodeMatcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	if m.err != nil {
+		return false, m.err
+	}
+	return qCtx.R() != nil && qCtx.R().Rcode == m.rcode, nil
+}
+
+func Test_cachePlugin_noStore(t *testing.T) {
+	matchers := map[string]executable_seq.Matcher{
+		"refused": &rcodeMatcher{rcode: dns.RcodeRefused},
+		"success": &rcodeMatcher{rcode: dns.RcodeSuccess},
+		"err":     &rcodeMatcher{err: errors.New("matcher failed")},
+	}
+	tests := []struct {
+		name       string
+		noStore    string
+		wantCached bool
+	}{
+		{"matched", "success", false},
+		{"not matched", "refused", true},
+		{"negated", "!refused", false},
+		{"matcher error", "err", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := coremain.NewTestMosdns(nil, matchers)
+			c, err := newCachePlugin(coremain.NewBP("cache", PluginType, nil, m), &Args{NoStore: tt.noStore})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Shutdown()
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			if _, err := execCache(c, "example.com.", &executable_seq.DummyExecutable{WantR: testReply(q, 300)}); err != nil {
+				t.Fatal(err)
+			}
+			r, err := execCache(c, "example.com.", &executable_seq.DummyExecutable{WantErr: errors.New("not cached")})
+			if cached := err == nil && r != nil; cached != tt.wantCached {
+				t.Fatalf("cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+
+	if _, err := newCachePlugin(coremain.NewBP("cache", PluginType, nil, coremain.NewTestMosdns(nil, matchers)), &Args{NoStore: "missing"}); err == nil {
+		t.Fatal("unknown matcher is accepted")
+	}
+}
+
+func Test_noCache(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	notCached := &executable_seq.DummyExecutable{WantErr: errors.New("not cached")}
+
+	t.Run("before cache", func(t *testing.T) {
+		c := newTestCache(t, &Args{})
+		if _, err := execCache(c, "example.com.", &executable_seq.DummyExecutable{WantR: testReply(q, 300)}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Marked queries skip the cached response.
+		qCtx := query_context.NewContext(q.Copy(), nil)
+		cacheNode := executable_seq.WrapExecutable(c)
+		cacheNode.LinkNext(executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: testReply(q, 10)}))
+		if err := new(noCache).Exec(context.Background(), qCtx, cacheNode); err != nil {
+			t.Fatal(err)
+		}
+		if ttl := qCtx.R().Answer[0].Header().Ttl; ttl != 10 {
+			t.Fatalf("want the response of next, got ttl %d", ttl)
+		}
+
+		// And their responses are not stored.
+		r, err := execCache(c, "example.com.", notCached)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl := r.Answer[0].Header().Ttl; ttl < 299 {
+			t.Fatalf("cached response is replaced, got ttl %d", ttl)
+		}
+	})
+
+	t.Run("after cache", func(t *testing.T) {
+		c := newTestCache(t, &Args{})
+		next := executable_seq.WrapExecutable(new(noCache))
+		next.LinkNext(executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: testReply(q, 300)}))
+		qCtx := query_context.NewContext(q.Copy(), nil)
+		if err := c.Exec(context.Background(), qCtx, next); err != nil {
+			t.Fatal(err)
+		}
+		if qCtx.R() == nil {
+			t.Fatal("no response")
+		}
+		if _, err := execCache(c, "example.com.", notCached); err == nil {
+			t.Fatal("response of a marked query is cached")
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// msgCodec compresses the packed messages before they are stored.
+type msgCodec interface {
+	encode(v []byte) []byte
+	decode(v []byte) ([]byte, error)
+	close()
+}
+
+// newMsgCodec returns the codec of Args.Compress. It returns nil if
+// compress is empty, which means no compression.
+func newMsgCodec(compress, zstdDict string) (msgCodec, error) {
+	switch compress {
+	case "":
+		return nil, nil
+	case "snappy":
+		return snappyCodec{}, nil
+	case "zstd":
+		return newZstdCodec(zstdDict)
+	default:
+		return nil, fmt.Errorf("unknown compress algorithm %s", compress)
+	}
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) encode(v []byte) []byte {
+	return snappy.Encode(nil, v)
+}
+
+func (snappyCodec) decode(v []byte) ([]byte, error) {
+	return snappy.Decode(nil, v)
+}
+
+func (snappyCodec) close() {}
+
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// newZstdCodec returns a zstd codec. dictFile is an optional zstd
+// dictionary, e.g. trained from dns messages by `zstd --train`. A
+// dictionary makes small messages compress much better. Entries stored
+// with a different dictionary cannot be decoded.
+func newZstdCodec(dictFile string) (*zstdCodec, error) {
+	encOpts := []zstd.EOption{zstd.WithEncoderConcurrency(1), zstd.WithZeroFrames(true)}
+	decOpts := []zstd.DOption{zstd.WithDecoderConcurrency(0)}
+	if len(dictFile) > 0 {
+		dict, err := os.ReadFile(dictFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zstd dict, %w", err)
+		}
+		encOpts = append(encOpts, zstd.WithEncoderDict(dict))
+		decOpts = append(decOpts, zstd.WithDecoderDicts(dict))
+	}
+	enc, err := zstd.NewWriter(nil, encOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init zstd encoder, %w", err)
+	}
+	dec, err := zstd.NewReader(nil, decOpts...)
+	if err != nil {
+		enc.Close()
+		return nil, fmt.Errorf("failed to init zstd decoder, %w", err)
+	}
+	return &zstdCodec{enc: enc, dec: dec}, nil
+}
+
+func (c *zstdCodec) encode(v []byte) []byte {
+	return c.enc.EncodeAll(v, nil)
+}
+
+func (c *zstdCodec) decode(v []byte) ([]byte, error) {
+	return c.dec.DecodeAll(v, nil)
+}
+
+func (c *zstdCodec) close() {
+	c.enc.Close()
+	c.dec.Close()
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+)
+
+func Test_cachePlugin_compress(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	failed := &executable_seq.DummyExecutable{WantErr: errors.New("upstream failed")}
+
+	for _, compress := range []string{"", "snappy", "zstd"} {
+		t.Run(compress, func(t *testing.T) {
+			c := newTestCache(t, &Args{Compress: compress})
+			if _, err := execCache(c, "example.com.", &executable_seq.DummyExecutable{WantR: testReply(q, 300)}); err != nil {
+				t.Fatal(err)
+			}
+			r, err := execCache(c, "example.com.", failed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+				t.Fatalf("invalid cached response %v", r)
+			}
+		})
+	}
+
+	if _, err := newMsgCodec("gzip", ""); err == nil {
+		t.Fatal("unknown algorithm is accepted")
+	}
+}
+
+// Entries stored with other compress options are misses, and are
+// replaced.
+func Test_cachePlugin_compressChanged(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	for _, tt := range []struct{ from, to string }{
+		{"", "snappy"},
+		{"snappy", ""},
+		{"", "zstd"},
+		{"zstd", ""},
+		{"snappy", "zstd"},
+	} {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			old := newTestCache(t, &Args{Compress: tt.from})
+			if err := old.tryStoreMsg(msgKey(t, old, q), testReply(q, 300), time.Now().Unix()); err != nil {
+				t.Fatal(err)
+			}
+			c := newTestCache(t, &Args{Compress: tt.to})
+			c.backend = old.backend
+
+			if r, _, _, _ := c.lookupCache(msgKey(t, c, q), time.Now().Unix()); r != nil {
+				t.Fatalf("entry of another format is decoded, %v", r)
+			}
+			r, err := execCache(c, "example.com.", &executable_seq.DummyExecutable{WantR: testReply(q, 300)})
+			if err != nil || r.Rcode != dns.RcodeSuccess {
+				t.Fatalf("miss failed, %v, %v", r, err)
+			}
+			if r, _, _, _ := c.lookupCache(msgKey(t, c, q), time.Now().Unix()); r == nil {
+				t.Fatal("entry is not replaced")
+			}
+		})
+	}
+}
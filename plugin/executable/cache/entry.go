@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+// Responses are cached as entries of their packed msgs and the ttl offsets
+// of the msgs, so cache hits can be served as packed msgs with their ids
+// and ttls patched in place, without being unpacked. An entry is
+//
+//	| entryMagic | number of offsets, 2 bytes | ttl offsets, 2 bytes each | packed msg |
+//
+// Entries of other formats, e.g. stored by older versions in a redis or
+// disk backend, are invalid and are misses.
+const entryMagic uint16 = 0x5257
+
+var errInvalidEntry = errors.New("invalid cache entry")
+
+// packEntry packs r into an entry. The msg is always compressed.
+func packEntry(r *dns.Msg) ([]byte, error) {
+	m := *r
+	m.Compress = true
+	b, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := dnsutils.TTLOffsets(b)
+	if err != nil {
+		return nil, err
+	}
+	e := make([]byte, 0, 4+2*len(offsets)+len(b))
+	e = binary.BigEndian.AppendUint16(e, entryMagic)
+	e = binary.BigEndian.AppendUint16(e, uint16(len(offsets)))
+	for _, off := range offsets {
+		e = binary.BigEndian.AppendUint16(e, off)
+	}
+	return append(e, b...), nil
+}
+
+// parseEntry returns the packed msg and its ttl offsets of the entry e.
+// msg is a sub slice of e.
+func parseEntry(e []byte) (msg []byte, offsets []uint16, err error) {
+	if len(e) < 4 || binary.BigEndian.Uint16(e) != entryMagic {
+		return nil, nil, errInvalidEntry
+	}
+	n := int(binary.BigEndian.Uint16(e[2:]))
+	if len(e) < 4+2*n {
+		return nil, nil, errInvalidEntry
+	}
+	offsets = make([]uint16, n)
+	for i := range offsets {
+		offsets[i] = binary.BigEndian.Uint16(e[4+2*i:])
+	}
+	msg = e[4+2*n:]
+	if !dnsutils.ValidTTLOffsets(msg, offsets) {
+		return nil, nil, errInvalidEntry
+	}
+	return msg, offsets, nil
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_parseEntry(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	e, err := packEntry(testReply(q, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, offsets, err := parseEntry(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) != 1 || dnsutils.GetMinimalRawTTL(msg, offsets) != 300 {
+		t.Fatalf("invalid ttl offsets %v", offsets)
+	}
+
+	plain, err := testReply(q, 300).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range [][]byte{nil, e[:3], e[:5], plain} {
+		if _, _, err := parseEntry(v); err == nil {
+			t.Fatalf("invalid entry %v is parsed", v)
+		}
+	}
+}
+
+func Test_cachePlugin_rawHit(t *testing.T) {
+	for _, compress := range []string{"", "snappy"} {
+		t.Run(compress, func(t *testing.T) {
+			c := newTestCache(t, &Args{Compress: compress})
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			if err := c.tryStoreMsg(msgKey(t, c, q), testReply(q, 300), time.Now().Unix()-10); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				q.Id = dns.Id()
+				qCtx := query_context.NewContext(q, nil)
+				if err := c.Exec(context.Background(), qCtx, nil); err != nil {
+					t.Fatal(err)
+				}
+				raw := qCtx.RawR()
+				if raw == nil {
+					t.Fatal("cache hit is not a packed response")
+				}
+				offsets, err := dnsutils.TTLOffsets(raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if id := binary.BigEndian.Uint16(raw); id != q.Id {
+					t.Fatalf("want id %d, got %d", q.Id, id)
+				}
+				if ttl := dnsutils.GetMinimalRawTTL(raw, offsets); ttl < 289 || ttl > 290 {
+					t.Fatalf("want ttl 290, got %d", ttl)
+				}
+				// Patches of a hit must not change the stored entry.
+				dnsutils.SetRawTTL(raw, offsets, 0)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// Bits of the cache key salt.
+const (
+	keySaltCD uint16 = 1 << iota
+	keySaltDO
+	keySaltPayloadShift = iota                    // 2 bits of payload class
+	keySaltGroupShift   = keySaltPayloadShift + 2 // the rest bits of client group
+
+	maxClientGroups = 1<<(16-keySaltGroupShift) - 1
+)
+
+// ClientGroup is a group of clients that has its own view of the cache.
+type ClientGroup struct {
+	Name string `yaml:"name"`
+	// If is a condition of matcher tags, in the syntax of the "if" of
+	// sequences, e.g. a query_matcher of client_ip.
+	If string `yaml:"if"`
+}
+
+type clientGroup struct {
+	name string
+	m    executable_seq.Matcher
+}
+
+func newClientGroups(groups []ClientGroup, lg *zap.Logger, matchers map[string]executable_seq.Matcher) ([]clientGroup, error) {
+	if len(groups) > maxClientGroups {
+		return nil, fmt.Errorf("too many client groups, max is %d", maxClientGroups)
+	}
+	names := make(map[string]struct{}, len(groups))
+	cgs := make([]clientGroup, 0, len(groups))
+	for i, g := range groups {
+		if len(g.Name) == 0 {
+			return nil, fmt.Errorf("client group #%d has no name", i)
+		}
+		if _, dup := names[g.Name]; dup {
+			return nil, fmt.Errorf("duplicated client group %s", g.Name)
+		}
+		names[g.Name] = struct{}{}
+		if len(g.If) == 0 {
+			return nil, fmt.Errorf("client group %s has no condition", g.Name)
+		}
+		m, err := executable_seq.ParseConditionMatcher(lg.Named(g.Name), g.If, matchers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition of client group %s, %w", g.Name, err)
+		}
+		cgs = append(cgs, clientGroup{name: g.Name, m: m})
+	}
+	return cgs, nil
+}
+
+// msgKeySalt returns the salt of the cache key of qCtx. It separates the
+// entries of queries with different DO and CD bits, so clients without
+// DNSSEC won't get answers with RRSIGs and clients with DNSSEC won't get
+// answers without them, or unvalidated answers. Queries of the
+// dnssecKeyOptOut qtypes ignore the bits. If keyPayloadClass, queries with
+// different udp payload sizes are also separated, see payloadClass.
+// Queries from different client groups are always separated, so answers
+// won't leak between e.g. filtered and unfiltered clients.
+func (c *cachePlugin) msgKeySalt(ctx context.Context, qCtx *query_context.Context) (uint16, error) {
+	q := qCtx.Q()
+	group, err := c.clientGroup(ctx, qCtx)
+	if err != nil {
+		return 0, err
+	}
+	salt := group << keySaltGroupShift
+	opt := q.IsEdns0()
+	if _, optOut := c.dnssecKeyOptOut[q.Question[0].Qtype]; !optOut {
+		if q.CheckingDisabled {
+			salt |= keySaltCD
+		}
+		if opt != nil && opt.Do() {
+			salt |= keySaltDO
+		}
+	}
+	if c.keyPayloadClass {
+		salt |= payloadClass(opt) << keySaltPayloadShift
+	}
+	return salt, nil
+}
+
+// clientGroup returns the 1-based index of the first client group that
+// qCtx matches, or 0 if it matches none.
+func (c *cachePlugin) clientGroup(ctx context.Context, qCtx *query_context.Context) (uint16, error) {
+	for i, g := range c.clientGroups {
+		matched, err := g.m.Match(ctx, qCtx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to match client group %s, %w", g.name, err)
+		}
+		if matched {
+			return uint16(i + 1), nil
+		}
+	}
+	return 0, nil
+}
+
+// payloadClass classifies the udp payload size of opt: 0 is no edns0 (512
+// bytes), 1 is up to 1232 bytes (the dns flag day 2020 default) and 2 is
+// larger.
+func payloadClass(opt *dns.OPT) uint16 {
+	switch {
+	case opt == nil:
+		return 0
+	case opt.UDPSize() <= 1232:
+		return 1
+	default:
+		return 2
+	}
+}
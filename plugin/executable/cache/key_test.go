@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// keyQuery returns a query of qtype. udpSize 0 means no edns0.
+func keyQuery(qtype uint16, udpSize uint16, do, cd bool) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", qtype)
+	q.CheckingDisabled = cd
+	if udpSize > 0 {
+		q.SetEdns0(udpSize, do)
+	}
+	return q
+}
+
+func Test_cachePlugin_msgKeySalt(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     *Args
+		a, b     *dns.Msg
+		wantSame bool
+	}{
+		{"do", &Args{}, keyQuery(dns.TypeA, 1232, false, false), keyQuery(dns.TypeA, 1232, true, false), false},
+		{"cd", &Args{}, keyQuery(dns.TypeA, 1232, false, false), keyQuery(dns.TypeA, 1232, false, true), false},
+		{"opt out", &Args{DNSSECKeyOptOut: []uint16{dns.TypeA}}, keyQuery(dns.TypeA, 1232, false, false), keyQuery(dns.TypeA, 1232, true, true), true},
+		{"not opted out", &Args{DNSSECKeyOptOut: []uint16{dns.TypeAAAA}}, keyQuery(dns.TypeA, 1232, false, false), keyQuery(dns.TypeA, 1232, true, false), false},
+		{"payload ignored", &Args{}, keyQuery(dns.TypeA, 0, false, false), keyQuery(dns.TypeA, 4096, false, false), true},
+		{"payload same class", &Args{KeyPayloadClass: true}, keyQuery(dns.TypeA, 512, false, false), keyQuery(dns.TypeA, 1232, false, false), true},
+		{"payload classes", &Args{KeyPayloadClass: true}, keyQuery(dns.TypeA, 1232, false, false), keyQuery(dns.TypeA, 4096, false, false), false},
+		{"no edns0", &Args{KeyPayloadClass: true}, keyQuery(dns.TypeA, 0, false, false), keyQuery(dns.TypeA, 512, false, false), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, tt.args)
+			if same := msgKey(t, c, tt.a) == msgKey(t, c, tt.b); same != tt.wantSame {
+				t.Fatalf("same key = %v, want %v", same, tt.wantSame)
+			}
+		})
+	}
+}
+
+// markMatcher matches queries with mark, or returns err.
+type markMatcher struct {
+	mark uint
+	err  error
+}
+
+func (m *markMatcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	if m.err != nil {
+		return false, m.err
+	}
+	return qCtx.HasMark(m.mark), nil
+}
+
+func Test_cachePlugin_clientGroups(t *testing.T) {
+	matchers := map[string]executable_seq.Matcher{
+		"filtered": &markMatcher{mark: 1},
+		"kids":     &markMatcher{mark: 2},
+		"err":      &markMatcher{err: errors.New("matcher failed")},
+	}
+	newCache := func(t *testing.T, groups []ClientGroup) *cachePlugin {
+		t.Helper()
+		m := coremain.NewTestMosdns(nil, matchers)
+		c, err := newCachePlugin(coremain.NewBP("cache", PluginType, nil, m), &Args{ClientGroups: groups})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Shutdown() })
+		return c
+	}
+	saltOf := func(t *testing.T, c *cachePlugin, marks ...uint) (uint16, error) {
+		t.Helper()
+		qCtx := query_context.NewContext(keyQuery(dns.TypeA, 1232, false, false), nil)
+		for _, mark := range marks {
+			qCtx.AddMark(mark)
+		}
+		return c.msgKeySalt(context.Background(), qCtx)
+	}
+
+	t.Run("views", func(t *testing.T) {
+		c := newCache(t, []ClientGroup{{Name: "filtered", If: "filtered"}, {Name: "kids", If: "kids"}})
+		salts := make(map[uint16]string)
+		for _, tt := range []struct {
+			name  string
+			marks []uint
+		}{
+			{"no group", nil},
+			{"filtered", []uint{1}},
+			{"kids", []uint{2}},
+		} {
+			salt, err := saltOf(t, c, tt.marks...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other, ok := salts[salt]; ok {
+				t.Fatalf("%s and %s share a cache view", tt.name, other)
+			}
+			salts[salt] = tt.name
+		}
+
+		// The first matched group wins.
+		first, err := saltOf(t, c, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if salts[first] != "filtered" {
+			t.Fatalf("query of both groups is in the view of %s, want filtered", salts[first])
+		}
+	})
+
+	t.Run("matcher error", func(t *testing.T) {
+		c := newCache(t, []ClientGroup{{Name: "err", If: "err"}})
+		if _, err := saltOf(t, c); err == nil {
+			t.Fatal("matcher error is ignored")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tooMany := make([]ClientGroup, maxClientGroups+1)
+		for i := range tooMany {
+			tooMany[i] = ClientGroup{Name: fmt.Sprintf("g%d", i), If: "filtered"}
+		}
+		for _, groups := range [][]ClientGroup{
+			tooMany,
+			{{If: "filtered"}},
+			{{Name: "a", If: "filtered"}, {Name: "a", If: "kids"}},
+			{{Name: "a"}},
+			{{Name: "a", If: "not_exist"}},
+		} {
+			m := coremain.NewTestMosdns(nil, matchers)
+			if _, err := newCachePlugin(coremain.NewBP("cache", PluginType, nil, m), &Args{ClientGroups: groups}); err == nil {
+				t.Fatalf("invalid client groups are accepted, %+v", groups)
+			}
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pmkol/mosdns-x/pkg/cache"
+	"github.com/pmkol/mosdns-x/pkg/xdp"
+)
+
+// metrics are the counters of the cache plugin.
+type metrics struct {
+	query      atomic.Uint64
+	hit        atomic.Uint64
+	lazyHit    atomic.Uint64
+	prefetch   atomic.Uint64
+	store      atomic.Uint64
+	storeBytes atomic.Uint64
+	storeError atomic.Uint64 // errors of the plugin, not of the backend
+	sharedMiss atomic.Uint64
+}
+
+// collectors returns the prometheus collectors of m, the backend, the
+// updateQueue and the xdp responder, which can be nil.
+func (m *metrics) collectors(backend cache.Backend, uq *updateQueue, xr *xdp.Responder) []prometheus.Collector {
+	counter := func(name, help string, f func() uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, func() float64 {
+			return float64(f())
+		})
+	}
+	gauge := func(name, help string, f func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, f)
+	}
+	// ratio returns 0 instead of NaN if there is nothing yet.
+	ratio := func(a, b *atomic.Uint64) func() float64 {
+		return func() float64 {
+			d := b.Load()
+			if d == 0 {
+				return 0
+			}
+			return float64(a.Load()) / float64(d)
+		}
+	}
+	statsReporter, _ := backend.(cache.StatsReporter)
+	backendStats := func() cache.Stats {
+		if statsReporter == nil {
+			return cache.Stats{}
+		}
+		return statsReporter.Stats()
+	}
+
+	cs := []prometheus.Collector{
+		counter("query_total", "The total number of processed queries", m.query.Load),
+		counter("hit_total", "The total number of queries that hit the cache", m.hit.Load),
+		counter("lazy_hit_total", "The total number of queries that hit the expired cache", m.lazyHit.Load),
+		counter("prefetch_total", "The total number of hot cache entries that were refreshed before they expired", m.prefetch.Load),
+		counter("shared_miss_total", "The total number of missed queries that shared the response of a concurrent identical query", m.sharedMiss.Load),
+		counter("store_total", "The total number of responses that were stored", m.store.Load),
+		counter("store_error_total", "The total number of responses that failed to be stored", func() uint64 {
+			return m.storeError.Load() + backendStats().StoreErrors
+		}),
+		gauge("hit_ratio", "The ratio of queries that hit the cache", ratio(&m.hit, &m.query)),
+		gauge("lazy_hit_ratio", "The ratio of queries that hit the expired cache", ratio(&m.lazyHit, &m.query)),
+		gauge("avg_entry_size", "The average size in bytes of the stored responses", ratio(&m.storeBytes, &m.store)),
+		gauge("cache_size", "Current cache size in records", func() float64 {
+			return float64(backend.Len())
+		}),
+		gauge("lazy_update_queued", "Current number of background updates waiting for a worker", func() float64 {
+			return float64(uq.queued())
+		}),
+		counter("lazy_update_dropped_total", "The total number of background updates dropped because the queue was full", uq.dropped.Load),
+	}
+	if statsReporter != nil {
+		cs = append(cs,
+			counter("eviction_total", "The total number of entries that were evicted to make room for new entries", func() uint64 {
+				return backendStats().Evictions
+			}),
+			counter("cleaner_runs_total", "The total number of runs of the cleaner of expired entries", func() uint64 {
+				return backendStats().CleanerRuns
+			}),
+			counter("cleaner_removed_total", "The total number of expired entries removed by the cleaner", func() uint64 {
+				return backendStats().CleanerRemoved
+			}),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "cleaner_duration_seconds_total",
+				Help: "The total time spent by the cleaner of expired entries",
+			}, func() float64 {
+				return backendStats().CleanerDuration.Seconds()
+			}),
+			gauge("cleaner_last_duration_seconds", "The time spent by the last run of the cleaner of expired entries", func() float64 {
+				return backendStats().CleanerLastDuration.Seconds()
+			}),
+			&shardCollector{
+				sizeDesc: prometheus.NewDesc("shard_size", "Current size in records of each cache shard", []string{"shard"}, nil),
+				fillDesc: prometheus.NewDesc("shard_fill_ratio", "Current size of each cache shard relative to its capacity in records", []string{"shard"}, nil),
+				stats:    statsReporter,
+			},
+		)
+	}
+	if xr != nil {
+		cs = append(cs, counter("xdp_hit_total", "The total number of queries that were answered by the xdp program", func() uint64 {
+			n, _ := xr.Hits()
+			return n
+		}))
+	}
+	return cs
+}
+
+// shardCollector collects the size of each shard of a sharded backend,
+// and its fill ratio if the shards have a capacity.
+type shardCollector struct {
+	sizeDesc *prometheus.Desc
+	fillDesc *prometheus.Desc
+	stats    cache.StatsReporter
+}
+
+func (c *shardCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sizeDesc
+	ch <- c.fillDesc
+}
+
+func (c *shardCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.stats.Stats()
+	for i, l := range stats.ShardLens {
+		shard := strconv.Itoa(i)
+		ch <- prometheus.MustNewConstMetric(c.sizeDesc, prometheus.GaugeValue, float64(l), shard)
+		if stats.ShardCap > 0 {
+			ch <- prometheus.MustNewConstMetric(c.fillDesc, prometheus.GaugeValue, float64(l)/float64(stats.ShardCap), shard)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// noCacheMark is the mark added by _no_cache. Cache plugins neither serve
+// marked queries from the cache nor store their responses.
+var noCacheMark uint
+
+func init() {
+	m, err := query_context.AllocateMark()
+	if err != nil {
+		panic(err)
+	}
+	noCacheMark = m
+
+	coremain.RegNewPersetPluginFunc("_no_cache", func(bp *coremain.BP) (coremain.Plugin, error) {
+		return &noCache{BP: bp}, nil
+	})
+}
+
+var _ coremain.ExecutablePlugin = (*noCache)(nil)
+
+// noCache marks queries to bypass the cache. Place it before the cache in
+// a sequence, e.g. in an "if" branch. If it is placed after the cache, the
+// response is only not stored.
+type noCache struct {
+	*coremain.BP
+}
+
+func (n *noCache) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	qCtx.AddMark(noCacheMark)
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
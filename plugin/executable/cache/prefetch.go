@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const (
+	defaultPrefetchTTL   = 10
+	defaultPrefetchSize  = 1024
+	prefetchScanInterval = time.Second
+)
+
+// prefetcher counts the hits of cached entries and refreshes the hot ones
+// before they expire. Hits are counted from the first hit of an entry to
+// its refresh, so an entry must be hit minHits times again before it is
+// refreshed again.
+type prefetcher struct {
+	minHits  int
+	ttl      int64 // Entries are refreshed when their remaining ttl <= ttl.
+	maxSize  int
+	refresh  func(key uint64, qCtx *query_context.Context, next executable_seq.ExecutableChainNode)
+	closeC   chan struct{}
+	closeOne sync.Once
+
+	mu      sync.Mutex
+	entries map[uint64]*prefetchEntry
+	seq     uint64 // of the last tracked entry
+}
+
+type prefetchEntry struct {
+	key      uint64
+	seq      uint64 // order of the entries, the oldest has the smallest
+	hits     int
+	expireAt int64 // Unix time when the dns ttl of the cached entry expires.
+	qCtx     *query_context.Context
+	next     executable_seq.ExecutableChainNode
+}
+
+func newPrefetcher(
+	minHits int,
+	ttl int64,
+	maxSize int,
+	refresh func(key uint64, qCtx *query_context.Context, next executable_seq.ExecutableChainNode),
+) *prefetcher {
+	p := &prefetcher{
+		minHits: minHits,
+		ttl:     ttl,
+		maxSize: maxSize,
+		refresh: refresh,
+		closeC:  make(chan struct{}),
+		entries: make(map[uint64]*prefetchEntry),
+	}
+	go p.run()
+	return p
+}
+
+// hit records a hit of a fresh cached entry. If the entry is not tracked
+// yet and the prefetcher is full, the least hit entry, or the oldest one
+// of them, is evicted for it.
+func (p *prefetcher) hit(key uint64, expireAt int64, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.entries[key]
+	if e == nil {
+		if len(p.entries) >= p.maxSize {
+			p.evictLocked()
+		}
+		p.seq++
+		e = &prefetchEntry{key: key, seq: p.seq, qCtx: qCtx.ShallowCopyForBackground(), next: next}
+		p.entries[key] = e
+	}
+	e.hits++
+	e.expireAt = expireAt
+}
+
+// evictLocked evicts the least hit entry. Ties are broken by age, so new
+// entries can replace old entries that are not hot. It scans all entries,
+// which is cheap for the small sizes of prefetch.
+func (p *prefetcher) evictLocked() {
+	var victim *prefetchEntry
+	for _, e := range p.entries {
+		if victim == nil || e.hits < victim.hits || (e.hits == victim.hits && e.seq < victim.seq) {
+			victim = e
+		}
+	}
+	if victim != nil {
+		delete(p.entries, victim.key)
+	}
+}
+
+func (p *prefetcher) run() {
+	ticker := time.NewTicker(prefetchScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeC:
+			return
+		case <-ticker.C:
+			p.scan(time.Now().Unix())
+		}
+	}
+}
+
+// scan refreshes the hot entries that are about to expire and forgets
+// the entries that have expired.
+func (p *prefetcher) scan(nowUnix int64) {
+	var hot []*prefetchEntry
+	p.mu.Lock()
+	for key, e := range p.entries {
+		switch {
+		case nowUnix >= e.expireAt:
+			delete(p.entries, key)
+		case e.hits >= p.minHits && e.expireAt-nowUnix <= p.ttl:
+			delete(p.entries, key)
+			hot = append(hot, e)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, e := range hot {
+		p.refresh(e.key, e.qCtx, e.next)
+	}
+}
+
+func (p *prefetcher) close() {
+	p.closeOne.Do(func() { close(p.closeC) })
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func newTestPrefetcher(t *testing.T, maxSize int, refresh func(key uint64, qCtx *query_context.Context, next executable_seq.ExecutableChainNode)) *prefetcher {
+	t.Helper()
+	if refresh == nil {
+		refresh = func(uint64, *query_context.Context, executable_seq.ExecutableChainNode) {}
+	}
+	p := newPrefetcher(2, defaultPrefetchTTL, maxSize, refresh)
+	t.Cleanup(p.close)
+	return p
+}
+
+// farExpireAt is far from now, see Test_prefetcher_scan.
+var farExpireAt = time.Now().Unix() + 3600
+
+func hitN(p *prefetcher, key uint64, n int, expireAt int64) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	for i := 0; i < n; i++ {
+		p.hit(key, expireAt, qCtx, nil)
+	}
+}
+
+func (p *prefetcher) tracked(key uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.entries[key] != nil
+}
+
+func Test_prefetcher_evict(t *testing.T) {
+	t.Run("least hit", func(t *testing.T) {
+		p := newTestPrefetcher(t, 2, nil)
+		hitN(p, 1, 1, farExpireAt)
+		hitN(p, 2, 3, farExpireAt)
+		hitN(p, 3, 1, farExpireAt)
+		if p.tracked(1) || !p.tracked(2) || !p.tracked(3) {
+			t.Fatal("the least hit entry is not evicted")
+		}
+	})
+	t.Run("oldest of the least hit", func(t *testing.T) {
+		p := newTestPrefetcher(t, 2, nil)
+		hitN(p, 1, 2, farExpireAt)
+		hitN(p, 2, 2, farExpireAt)
+		hitN(p, 3, 1, farExpireAt)
+		if p.tracked(1) || !p.tracked(2) || !p.tracked(3) {
+			t.Fatal("the oldest entry is not evicted")
+		}
+		if len(p.entries) != 2 {
+			t.Fatalf("want 2 entries, got %d", len(p.entries))
+		}
+	})
+}
+
+func Test_prefetcher_scan(t *testing.T) {
+	var mu sync.Mutex
+	var refreshed []uint64
+	p := newTestPrefetcher(t, 8, func(key uint64, _ *query_context.Context, _ executable_seq.ExecutableChainNode) {
+		mu.Lock()
+		defer mu.Unlock()
+		refreshed = append(refreshed, key)
+	})
+	// Far from now, so the background scans of p do nothing.
+	now := farExpireAt
+	hitN(p, 1, 2, now+5)   // hot and about to expire
+	hitN(p, 2, 1, now+5)   // not hot
+	hitN(p, 3, 2, now+100) // hot but fresh
+	hitN(p, 4, 2, now)     // expired
+	p.scan(now)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(refreshed) != 1 || refreshed[0] != 1 {
+		t.Fatalf("want key 1 refreshed, got %v", refreshed)
+	}
+	if p.tracked(1) || !p.tracked(2) || !p.tracked(3) || p.tracked(4) {
+		t.Fatal("refreshed or expired entries are still tracked")
+	}
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// execSharedMiss is execMiss, but only one of the concurrent misses of
+// msgKey runs it. The others wait for it and get a copy of its response.
+// They are bounded by the deadline of the one that runs.
+func (c *cachePlugin) execSharedMiss(ctx context.Context, msgKey uint64, qCtx *query_context.Context, next executable_seq.ExecutableChainNode, nowUnix int64) error {
+	leader := false
+	v, err, _ := c.missGroup.Do(strconv.FormatUint(msgKey, 16), func() (interface{}, error) {
+		leader = true
+		r, err := c.execMiss(ctx, msgKey, qCtx, next, nowUnix)
+		if r != nil {
+			// The response of qCtx may be modified once it is returned.
+			r = r.Copy()
+		}
+		return r, err
+	})
+	if leader {
+		return err
+	}
+
+	c.metrics.sharedMiss.Add(1)
+	if r, _ := v.(*dns.Msg); r != nil {
+		r = r.Copy()
+		r.Id = qCtx.Q().Id
+		qCtx.SetResponse(r)
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// refreshExpired refreshes an expired entry before serving it (RFC 8767).
+// It returns a copy of the new response if next answers in
+// staleAnswerTimeout. Otherwise, it returns nil and the stale answer
+// should be served, while the refresh continues in background. Errors and
+// SERVFAIL responses are failures, so a transient error of upstream does
+// not replace a usable stale answer. Other answers, e.g. NXDOMAIN that is
+// not cached, are served even if they are not cached.
+func (c *cachePlugin) refreshExpired(ctx context.Context, msgKey uint64, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) *dns.Msg {
+	resC := c.doBackgroundUpdate(msgKey, qCtx.ShallowCopyForBackground(), next, 0)
+	timer := time.NewTimer(c.staleAnswerTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-resC:
+		if res.err != nil || res.r == nil || res.r.Rcode == dns.RcodeServerFailure {
+			return nil
+		}
+		return res.r.Copy()
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/data_provider"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// TTLRule overrides the ttls of the responses of Domain.
+type TTLRule struct {
+	// Domain is the domain patterns of the rule, e.g. "full:example.com",
+	// and domain list providers, e.g. "provider:ddns_list".
+	Domain []string `yaml:"domain"`
+	MinTTL uint32   `yaml:"min_ttl"` // zero means no min ttl
+	MaxTTL uint32   `yaml:"max_ttl"` // zero means no max ttl
+}
+
+type ttlRange struct {
+	min, max uint32
+}
+
+// ttlRules is the TTL, TTLRules, MinTTL and MaxTTL of Args. The first
+// matched rule is used. The MinTTL and MaxTTL are used if no rule matches.
+type ttlRules struct {
+	static *domain.MixMatcher[ttlRange]
+	rules  []ttlRule
+	def    *ttlRange // nil if there are no MinTTL and MaxTTL
+}
+
+type ttlRule struct {
+	m *domain.MatcherGroup[struct{}]
+	r ttlRange
+}
+
+// parseTTLRule parses a rule of Args.TTL, which is "pattern ttl" or
+// "pattern min_ttl max_ttl".
+func parseTTLRule(s string) (pattern string, r ttlRange, err error) {
+	f := strings.Fields(s)
+	if len(f) != 2 && len(f) != 3 {
+		return "", r, fmt.Errorf("ttl rule must have 2 or 3 fields, but got %d", len(f))
+	}
+	ttls := make([]uint32, 0, 2)
+	for _, s := range f[1:] {
+		ttl, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return "", r, fmt.Errorf("invalid ttl %s, %w", s, err)
+		}
+		ttls = append(ttls, uint32(ttl))
+	}
+	if len(ttls) == 1 {
+		return f[0], ttlRange{min: ttls[0], max: ttls[0]}, nil
+	}
+	if ttls[1] != 0 && ttls[0] > ttls[1] {
+		return "", r, fmt.Errorf("min ttl %d is larger than max ttl %d", ttls[0], ttls[1])
+	}
+	return f[0], ttlRange{min: ttls[0], max: ttls[1]}, nil
+}
+
+func newTTLRules(static []string, rules []TTLRule, minTTL, maxTTL uint32, dm *data_provider.DataManager) (*ttlRules, error) {
+	if len(static) == 0 && len(rules) == 0 && minTTL == 0 && maxTTL == 0 {
+		return nil, nil
+	}
+	if maxTTL != 0 && minTTL > maxTTL {
+		return nil, fmt.Errorf("min_ttl %d is larger than max_ttl %d", minTTL, maxTTL)
+	}
+	t := &ttlRules{static: domain.NewMixMatcher[ttlRange]()}
+	if minTTL != 0 || maxTTL != 0 {
+		t.def = &ttlRange{min: minTTL, max: maxTTL}
+	}
+	t.static.SetDefaultMatcher(domain.MatcherFull)
+	for _, s := range static {
+		if err := domain.Load[ttlRange](t.static, strings.ToLower(s), parseTTLRule); err != nil {
+			t.close()
+			return nil, fmt.Errorf("invalid ttl rule %s, %w", s, err)
+		}
+	}
+	for i, rule := range rules {
+		if rule.MaxTTL != 0 && rule.MinTTL > rule.MaxTTL {
+			t.close()
+			return nil, fmt.Errorf("ttl rule #%d, min_ttl %d is larger than max_ttl %d", i, rule.MinTTL, rule.MaxTTL)
+		}
+		m, err := domain.BatchLoadDomainProvider(rule.Domain, dm)
+		if err != nil {
+			t.close()
+			return nil, fmt.Errorf("ttl rule #%d, %w", i, err)
+		}
+		t.rules = append(t.rules, ttlRule{m: m, r: ttlRange{min: rule.MinTTL, max: rule.MaxTTL}})
+	}
+	return t, nil
+}
+
+func (t *ttlRules) match(qname string) (ttlRange, bool) {
+	if r, ok := t.static.Match(qname); ok {
+		return r, true
+	}
+	for _, rule := range t.rules {
+		if _, ok := rule.m.Match(qname); ok {
+			return rule.r, true
+		}
+	}
+	if t.def != nil {
+		return *t.def, true
+	}
+	return ttlRange{}, false
+}
+
+func (t *ttlRules) close() {
+	for _, rule := range t.rules {
+		_ = rule.m.Close()
+	}
+}
+
+// applyTTLRules applies the ttl rule of the query to the response of qCtx
+// before it is stored, so clients of this response and of the cached one
+// see the same ttls. It returns the response, which may be nil.
+func (c *cachePlugin) applyTTLRules(qCtx *query_context.Context) *dns.Msg {
+	r := qCtx.R()
+	if r == nil || c.ttlRules == nil {
+		return r
+	}
+	q := qCtx.Q()
+	tr, ok := c.ttlRules.match(q.Question[0].Name)
+	if !ok {
+		return r
+	}
+	r = qCtx.MutableR()
+	if tr.max > 0 {
+		dnsutils.ApplyMaximumTTL(r, tr.max)
+	}
+	if tr.min > 0 {
+		dnsutils.ApplyMinimalTTL(r, tr.min)
+	}
+	return r
+}
@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const (
+	defaultLazyUpdateWorkers = 32
+	defaultLazyUpdateQueue   = 1024
+)
+
+var (
+	errUpdateDropped = errors.New("background update dropped, the queue is full")
+	errUpdateClosed  = errors.New("background update canceled, the cache is closed")
+)
+
+// updateResult is the result of a background update, the response (may be
+// nil) and the error of next.
+type updateResult struct {
+	r   *dns.Msg
+	err error
+}
+
+type updateJob struct {
+	key     uint64
+	qCtx    *query_context.Context
+	next    executable_seq.ExecutableChainNode
+	waiters []chan updateResult
+}
+
+// updateQueue runs background updates with at most maxWorkers goroutines,
+// so a burst of expired entries won't spawn a goroutine for each of them.
+// Updates of the same key are merged until the update is done. Updates
+// wait in a queue of maxQueue. If it is full, the oldest one is dropped.
+type updateQueue struct {
+	maxWorkers int
+	maxQueue   int
+	run        func(job *updateJob) updateResult
+	dropped    atomic.Uint64
+
+	mu      sync.Mutex
+	closed  bool
+	workers int
+	queue   []*updateJob
+	jobs    map[uint64]*updateJob // delayed, queued and running jobs
+}
+
+func newUpdateQueue(maxWorkers, maxQueue int, run func(job *updateJob) updateResult) *updateQueue {
+	return &updateQueue{
+		maxWorkers: maxWorkers,
+		maxQueue:   maxQueue,
+		run:        run,
+		jobs:       make(map[uint64]*updateJob),
+	}
+}
+
+// submit queues an update of key after delay, unless there is one
+// already. The returned channel receives the result of the update.
+func (q *updateQueue) submit(key uint64, qCtx *query_context.Context, next executable_seq.ExecutableChainNode, delay time.Duration) <-chan updateResult {
+	resC := make(chan updateResult, 1)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		resC <- updateResult{err: errUpdateClosed}
+		return resC
+	}
+	if job := q.jobs[key]; job != nil {
+		job.waiters = append(job.waiters, resC)
+		return resC
+	}
+
+	job := &updateJob{key: key, qCtx: qCtx, next: next, waiters: []chan updateResult{resC}}
+	q.jobs[key] = job
+	if delay > 0 {
+		time.AfterFunc(delay, func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.enqueueLocked(job)
+		})
+	} else {
+		q.enqueueLocked(job)
+	}
+	return resC
+}
+
+func (q *updateQueue) enqueueLocked(job *updateJob) {
+	if q.closed {
+		q.finishLocked(job, updateResult{err: errUpdateClosed})
+		return
+	}
+	if len(q.queue) >= q.maxQueue {
+		oldest := q.queue[0]
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+		q.dropped.Add(1)
+		q.finishLocked(oldest, updateResult{err: errUpdateDropped})
+	}
+	q.queue = append(q.queue, job)
+	if q.workers < q.maxWorkers {
+		q.workers++
+		go q.work()
+	}
+}
+
+// work runs the queued jobs until the queue is empty.
+func (q *updateQueue) work() {
+	for {
+		q.mu.Lock()
+		if len(q.queue) == 0 {
+			q.workers--
+			q.mu.Unlock()
+			return
+		}
+		job := q.queue[0]
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+		q.mu.Unlock()
+
+		res := q.run(job)
+		q.mu.Lock()
+		q.finishLocked(job, res)
+		q.mu.Unlock()
+	}
+}
+
+// finishLocked sends res to the waiters of job and forgets it.
+func (q *updateQueue) finishLocked(job *updateJob, res updateResult) {
+	delete(q.jobs, job.key)
+	for _, c := range job.waiters {
+		c <- res
+	}
+}
+
+// queued returns the number of queued jobs.
+func (q *updateQueue) queued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queue)
+}
+
+// close drops the queued jobs. Running jobs are not canceled.
+func (q *updateQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	for _, job := range q.queue {
+		q.finishLocked(job, updateResult{err: errUpdateClosed})
+	}
+	q.queue = nil
+}
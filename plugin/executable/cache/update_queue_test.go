@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_updateQueue(t *testing.T) {
+	release := make(chan struct{})
+	var runs atomic.Int32
+	q := newUpdateQueue(1, 2, func(job *updateJob) updateResult {
+		runs.Add(1)
+		<-release
+		return updateResult{}
+	})
+
+	r1 := q.submit(1, nil, nil, 0)
+	time.Sleep(10 * time.Millisecond) // let the worker take job 1
+	r1b := q.submit(1, nil, nil, 0)   // merged into the running job 1
+	r2 := q.submit(2, nil, nil, 0)
+	r3 := q.submit(3, nil, nil, 0)
+	r4 := q.submit(4, nil, nil, 0) // drops job 2, the oldest queued one
+	if n := q.queued(); n != 2 {
+		t.Fatalf("want 2 queued jobs, got %d", n)
+	}
+	if res := <-r2; res.err != errUpdateDropped {
+		t.Fatalf("want job 2 dropped, got %v", res.err)
+	}
+	if got := q.dropped.Load(); got != 1 {
+		t.Fatalf("want 1 dropped, got %d", got)
+	}
+
+	close(release)
+	for i, c := range []<-chan updateResult{r1, r1b, r3, r4} {
+		if res := <-c; res.err != nil {
+			t.Fatalf("result #%d, %v", i, res.err)
+		}
+	}
+	if got := runs.Load(); got != 3 {
+		t.Fatalf("want 3 runs, got %d", got)
+	}
+
+	q.close()
+	if res := <-q.submit(5, nil, nil, 0); res.err != errUpdateClosed {
+		t.Fatalf("want closed error, got %v", res.err)
+	}
+}
@@ -0,0 +1,219 @@
+package cache_warmup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "cache_warmup"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	defaultQPS          = 100
+	maxQPS              = 10000
+	defaultQueryTimeout = time.Second * 5
+)
+
+// Args of cache_warmup. It resolves the domains through Exec once after
+// startup, so a cache in Exec is populated before clients arrive. It must
+// be placed after the plugins that Exec references.
+type Args struct {
+	// Exec is the sequence to resolve the domains, e.g. the tag of the
+	// sequence of a server.
+	Exec interface{} `yaml:"exec"`
+	// Domains are domains, and domain list files, e.g. "provider:top_list",
+	// whose lines are domains. Prefixes "full:" and "domain:" are ignored,
+	// and lines of other patterns, e.g. "regexp:", are skipped.
+	Domains []string `yaml:"domains"`
+	// QTypes are the qtypes to query for each domain, default A and AAAA.
+	QTypes []uint16 `yaml:"qtypes"`
+	// QPS is the max number of queries per second (default 100). Values
+	// above 10000 are lowered to 10000.
+	QPS int `yaml:"qps"`
+	// Delay (ms) delays the warm-up after startup.
+	Delay int `yaml:"delay"`
+}
+
+var _ coremain.Plugin = (*warmUp)(nil)
+
+type warmUp struct {
+	*coremain.BP
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newWarmUp(bp, args.(*Args))
+}
+
+func newWarmUp(bp *coremain.BP, args *Args) (*warmUp, error) {
+	if args.Exec == nil {
+		return nil, errors.New("exec is empty")
+	}
+	if args.QPS <= 0 {
+		args.QPS = defaultQPS
+	}
+	args.QPS = min(args.QPS, maxQPS)
+	if len(args.QTypes) == 0 {
+		args.QTypes = []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+
+	exec, err := executable_seq.BuildExecutableLogicTree(args.Exec, bp.L(), bp.M().GetExecutables(), bp.M().GetMatchers())
+	if err != nil {
+		return nil, fmt.Errorf("invalid exec, %w", err)
+	}
+	names, err := loadDomains(args.Domains, bp.M())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &warmUp{
+		BP:     bp,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		select {
+		case <-time.After(time.Duration(args.Delay) * time.Millisecond):
+		case <-ctx.Done():
+			return
+		}
+		w.run(ctx, exec, names, args.QTypes, args.QPS)
+	}()
+	return w, nil
+}
+
+// loadDomains returns the fqdns of domains, without duplicates.
+func loadDomains(domains []string, m *coremain.Mosdns) ([]string, error) {
+	var names []string
+	seen := make(map[string]struct{})
+	add := func(s string) {
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+		s = strings.ToLower(strings.TrimSpace(s))
+		if typ, d, ok := strings.Cut(s, ":"); ok {
+			if typ != "full" && typ != "domain" {
+				return
+			}
+			s = d
+		}
+		if len(s) == 0 {
+			return
+		}
+		s = dns.Fqdn(s)
+		if _, dup := seen[s]; dup {
+			return
+		}
+		seen[s] = struct{}{}
+		names = append(names, s)
+	}
+
+	for _, s := range domains {
+		providerTag, ok := strings.CutPrefix(s, "provider:")
+		if !ok {
+			add(s)
+			continue
+		}
+		provider := m.GetDataManager().GetDataProvider(providerTag)
+		if provider == nil {
+			return nil, fmt.Errorf("cannot find provider %s", providerTag)
+		}
+		b, err := provider.GetData()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load data from provider %s, %w", providerTag, err)
+		}
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for sc.Scan() {
+			add(sc.Text())
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read data from provider %s, %w", providerTag, err)
+		}
+	}
+	return names, nil
+}
+
+// run queries names with qtypes through exec at most qps queries a second.
+func (w *warmUp) run(ctx context.Context, exec executable_seq.ExecutableChainNode, names []string, qtypes []uint16, qps int) {
+	start := time.Now()
+	w.L().Info("cache warm-up started", zap.Int("domains", len(names)))
+
+	ticker := time.NewTicker(time.Second / time.Duration(qps))
+	defer ticker.Stop()
+	var wg sync.WaitGroup
+	var queried, failed atomic.Int64
+	func() {
+		for _, name := range names {
+			for _, qtype := range qtypes {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					queried.Add(1)
+					if err := w.query(ctx, exec, name, qtype); err != nil {
+						failed.Add(1)
+						if w.L().Core().Enabled(zap.DebugLevel) {
+							w.L().Debug("warm-up query failed", zap.String("name", name), zap.Uint16("qtype", qtype), zap.Error(err))
+						}
+					}
+				}()
+			}
+		}
+	}()
+	wg.Wait()
+
+	w.L().Info(
+		"cache warm-up finished",
+		zap.Int64("queries", queried.Load()),
+		zap.Int64("failed", failed.Load()),
+		zap.Duration("elapsed", time.Since(start)),
+	)
+}
+
+func (w *warmUp) query(ctx context.Context, exec executable_seq.ExecutableChainNode, name string, qtype uint16) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultQueryTimeout)
+	defer cancel()
+
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	qCtx := query_context.NewContext(q, nil)
+	if err := executable_seq.ExecChainNode(ctx, qCtx, exec); err != nil {
+		return err
+	}
+	if r := qCtx.R(); r == nil || r.Rcode == dns.RcodeServerFailure {
+		return errors.New("no usable response")
+	}
+	return nil
+}
+
+// Close stops the warm-up if it is running.
+func (w *warmUp) Close() error {
+	w.cancel()
+	<-w.done
+	return nil
+}
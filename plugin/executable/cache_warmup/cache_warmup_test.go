@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache_warmup
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// countExec answers all queries and counts them.
+type countExec struct {
+	n atomic.Int64
+}
+
+func (e *countExec) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	e.n.Add(1)
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func newTestWarmUp(t *testing.T, args *Args) (*warmUp, *countExec) {
+	t.Helper()
+	e := new(countExec)
+	m := coremain.NewTestMosdns(map[string]executable_seq.Executable{"stub": e}, nil)
+	args.Exec = "stub"
+	w, err := newWarmUp(coremain.NewBP("warmup", PluginType, nil, m), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, e
+}
+
+func Test_warmUp_qps(t *testing.T) {
+	start := time.Now()
+	w, e := newTestWarmUp(t, &Args{
+		Domains: []string{"a.com", "b.com", "c.com", "d.com", "e.com"},
+		QTypes:  []uint16{dns.TypeA},
+		QPS:     50,
+	})
+	<-w.done
+	if n := e.n.Load(); n != 5 {
+		t.Fatalf("want 5 queries, got %d", n)
+	}
+	// 5 queries at 50 qps take at least 100ms.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("queries are not rate limited, elapsed %s", elapsed)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_warmUp_maxQPS(t *testing.T) {
+	args := &Args{Domains: []string{"a.com"}, QPS: 2e9}
+	w, e := newTestWarmUp(t, args)
+	<-w.done
+	if args.QPS != maxQPS {
+		t.Fatalf("want qps %d, got %d", maxQPS, args.QPS)
+	}
+	if n := e.n.Load(); n != 2 {
+		t.Fatalf("want 2 queries, got %d", n)
+	}
+}
+
+func Test_warmUp_Close(t *testing.T) {
+	w, e := newTestWarmUp(t, &Args{
+		Domains: []string{"a.com", "b.com", "c.com", "d.com", "e.com"},
+		QPS:     1,
+	})
+	time.Sleep(1500 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		_ = w.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close does not stop the warm-up")
+	}
+	if n := e.n.Load(); n < 1 || n >= 10 {
+		t.Fatalf("want the warm-up to stop in the middle, got %d queries", n)
+	}
+
+	// Close during the delay.
+	w, e = newTestWarmUp(t, &Args{Domains: []string{"a.com"}, Delay: 60000})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.n.Load(); n != 0 {
+		t.Fatalf("want no queries, got %d", n)
+	}
+}
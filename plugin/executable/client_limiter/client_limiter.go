@@ -21,12 +21,16 @@ package client_limiter
 
 import (
 	"context"
+	"encoding/json"
+	"net/netip"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
+	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/cluster"
 	"github.com/pmkol/mosdns-x/pkg/concurrent_limiter"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
@@ -42,8 +46,15 @@ type Args struct {
 	MaxQPS int `yaml:"max_qps"`
 	V4Mask int `yaml:"v4_mask"` // default is 32
 	V6Mask int `yaml:"v6_mask"` // default is 48
+
+	// Cluster shares the counters with other instances in the cluster,
+	// see coremain.ClusterConfig. The counts are exchanged every
+	// clusterSyncInterval, so the limit is approximate.
+	Cluster bool `yaml:"cluster"`
 }
 
+const clusterSyncInterval = time.Millisecond * 200
+
 var _ coremain.ExecutablePlugin = (*Limiter)(nil)
 
 type Limiter struct {
@@ -52,6 +63,11 @@ type Limiter struct {
 	closeOnce   sync.Once
 	closeNotify chan struct{}
 	hpLimiter   *concurrent_limiter.HPClientLimiter
+
+	cluster      *cluster.Cluster // nil if sharing is disabled
+	clusterTopic string
+	pendingMu    sync.Mutex
+	pending      map[netip.Addr]int // local counts that are not published yet
 }
 
 func NewLimiter(bp *coremain.BP, args *Args) (*Limiter, error) {
@@ -68,6 +84,17 @@ func NewLimiter(bp *coremain.BP, args *Args) (*Limiter, error) {
 		closeNotify: make(chan struct{}),
 	}
 	go l.cleanerLoop()
+
+	if args.Cluster && bp.M().GetCluster() == nil {
+		bp.L().Warn("cluster mode is disabled, counters are not shared")
+	}
+	if args.Cluster && bp.M().GetCluster() != nil {
+		l.cluster = bp.M().GetCluster()
+		l.clusterTopic = PluginType + "/" + bp.Tag()
+		l.pending = make(map[netip.Addr]int)
+		l.cluster.Subscribe(l.clusterTopic, l.handleClusterCounts)
+		go l.clusterSyncLoop()
+	}
 	return l, nil
 }
 
@@ -82,9 +109,55 @@ func (l *Limiter) Exec(ctx context.Context, qCtx *query_context.Context, next ex
 		qCtx.SetResponse(r)
 		return nil
 	}
+	if l.pending != nil {
+		key := l.hpLimiter.ApplyMask(addr).Addr()
+		l.pendingMu.Lock()
+		l.pending[key]++
+		l.pendingMu.Unlock()
+	}
 	return executable_seq.ExecChainNode(ctx, qCtx, next)
 }
 
+// clusterSyncLoop publishes the pending local counts periodically.
+func (l *Limiter) clusterSyncLoop() {
+	ticker := time.NewTicker(clusterSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.pendingMu.Lock()
+			if len(l.pending) == 0 {
+				l.pendingMu.Unlock()
+				continue
+			}
+			counts := l.pending
+			l.pending = make(map[netip.Addr]int, len(counts))
+			l.pendingMu.Unlock()
+
+			b, err := json.Marshal(counts)
+			if err != nil {
+				continue
+			}
+			l.cluster.Publish(l.clusterTopic, b)
+		case <-l.closeNotify:
+			return
+		}
+	}
+}
+
+func (l *Limiter) handleClusterCounts(data []byte) {
+	var counts map[netip.Addr]int
+	if err := json.Unmarshal(data, &counts); err != nil {
+		l.L().Warn("invalid cluster counts", zap.Error(err))
+		return
+	}
+	for addr, n := range counts {
+		if addr.IsValid() && n > 0 {
+			l.hpLimiter.AddCount(addr, n)
+		}
+	}
+}
+
 func (l *Limiter) Close() error {
 	l.closeOnce.Do(func() {
 		close(l.closeNotify)
@@ -86,6 +86,11 @@ func (s *Selector) Exec(ctx context.Context, qCtx *query_context.Context, next e
 		return executable_seq.ExecChainNode(ctx, qCtx, next)
 	}
 
+	// skip the reference query if there is no time to wait for it.
+	if !query_context.HasBudget(ctx, s.getWaitTimeout()) {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
 	// start reference goroutine
 	qCtxRef := qCtx.Copy()
 	var refQtype uint16
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/cluster"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 )
@@ -17,6 +18,10 @@ const PluginType = "dynamic_domain_collector"
 
 type Args struct {
 	FileName string `yaml:"file"`
+
+	// Cluster shares collected domains with other instances in the
+	// cluster, see coremain.ClusterConfig.
+	Cluster bool `yaml:"cluster"`
 }
 
 type Collector struct {
@@ -24,6 +29,9 @@ type Collector struct {
 	fileName string
 	seen     sync.Map    // Optimal for read-heavy workloads
 	ch       chan string // Async buffer for batch file writing
+
+	cluster      *cluster.Cluster // nil if sharing is disabled
+	clusterTopic string
 }
 
 func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
@@ -51,6 +59,16 @@ func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
 	// Background worker for non-blocking disk I/O
 	go c.asyncWriter()
 
+	if a.Cluster {
+		c.cluster = bp.M().GetCluster()
+		c.clusterTopic = PluginType + "/" + bp.Tag()
+		c.cluster.Subscribe(c.clusterTopic, func(data []byte) {
+			if d := strings.ToLower(strings.Trim(string(data), ". \t\n\r")); d != "" {
+				c.add(d)
+			}
+		})
+	}
+
 	return c, nil
 }
 
@@ -89,19 +107,28 @@ func (c *Collector) Exec(ctx context.Context, qCtx *query_context.Context, next
 	// Since misc_optm already lowercased the domain, we avoid redundant heap allocations.
 	cleaned := strings.TrimSuffix(raw, ".")
 
-	// ATOMIC LOOKUP:
-	// LoadOrStore handles check-and-set in a single atomic-like operation.
-	if _, loaded := c.seen.LoadOrStore(cleaned, struct{}{}); !loaded {
-		select {
-		case c.ch <- cleaned:
-		default:
-			// Buffer full: drop to ensure zero impact on DNS response latency
-		}
+	if c.add(cleaned) {
+		c.cluster.Publish(c.clusterTopic, []byte(cleaned))
 	}
 
 	return executable_seq.ExecChainNode(ctx, qCtx, next)
 }
 
+// add adds a new domain and reports whether it was not seen before.
+func (c *Collector) add(domain string) bool {
+	// ATOMIC LOOKUP:
+	// LoadOrStore handles check-and-set in a single atomic-like operation.
+	if _, loaded := c.seen.LoadOrStore(domain, struct{}{}); loaded {
+		return false
+	}
+	select {
+	case c.ch <- domain:
+	default:
+		// Buffer full: drop to ensure zero impact on DNS response latency
+	}
+	return true
+}
+
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
 }
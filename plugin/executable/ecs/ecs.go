@@ -104,7 +104,8 @@ func (e *ecsPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next
 		return err
 	}
 
-	if r := qCtx.R(); r != nil {
+	if r := qCtx.R(); r != nil && (upgraded || newECS) {
+		r = qCtx.MutableR()
 		if upgraded {
 			dnsutils.RemoveEDNS0(r)
 		} else if newECS {
@@ -214,7 +215,7 @@ func (n *noECS) Exec(ctx context.Context, qCtx *query_context.Context, next exec
 
 	err := executable_seq.ExecChainNode(ctx, qCtx, next)
 	
-	if r := qCtx.R(); r != nil {
+	if r := qCtx.MutableR(); r != nil {
 		dnsutils.RemoveMsgECS(r)
 	}
 	return err
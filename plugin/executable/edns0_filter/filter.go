@@ -2,6 +2,7 @@ package edns0_filter
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/miekg/dns"
 
@@ -21,13 +22,35 @@ func init() {
 	coremain.RegNewPersetPluginFunc("_edns0_filter_ecs_only", func(bp *coremain.BP) (coremain.Plugin, error) {
 		return NewFilter(bp, &Args{Keep: []uint16{dns.EDNS0SUBNET}}), nil
 	})
+	coremain.RegNewPersetPluginFunc("_edns0_filter_ecs_only_keep_padding", func(bp *coremain.BP) (coremain.Plugin, error) {
+		return NewFilter(bp, &Args{Keep: []uint16{dns.EDNS0SUBNET}, Padding: PaddingKeep}), nil
+	})
+	coremain.RegNewPersetPluginFunc("_edns0_filter_ecs_only_repad", func(bp *coremain.BP) (coremain.Plugin, error) {
+		return NewFilter(bp, &Args{Keep: []uint16{dns.EDNS0SUBNET}, Padding: PaddingRepad}), nil
+	})
 }
 
+// Padding policies.
+const (
+	PaddingStrip = "strip" // Remove the padding option.
+	PaddingKeep  = "keep"  // Keep the padding option regardless of other filter rules.
+	PaddingRepad = "repad" // Replace the padding of padded queries with a new one, to a multiple of 128 octets (RFC 8467).
+)
+
+const paddingBlockLen = 128 // the recommended Block-Length of queries of RFC 8467
+
 type Args struct {
 	// Args priority: NoEDNS > Keep > Discard.
 	NoEDNS  bool     `yaml:"no_edns"`
 	Keep    []uint16 `yaml:"accept"`
 	Discard []uint16 `yaml:"discard"`
+
+	// Padding is the policy of the client's padding option, applied after
+	// the filter rules above (except NoEDNS). Can be "strip", "keep" or "repad".
+	// Empty means the padding option is filtered like any other option.
+	// Padding never affects the cache key, so padded clients share cache
+	// entries with non-padded ones.
+	Padding string `yaml:"padding"`
 }
 
 var _ coremain.ExecutablePlugin = (*Filter)(nil)
@@ -40,7 +63,13 @@ type Filter struct {
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
-	return NewFilter(bp, args.(*Args)), nil
+	a := args.(*Args)
+	switch a.Padding {
+	case "", PaddingStrip, PaddingKeep, PaddingRepad:
+	default:
+		return nil, fmt.Errorf("invalid padding policy %s", a.Padding)
+	}
+	return NewFilter(bp, a), nil
 }
 
 func NewFilter(bp *coremain.BP, args *Args) *Filter {
@@ -71,6 +100,30 @@ func (s *Filter) Exec(ctx context.Context, qCtx *query_context.Context, next exe
 }
 
 func (s *Filter) applyFilter(q *dns.Msg) {
+	if s.args.NoEDNS || len(s.args.Padding) == 0 {
+		s.applyOptionFilter(q)
+		return
+	}
+
+	var padding dns.EDNS0
+	if opt := q.IsEdns0(); opt != nil {
+		padding = dnsutils.GetEDNS0Option(opt, dns.EDNS0PADDING)
+	}
+	s.applyOptionFilter(q)
+	if padding == nil {
+		return
+	}
+	opt := q.IsEdns0()
+	dnsutils.RemoveEDNS0Option(opt, dns.EDNS0PADDING)
+	switch s.args.Padding {
+	case PaddingKeep:
+		opt.Option = append(opt.Option, padding)
+	case PaddingRepad:
+		dnsutils.PadToBlock(q, paddingBlockLen)
+	}
+}
+
+func (s *Filter) applyOptionFilter(q *dns.Msg) {
 	switch {
 	case s.args.NoEDNS:
 		dnsutils.RemoveEDNS0(q)
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package edns0_filter
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+func Test_Filter_padding(t *testing.T) {
+	padding := &dns.EDNS0_PADDING{Padding: bytes.Repeat([]byte{1}, 40)}
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IP{1, 2, 3, 0}}
+	cookie := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"}
+
+	tests := []struct {
+		name        string
+		padding     string
+		padded      bool
+		wantPadding []byte // nil means no padding option
+		wantLen     int    // If not zero, the wire length of the filtered query.
+		qname       string // Default is example.com.
+	}{
+		{"filtered", "", true, nil, 0, ""},
+		{"strip", PaddingStrip, true, nil, 0, ""},
+		{"keep", PaddingKeep, true, padding.Padding, 0, ""},
+		{"repad", PaddingRepad, true, nil, paddingBlockLen, ""},
+		{"repad over a block", PaddingRepad, true, nil, 2 * paddingBlockLen, strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + ".example.com."},
+		{"repad non-padded", PaddingRepad, false, nil, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qname := tt.qname
+			if len(qname) == 0 {
+				qname = "example.com."
+			}
+			q := new(dns.Msg)
+			q.SetQuestion(qname, dns.TypeA)
+			q.SetEdns0(1232, false)
+			opt := q.IsEdns0()
+			if tt.padded {
+				opt.Option = append(opt.Option, padding)
+			}
+			opt.Option = append(opt.Option, ecs, cookie)
+
+			f := NewFilter(nil, &Args{Keep: []uint16{dns.EDNS0SUBNET}, Padding: tt.padding})
+			f.applyFilter(q)
+
+			opt = q.IsEdns0()
+			if dnsutils.GetEDNS0Option(opt, dns.EDNS0SUBNET) == nil {
+				t.Fatal("ecs option is removed")
+			}
+			if dnsutils.GetEDNS0Option(opt, dns.EDNS0COOKIE) != nil {
+				t.Fatal("cookie option is not removed")
+			}
+			if tt.wantLen > 0 {
+				if l := q.Len(); l != tt.wantLen {
+					t.Fatalf("want repadded length %d, got %d", tt.wantLen, l)
+				}
+				return
+			}
+			pd, _ := dnsutils.GetEDNS0Option(opt, dns.EDNS0PADDING).(*dns.EDNS0_PADDING)
+			if tt.wantPadding == nil {
+				if pd != nil {
+					t.Fatalf("unexpected padding %v", pd)
+				}
+				return
+			}
+			if pd == nil || !bytes.Equal(pd.Padding, tt.wantPadding) {
+				t.Fatalf("want the original padding, got %v", pd)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/upstream"
+)
+
+type upstreamConns struct {
+	Upstream string     `json:"upstream"`
+	Conns    []connInfo `json:"conns"` // nil if the upstream does not support introspection.
+}
+
+type connInfo struct {
+	Protocol   string `json:"protocol"`
+	RemoteAddr string `json:"remote_addr"`
+	Age        string `json:"age"`
+	InFlight   int    `json:"in_flight"`
+	Served     uint64 `json:"served"`
+}
+
+// ServeHTTP serves the upstream introspection API.
+// GET conns: lists live connections of each upstream.
+// GET capture: dumps the captured wire messages of each upstream.
+func (f *fastForward) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/conns"):
+		f.serveConns(w)
+	case strings.HasSuffix(req.URL.Path, "/capture"):
+		f.serveCapture(w)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (f *fastForward) serveCapture(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, bu := range f.upstreamWrappers {
+		uw, ok := bu.(*upstreamWrapper)
+		if !ok || uw.capture == nil {
+			continue
+		}
+		fmt.Fprintf(w, "### %s\n\n", uw.address)
+		if err := uw.capture.WriteHex(w); err != nil {
+			f.L().Warn("failed to write api response", zap.Error(err))
+			return
+		}
+	}
+}
+
+func (f *fastForward) serveConns(w http.ResponseWriter) {
+	res := make([]upstreamConns, 0, len(f.upstreamWrappers))
+	for _, bu := range f.upstreamWrappers {
+		uc := upstreamConns{Upstream: bu.Address()}
+		if uw, ok := bu.(*upstreamWrapper); ok {
+			if r, ok := uw.u.(upstream.ConnInfoReporter); ok {
+				uc.Conns = make([]connInfo, 0)
+				for _, c := range r.ConnInfo() {
+					uc.Conns = append(uc.Conns, connInfo{
+						Protocol:   c.Protocol,
+						RemoteAddr: c.RemoteAddr,
+						Age:        c.Age.Round(time.Millisecond).String(),
+						InFlight:   c.InFlight,
+						Served:     c.Served,
+					})
+				}
+			}
+		}
+		res = append(res, uc)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		f.L().Warn("failed to write api response", zap.Error(err))
+	}
+}
@@ -8,20 +8,30 @@ package fastforward
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/allocaudit"
 	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 	"github.com/pmkol/mosdns-x/pkg/upstream"
+	"github.com/pmkol/mosdns-x/pkg/upstream/capture"
+	"github.com/pmkol/mosdns-x/pkg/upstream/session_cache"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
@@ -38,30 +48,69 @@ type fastForward struct {
 	args *Args
 
 	upstreamWrappers []bundled_upstream.Upstream
+	tiers            []tier // upstreamWrappers grouped by tier, in order
+	tierTimeout      time.Duration
 	upstreamsCloser  []io.Closer
+	sessionCache     *session_cache.Store // nil if not configured
+
+	queryTotal      *prometheus.CounterVec
+	errTotal        *prometheus.CounterVec
+	inflight        *prometheus.GaugeVec
+	responseLatency *prometheus.HistogramVec
 }
 
 type Args struct {
 	Upstream []*UpstreamConfig `yaml:"upstream"`
-	CA        []string          `yaml:"ca"`
+	CA       []string          `yaml:"ca"`
+
+	// SessionCache is the file that stores TLS sessions of upstreams,
+	// so they can be resumed after a restart.
+	SessionCache string `yaml:"session_cache"`
+
+	// TierTimeout in milliseconds. It is the time budget of each tier
+	// except the last one. Default is an even share of the time left
+	// for the query among the remaining tiers.
+	TierTimeout int `yaml:"tier_timeout"`
 }
 
 type UpstreamConfig struct {
-	Addr           string `yaml:"addr"` // required
-	DialAddr       string `yaml:"dial_addr"`
-	Trusted        bool   `yaml:"trusted"` // Ignored by racing logic, kept for config compatibility
-	Socks5         string `yaml:"socks5"`
-	S5Username     string `yaml:"s5_username"`
-	S5Password     string `yaml:"s5_password"`
-	SoMark         int    `yaml:"so_mark"`
-	BindToDevice   string `yaml:"bind_to_device"`
-	IdleTimeout    int    `yaml:"idle_timeout"`
-	MaxConns       int    `yaml:"max_conns"`
-	EnablePipeline bool   `yaml:"enable_pipeline"`
-	Bootstrap      string `yaml:"bootstrap"`
-	Insecure       bool   `yaml:"insecure"`
-	KernelTX       bool   `yaml:"kernel_tx"`
-	KernelRX       bool   `yaml:"kernel_rx"`
+	Addr             string `yaml:"addr"` // required
+	Tier             int    `yaml:"tier"` // Upstreams in a tier are only used if all upstreams in the previous tiers failed. Default is 1.
+	DialAddr         string `yaml:"dial_addr"`
+	Trusted          bool   `yaml:"trusted"` // Ignored by racing logic, kept for config compatibility
+	Socks5           string `yaml:"socks5"`
+	S5Username       string `yaml:"s5_username"`
+	S5Password       string `yaml:"s5_password"`
+	HTTPProxy        string `yaml:"http_proxy"`
+	SoMark           int    `yaml:"so_mark"`
+	BindToDevice     string `yaml:"bind_to_device"`
+	IdleTimeout      int    `yaml:"idle_timeout"`
+	MinIdle          int    `yaml:"min_idle"`
+	MaxLifetime      int    `yaml:"max_lifetime"`
+	MaxConns         int    `yaml:"max_conns"`
+	TruncateFallback string `yaml:"truncate_fallback"` // "tcp" (default), "dot" or "never"
+	AdaptiveBufSize  bool   `yaml:"adaptive_bufsize"`
+	RandomizeCase    bool   `yaml:"randomize_case"` // dns 0x20, udp only
+	UDPPoolMin       int    `yaml:"udp_pool_min"`
+	UDPPoolMax       int    `yaml:"udp_pool_max"` // Enables an adaptive pool of udp sockets.
+	MaxInflight      int    `yaml:"max_inflight"` // Queries exceeding this limit fail immediately. Zero means no limit.
+	EnablePipeline   bool   `yaml:"enable_pipeline"`
+	EnableKeepalive  bool   `yaml:"enable_keepalive"`
+	Bootstrap        string `yaml:"bootstrap"`
+	Insecure         bool   `yaml:"insecure"`
+	ECH              string `yaml:"ech"`         // base64 encoded ECHConfigList or "auto"
+	ClientCert       string `yaml:"client_cert"` // client certificate file for mutual TLS
+	ClientKey        string `yaml:"client_key"`
+	DANE             bool   `yaml:"dane"` // verify server certificates against tlsa records
+	KernelTX         bool   `yaml:"kernel_tx"`
+	KernelRX         bool   `yaml:"kernel_rx"`
+	MinTTL           uint32 `yaml:"min_ttl"` // Raises lower ttls of responses to this value.
+
+	// Capture records the wire messages exchanged with the upstream in a
+	// ring buffer for diagnostics. They can be dumped via the api.
+	Capture        bool     `yaml:"capture"`
+	CaptureDomains []string `yaml:"capture_domains"` // Only capture these domains. Default is all.
+	CaptureSize    int      `yaml:"capture_size"`    // Max number of captured messages. Default is 256.
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -75,12 +124,33 @@ func newFastForward(bp *coremain.BP, args *Args) (*fastForward, error) {
 	}
 
 	f := &fastForward{
-		BP:   bp,
-		args: args,
+		BP:          bp,
+		args:        args,
+		tierTimeout: time.Duration(args.TierTimeout) * time.Millisecond,
+
+		queryTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_query_total",
+			Help: "The total number of queries sent to the upstream",
+		}, []string{"upstream"}),
+		errTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_err_total",
+			Help: "The total number of queries failed by the upstream",
+		}, []string{"upstream"}),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "upstream_inflight",
+			Help: "The number of queries currently waiting for the upstream",
+		}, []string{"upstream"}),
+		responseLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "upstream_response_latency_millisecond",
+			Help:    "The response latency of the upstream in millisecond",
+			Buckets: []float64{1, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000},
+		}, []string{"upstream"}),
 	}
+	bp.GetMetricsReg().MustRegister(f.queryTotal, f.errTotal, f.inflight, f.responseLatency)
 
 	f.upstreamWrappers = make([]bundled_upstream.Upstream, 0, n)
 	f.upstreamsCloser = make([]io.Closer, 0, n)
+	tiers := make(map[int][]bundled_upstream.Upstream)
 
 	var rootCAs *x509.CertPool
 	if len(args.CA) != 0 {
@@ -91,33 +161,89 @@ func newFastForward(bp *coremain.BP, args *Args) (*fastForward, error) {
 		}
 	}
 
+	var sessionCache *session_cache.Store
+	if len(args.SessionCache) != 0 {
+		var err error
+		sessionCache, err = session_cache.Open(args.SessionCache)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open session cache: %w", err)
+		}
+		f.sessionCache = sessionCache
+	}
+
 	for _, c := range args.Upstream {
 		if len(c.Addr) == 0 {
 			return nil, errors.New("missing server addr")
 		}
+		if c.Tier <= 0 {
+			c.Tier = 1
+		}
 
 		if strings.HasPrefix(c.Addr, "udpme://") {
 			u := newUDPME(c.Addr[8:])
-			f.upstreamWrappers = append(f.upstreamWrappers, u)
+			uw := f.newUpstreamWrapper(c.Addr, u, c.MaxInflight)
+			uw.minTTL = c.MinTTL
+			f.upstreamWrappers = append(f.upstreamWrappers, uw)
+			tiers[c.Tier] = append(tiers[c.Tier], uw)
 			continue
 		}
 
+		var clientCert *tls.Certificate
+		if len(c.ClientCert) != 0 || len(c.ClientKey) != 0 {
+			cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client cert of upstream %s: %w", c.Addr, err)
+			}
+			clientCert = &cert
+		}
+
+		var wireCapture *capture.Capture
+		if c.Capture {
+			var match func(string) bool
+			if len(c.CaptureDomains) > 0 {
+				mg, err := domain.BatchLoadDomainProvider(c.CaptureDomains, bp.M().GetDataManager())
+				if err != nil {
+					return nil, fmt.Errorf("failed to load capture domains of upstream %s: %w", c.Addr, err)
+				}
+				f.upstreamsCloser = append(f.upstreamsCloser, mg)
+				match = func(name string) bool {
+					_, ok := mg.Match(name)
+					return ok
+				}
+			}
+			wireCapture = capture.New(c.CaptureSize, match)
+		}
+
 		opt := &upstream.Opt{
-			DialAddr:       c.DialAddr,
-			Socks5:         c.Socks5,
-			S5Username:     c.S5Username,
-			S5Password:     c.S5Password,
-			SoMark:         c.SoMark,
-			BindToDevice:   c.BindToDevice,
-			IdleTimeout:    time.Duration(c.IdleTimeout) * time.Second,
-			MaxConns:       c.MaxConns,
-			EnablePipeline: c.EnablePipeline,
-			Bootstrap:      c.Bootstrap,
-			Insecure:       c.Insecure,
-			RootCAs:        rootCAs,
-			KernelTX:       c.KernelTX,
-			KernelRX:       c.KernelRX,
-			Logger:         bp.L(),
+			DialAddr:         c.DialAddr,
+			Socks5:           c.Socks5,
+			S5Username:       c.S5Username,
+			S5Password:       c.S5Password,
+			HTTPProxy:        c.HTTPProxy,
+			SoMark:           c.SoMark,
+			BindToDevice:     c.BindToDevice,
+			IdleTimeout:      time.Duration(c.IdleTimeout) * time.Second,
+			MinIdleTimeout:   time.Duration(c.MinIdle) * time.Second,
+			MaxLifetime:      time.Duration(c.MaxLifetime) * time.Second,
+			MaxConns:         c.MaxConns,
+			TruncateFallback: c.TruncateFallback,
+			AdaptiveBufSize:  c.AdaptiveBufSize,
+			RandomizeCase:    c.RandomizeCase,
+			UDPPoolMin:       c.UDPPoolMin,
+			UDPPoolMax:       c.UDPPoolMax,
+			EnablePipeline:   c.EnablePipeline,
+			EnableKeepalive:  c.EnableKeepalive,
+			Bootstrap:        c.Bootstrap,
+			Insecure:         c.Insecure,
+			ECH:              c.ECH,
+			RootCAs:          rootCAs,
+			ClientCert:       clientCert,
+			DANE:             c.DANE,
+			Capture:          wireCapture,
+			SessionCache:     sessionCache,
+			KernelTX:         c.KernelTX,
+			KernelRX:         c.KernelRX,
+			Logger:           bp.L(),
 		}
 
 		u, err := upstream.NewUpstream(c.Addr, opt)
@@ -125,25 +251,85 @@ func newFastForward(bp *coremain.BP, args *Args) (*fastForward, error) {
 			return nil, fmt.Errorf("failed to init upstream %s: %w", c.Addr, err)
 		}
 
-		w := &upstreamWrapper{
-			address: c.Addr,
-			u:       u,
-		}
-
-		f.upstreamWrappers = append(f.upstreamWrappers, w)
+		uw := f.newUpstreamWrapper(c.Addr, u, c.MaxInflight)
+		uw.capture = wireCapture
+		uw.minTTL = c.MinTTL
+		f.upstreamWrappers = append(f.upstreamWrappers, uw)
 		f.upstreamsCloser = append(f.upstreamsCloser, u)
+		tiers[c.Tier] = append(tiers[c.Tier], uw)
 	}
 
+	tierNums := make([]int, 0, len(tiers))
+	for t := range tiers {
+		tierNums = append(tierNums, t)
+	}
+	sort.Ints(tierNums)
+	for _, t := range tierNums {
+		f.tiers = append(f.tiers, tier{num: t, upstreams: tiers[t]})
+	}
 	return f, nil
 }
 
+// tier is the upstreams of a configured UpstreamConfig.Tier.
+type tier struct {
+	num       int
+	upstreams []bundled_upstream.Upstream
+}
+
+var errTooManyInflight = errors.New("too many in-flight queries")
+
 type upstreamWrapper struct {
-	address string
-	u       upstream.Upstream
+	address     string
+	u           upstream.Upstream
+	maxInflight int32
+	running     atomic.Int32
+	capture     *capture.Capture // nil if capture is disabled
+	minTTL      uint32
+
+	queryTotal      prometheus.Counter
+	errTotal        prometheus.Counter
+	inflight        prometheus.Gauge
+	responseLatency prometheus.Observer
+}
+
+func (f *fastForward) newUpstreamWrapper(addr string, u upstream.Upstream, maxInflight int) *upstreamWrapper {
+	return &upstreamWrapper{
+		address:         addr,
+		u:               u,
+		maxInflight:     int32(maxInflight),
+		queryTotal:      f.queryTotal.WithLabelValues(addr),
+		errTotal:        f.errTotal.WithLabelValues(addr),
+		inflight:        f.inflight.WithLabelValues(addr),
+		responseLatency: f.responseLatency.WithLabelValues(addr),
+	}
 }
 
 func (u *upstreamWrapper) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
-	return u.u.ExchangeContext(ctx, q)
+	u.queryTotal.Inc()
+	if u.maxInflight > 0 {
+		if u.running.Add(1) > u.maxInflight {
+			u.running.Add(-1)
+			u.errTotal.Inc()
+			return nil, errTooManyInflight
+		}
+		defer u.running.Add(-1)
+	}
+	u.inflight.Inc()
+	defer u.inflight.Dec()
+
+	start := time.Now()
+	s := allocaudit.Begin()
+	r, err := u.u.ExchangeContext(ctx, q)
+	s.End(allocaudit.UpstreamExchange)
+	if err != nil {
+		u.errTotal.Inc()
+		return nil, err
+	}
+	u.responseLatency.Observe(float64(time.Since(start).Milliseconds()))
+	if u.minTTL > 0 {
+		dnsutils.ApplyMinimalTTL(r, u.minTTL)
+	}
+	return r, nil
 }
 
 func (u *upstreamWrapper) Address() string {
@@ -163,20 +349,11 @@ func (f *fastForward) Exec(ctx context.Context, qCtx *query_context.Context, nex
 }
 
 func (f *fastForward) exec(ctx context.Context, qCtx *query_context.Context) error {
-	upstreams := f.upstreamWrappers
-	
-	// Hot Path: Direct call for single upstream to avoid concurrency overhead
-	if len(upstreams) == 1 {
-		r, err := upstreams[0].Exchange(ctx, qCtx.Q())
-		if err != nil {
-			return err
-		}
-		qCtx.SetResponse(r)
-		return nil
+	if len(f.tiers) > 1 {
+		return f.execTiers(ctx, qCtx)
 	}
 
-	// Normal Path: Racing logic for multiple upstreams
-	r, err := bundled_upstream.ExchangeParallel(ctx, qCtx, upstreams, f.L())
+	r, err := f.exchange(ctx, qCtx, f.upstreamWrappers)
 	if err != nil {
 		return err
 	}
@@ -184,9 +361,75 @@ func (f *fastForward) exec(ctx context.Context, qCtx *query_context.Context) err
 	return nil
 }
 
+func (f *fastForward) exchange(ctx context.Context, qCtx *query_context.Context, upstreams []bundled_upstream.Upstream) (*dns.Msg, error) {
+	// Hot Path: Direct call for single upstream to avoid concurrency overhead
+	if len(upstreams) == 1 {
+		return upstreams[0].Exchange(ctx, qCtx.Q())
+	}
+
+	// Normal Path: Racing logic for multiple upstreams
+	return bundled_upstream.ExchangeParallel(ctx, qCtx, upstreams, f.L())
+}
+
+// execTiers tries tiers in order. The next tier is used if all upstreams
+// of the current tier failed or returned SERVFAIL.
+func (f *fastForward) execTiers(ctx context.Context, qCtx *query_context.Context) error {
+	var servFail *dns.Msg
+	var err error
+	for i, t := range f.tiers {
+		var r *dns.Msg
+		tierCtx, cancel := f.tierContext(ctx, i)
+		r, err = f.exchange(tierCtx, qCtx, t.upstreams)
+		cancel()
+		if err == nil && r != nil && r.Rcode != dns.RcodeServerFailure {
+			qCtx.SetResponse(r)
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+			break
+		}
+		if r != nil {
+			servFail = r
+		}
+		if i < len(f.tiers)-1 {
+			f.L().Debug("tier failed, trying next tier", qCtx.InfoField(), zap.Int("tier", t.num), zap.Error(err))
+		}
+	}
+	if servFail != nil {
+		qCtx.SetResponse(servFail)
+		return nil
+	}
+	return err
+}
+
+// tierContext returns the context of the i-th tier. Tiers except the last
+// one get a budget of their own, so a hanging tier won't use up the time of
+// the query and leave none for the next tiers.
+func (f *fastForward) tierContext(ctx context.Context, i int) (context.Context, context.CancelFunc) {
+	if i == len(f.tiers)-1 {
+		return ctx, func() {}
+	}
+	timeout := f.tierTimeout
+	if timeout <= 0 {
+		d, ok := query_context.Remaining(ctx)
+		if !ok {
+			return ctx, func() {}
+		}
+		timeout = d / time.Duration(len(f.tiers)-i)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 func (f *fastForward) Shutdown() error {
 	for _, u := range f.upstreamsCloser {
 		_ = u.Close()
 	}
+	// Closed after the upstreams, which may still store sessions.
+	if f.sessionCache != nil {
+		if err := f.sessionCache.Close(); err != nil {
+			f.L().Warn("failed to save session cache", zap.Error(err))
+		}
+	}
 	return nil
 }
@@ -0,0 +1,283 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+type testUpstream struct {
+	rcode int
+	err   error
+}
+
+func (u *testUpstream) Exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	r := new(dns.Msg)
+	r.SetRcode(q, u.rcode)
+	return r, nil
+}
+
+func (u *testUpstream) Trusted() bool   { return true }
+func (u *testUpstream) Address() string { return "test" }
+
+func Test_fastForward_execTiers(t *testing.T) {
+	errUpstream := &testUpstream{err: errors.New("upstream err")}
+	servFail := &testUpstream{rcode: dns.RcodeServerFailure}
+	nxDomain := &testUpstream{rcode: dns.RcodeNameError}
+
+	tests := []struct {
+		name      string
+		first     bundled_upstream.Upstream
+		second    bundled_upstream.Upstream
+		wantRcode int
+		wantErr   bool
+	}{
+		{"failed first tier", errUpstream, nxDomain, dns.RcodeNameError, false},
+		{"servfail first tier", servFail, nxDomain, dns.RcodeNameError, false},
+		{"servfail then error", servFail, errUpstream, dns.RcodeServerFailure, false},
+		{"error then servfail", errUpstream, servFail, dns.RcodeServerFailure, false},
+		{"all failed", errUpstream, errUpstream, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			f := &fastForward{
+				BP: coremain.NewBP("ff", PluginType, zap.New(core), nil),
+				tiers: []tier{
+					{num: 2, upstreams: []bundled_upstream.Upstream{tt.first}},
+					{num: 5, upstreams: []bundled_upstream.Upstream{tt.second}},
+				},
+			}
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			qCtx := query_context.NewContext(q, nil)
+			err := f.exec(context.Background(), qCtx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("exec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				if r := qCtx.R(); r == nil || r.Rcode != tt.wantRcode {
+					t.Fatalf("want rcode %d, got %v", tt.wantRcode, r)
+				}
+			}
+
+			entries := logs.FilterMessage("tier failed, trying next tier").All()
+			if len(entries) != 1 {
+				t.Fatalf("want 1 tier log, got %d", len(entries))
+			}
+			if got := entries[0].ContextMap()["tier"]; got != int64(2) {
+				t.Fatalf("want the configured tier 2 in the log, got %v", got)
+			}
+		})
+	}
+}
+
+// hangingUpstream blocks exchanges until ctx is done, like a blackholed
+// upstream.
+type hangingUpstream struct{}
+
+func (u *hangingUpstream) Exchange(ctx context.Context, _ *dns.Msg) (*dns.Msg, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (u *hangingUpstream) Trusted() bool   { return true }
+func (u *hangingUpstream) Address() string { return "hanging" }
+
+func Test_fastForward_execTiers_hanging(t *testing.T) {
+	tests := []struct {
+		name        string
+		tierTimeout time.Duration
+		ctxTimeout  time.Duration // zero means no deadline
+	}{
+		{"configured timeout", 50 * time.Millisecond, 0},
+		{"share of deadline", 0, 200 * time.Millisecond},
+		{"configured timeout with deadline", 50 * time.Millisecond, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fastForward{
+				BP:          coremain.NewBP("ff", PluginType, nil, nil),
+				tierTimeout: tt.tierTimeout,
+				tiers: []tier{
+					{num: 1, upstreams: []bundled_upstream.Upstream{&hangingUpstream{}}},
+					{num: 2, upstreams: []bundled_upstream.Upstream{&testUpstream{rcode: dns.RcodeNameError}}},
+				},
+			}
+
+			ctx := context.Background()
+			if tt.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.ctxTimeout)
+				defer cancel()
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			qCtx := query_context.NewContext(q, nil)
+			if err := f.exec(ctx, qCtx); err != nil {
+				t.Fatal(err)
+			}
+			if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeNameError {
+				t.Fatalf("want the response of tier 2, got %v", r)
+			}
+		})
+	}
+}
+
+// blockingUpstream blocks exchanges until release is closed.
+type blockingUpstream struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (u *blockingUpstream) ExchangeContext(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	u.entered <- struct{}{}
+	<-u.release
+	r := new(dns.Msg)
+	r.SetReply(q)
+	return r, nil
+}
+
+func (u *blockingUpstream) Close() error { return nil }
+
+func Test_upstreamWrapper_maxInflight(t *testing.T) {
+	f, err := newFastForward(coremain.NewBP("ff", PluginType, nil, coremain.NewTestMosdns(nil, nil)), &Args{
+		Upstream: []*UpstreamConfig{{Addr: "udp://127.0.0.1:53", MaxInflight: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Shutdown()
+	u := &blockingUpstream{entered: make(chan struct{}, 2), release: make(chan struct{})}
+	uw := f.upstreamWrappers[0].(*upstreamWrapper)
+	uw.u = u
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := uw.Exchange(context.Background(), q)
+			errs <- err
+		}()
+	}
+	<-u.entered
+	<-u.entered
+
+	if _, err := uw.Exchange(context.Background(), q); !errors.Is(err, errTooManyInflight) {
+		t.Fatalf("want errTooManyInflight, got %v", err)
+	}
+
+	close(u.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Finished queries free their slots.
+	go func() { <-u.entered }()
+	if _, err := uw.Exchange(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_newFastForward_clientCert(t *testing.T) {
+	_, err := newFastForward(coremain.NewBP("ff", PluginType, nil, coremain.NewTestMosdns(nil, nil)), &Args{
+		Upstream: []*UpstreamConfig{{Addr: "tls://127.0.0.1:853", ClientCert: "testdata/missing.crt"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "client cert") {
+		t.Fatalf("want client cert error, got %v", err)
+	}
+}
+
+// ttlUpstream answers queries with A records of ttls.
+type ttlUpstream struct {
+	ttls []uint32
+}
+
+func (u *ttlUpstream) ExchangeContext(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	for _, ttl := range u.ttls {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   []byte{192, 0, 2, 1},
+		})
+	}
+	return r, nil
+}
+
+func (u *ttlUpstream) Close() error { return nil }
+
+func Test_upstreamWrapper_minTTL(t *testing.T) {
+	f, err := newFastForward(coremain.NewBP("ff", PluginType, nil, coremain.NewTestMosdns(nil, nil)), &Args{
+		Upstream: []*UpstreamConfig{
+			{Addr: "udp://127.0.0.1:53", MinTTL: 300},
+			{Addr: "udp://127.0.0.2:53"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Shutdown()
+
+	tests := []struct {
+		name string
+		uw   *upstreamWrapper
+		want []uint32
+	}{
+		{"min_ttl", f.upstreamWrappers[0].(*upstreamWrapper), []uint32{300, 600}},
+		{"no min_ttl", f.upstreamWrappers[1].(*upstreamWrapper), []uint32{10, 600}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.uw.u = &ttlUpstream{ttls: []uint32{10, 600}}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			r, err := tt.uw.Exchange(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, rr := range r.Answer {
+				if got := rr.Header().Ttl; got != tt.want[i] {
+					t.Fatalf("answer #%d, want ttl %d, got %d", i, tt.want[i], got)
+				}
+			}
+		})
+	}
+}
@@ -21,17 +21,12 @@ func newUDPME(addr string) *udpmeUpstream {
 	return &udpmeUpstream{addr: addr}
 }
 
-func (u *udpmeUpstream) Address() string {
-	return u.addr
+// Close is a noop. udpmeUpstream does not keep any connection.
+func (u *udpmeUpstream) Close() error {
+	return nil
 }
 
-// Trusted now always returns true to satisfy the interface.
-// The core racing logic in bundled_upstream no longer uses this value.
-func (u *udpmeUpstream) Trusted() bool {
-	return true
-}
-
-func (u *udpmeUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+func (u *udpmeUpstream) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
 	ddl, ok := ctx.Deadline()
 	if !ok {
 		ddl = time.Now().Add(time.Second * 3)
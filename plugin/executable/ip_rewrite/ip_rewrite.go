@@ -0,0 +1,203 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_rewrite
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "ip_rewrite"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*ipRewrite)(nil)
+
+type Args struct {
+	// Domain limits the rewriting to responses of these domains.
+	// Empty means all domains.
+	Domain []string `yaml:"domain"`
+
+	// Rule is a list of "from to" mappings. Both can be an IP or a CIDR
+	// with the same family and length, in which case the host bits are
+	// kept. e.g. "203.0.113.10 192.168.1.10", "203.0.113.0/24 192.168.1.0/24".
+	Rule []string `yaml:"rule"`
+}
+
+type rule struct {
+	from netip.Prefix
+	to   netip.Prefix
+}
+
+type ipRewrite struct {
+	*coremain.BP
+	domain *domain.MatcherGroup[struct{}] // nil if all domains are matched
+	rules  []rule
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newIPRewrite(bp, args.(*Args))
+}
+
+func newIPRewrite(bp *coremain.BP, args *Args) (*ipRewrite, error) {
+	p := &ipRewrite{BP: bp}
+	for _, s := range args.Rule {
+		r, err := parseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		p.rules = append(p.rules, r)
+	}
+	if len(args.Domain) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(args.Domain, bp.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		p.domain = mg
+		bp.L().Info("domain matcher loaded", zap.Int("length", mg.Len()))
+	}
+	return p, nil
+}
+
+func parseRule(s string) (rule, error) {
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return rule{}, fmt.Errorf("ip rewrite rule must have 2 fields, but got %d", len(f))
+	}
+	from, err := parsePrefix(f[0])
+	if err != nil {
+		return rule{}, err
+	}
+	to, err := parsePrefix(f[1])
+	if err != nil {
+		return rule{}, err
+	}
+	if from.Addr().Is4() != to.Addr().Is4() || from.Bits() != to.Bits() {
+		return rule{}, fmt.Errorf("invalid rule %s, both sides must have the same family and length", s)
+	}
+	return rule{from: from, to: to}, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()).Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (p *ipRewrite) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+
+	r := qCtx.R()
+	if r == nil || len(r.Answer) == 0 {
+		return nil
+	}
+	if p.domain != nil {
+		q := qCtx.Q()
+		if len(q.Question) != 1 {
+			return nil
+		}
+		if _, ok := p.domain.Match(q.Question[0].Name); !ok {
+			return nil
+		}
+	}
+	p.rewrite(qCtx.MutableR())
+	return nil
+}
+
+func (p *ipRewrite) rewrite(r *dns.Msg) {
+	for _, rr := range r.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if addr, ok := netip.AddrFromSlice(rr.A); ok {
+				if newAddr, ok := p.lookup(addr.Unmap()); ok {
+					rr.A = newAddr.AsSlice()
+				}
+			}
+		case *dns.AAAA:
+			if addr, ok := netip.AddrFromSlice(rr.AAAA); ok {
+				if newAddr, ok := p.lookup(addr); ok {
+					rr.AAAA = net.IP(newAddr.AsSlice())
+				}
+			}
+		}
+	}
+}
+
+// lookup returns the replacement of addr from the first matched rule.
+func (p *ipRewrite) lookup(addr netip.Addr) (netip.Addr, bool) {
+	for _, r := range p.rules {
+		if r.from.Contains(addr) {
+			return translate(addr, r.to), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// translate replaces the network bits of addr with the ones of to.
+func translate(addr netip.Addr, to netip.Prefix) netip.Addr {
+	b := addr.AsSlice()
+	t := to.Addr().AsSlice()
+	bits := to.Bits()
+	for i := range b {
+		switch {
+		case bits >= 8:
+			b[i] = t[i]
+			bits -= 8
+		case bits > 0:
+			mask := byte(0xff) << (8 - bits)
+			b[i] = t[i]&mask | b[i]&^mask
+			bits = 0
+		}
+	}
+	newAddr, _ := netip.AddrFromSlice(b)
+	return newAddr
+}
+
+func (p *ipRewrite) Close() error {
+	if p.domain != nil {
+		_ = p.domain.Close()
+	}
+	return nil
+}
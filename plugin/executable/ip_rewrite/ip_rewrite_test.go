@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_rewrite
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_ipRewrite_rewrite(t *testing.T) {
+	p := new(ipRewrite)
+	for _, s := range []string{
+		"203.0.113.10 192.168.1.10",
+		"198.51.100.0/24 10.0.0.0/24",
+		"2001:db8::/64 fd00::/64",
+	} {
+		r, err := parseRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.rules = append(p.rules, r)
+	}
+	if _, err := parseRule("203.0.113.0/24 10.0.0.0/16"); err == nil {
+		t.Fatal("want err for different prefix length")
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"203.0.113.10", "192.168.1.10"},
+		{"203.0.113.11", "203.0.113.11"},
+		{"198.51.100.7", "10.0.0.7"},
+		{"2001:db8::1:2", "fd00::1:2"},
+		{"2001:db8:1::1", "2001:db8:1::1"},
+	}
+	for _, tt := range tests {
+		m := new(dns.Msg)
+		ip := net.ParseIP(tt.ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}, A: ip4})
+		} else {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: ip})
+		}
+		p.rewrite(m)
+		var got net.IP
+		switch rr := m.Answer[0].(type) {
+		case *dns.A:
+			got = rr.A
+		case *dns.AAAA:
+			got = rr.AAAA
+		}
+		if !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("rewrite(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -45,6 +45,7 @@ func (t *noCNAME) Exec(ctx context.Context, qCtx *query_context.Context, next ex
 		return nil
 	}
 
+	r = qCtx.MutableR()
 	ans := r.Answer
 	qName := r.Question[0].Name
 	writeIdx := 0
@@ -0,0 +1,256 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package nptv6
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "nptv6"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*nptv6)(nil)
+
+type Args struct {
+	// Domain limits the rewriting to responses of these domains.
+	// Empty means all domains.
+	Domain []string `yaml:"domain"`
+
+	// Prefix is a list of "external internal" prefix pairs. AAAA answers
+	// in the external prefix are translated to the internal prefix with
+	// the checksum-neutral mapping of RFC 6296, the same way an NPTv6
+	// translator maps them. Both prefixes must have the same length,
+	// which must not be longer than 64. e.g. "2001:db8:1::/48 fd01:203:405::/48".
+	Prefix []string `yaml:"prefix"`
+}
+
+type mapping struct {
+	from netip.Prefix
+	to   netip.Prefix
+	adj  uint16 // one's complement difference between from and to
+}
+
+type nptv6 struct {
+	*coremain.BP
+	domain   *domain.MatcherGroup[struct{}] // nil if all domains are matched
+	mappings []mapping
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newNPTv6(bp, args.(*Args))
+}
+
+func newNPTv6(bp *coremain.BP, args *Args) (*nptv6, error) {
+	p := &nptv6{BP: bp}
+	for _, s := range args.Prefix {
+		m, err := parseMapping(s)
+		if err != nil {
+			return nil, err
+		}
+		p.mappings = append(p.mappings, m)
+	}
+	if len(args.Domain) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(args.Domain, bp.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		p.domain = mg
+		bp.L().Info("domain matcher loaded", zap.Int("length", mg.Len()))
+	}
+	return p, nil
+}
+
+func parseMapping(s string) (mapping, error) {
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return mapping{}, fmt.Errorf("nptv6 prefix pair must have 2 fields, but got %d", len(f))
+	}
+	from, err := parsePrefix(f[0])
+	if err != nil {
+		return mapping{}, err
+	}
+	to, err := parsePrefix(f[1])
+	if err != nil {
+		return mapping{}, err
+	}
+	if from.Bits() != to.Bits() {
+		return mapping{}, fmt.Errorf("invalid prefix pair %s, both sides must have the same length", s)
+	}
+	return mapping{
+		from: from,
+		to:   to,
+		adj:  onesAdd(prefixSum(from), ^prefixSum(to)),
+	}, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if !p.Addr().Is6() || p.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("%s is not an ipv6 prefix", s)
+	}
+	if p.Bits() > 64 {
+		return netip.Prefix{}, fmt.Errorf("prefix %s is longer than 64", s)
+	}
+	return p.Masked(), nil
+}
+
+func (p *nptv6) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+
+	r := qCtx.R()
+	if r == nil || !hasAAAA(r) {
+		return nil
+	}
+	if p.domain != nil {
+		q := qCtx.Q()
+		if len(q.Question) != 1 {
+			return nil
+		}
+		if _, ok := p.domain.Match(q.Question[0].Name); !ok {
+			return nil
+		}
+	}
+	p.rewrite(qCtx.MutableR())
+	return nil
+}
+
+func hasAAAA(r *dns.Msg) bool {
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *nptv6) rewrite(r *dns.Msg) {
+	for _, rr := range r.Answer {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(aaaa.AAAA)
+		if !ok || !addr.Is6() || addr.Is4In6() {
+			continue
+		}
+		if newAddr, ok := p.lookup(addr); ok {
+			aaaa.AAAA = net.IP(newAddr.AsSlice())
+		}
+	}
+}
+
+// lookup returns the translated addr from the first matched mapping.
+func (p *nptv6) lookup(addr netip.Addr) (netip.Addr, bool) {
+	for _, m := range p.mappings {
+		if m.from.Contains(addr) {
+			return m.translate(addr)
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// translate maps addr from m.from to m.to as described in RFC 6296 section 3.
+// It returns false if addr cannot be translated, i.e. its adjustment word
+// is 0xffff.
+func (m mapping) translate(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+	t := m.to.Addr().As16()
+	bits := m.to.Bits()
+	for i := range b {
+		switch {
+		case bits >= 8:
+			b[i] = t[i]
+			bits -= 8
+		case bits > 0:
+			mask := byte(0xff) << (8 - bits)
+			b[i] = t[i]&mask | b[i]&^mask
+			bits = 0
+		}
+	}
+
+	// For prefixes up to /48, the adjustment is applied to bits 48-63.
+	// Otherwise, to the first word of the interface identifier that
+	// is not 0xffff.
+	word := -1
+	if m.to.Bits() <= 48 {
+		if binary.BigEndian.Uint16(b[6:]) != 0xffff {
+			word = 3
+		}
+	} else {
+		for i := 4; i < 8; i++ {
+			if binary.BigEndian.Uint16(b[i*2:]) != 0xffff {
+				word = i
+				break
+			}
+		}
+	}
+	if word < 0 {
+		return netip.Addr{}, false
+	}
+	w := onesAdd(binary.BigEndian.Uint16(b[word*2:]), m.adj)
+	if w == 0xffff {
+		w = 0
+	}
+	binary.BigEndian.PutUint16(b[word*2:], w)
+	return netip.AddrFrom16(b), true
+}
+
+// prefixSum returns the one's complement sum of the 16-bit words of p.
+func prefixSum(p netip.Prefix) uint16 {
+	b := p.Addr().As16()
+	var s uint16
+	for i := 0; i < 16; i += 2 {
+		s = onesAdd(s, binary.BigEndian.Uint16(b[i:]))
+	}
+	return s
+}
+
+func onesAdd(a, b uint16) uint16 {
+	s := uint32(a) + uint32(b)
+	return uint16(s&0xffff + s>>16)
+}
+
+func (p *nptv6) Close() error {
+	if p.domain != nil {
+		_ = p.domain.Close()
+	}
+	return nil
+}
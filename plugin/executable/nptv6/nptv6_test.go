@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package nptv6
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_nptv6_rewrite(t *testing.T) {
+	p := new(nptv6)
+	for _, s := range []string{
+		"2001:db8:1::/48 fd01:203:405::/48",
+		"2001:db8:2::/56 fd00:0:0:100::/56",
+		"2001:db8:3:4::/64 fd00:0:0:4::/64",
+	} {
+		m, err := parseMapping(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.mappings = append(p.mappings, m)
+	}
+	for _, s := range []string{
+		"2001:db8::/48 fd00::/64",
+		"2001:db8::/96 fd00::/96",
+		"192.0.2.0/24 198.51.100.0/24",
+	} {
+		if _, err := parseMapping(s); err == nil {
+			t.Fatalf("want err for %s", s)
+		}
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		// Example from RFC 6296 section 3.1, reversed.
+		{"2001:db8:1:d550::1234", "fd01:203:405:1::1234"},
+		{"2001:db8:1:ffff::1", "2001:db8:1:ffff::1"}, // untranslatable
+		{"2001:db8:9::1", "2001:db8:9::1"},
+	}
+	for _, tt := range tests {
+		m := new(dns.Msg)
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP(tt.ip)})
+		p.rewrite(m)
+		if got := m.Answer[0].(*dns.AAAA).AAAA; !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("rewrite(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+
+	// Translations must be checksum-neutral and reversible.
+	for _, tt := range []struct {
+		pair string
+		ip   string
+	}{
+		{"2001:db8:2::/56 fd00:0:0:100::/56", "2001:db8:2:42:1:2:3:4"},
+		{"2001:db8:3:4::/64 fd00:0:0:4::/64", "2001:db8:3:4:ffff:0:0:1"},
+	} {
+		m, _ := parseMapping(tt.pair)
+		fwd := new(nptv6)
+		fwd.mappings = append(fwd.mappings, m)
+		r, _ := parseMapping(m.to.String() + " " + m.from.String())
+		rev := new(nptv6)
+		rev.mappings = append(rev.mappings, r)
+
+		msg := new(dns.Msg)
+		msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP(tt.ip)})
+		fwd.rewrite(msg)
+		translated := msg.Answer[0].(*dns.AAAA).AAAA
+		if !m.to.Contains(ipToAddr(translated)) {
+			t.Fatalf("%s was translated to %s, which is not in %s", tt.ip, translated, m.to)
+		}
+		if addrSum(translated) != addrSum(net.ParseIP(tt.ip)) {
+			t.Errorf("translation of %s to %s is not checksum-neutral", tt.ip, translated)
+		}
+		rev.rewrite(msg)
+		if got := msg.Answer[0].(*dns.AAAA).AAAA; !got.Equal(net.ParseIP(tt.ip)) {
+			t.Errorf("reverse translation of %s = %s, want %s", translated, got, tt.ip)
+		}
+	}
+}
+
+func ipToAddr(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr
+}
+
+// addrSum returns the one's complement sum of ip, with 0xffff
+// normalized to 0.
+func addrSum(ip net.IP) uint16 {
+	s := prefixSum(netip.PrefixFrom(ipToAddr(ip), 128))
+	if s == 0xffff {
+		return 0
+	}
+	return s
+}
@@ -66,7 +66,7 @@ func (p *PadQuery) Exec(ctx context.Context, qCtx *query_context.Context, next e
 	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
 		return err
 	}
-	if r := qCtx.R(); r != nil {
+	if r := qCtx.MutableR(); r != nil {
 		oq := qCtx.OriginalQuery()
 		opt := oq.IsEdns0()
 		if opt == nil { // The original query does not have EDNS0
@@ -96,7 +96,7 @@ func (h *ResponsePaddingHandler) Exec(ctx context.Context, qCtx *query_context.C
 	}
 
 	oq := qCtx.OriginalQuery()
-	if r := qCtx.R(); r != nil {
+	if r := qCtx.MutableR(); r != nil {
 		opt := oq.IsEdns0()
 		if opt != nil { // Only pad response if client supports EDNS0.
 			if h.Always {
@@ -4,6 +4,12 @@
  *
  * Usage in config:
  * - _pre_reject
+ *
+ * or, with options, as a plugin of type pre_reject:
+ *   type: pre_reject
+ *   args:
+ *     strict_name_check: true
+ *     allow_escaped_octets: true
  */
 
 package pre_reject
@@ -18,18 +24,47 @@ import (
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 )
 
-const PluginType = "_pre_reject"
+const PluginType = "pre_reject"
 
 func init() {
-	coremain.RegNewPersetPluginFunc(PluginType, func(bp *coremain.BP) (coremain.Plugin, error) {
-		return &preReject{BP: bp}, nil
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+	coremain.RegNewPersetPluginFunc("_pre_reject", func(bp *coremain.BP) (coremain.Plugin, error) {
+		return newPreReject(bp, &Args{}), nil
 	})
 }
 
+// Args of pre_reject. By default, names can have letters, digits, '-'
+// and '_'.
+type Args struct {
+	// StrictNameCheck rejects '_' too, unless AllowUnderscore is set,
+	// which allows service labels like "_dns._udp".
+	StrictNameCheck bool `yaml:"strict_name_check"`
+	AllowUnderscore bool `yaml:"allow_underscore"`
+
+	// AllowEscapedOctets allows arbitrary octets, which are escaped in
+	// names, e.g. spaces of DNS-SD instance names and unicode names that
+	// are not punycode.
+	AllowEscapedOctets bool `yaml:"allow_escaped_octets"`
+}
+
 var _ coremain.ExecutablePlugin = (*preReject)(nil)
 
 type preReject struct {
 	*coremain.BP
+	validChar          [256]bool
+	allowEscapedOctets bool
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newPreReject(bp, args.(*Args)), nil
+}
+
+func newPreReject(bp *coremain.BP, args *Args) *preReject {
+	p := &preReject{BP: bp, validChar: validChar, allowEscapedOctets: args.AllowEscapedOctets}
+	if args.StrictNameCheck && !args.AllowUnderscore {
+		p.validChar['_'] = false
+	}
+	return p
 }
 
 func (p *preReject) Exec(
@@ -59,7 +94,17 @@ func (p *preReject) Exec(
 	for i := 0; i < len(name)-1; i++ {
 		c := name[i]
 
-		if !validChar[c] {
+		if c == '\\' && p.allowEscapedOctets {
+			// Skip the escaped octet, which is \DDD or \X.
+			if i+3 < len(name) && isDigit(name[i+1]) && isDigit(name[i+2]) && isDigit(name[i+3]) {
+				i += 3
+			} else {
+				i++
+			}
+			continue
+		}
+
+		if !p.validChar[c] {
 			return reject(q, qCtx)
 		}
 
@@ -81,6 +126,10 @@ func reject(q *dns.Msg, qCtx *query_context.Context) error {
 	return nil
 }
 
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
 var validChar = [256]bool{
 	'.': true, '-': true, '_': true,
 
@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package pre_reject
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_preReject_Exec(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      *Args
+		qname     string
+		wantRcode int
+	}{
+		{"ldh", &Args{}, "a-1.example.", dns.RcodeSuccess},
+		{"no tld", &Args{}, "localhost.", dns.RcodeNameError},
+		{"underscore", &Args{}, "_dns.resolver.arpa.", dns.RcodeSuccess},
+		{"strict underscore", &Args{StrictNameCheck: true}, "_dns.resolver.arpa.", dns.RcodeNameError},
+		{"strict underscore allowed", &Args{StrictNameCheck: true, AllowUnderscore: true}, "_dns.resolver.arpa.", dns.RcodeSuccess},
+		{"octets", &Args{}, `My\ Printer._ipp._tcp.local.`, dns.RcodeNameError},
+		{"octets allowed", &Args{AllowEscapedOctets: true}, `My\ Printer._ipp._tcp.local.`, dns.RcodeSuccess},
+		{"strict octets allowed", &Args{StrictNameCheck: true, AllowUnderscore: true, AllowEscapedOctets: true}, `My\ Printer._ipp._tcp.local.`, dns.RcodeSuccess},
+		{"unicode allowed", &Args{AllowEscapedOctets: true}, `caf\195\169.example.`, dns.RcodeSuccess},
+		{"escaped dot is not a dot", &Args{AllowEscapedOctets: true}, `a\.b.`, dns.RcodeNameError},
+		{"raw punctuation", &Args{AllowEscapedOctets: true}, "*.example.", dns.RcodeNameError},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPreReject(coremain.NewBP("test", PluginType, nil, nil), tt.args)
+
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, dns.TypeA)
+			r := new(dns.Msg)
+			r.SetReply(q)
+			next := executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: r})
+
+			qCtx := query_context.NewContext(q, nil)
+			if err := p.Exec(ctx, qCtx, next); err != nil {
+				t.Fatal(err)
+			}
+			if got := qCtx.R().Rcode; got != tt.wantRcode {
+				t.Fatalf("got rcode %d, want %d", got, tt.wantRcode)
+			}
+		})
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/mlog"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	C "github.com/pmkol/mosdns-x/pkg/query_context"
 )
@@ -89,7 +90,7 @@ func (l *logger) Exec(ctx context.Context, qCtx *C.Context, next executable_seq.
 	l.BP.L().Info(
 		l.args.Msg,
 		append(inboundInfo,
-			zap.String("qname", question.Name),
+			zap.String("qname", mlog.QName(question.Name)),
 			zap.Uint16("qtype", question.Qtype),
 			zap.Uint16("qclass", question.Qclass),
 			zap.Int("resp_rcode", respRcode),
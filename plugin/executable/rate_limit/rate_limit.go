@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rate_limit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/concurrent_limiter"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "rate_limit"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+// Actions of limited queries.
+const (
+	actionRefuse   = "refuse"
+	actionDrop     = "drop"
+	actionTruncate = "truncate"
+)
+
+type Args struct {
+	QPS    float64 `yaml:"qps"`
+	Burst  int     `yaml:"burst"`   // default is max(1, qps)
+	V4Mask int     `yaml:"v4_mask"` // default is 24
+	V6Mask int     `yaml:"v6_mask"` // default is 56
+
+	// Action of limited queries. Can be "refuse" (default), "drop" or
+	// "truncate". "truncate" responds an empty truncated response to
+	// udp queries, so clients will retry over tcp. It is the same as
+	// "refuse" for queries from other protocols.
+	Action string `yaml:"action"`
+}
+
+var _ coremain.ExecutablePlugin = (*rateLimit)(nil)
+
+type rateLimit struct {
+	*coremain.BP
+	action  string
+	limiter *concurrent_limiter.TokenBucketLimiter
+
+	limitedTotal *prometheus.CounterVec
+}
+
+func newRateLimit(bp *coremain.BP, args *Args) (*rateLimit, error) {
+	action := args.Action
+	switch action {
+	case "":
+		action = actionRefuse
+	case actionRefuse, actionDrop, actionTruncate:
+	default:
+		return nil, fmt.Errorf("invalid action %s", action)
+	}
+
+	l, err := concurrent_limiter.NewTokenBucketLimiter(concurrent_limiter.TokenBucketLimiterOpts{
+		QPS:      args.QPS,
+		Burst:    args.Burst,
+		IPv4Mask: args.V4Mask,
+		IPv6Mask: args.V6Mask,
+	})
+	if err != nil {
+		return nil, err
+	}
+	p := &rateLimit{
+		BP:      bp,
+		action:  action,
+		limiter: l,
+		limitedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "limited_query_total",
+			Help: "The total number of queries that exceed the rate limit",
+		}, []string{"action"}),
+	}
+	bp.GetMetricsReg().MustRegister(p.limitedTotal)
+	return p, nil
+}
+
+func (p *rateLimit) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	addr := qCtx.ReqMeta().GetClientAddr()
+	if !addr.IsValid() || p.limiter.AcquireToken(addr) {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	action := p.action
+	if action == actionTruncate && qCtx.ReqMeta().GetProtocol() != query_context.ProtocolUDP {
+		action = actionRefuse
+	}
+	p.limitedTotal.WithLabelValues(action).Inc()
+
+	switch action {
+	case actionDrop:
+		return query_context.ErrDropQuery
+	case actionTruncate:
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		r.Truncated = true
+		qCtx.SetResponse(r)
+	default:
+		r := new(dns.Msg)
+		r.SetRcode(qCtx.Q(), dns.RcodeRefused)
+		qCtx.SetResponse(r)
+	}
+	return nil
+}
+
+func (p *rateLimit) Close() error {
+	return p.limiter.Close()
+}
+
+// Init is a handler.NewPluginFunc.
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newRateLimit(bp, args.(*Args))
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package rate_limit
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_rateLimit_Exec(t *testing.T) {
+	tests := []struct {
+		name      string
+		action    string
+		protocol  string
+		wantErr   error
+		wantRcode int
+		wantTC    bool
+	}{
+		{"refuse", "", query_context.ProtocolUDP, nil, dns.RcodeRefused, false},
+		{"drop", actionDrop, query_context.ProtocolUDP, query_context.ErrDropQuery, 0, false},
+		{"drop over https", actionDrop, query_context.ProtocolH2, query_context.ErrDropQuery, 0, false},
+		{"truncate", actionTruncate, query_context.ProtocolUDP, nil, dns.RcodeSuccess, true},
+		{"truncate over tcp", actionTruncate, query_context.ProtocolTCP, nil, dns.RcodeRefused, false},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bp := coremain.NewBP("test", PluginType, nil, coremain.NewTestMosdns(nil, nil))
+			p, err := newRateLimit(bp, &Args{QPS: 0.001, Burst: 1, Action: tt.action})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			exec := func() (*query_context.Context, error) {
+				q := new(dns.Msg)
+				q.SetQuestion("example.", dns.TypeA)
+				r := new(dns.Msg)
+				r.SetReply(q)
+				next := executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: r})
+				meta := query_context.NewRequestMeta(netip.MustParseAddr("192.0.2.1"))
+				meta.SetProtocol(tt.protocol)
+				qCtx := query_context.NewContext(q, meta)
+				return qCtx, p.Exec(ctx, qCtx, next)
+			}
+
+			// The first query takes the only token.
+			if qCtx, err := exec(); err != nil || qCtx.R() == nil || qCtx.R().Rcode != dns.RcodeSuccess {
+				t.Fatalf("first query is limited, err = %v", err)
+			}
+
+			qCtx, err := exec()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("want err %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			if r.Rcode != tt.wantRcode || r.Truncated != tt.wantTC {
+				t.Fatalf("got rcode %d tc %v, want rcode %d tc %v", r.Rcode, r.Truncated, tt.wantRcode, tt.wantTC)
+			}
+		})
+	}
+}
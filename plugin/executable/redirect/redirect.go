@@ -88,7 +88,7 @@ func (r *redirectPlugin) Exec(ctx context.Context, qCtx *query_context.Context,
 	err := executable_seq.ExecChainNode(ctx, qCtx, next)
 
 	// PHASE 2: Reverse Path - Restore Protocol Integrity
-	resp := qCtx.R()
+	resp := qCtx.MutableR()
 	if resp == nil {
 		return err
 	}
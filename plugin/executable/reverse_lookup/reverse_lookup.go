@@ -29,7 +29,6 @@ import (
 
 	"github.com/cespare/xxhash/v2"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/miekg/dns"
 
 	"github.com/pmkol/mosdns-x/coremain"
@@ -56,6 +55,11 @@ type Args struct {
 	Redis     string `yaml:"redis"`
 	HandlePTR bool   `yaml:"handle_ptr"`
 	TTL       int    `yaml:"ttl"` // Default is 1800 (30min)
+
+	// NAT64Prefix are the NAT64 prefixes (RFC 6052), e.g. "64:ff9b::/96".
+	// PTR queries of addresses inside these prefixes will be answered
+	// by the PTR of the embedded IPv4 address.
+	NAT64Prefix []string `yaml:"nat64_prefix"`
 }
 
 func (a *Args) initDefault() *Args {
@@ -70,8 +74,9 @@ func (a *Args) initDefault() *Args {
 
 type reverseLookup struct {
 	*coremain.BP
-	args *Args
-	c    cache.Backend
+	args  *Args
+	c     cache.Backend
+	nat64 []netip.Prefix
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -80,13 +85,21 @@ func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 
 func newReverseLookup(bp *coremain.BP, args *Args) (coremain.Plugin, error) {
 	args.initDefault()
+	var nat64 []netip.Prefix
+	for _, s := range args.NAT64Prefix {
+		prefix, err := parseNAT64Prefix(s)
+		if err != nil {
+			return nil, err
+		}
+		nat64 = append(nat64, prefix)
+	}
+
 	var c cache.Backend
 	if u := args.Redis; len(u) > 0 {
-		opts, err := redis.ParseURL(u)
+		r, err := redis_cache.NewClient(u, 0)
 		if err != nil {
 			return nil, fmt.Errorf("invalid redis url, %w", err)
 		}
-		r := redis.NewClient(opts)
 		rc, err := redis_cache.NewRedisCache(redis_cache.RedisCacheOpts{
 			Client:       r,
 			ClientCloser: r,
@@ -100,9 +113,10 @@ func newReverseLookup(bp *coremain.BP, args *Args) (coremain.Plugin, error) {
 		c = mem_cache.NewMemCache(args.Size, 0)
 	}
 	p := &reverseLookup{
-		BP:   bp,
-		args: args,
-		c:    c,
+		BP:    bp,
+		args:  args,
+		c:     c,
+		nat64: nat64,
 	}
 	return p, nil
 }
@@ -113,6 +127,14 @@ func (p *reverseLookup) Exec(ctx context.Context, qCtx *query_context.Context, n
 		qCtx.SetResponse(r)
 		return nil
 	}
+	r, err := p.handleNAT64PTRQuery(ctx, qCtx, next)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
 
 	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
 		return err
@@ -156,6 +178,11 @@ func (p *reverseLookup) handlePTRQuery(q *dns.Msg) *dns.Msg {
 			return nil
 		}
 		fqdn := p.lookup(addr)
+		if len(fqdn) == 0 {
+			if addr4, ok := p.nat64Embedded(addr); ok {
+				fqdn = p.lookup(addr4)
+			}
+		}
 		if len(fqdn) > 0 {
 			r := new(dns.Msg)
 			r.SetReply(q)
@@ -174,6 +201,100 @@ func (p *reverseLookup) handlePTRQuery(q *dns.Msg) *dns.Msg {
 	return nil
 }
 
+// handleNAT64PTRQuery handles PTR queries of addresses inside the NAT64
+// prefixes by querying the PTR of the embedded IPv4 address. It returns
+// nil if q is not such a query or the IPv4 address has no PTR record.
+func (p *reverseLookup) handleNAT64PTRQuery(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) (*dns.Msg, error) {
+	q := qCtx.Q()
+	if len(p.nat64) == 0 || len(q.Question) != 1 || q.Question[0].Qtype != dns.TypePTR {
+		return nil, nil
+	}
+	question := q.Question[0]
+	addr, _ := utils.ParsePTRName(question.Name)
+	if !addr.IsValid() {
+		return nil, nil
+	}
+	addr4, ok := p.nat64Embedded(addr)
+	if !ok {
+		return nil, nil
+	}
+
+	name4, err := dns.ReverseAddr(addr4.String())
+	if err != nil {
+		return nil, nil
+	}
+	qCtx4 := qCtx.Copy()
+	qCtx4.Q().Question[0].Name = name4
+	if err := executable_seq.ExecChainNode(ctx, qCtx4, next); err != nil {
+		return nil, err
+	}
+	if r := qCtx4.R(); r == nil || r.Rcode != dns.RcodeSuccess {
+		return nil, nil
+	}
+	// The response may be shared with a cache or a static table.
+	r := qCtx4.MutableR()
+
+	var answer []dns.RR
+	for _, rr := range r.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok && ptr.Hdr.Name == name4 {
+			ptr.Hdr.Name = question.Name
+			answer = append(answer, ptr)
+		}
+	}
+	if len(answer) == 0 {
+		return nil, nil
+	}
+	r.Question = q.Question
+	r.Answer = answer
+	r.Ns = nil
+	return r, nil
+}
+
+// nat64Embedded returns the IPv4 address embedded in addr if addr
+// is inside one of the NAT64 prefixes.
+func (p *reverseLookup) nat64Embedded(addr netip.Addr) (netip.Addr, bool) {
+	if !addr.Is6() || addr.Is4In6() {
+		return netip.Addr{}, false
+	}
+	for _, prefix := range p.nat64 {
+		if prefix.Contains(addr) {
+			return extractNAT64(addr, prefix.Bits()), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+func parseNAT64Prefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid nat64 prefix %s, %w", s, err)
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("invalid nat64 prefix %s, not an ipv6 prefix", s)
+	}
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return netip.Prefix{}, fmt.Errorf("invalid nat64 prefix %s, length must be one of 32, 40, 48, 56, 64, 96", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// extractNAT64 extracts the IPv4 address from addr as described in
+// RFC 6052 section 2.2. Bits 64 to 71 of the address are skipped.
+func extractNAT64(addr netip.Addr, bits int) netip.Addr {
+	b := addr.As16()
+	var ip4 [4]byte
+	for i, j := bits/8, 0; j < 4; i++ {
+		if i == 8 {
+			continue
+		}
+		ip4[j] = b[i]
+		j++
+	}
+	return netip.AddrFrom4(ip4)
+}
+
 func (p *reverseLookup) saveIPs(q, r *dns.Msg) {
 	if r == nil {
 		return
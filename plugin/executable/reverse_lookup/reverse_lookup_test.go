@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package reverselookup
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_nat64Embedded(t *testing.T) {
+	// Examples from RFC 6052 section 2.4.
+	tests := []struct {
+		prefix string
+		addr   string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::", "192.0.2.33"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::", "192.0.2.33"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::", "192.0.2.33"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::", "192.0.2.33"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0", "192.0.2.33"},
+		{"64:ff9b::/96", "64:ff9b::192.0.2.33", "192.0.2.33"},
+		{"64:ff9b::/96", "2001:db8::1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			prefix, err := parseNAT64Prefix(tt.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &reverseLookup{nat64: []netip.Prefix{prefix}}
+			got, ok := p.nat64Embedded(netip.MustParseAddr(tt.addr))
+			if len(tt.want) == 0 {
+				if ok {
+					t.Fatalf("nat64Embedded() = %s, want none", got)
+				}
+				return
+			}
+			if !ok || got != netip.MustParseAddr(tt.want) {
+				t.Fatalf("nat64Embedded() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseNAT64Prefix("64:ff9b::/80"); err == nil {
+		t.Fatal("want err for invalid prefix length")
+	}
+}
+
+// sharedPTR answers the PTR of name4 with shared, like a cache or a static
+// table that keeps referencing its response.
+type sharedPTR struct {
+	shared *dns.Msg
+}
+
+func (s *sharedPTR) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	qCtx.SetSharedResponse(s.shared)
+	return nil
+}
+
+func Test_reverseLookup_handleNAT64PTRQuery(t *testing.T) {
+	prefix, err := parseNAT64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &reverseLookup{nat64: []netip.Prefix{prefix}}
+
+	name6, _ := dns.ReverseAddr("64:ff9b::192.0.2.33")
+	name4, _ := dns.ReverseAddr("192.0.2.33")
+	q4 := new(dns.Msg)
+	q4.SetQuestion(name4, dns.TypePTR)
+	shared := new(dns.Msg)
+	shared.SetReply(q4)
+	shared.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: name4, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 300},
+		Ptr: "host.example.",
+	}}
+
+	q := new(dns.Msg)
+	q.SetQuestion(name6, dns.TypePTR)
+	qCtx := query_context.NewContext(q, nil)
+	r, err := p.handleNAT64PTRQuery(context.Background(), qCtx, executable_seq.WrapExecutable(&sharedPTR{shared: shared}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || len(r.Answer) != 1 || r.Answer[0].Header().Name != name6 || r.Question[0].Name != name6 {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if got := shared.Answer[0].Header().Name; got != name4 || shared.Question[0].Name != name4 {
+		t.Fatalf("shared response was modified, name %s", got)
+	}
+}
@@ -0,0 +1,204 @@
+package rpz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/rpz"
+)
+
+const (
+	axfrTimeout       = time.Second * 30
+	soaQueryTimeout   = time.Second * 5
+	defaultAXFRRetry  = time.Minute
+	minAXFRInterval   = time.Second * 30
+	defaultTSIGMaxAge = 300 // sec, fudge of tsig
+)
+
+// axfrSource keeps a zoneSource up to date by zone transfers.
+type axfrSource struct {
+	s       *zoneSource
+	zone    string
+	primary string
+	refresh time.Duration // zero means the refresh of the SOA
+	lg      *zap.Logger
+
+	tsigName, tsigSecret, tsigAlgorithm string
+}
+
+func newAXFRSource(s *zoneSource, zc *ZoneConfig, lg *zap.Logger) (*axfrSource, error) {
+	if len(zc.Zone) == 0 {
+		return nil, errors.New("primary is set but zone is empty")
+	}
+	if (len(zc.TSIGName) == 0) != (len(zc.TSIGSecret) == 0) {
+		return nil, errors.New("tsig_name and tsig_secret must be set together")
+	}
+	a := &axfrSource{
+		s:       s,
+		zone:    dns.Fqdn(strings.ToLower(zc.Zone)),
+		primary: zc.Primary,
+		refresh: time.Duration(zc.Refresh) * time.Second,
+		lg:      lg.With(zap.String("zone", dns.Fqdn(zc.Zone)), zap.String("primary", zc.Primary)),
+	}
+	if len(zc.TSIGName) > 0 {
+		a.tsigName = dns.Fqdn(zc.TSIGName)
+		a.tsigSecret = zc.TSIGSecret
+		a.tsigAlgorithm = dns.HmacSHA256
+		if len(zc.TSIGAlgorithm) > 0 {
+			a.tsigAlgorithm = dns.Fqdn(zc.TSIGAlgorithm)
+		}
+	}
+	return a, nil
+}
+
+// run updates the zone until ctx is done.
+func (a *axfrSource) run(ctx context.Context) {
+	for {
+		d := a.update(ctx)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// update transfers the zone if it is not loaded or its serial changed. It
+// returns when the zone should be checked again.
+func (a *axfrSource) update(ctx context.Context) time.Duration {
+	cur := a.s.z.Load()
+	if cur != nil {
+		serial, err := a.querySerial(ctx)
+		if ctx.Err() != nil {
+			return 0 // closed
+		}
+		if err != nil {
+			a.lg.Warn("failed to query the soa of the zone", zap.Error(err))
+			return a.retryInterval(cur)
+		}
+		if serial == cur.SOA.Serial {
+			return a.refreshInterval(cur)
+		}
+	}
+
+	start := time.Now()
+	z, err := a.transfer(ctx)
+	if ctx.Err() != nil {
+		return 0 // closed
+	}
+	if err != nil {
+		if cur == nil {
+			a.lg.Warn("zone transfer failed, the zone is not applied until a transfer succeeds", zap.Error(err))
+		} else {
+			a.lg.Warn("zone transfer failed", zap.Error(err))
+		}
+		return a.retryInterval(cur)
+	}
+	if z.Origin != a.zone {
+		a.lg.Warn("zone transfer returned another zone", zap.String("origin", z.Origin))
+		return a.retryInterval(cur)
+	}
+	a.s.z.Store(z)
+	a.lg.Info(
+		"zone transferred",
+		zap.Uint32("serial", z.SOA.Serial),
+		zap.Int("triggers", z.Len()),
+		zap.Int("skipped", z.Skipped),
+		zap.Duration("elapsed", time.Since(start)),
+	)
+	return a.refreshInterval(z)
+}
+
+func (a *axfrSource) refreshInterval(z *rpz.Zone) time.Duration {
+	if a.refresh > 0 {
+		return a.refresh
+	}
+	return max(time.Duration(z.SOA.Refresh)*time.Second, minAXFRInterval)
+}
+
+// retryInterval uses the retry of the SOA of cur, the loaded zone, or
+// defaultAXFRRetry if there is none.
+func (a *axfrSource) retryInterval(cur *rpz.Zone) time.Duration {
+	if cur == nil {
+		return defaultAXFRRetry
+	}
+	return max(time.Duration(cur.SOA.Retry)*time.Second, minAXFRInterval)
+}
+
+func (a *axfrSource) sign(m *dns.Msg) map[string]string {
+	if len(a.tsigName) == 0 {
+		return nil
+	}
+	m.SetTsig(a.tsigName, a.tsigAlgorithm, defaultTSIGMaxAge, time.Now().Unix())
+	return map[string]string{a.tsigName: a.tsigSecret}
+}
+
+// dial connects to the primary. The connection is closed once ctx is done,
+// which stops the exchanges on it. stop must be called after it is used.
+func (a *axfrSource) dial(ctx context.Context) (_ *dns.Conn, stop func(), err error) {
+	d := net.Dialer{Timeout: soaQueryTimeout}
+	c, err := d.DialContext(ctx, "tcp", a.primary)
+	if err != nil {
+		return nil, nil, err
+	}
+	stopClose := context.AfterFunc(ctx, func() { c.Close() })
+	return &dns.Conn{Conn: c}, func() {
+		stopClose()
+		c.Close()
+	}, nil
+}
+
+// querySerial returns the serial of the SOA of the zone at the primary.
+func (a *axfrSource) querySerial(ctx context.Context) (uint32, error) {
+	conn, stop, err := a.dial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer stop()
+	m := new(dns.Msg)
+	m.SetQuestion(a.zone, dns.TypeSOA)
+	c := &dns.Client{Net: "tcp", Timeout: soaQueryTimeout}
+	c.TsigSecret = a.sign(m)
+	r, _, err := c.ExchangeWithConnContext(ctx, m, conn)
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("no soa in the response, rcode %s", dns.RcodeToString[r.Rcode])
+}
+
+// transfer transfers the zone by AXFR.
+func (a *axfrSource) transfer(ctx context.Context) (*rpz.Zone, error) {
+	conn, stop, err := a.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	m := new(dns.Msg)
+	m.SetAxfr(a.zone)
+	t := &dns.Transfer{Conn: conn, ReadTimeout: axfrTimeout}
+	t.TsigSecret = a.sign(m)
+	ch, err := t.In(m, a.primary)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	return rpz.FromRRs(rrs)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/rpz"
+)
+
+const (
+	testTSIGName   = "key.test."
+	testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+// startPrimary starts a tcp server of a rpz zone with serial. It requires
+// tsig. It returns its address and the number of transfers.
+func startPrimary(t *testing.T, serial *atomic.Uint32) (string, *atomic.Int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfers := new(atomic.Int32)
+	soa := func() dns.RR {
+		return &dns.SOA{
+			Hdr:     dns.RR_Header{Name: "rpz.test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:      "localhost.",
+			Mbox:    "root.localhost.",
+			Serial:  serial.Load(),
+			Refresh: 3600,
+			Retry:   600,
+			Minttl:  60,
+		}
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc("rpz.test.", func(w dns.ResponseWriter, q *dns.Msg) {
+		if q.IsTsig() == nil || w.TsigStatus() != nil {
+			r := new(dns.Msg)
+			r.SetRcode(q, dns.RcodeRefused)
+			w.WriteMsg(r)
+			return
+		}
+		if q.Question[0].Qtype == dns.TypeAXFR {
+			transfers.Add(1)
+			rr, _ := dns.NewRR("bad.example.rpz.test. 300 IN CNAME .")
+			ch := make(chan *dns.Envelope, 1)
+			ch <- &dns.Envelope{RR: []dns.RR{soa(), rr, soa()}}
+			close(ch)
+			tr := new(dns.Transfer)
+			tr.TsigSecret = map[string]string{testTSIGName: testTSIGSecret}
+			tr.Out(w, q, ch)
+			return
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = []dns.RR{soa()}
+		r.SetTsig(testTSIGName, dns.HmacSHA256, 300, int64(q.IsTsig().TimeSigned))
+		w.WriteMsg(r)
+	})
+	s := &dns.Server{
+		Listener:   l,
+		Handler:    mux,
+		TsigSecret: map[string]string{testTSIGName: testTSIGSecret},
+	}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return l.Addr().String(), transfers
+}
+
+func Test_axfrSource(t *testing.T) {
+	serial := new(atomic.Uint32)
+	serial.Store(1)
+	addr, transfers := startPrimary(t, serial)
+
+	s := new(zoneSource)
+	a, err := newAXFRSource(s, &ZoneConfig{
+		Primary:    addr,
+		Zone:       "RPZ.test",
+		TSIGName:   testTSIGName,
+		TSIGSecret: testTSIGSecret,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	a.update(ctx)
+	z := s.z.Load()
+	if z == nil {
+		t.Fatal("zone is not transferred")
+	}
+	if r := z.Match("bad.example."); r == nil || r.Action != rpz.ActionNXDomain {
+		t.Fatalf("invalid rule %v", r)
+	}
+
+	// Unchanged serial, no transfer.
+	if d := a.update(ctx); d != time.Hour {
+		t.Fatalf("want refresh 1h, got %s", d)
+	}
+	if n := transfers.Load(); n != 1 {
+		t.Fatalf("want 1 transfer, got %d", n)
+	}
+
+	serial.Store(2)
+	a.update(ctx)
+	if n := transfers.Load(); n != 2 || s.z.Load().SOA.Serial != 2 {
+		t.Fatalf("want the zone of serial 2 by 2 transfers, got serial %d by %d", s.z.Load().SOA.Serial, n)
+	}
+
+	// Failures keep the loaded zone.
+	a.tsigSecret = "d3Jvbmc="
+	a.update(ctx)
+	if s.z.Load().SOA.Serial != 2 {
+		t.Fatal("the loaded zone is lost")
+	}
+}
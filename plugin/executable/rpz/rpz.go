@@ -0,0 +1,285 @@
+package rpz
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/rpz"
+)
+
+const PluginType = "rpz"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+// Args of rpz. Queries are matched against the QNAME triggers of Zones,
+// and the policy of the first matched zone is applied:
+//   - NXDOMAIN (CNAME .) and NODATA (CNAME *.) answer empty responses.
+//   - PASSTHRU (CNAME rpz-passthru.) passes the query to the next plugins.
+//   - DROP (CNAME rpz-drop.) drops the query.
+//   - TCP-Only (CNAME rpz-tcp-only.) answers truncated responses to udp
+//     queries, so clients retry over tcp, where the query is passed.
+//   - Local-Data (other records) answers the records of the qtype, or the
+//     CNAME. The target of the CNAME is resolved by the next plugins.
+//
+// The SOA and NS records of the zone are added to the additional section
+// of the responses, so clients can tell which zone rewrote them.
+type Args struct {
+	Zones []ZoneConfig `yaml:"zones"`
+}
+
+// ZoneConfig is a response policy zone from File, or transferred from
+// Primary by AXFR.
+type ZoneConfig struct {
+	// File is a zone file, or the zone file of a data provider, e.g.
+	// "provider:rpz_feed", which is reloaded if the provider is.
+	File string `yaml:"file"`
+
+	// Primary is the address of the server, e.g. "192.0.2.1:53", to
+	// transfer Zone from. The zone is checked for updates every Refresh
+	// (sec, default the refresh of its SOA). TSIGName, TSIGSecret (base64)
+	// and TSIGAlgorithm (default hmac-sha256) sign the transfers.
+	// The transfers run in the background, the zone is not applied until
+	// the first one succeeds.
+	//
+	// For File, Zone is optional. If it is set, it is the origin of the
+	// relative names of the file if the file has no $ORIGIN, and the zone
+	// of the file must be Zone.
+	Primary       string `yaml:"primary"`
+	Zone          string `yaml:"zone"`
+	Refresh       int    `yaml:"refresh"`
+	TSIGName      string `yaml:"tsig_name"`
+	TSIGSecret    string `yaml:"tsig_secret"`
+	TSIGAlgorithm string `yaml:"tsig_algorithm"`
+}
+
+var _ coremain.ExecutablePlugin = (*rpzPlugin)(nil)
+
+type rpzPlugin struct {
+	*coremain.BP
+	zones   []*zoneSource
+	closers []func()
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// zoneSource holds the latest zone of a ZoneConfig.
+type zoneSource struct {
+	origin string                   // of zone files, can be empty
+	z      atomic.Pointer[rpz.Zone] // nil if the zone is not loaded yet
+}
+
+// Update implements data_provider.DataListener.
+func (s *zoneSource) Update(b []byte) error {
+	z, err := rpz.Parse(bytes.NewReader(b), s.origin)
+	if err != nil {
+		return err
+	}
+	if len(s.origin) != 0 && z.Origin != s.origin {
+		return fmt.Errorf("the file is of zone %s", z.Origin)
+	}
+	s.z.Store(z)
+	return nil
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newRPZ(bp, args.(*Args))
+}
+
+func newRPZ(bp *coremain.BP, args *Args) (_ *rpzPlugin, err error) {
+	if len(args.Zones) == 0 {
+		return nil, errors.New("no zone")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &rpzPlugin{BP: bp, cancel: cancel}
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+
+	for i, zc := range args.Zones {
+		s := new(zoneSource)
+		p.zones = append(p.zones, s)
+		switch {
+		case len(zc.File) != 0 && len(zc.Primary) != 0:
+			return nil, fmt.Errorf("zone #%d has both file and primary", i)
+		case len(zc.File) != 0:
+			if len(zc.Zone) != 0 {
+				s.origin = dns.Fqdn(strings.ToLower(zc.Zone))
+			}
+			if err := p.loadFile(s, zc.File); err != nil {
+				return nil, fmt.Errorf("failed to load zone #%d, %w", i, err)
+			}
+			if z := s.z.Load(); z != nil {
+				bp.L().Info("zone loaded", zap.String("zone", z.Origin), zap.Int("triggers", z.Len()), zap.Int("skipped", z.Skipped))
+			}
+		case len(zc.Primary) != 0:
+			a, err := newAXFRSource(s, &zc, bp.L())
+			if err != nil {
+				return nil, fmt.Errorf("invalid zone #%d, %w", i, err)
+			}
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				a.run(ctx)
+			}()
+		default:
+			return nil, fmt.Errorf("zone #%d has no file or primary", i)
+		}
+	}
+	return p, nil
+}
+
+func (p *rpzPlugin) loadFile(s *zoneSource, file string) error {
+	providerTag, ok := strings.CutPrefix(file, "provider:")
+	if !ok {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		return s.Update(b)
+	}
+	provider := p.M().GetDataManager().GetDataProvider(providerTag)
+	if provider == nil {
+		return fmt.Errorf("cannot find provider %s", providerTag)
+	}
+	if err := provider.LoadAndAddListener(s); err != nil {
+		return fmt.Errorf("failed to load data from provider %s, %w", providerTag, err)
+	}
+	p.closers = append(p.closers, func() {
+		provider.DeleteListener(s)
+	})
+	return nil
+}
+
+// match returns the rule of qname in the first zone that matches it.
+func (p *rpzPlugin) match(qname string) (*rpz.Zone, *rpz.Rule) {
+	for _, s := range p.zones {
+		z := s.z.Load()
+		if z == nil {
+			continue
+		}
+		if r := z.Match(qname); r != nil {
+			return z, r
+		}
+	}
+	return nil, nil
+}
+
+func (p *rpzPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	question := q.Question[0]
+	z, rule := p.match(strings.ToLower(question.Name))
+	if rule == nil {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	if p.L().Core().Enabled(zap.DebugLevel) {
+		p.L().Debug("policy matched", qCtx.InfoField(), zap.String("zone", z.Origin), zap.Stringer("action", rule.Action))
+	}
+
+	var r *dns.Msg
+	switch rule.Action {
+	case rpz.ActionPassthru:
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	case rpz.ActionDrop:
+		return query_context.ErrDropQuery
+	case rpz.ActionTCPOnly:
+		if qCtx.ReqMeta().GetProtocol() != query_context.ProtocolUDP {
+			return executable_seq.ExecChainNode(ctx, qCtx, next)
+		}
+		r = new(dns.Msg)
+		r.SetReply(q)
+		r.Truncated = true
+	case rpz.ActionNXDomain:
+		r = dnsutils.GenEmptyReply(q, dns.RcodeNameError)
+	case rpz.ActionNoData:
+		r = dnsutils.GenEmptyReply(q, dns.RcodeSuccess)
+	case rpz.ActionLocalData:
+		for _, rr := range rule.Data {
+			if rr.Header().Rrtype == question.Qtype {
+				if r == nil {
+					r = new(dns.Msg)
+					r.SetReply(q)
+					r.RecursionAvailable = true
+				}
+				r.Answer = append(r.Answer, withName(rr, question.Name))
+			}
+		}
+		if r == nil {
+			if cname := rule.CNAME(); cname != nil {
+				return p.execCNAME(ctx, qCtx, next, z, cname)
+			}
+			r = dnsutils.GenEmptyReply(q, dns.RcodeSuccess)
+		}
+	}
+	addTrailer(r, z)
+	qCtx.SetResponse(r)
+	return nil
+}
+
+// execCNAME answers the CNAME of the local data, followed by the records
+// of its target resolved by next.
+func (p *rpzPlugin) execCNAME(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode, z *rpz.Zone, cname *dns.CNAME) error {
+	q := qCtx.Q()
+	qName := q.Question[0].Name
+	q.Question[0].Name = cname.Target
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+	q.Question[0].Name = qName
+
+	r := qCtx.MutableR()
+	if r == nil {
+		return err
+	}
+	r.Id = q.Id
+	if len(r.Question) > 0 {
+		r.Question[0].Name = qName
+	}
+	r.Answer = append([]dns.RR{withName(cname, qName)}, r.Answer...)
+	addTrailer(r, z)
+	return err
+}
+
+// withName returns a copy of rr with name.
+func withName(rr dns.RR, name string) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = name
+	return rr
+}
+
+// addTrailer adds the SOA and NS records of z to the additional section
+// of r.
+func addTrailer(r *dns.Msg, z *rpz.Zone) {
+	r.Extra = append(r.Extra, dns.Copy(z.SOA))
+	for _, ns := range z.NS {
+		r.Extra = append(r.Extra, dns.Copy(ns))
+	}
+}
+
+// Close stops the zone transfers and the reloads of the zone files.
+func (p *rpzPlugin) Close() error {
+	p.cancel()
+	p.wg.Wait()
+	for _, f := range p.closers {
+		f()
+	}
+	return nil
+}
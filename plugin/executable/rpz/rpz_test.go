@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package rpz
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/rpz"
+)
+
+func newTestRPZ(t *testing.T, args *Args) (*rpzPlugin, error) {
+	t.Helper()
+	return newRPZ(coremain.NewBP("test", PluginType, nil, coremain.NewTestMosdns(nil, nil)), args)
+}
+
+func Test_rpz_fileWithoutOrigin(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rpz.zone")
+	zone := "$TTL 300\n" +
+		"@           SOA   localhost. root.localhost. 1 3600 600 86400 60\n" +
+		"            NS    localhost.\n" +
+		"bad.example CNAME .\n"
+	if err := os.WriteFile(file, []byte(zone), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newTestRPZ(t, &Args{Zones: []ZoneConfig{{File: file, Zone: "RPZ.test"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	z, r := p.match("bad.example.")
+	if z == nil || z.Origin != "rpz.test." || r.Action != rpz.ActionNXDomain {
+		t.Fatalf("want nxdomain of rpz.test., got %v, %v", z, r)
+	}
+
+	// $ORIGIN of the file overrides Zone, which must match the zone.
+	if err := os.WriteFile(file, []byte("$ORIGIN rpz.test.\n"+zone), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestRPZ(t, &Args{Zones: []ZoneConfig{{File: file, Zone: "other.test"}}}); err == nil {
+		t.Fatal("zone file of another zone is loaded")
+	}
+}
+
+func Test_rpz_closeDuringTransfer(t *testing.T) {
+	// The primary accepts connections but never responds.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	p, err := newTestRPZ(t, &Args{Zones: []ZoneConfig{{Primary: l.Addr().String(), Zone: "rpz.test"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-accepted:
+		defer c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("transfer is not started")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close is blocked by the transfer")
+	}
+}
@@ -22,6 +22,7 @@ package sequence
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/pmkol/mosdns-x/coremain"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
@@ -40,11 +41,17 @@ func init() {
 type sequence struct {
 	*coremain.BP
 
-	ecs executable_seq.ExecutableChainNode
+	ecs     executable_seq.ExecutableChainNode
+	timeout time.Duration
 }
 
 type Args struct {
 	Exec interface{} `yaml:"exec"`
+
+	// Timeout (ms) limits the time of queries passing through this
+	// sequence. It overrides the query timeout of the server but never
+	// extends the deadline of the query. Zero means no additional limit.
+	Timeout int `yaml:"timeout"`
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -58,19 +65,29 @@ func newSequencePlugin(bp *coremain.BP, args *Args) (*sequence, error) {
 	}
 
 	return &sequence{
-		BP:  bp,
-		ecs: ecs,
+		BP:      bp,
+		ecs:     ecs,
+		timeout: time.Duration(args.Timeout) * time.Millisecond,
 	}, nil
 }
 
 func (s *sequence) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
-	if err := executable_seq.ExecChainNode(ctx, qCtx, s.ecs); err != nil {
+	if err := s.exec(ctx, qCtx); err != nil {
 		return err
 	}
 
 	return executable_seq.ExecChainNode(ctx, qCtx, next)
 }
 
+func (s *sequence) exec(ctx context.Context, qCtx *query_context.Context) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, s.ecs)
+}
+
 var _ coremain.ExecutablePlugin = (*_return)(nil)
 
 type _return struct {
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sequence
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// deadlineExec records the deadline of the query and waits until it
+// is done.
+type deadlineExec struct {
+	deadline time.Time
+}
+
+func (e *deadlineExec) Exec(ctx context.Context, _ *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	e.deadline, _ = ctx.Deadline()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func Test_sequence_timeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      int           // ms
+		parent       time.Duration // zero means no deadline
+		wantDeadline time.Duration
+	}{
+		{"sequence timeout", 50, 0, 50 * time.Millisecond},
+		{"shorter than the query", 50, time.Second, 50 * time.Millisecond},
+		{"not extending the query", 1000, 50 * time.Millisecond, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := new(deadlineExec)
+			m := coremain.NewTestMosdns(map[string]executable_seq.Executable{"stub": e}, nil)
+			s, err := newSequencePlugin(coremain.NewBP("seq", PluginType, nil, m), &Args{Exec: "stub", Timeout: tt.timeout})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+			start := time.Now()
+			if tt.parent > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.parent)
+				defer cancel()
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			next := &executable_seq.DummyExecutable{}
+			err = s.Exec(ctx, query_context.NewContext(q, nil), executable_seq.WrapExecutable(next))
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("want context.DeadlineExceeded, got %v", err)
+			}
+			if d := e.deadline.Sub(start); d < tt.wantDeadline || d > tt.wantDeadline+200*time.Millisecond {
+				t.Fatalf("want deadline in %s, got %s", tt.wantDeadline, d)
+			}
+		})
+	}
+}
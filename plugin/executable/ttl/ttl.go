@@ -65,6 +65,7 @@ func (t *ttlPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next
 		}
 	}
 
+	r = qCtx.MutableR()
 	processRRs(r.Answer)
 	processRRs(r.Ns)
 	processRRs(r.Extra)
@@ -57,6 +57,16 @@ type Args struct {
 	Domain   []string `yaml:"domain"`
 	QType    []int    `yaml:"qtype"`
 	QClass   []int    `yaml:"qclass"`
+
+	// ClientCertSubject matches the subject of the tls client certificate,
+	// e.g. "CN=client1,O=example".
+	ClientCertSubject []string `yaml:"client_cert_subject"`
+
+	// ServerIP and ServerPort match the local address and port where
+	// the request was received, e.g. one of several addresses the
+	// server listens on.
+	ServerIP   []string `yaml:"server_ip"`
+	ServerPort []int    `yaml:"server_port"`
 }
 
 type queryMatcher struct {
@@ -123,6 +133,21 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 	if len(args.QClass) > 0 {
 		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewQClassMatcher(elem.NewIntMatcher(args.QClass)))
 	}
+	if len(args.ClientCertSubject) > 0 {
+		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewClientCertSubjectMatcher(args.ClientCertSubject))
+	}
+	if len(args.ServerIP) > 0 {
+		l, err := netlist.BatchLoadProvider(args.ServerIP, bp.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewServerIPMatcher(l))
+		m.closer = append(m.closer, l)
+		bp.L().Info("server ip matcher loaded", zap.Int("length", l.Len()))
+	}
+	if len(args.ServerPort) > 0 {
+		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewServerPortMatcher(elem.NewIntMatcher(args.ServerPort)))
+	}
 
 	return m, nil
 }
@@ -30,6 +30,10 @@ type Args struct {
 	RCode []int    `yaml:"rcode"`
 	IP    []string `yaml:"ip"`
 	CNAME []string `yaml:"cname"`
+
+	// IPAllSections makes the ip matcher also check the authority and
+	// additional sections and the ip hints of SVCB/HTTPS records.
+	IPAllSections bool `yaml:"ip_all_sections"`
 }
 
 type responseMatcher struct {
@@ -78,7 +82,11 @@ func newResponseMatcher(bp *coremain.BP, args *Args) (m *responseMatcher, err er
 		if err != nil {
 			return nil, err
 		}
-		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewAAAAAIPMatcher(l))
+		if args.IPAllSections {
+			m.matcherGroup = append(m.matcherGroup, msg_matcher.NewAllSectionsIPMatcher(l))
+		} else {
+			m.matcherGroup = append(m.matcherGroup, msg_matcher.NewAAAAAIPMatcher(l))
+		}
 		m.closer = append(m.closer, l)
 		bp.L().Info("ip matcher loaded", zap.Int("length", l.Len()))
 	}